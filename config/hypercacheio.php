@@ -207,6 +207,147 @@ return [
          */
         'disable_local_ping_check' => env('HYPERCACHEIO_GO_DISABLE_LOCAL_PING', false),
 
+        /*
+         * JSON file defining tenants with their own tokens, isolated keyspace
+         * and quotas, e.g. {"tenants": [{"name": "shop", "tokens": ["..."],
+         * "max_keys": 10000, "max_memory": 67108864}]}. Leave empty to run
+         * with the single api_token only.
+         * Env: HYPERCACHEIO_GO_TENANTS_FILE
+         */
+        'tenants_file' => env('HYPERCACHEIO_GO_TENANTS_FILE', ''),
+
+        /*
+         * Namespace of requests that send no namespace header. The cache
+         * store always sends cache.prefix as that header, so this only
+         * applies to other clients. Leave empty to keep their keys unchanged,
+         * which is what data written by earlier versions expects.
+         * Env: HYPERCACHEIO_GO_NAMESPACE
+         */
+        'namespace' => env('HYPERCACHEIO_GO_NAMESPACE', ''),
+
+        /*
+         * Memory budget for cached items (e.g. '512mb'); empty means unlimited.
+         * When it is exceeded, keys are evicted according to the policy:
+         * 'lru', 'lfu', 'volatile-ttl' or 'noeviction' (writes answer 507).
+         * Evictions stay local unless 'replicate_evictions' is enabled.
+         * Env: HYPERCACHEIO_GO_MAX_MEMORY, HYPERCACHEIO_GO_EVICTION_POLICY,
+         *      HYPERCACHEIO_GO_REPLICATE_EVICTIONS
+         */
+        'max_memory' => env('HYPERCACHEIO_GO_MAX_MEMORY', ''),
+        'eviction_policy' => env('HYPERCACHEIO_GO_EVICTION_POLICY', 'lru'),
+        'replicate_evictions' => env('HYPERCACHEIO_GO_REPLICATE_EVICTIONS', false),
+
+        /*
+         * Storage engine of the daemon: 'sqlite' keeps everything in memory
+         * and writes through to the SQLite file, 'aof' appends every write
+         * to a log replayed on startup, 'memory' never touches disk.
+         * 'tiered' keeps only the most used keys in memory, up to
+         * 'max_memory', and reads the others from the SQLite file on demand.
+         * It cannot enforce tenant quotas, so it refuses a 'tenants_file'.
+         * Empty picks 'sqlite' whenever direct SQLite access is enabled.
+         * Env: HYPERCACHEIO_GO_STORAGE
+         */
+        'storage' => env('HYPERCACHEIO_GO_STORAGE', ''),
+
+        /*
+         * Number of keys the 'tiered' engine loads into memory on startup,
+         * the most recently used ones at the last shutdown first. 0 starts
+         * with an empty hot tier.
+         * Env: HYPERCACHEIO_GO_WARM_UP
+         */
+        'warm_up' => env('HYPERCACHEIO_GO_WARM_UP', 0),
+
+        /*
+         * Compress values of at least 'compress_min_size' with 'zstd' or
+         * 'snappy' in memory, on disk and on replication links to peers that
+         * support it. Values only reach the SQLite file compressed with
+         * 'compress_sqlite', which the PHP store cannot read, so only enable
+         * it when every read goes through the daemon.
+         * Env: HYPERCACHEIO_GO_COMPRESSION, HYPERCACHEIO_GO_COMPRESS_MIN_SIZE,
+         *      HYPERCACHEIO_GO_COMPRESS_SQLITE
+         */
+        'compression' => env('HYPERCACHEIO_GO_COMPRESSION', 'none'),
+        'compress_min_size' => env('HYPERCACHEIO_GO_COMPRESS_MIN_SIZE', '1kb'),
+        'compress_sqlite' => env('HYPERCACHEIO_GO_COMPRESS_SQLITE', false),
+
+        /*
+         * Encrypt values with AES-256-GCM before they reach the SQLite file,
+         * the append-only log or snapshots. The key file holds one 32 byte
+         * key per line, hex or base64 encoded (e.g. `openssl rand -hex 32`);
+         * the first one encrypts. To rotate, put a new key first and keep the
+         * old one below it until the server has re-encrypted its data.
+         * 'encrypt_keys' also replaces keys with keyed hashes. The PHP store
+         * cannot read encrypted rows, so only enable this when every read
+         * goes through the daemon.
+         * Env: HYPERCACHEIO_GO_ENCRYPTION_KEY_FILE, HYPERCACHEIO_GO_ENCRYPT_KEYS
+         */
+        'encryption_key_file' => env('HYPERCACHEIO_GO_ENCRYPTION_KEY_FILE', ''),
+        'encrypt_keys' => env('HYPERCACHEIO_GO_ENCRYPT_KEYS', false),
+
+        /*
+         * Append-only log of the 'aof' engine and when it is synced to disk:
+         * 'always' after every write, 'everysec' once a second or 'no' to
+         * leave it to the OS. The log is rewritten in the background once it
+         * has grown by 'aof_rewrite_percentage' percent since the last
+         * rewrite and is at least 'aof_rewrite_min_size'.
+         * Env: HYPERCACHEIO_GO_AOF_PATH, HYPERCACHEIO_GO_AOF_FSYNC,
+         *      HYPERCACHEIO_GO_AOF_REWRITE_MIN_SIZE, HYPERCACHEIO_GO_AOF_REWRITE_PERCENTAGE
+         */
+        'aof_path' => env('HYPERCACHEIO_GO_AOF_PATH', storage_path('hypercacheio/hypercacheio.aof')),
+        'aof_fsync' => env('HYPERCACHEIO_GO_AOF_FSYNC', 'everysec'),
+        'aof_rewrite_min_size' => env('HYPERCACHEIO_GO_AOF_REWRITE_MIN_SIZE', '64mb'),
+        'aof_rewrite_percentage' => env('HYPERCACHEIO_GO_AOF_REWRITE_PERCENTAGE', 100),
+
+        /*
+         * Point-in-time snapshots of the whole store, taken through
+         * POST /api/hypercacheio/admin/snapshots and, with an interval such
+         * as '1h', on a schedule. The newest 'snapshot_retain' are kept
+         * (0 keeps all). Start the server with --restore-from=<file> to
+         * restore one.
+         * Env: HYPERCACHEIO_GO_SNAPSHOT_DIR, HYPERCACHEIO_GO_SNAPSHOT_INTERVAL,
+         *      HYPERCACHEIO_GO_SNAPSHOT_RETAIN
+         */
+        'snapshot_dir' => env('HYPERCACHEIO_GO_SNAPSHOT_DIR', storage_path('hypercacheio/snapshots')),
+        'snapshot_interval' => env('HYPERCACHEIO_GO_SNAPSHOT_INTERVAL', ''),
+        'snapshot_retain' => env('HYPERCACHEIO_GO_SNAPSHOT_RETAIN', 5),
+
+        /*
+         * Online backups of the SQLite file, taken with
+         * `php artisan hypercacheio:go-server backup` or
+         * POST /api/hypercacheio/admin/backup, are written here. Add
+         * --path=<file> to the command to download the backup instead.
+         * Env: HYPERCACHEIO_GO_BACKUP_DIR
+         */
+        'backup_dir' => env('HYPERCACHEIO_GO_BACKUP_DIR', storage_path('hypercacheio/backups')),
+
+        /*
+         * Persist SQLite writes asynchronously: writes are queued, repeated
+         * writes to a key coalesced and flushed in transactions of up to
+         * 'write_batch' keys every 'write_interval'. The queue is drained on
+         * shutdown. Disable to write every change in the request path.
+         * Env: HYPERCACHEIO_GO_WRITE_BEHIND, HYPERCACHEIO_GO_WRITE_BATCH,
+         *      HYPERCACHEIO_GO_WRITE_INTERVAL
+         */
+        'write_behind' => env('HYPERCACHEIO_GO_WRITE_BEHIND', true),
+        'write_batch' => env('HYPERCACHEIO_GO_WRITE_BATCH', 512),
+        'write_interval' => env('HYPERCACHEIO_GO_WRITE_INTERVAL', '100ms'),
+
+        /*
+         * SQLite tuning of the daemon. WAL lets readers (including the PHP
+         * store) run alongside the writer; the database is checked with
+         * quick_check on startup and the server refuses to start on a
+         * damaged file.
+         * Env: HYPERCACHEIO_GO_SQLITE_JOURNAL_MODE, HYPERCACHEIO_GO_SQLITE_SYNCHRONOUS,
+         *      HYPERCACHEIO_GO_SQLITE_BUSY_TIMEOUT, HYPERCACHEIO_GO_SQLITE_MMAP_SIZE,
+         *      HYPERCACHEIO_GO_SQLITE_CACHE_SIZE, HYPERCACHEIO_GO_SQLITE_QUICK_CHECK
+         */
+        'sqlite_journal_mode' => env('HYPERCACHEIO_GO_SQLITE_JOURNAL_MODE', 'wal'),
+        'sqlite_synchronous' => env('HYPERCACHEIO_GO_SQLITE_SYNCHRONOUS', 'normal'),
+        'sqlite_busy_timeout' => env('HYPERCACHEIO_GO_SQLITE_BUSY_TIMEOUT', '5s'),
+        'sqlite_mmap_size' => env('HYPERCACHEIO_GO_SQLITE_MMAP_SIZE', '256mb'),
+        'sqlite_cache_size' => env('HYPERCACHEIO_GO_SQLITE_CACHE_SIZE', '64mb'),
+        'sqlite_quick_check' => env('HYPERCACHEIO_GO_SQLITE_QUICK_CHECK', true),
+
         'port' => env('HYPERCACHEIO_GO_PORT', '8080'),
         'ssl' => [
             'enabled' => env('HYPERCACHEIO_GO_SSL_ENABLED', false),
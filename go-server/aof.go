@@ -0,0 +1,533 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------------------------------------------------
+// Append-only Log Engine
+// -------------------------------------------------------------
+//
+// aofStore serves every read from memory and appends the resulting state of
+// every written key to a log, encoded as replication frames: SET for items
+// and locks, COUNTER for counter slots, TAGS, DEL and FLUSH. Every frame
+// carries a complete state rather than a delta, so replaying a frame twice
+// is harmless, which is what lets the log be rewritten in the background
+// while writes keep coming in. Frames are appended under the shard lock of
+// their key, so the log holds the states of a key in the order memory
+// applied them. On startup the log is replayed into memory.
+// With encryption on, SET values are sealed and keys possibly hashed, see
+// encryption.go.
+
+const (
+	storageAof = "aof"
+
+	fsyncAlways   = "always"
+	fsyncEverysec = "everysec"
+	fsyncNo       = "no"
+)
+
+var (
+	aofPath              string
+	aofFsync             = fsyncEverysec
+	aofRewriteMinSize    = "64mb"
+	aofRewritePercentage = 100
+)
+
+type aofStore struct {
+	*memoryStore
+	log *appendLog
+
+	// rewriteMu is held for the whole of a rewrite
+	rewriteMu sync.Mutex
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+type appendLog struct {
+	path          string
+	fsync         string
+	rewriteMin    int64
+	rewriteGrowth int
+
+	mu         sync.Mutex
+	file       *os.File
+	buf        *bufio.Writer
+	size       int64         // Bytes written, buffered ones included
+	baseSize   int64         // Size after the last replay or rewrite
+	rewriteBuf *bytes.Buffer // Frames appended while a rewrite runs
+
+	rewriting   atomic.Bool
+	appended    atomic.Uint64
+	rewrites    atomic.Uint64
+	lastRewrite atomic.Int64
+	errors      atomic.Uint64
+	lastError   atomic.Value // string
+}
+
+type AofStats struct {
+	Path        string `json:"path"`
+	Fsync       string `json:"fsync"`
+	Size        int64  `json:"size"`
+	BaseSize    int64  `json:"base_size"`
+	Appended    uint64 `json:"appended"`
+	Rewriting   bool   `json:"rewriting"`
+	Rewrites    uint64 `json:"rewrites"`
+	LastRewrite int64  `json:"last_rewrite,omitempty"`
+	Errors      uint64 `json:"errors"`
+	LastError   string `json:"last_error,omitempty"`
+}
+
+func validFsyncPolicy(policy string) bool {
+	switch policy {
+	case fsyncAlways, fsyncEverysec, fsyncNo:
+		return true
+	}
+	return false
+}
+
+// newAofStore opens the log at path for appending. It is replayed by Load.
+func newAofStore(mem *memoryStore, path, fsync string) (*aofStore, error) {
+	if !validFsyncPolicy(fsync) {
+		return nil, fmt.Errorf("invalid fsync policy %q (expected always, everysec or no)", fsync)
+	}
+	minSize, err := parseByteSize(aofRewriteMinSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rewrite minimum size: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	s := &aofStore{
+		memoryStore: mem,
+		log: &appendLog{
+			path:          path,
+			fsync:         fsync,
+			rewriteMin:    minSize,
+			rewriteGrowth: aofRewritePercentage,
+			file:          file,
+			buf:           bufio.NewWriter(file),
+			size:          info.Size(),
+			baseSize:      info.Size(),
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	mem.persist = s.record
+	mem.flushed = s.recordFlush
+	go s.run()
+	return s, nil
+}
+
+// run flushes the log every second and starts a rewrite once it has grown
+// by rewriteGrowth percent since the last one.
+func (s *aofStore) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+		s.log.mu.Lock()
+		s.log.flushLocked(s.log.fsync == fsyncEverysec)
+		due := s.log.size >= s.log.rewriteMin && s.log.size >= s.log.baseSize*int64(100+s.log.rewriteGrowth)/100
+		s.log.mu.Unlock()
+		if due && s.rewriteMu.TryLock() {
+			go func() {
+				defer s.rewriteMu.Unlock()
+				s.rewriteLocked()
+			}()
+		}
+	}
+}
+
+// record appends the state of a key. It is memoryStore.persist, so it runs
+// under the shard lock of the key and frames land in the order memory
+// applied them.
+func (s *aofStore) record(st keyState) {
+	var frame bytes.Buffer
+	writeStateFrames(&frame, st)
+	s.log.write(frame.Bytes())
+}
+
+// writeStateFrames encodes the state of a key as captured under its shard
+// lock, sealed if encryption is on. It is only used for files.
+func writeStateFrames(w io.Writer, st keyState) {
+	if !st.exists {
+		writeDelFrame(w, diskKey(st.key))
+		return
+	}
+	name, val := sealValue(st.key, st.item.Value)
+	writeSetFrame(w, OpSet, name, val, st.item.Expiration, st.item.Version)
+	if st.counter != nil {
+		for node, pos := range st.counter.Pos {
+			writeCounterFrame(w, name, node, st.counter.Epoch, pos, st.counter.Neg[node], st.item.Expiration)
+		}
+		for node, neg := range st.counter.Neg {
+			if _, ok := st.counter.Pos[node]; !ok {
+				writeCounterFrame(w, name, node, st.counter.Epoch, 0, neg, st.item.Expiration)
+			}
+		}
+	}
+	if st.tagged || st.dropped.tags {
+		writeTagsFrame(w, name, st.tags)
+	}
+}
+
+// recordFlush logs a flush while it still holds every shard lock, so no
+// write it did not remove can be logged before it.
+func (s *aofStore) recordFlush() {
+	s.log.write([]byte{OpFlush})
+}
+
+// Discard logs the removal of keys already gone from memory, such as
+// replicated evictions. Expired items need no entry, replay drops them.
+func (s *aofStore) Discard(removals []removal) {
+	if len(removals) == 0 {
+		return
+	}
+	var frames bytes.Buffer
+	for _, r := range removals {
+		writeDelFrame(&frames, diskKey(r.key))
+	}
+	s.log.write(frames.Bytes())
+}
+
+// Close waits for a running rewrite and makes every logged write durable.
+func (s *aofStore) Close() error {
+	close(s.stop)
+	<-s.done
+	s.rewriteMu.Lock()
+	defer s.rewriteMu.Unlock()
+
+	s.log.mu.Lock()
+	defer s.log.mu.Unlock()
+	if err := s.log.flushLocked(true); err != nil {
+		return err
+	}
+	return s.log.file.Close()
+}
+
+func (s *aofStore) Stats() StorageStats {
+	return StorageStats{Engine: storageAof, Aof: s.log.stats()}
+}
+
+// -------------------------------------------------------------
+// Log Writing
+// -------------------------------------------------------------
+
+// write appends encoded frames to the log.
+func (l *appendLog) write(frames []byte) {
+	if len(frames) == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rewriteBuf != nil {
+		l.rewriteBuf.Write(frames)
+	}
+	n, err := l.buf.Write(frames)
+	l.size += int64(n)
+	if err != nil {
+		l.fail(err)
+		return
+	}
+	l.appended.Add(1)
+	if l.fsync == fsyncAlways {
+		l.flushLocked(true)
+	}
+}
+
+// flushLocked hands buffered frames to the OS and, with sync set, waits for
+// them to reach the disk. Callers must hold mu.
+func (l *appendLog) flushLocked(sync bool) error {
+	if err := l.buf.Flush(); err != nil {
+		l.fail(err)
+		return err
+	}
+	if sync {
+		if err := l.file.Sync(); err != nil {
+			l.fail(err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *appendLog) fail(err error) {
+	l.errors.Add(1)
+	l.lastError.Store(err.Error())
+	log.Printf("Failed to write the append-only log: %v", err)
+}
+
+func (l *appendLog) stats() *AofStats {
+	l.mu.Lock()
+	size, baseSize := l.size, l.baseSize
+	l.mu.Unlock()
+	lastError, _ := l.lastError.Load().(string)
+	return &AofStats{
+		Path:        l.path,
+		Fsync:       l.fsync,
+		Size:        size,
+		BaseSize:    baseSize,
+		Appended:    l.appended.Load(),
+		Rewriting:   l.rewriting.Load(),
+		Rewrites:    l.rewrites.Load(),
+		LastRewrite: l.lastRewrite.Load(),
+		Errors:      l.errors.Load(),
+		LastError:   lastError,
+	}
+}
+
+// -------------------------------------------------------------
+// Log Rewriting
+// -------------------------------------------------------------
+
+// Rewrite replaces the log with the frames of the live keys.
+func (s *aofStore) Rewrite() error {
+	s.rewriteMu.Lock()
+	defer s.rewriteMu.Unlock()
+	return s.rewriteLocked()
+}
+
+// rewriteLocked dumps the keyspace to a new file while frames appended in the
+// meantime are also collected in rewriteBuf. Those are added to the new file
+// before it atomically replaces the log. Callers must hold rewriteMu.
+func (s *aofStore) rewriteLocked() error {
+	l := s.log
+	l.rewriting.Store(true)
+	defer l.rewriting.Store(false)
+	started := time.Now()
+
+	tmpPath := l.path + ".rewrite"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		l.fail(err)
+		return err
+	}
+	l.mu.Lock()
+	l.rewriteBuf = new(bytes.Buffer)
+	l.mu.Unlock()
+
+	abort := func(err error) error {
+		l.mu.Lock()
+		l.rewriteBuf = nil
+		l.mu.Unlock()
+		tmp.Close()
+		os.Remove(tmpPath)
+		l.fail(err)
+		return err
+	}
+
+	out := &countingWriter{w: bufio.NewWriter(tmp)}
+	now := time.Now().Unix()
+	s.keys.Range(func(st keyState) bool {
+		if st.live(now) {
+			writeStateFrames(out, st)
+			if len(st.tags) > 0 {
+				writeTagsFrame(out, diskKey(st.key), st.tags)
+			}
+		}
+		return out.err == nil
+	})
+	if out.err != nil {
+		return abort(out.err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out.Write(l.rewriteBuf.Bytes())
+	l.rewriteBuf = nil
+	if out.err == nil {
+		out.err = out.w.(*bufio.Writer).Flush()
+	}
+	if out.err == nil {
+		out.err = tmp.Sync()
+	}
+	if out.err == nil {
+		out.err = os.Rename(tmpPath, l.path)
+	}
+	if out.err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		l.fail(out.err)
+		return out.err
+	}
+	syncDir(filepath.Dir(l.path))
+
+	// Frames buffered for the old file are already part of the new one
+	l.buf.Reset(tmp)
+	l.file.Close()
+	l.file = tmp
+	l.size, l.baseSize = out.n, out.n
+	l.rewrites.Add(1)
+	l.lastRewrite.Store(time.Now().Unix())
+	log.Printf("Rewrote the append-only log to %d bytes in %s", out.n, time.Since(started).Round(time.Millisecond))
+	return nil
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// countingWriter counts the bytes written and remembers the first error.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
+
+// -------------------------------------------------------------
+// Log Replay
+// -------------------------------------------------------------
+
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Load replays the log into memory. A partial frame at the end, left by a
+// crash in the middle of a write, is cut off; anything else that cannot be
+// decoded stops the server.
+func (s *aofStore) Load() error {
+	file, err := os.Open(s.log.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	counted := &countingReader{r: file}
+	reader := bufio.NewReader(counted)
+	names := newSealedNames()
+	replayed := 0
+	var good int64
+	for {
+		good = counted.n - int64(reader.Buffered())
+		op, err := reader.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.replay(op, reader, names); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				log.Printf("The append-only log ends with a partial frame at offset %d, truncating it", good)
+				if err := os.Truncate(s.log.path, good); err != nil {
+					return err
+				}
+				break
+			}
+			return fmt.Errorf("append-only log %s is damaged at offset %d: %w", s.log.path, good, err)
+		}
+		replayed++
+	}
+	s.memoryStore.Sweep(time.Now().Unix(), sweepBatch)
+
+	s.log.mu.Lock()
+	s.log.size, s.log.baseSize = good, good
+	s.log.mu.Unlock()
+	log.Printf("Replayed %d operations from the append-only log, %d keys live", replayed, s.Len())
+
+	if names.stale > 0 {
+		encryptionCounters.stale.Store(uint64(names.stale))
+		log.Printf("Rewriting the append-only log to re-seal %d values with key %x", names.stale, sealing.active.id)
+		go s.Rewrite()
+	}
+	return nil
+}
+
+// replay applies one frame to the keyspace.
+func (s *aofStore) replay(op byte, r *bufio.Reader, names *sealedNames) error {
+	switch op {
+	case OpSet:
+		name, sealed, exp, version, err := readSetFrame(r)
+		if err != nil {
+			return err
+		}
+		key, val, err := names.open(name, sealed)
+		if err != nil {
+			return err
+		}
+		s.keys.Update(key, func(tx *itemTx) {
+			tx.Store(val, exp, version)
+			tx.DropCounter()
+		})
+	case OpCounter:
+		name, node, epoch, pos, neg, _, err := readCounterFrame(r)
+		if err != nil {
+			return err
+		}
+		s.keys.Update(names.key(name), func(tx *itemTx) {
+			c, ok := tx.Counter()
+			if !ok {
+				c = newPNCounter()
+				tx.SetCounter(c)
+			}
+			c.Merge(epoch, node, pos, neg)
+		})
+	case OpTags:
+		name, tags, err := readTagsFrame(r)
+		if err != nil {
+			return err
+		}
+		s.keys.Update(names.key(name), func(tx *itemTx) {
+			if _, found := tx.Item(); found {
+				tx.SetTags(tags)
+			}
+		})
+	case OpDel:
+		name, err := readDelFrame(r)
+		if err != nil {
+			return err
+		}
+		s.keys.Update(names.key(name), func(tx *itemTx) {
+			tx.Remove()
+		})
+	case OpFlush:
+		s.keys.Flush(nil)
+	default:
+		return fmt.Errorf("unknown op %d", op)
+	}
+	return nil
+}
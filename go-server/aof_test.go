@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openAof(t *testing.T, path string) *aofStore {
+	s, err := newAofStore(newMemoryStore(4), path, fsyncAlways)
+	if err != nil {
+		t.Fatalf("Failed to open the log: %v", err)
+	}
+	if err := s.Load(); err != nil {
+		t.Fatalf("Failed to replay the log: %v", err)
+	}
+	storage = s
+	t.Cleanup(func() { storage = newMemoryStore(defaultShards) })
+	return s
+}
+
+func TestAofReplaysWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hypercacheio.aof")
+	s := openAof(t, path)
+	s.Set("kept", []byte("i:1;"), 0, 0)
+	kept := s.Set("kept", []byte("i:2;"), 0, 0).Version
+	s.SetTags("kept", []string{"users"})
+	s.Set("deleted", []byte("i:1;"), 0, 0)
+	s.Delete("deleted")
+	s.Set("expired", []byte("i:1;"), time.Now().Unix()+60, 0)
+	s.Expire("expired", time.Now().Unix()-1)
+	s.Set(lockKey("job"), []byte("owner"), 0, 0)
+	incrCounter("hits", 5, nil)
+	incrCounter("hits", -2, nil)
+	s.Close()
+
+	s = openAof(t, path)
+	defer s.Close()
+	if item, ok := s.Get("kept"); !ok || string(item.Value) != "i:2;" || item.Version != kept {
+		t.Errorf("Expected kept at version %d, got %+v, %v", kept, item, ok)
+	}
+	s.View("kept", func(tx *itemTx) {
+		if tags := tx.Tags(); len(tags) != 1 || tags[0] != "users" {
+			t.Errorf("Expected the tags of kept to be replayed, got %v", tags)
+		}
+	})
+	if _, ok := s.Get("deleted"); ok {
+		t.Errorf("Expected deleted to stay deleted")
+	}
+	if _, ok := s.Get("expired"); ok {
+		t.Errorf("Expected expired items to be dropped on replay")
+	}
+	if item, ok := s.Get(lockKey("job")); !ok || string(item.Value) != "owner" {
+		t.Errorf("Expected the lock to be replayed, got %+v", item)
+	}
+	s.View("hits", func(tx *itemTx) {
+		if c, ok := tx.Counter(); !ok || c.Value() != 3 {
+			t.Errorf("Expected the counter to be replayed with value 3")
+		}
+	})
+}
+
+func TestAofReplaysFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hypercacheio.aof")
+	s := openAof(t, path)
+	s.Set("a", []byte("i:1;"), 0, 0)
+	s.Flush()
+	s.Set("b", []byte("i:1;"), 0, 0)
+	s.Close()
+
+	s = openAof(t, path)
+	defer s.Close()
+	if _, ok := s.Get("a"); ok || s.Len() != 1 {
+		t.Errorf("Expected only b to survive the flush, got %d keys", s.Len())
+	}
+}
+
+func TestAofLogsFlushBeforeLaterWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hypercacheio.aof")
+	s := openAof(t, path)
+	s.Set("early", []byte("i:1;"), 0, 0)
+
+	// A write arriving during the flush waits for the shard locks and must
+	// be replayed after the flush
+	var late sync.WaitGroup
+	flushed := s.memoryStore.flushed
+	s.memoryStore.flushed = func() {
+		flushed()
+		late.Add(1)
+		go func() {
+			defer late.Done()
+			s.Set("late", []byte("i:1;"), 0, 0)
+		}()
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Flush()
+	late.Wait()
+	s.Close()
+
+	s = openAof(t, path)
+	defer s.Close()
+	if _, ok := s.Get("late"); !ok || s.Len() != 1 {
+		t.Errorf("Expected only late to survive the flush, got %d keys", s.Len())
+	}
+}
+
+func TestAofTruncatesPartialFrame(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hypercacheio.aof")
+	s := openAof(t, path)
+	s.Set("a", []byte("i:1;"), 0, 0)
+	s.Close()
+	intact, _ := os.Stat(path)
+
+	// A crash in the middle of a SET frame
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	file.Write([]byte{OpSet, 0, 1, 0})
+	file.Close()
+
+	s = openAof(t, path)
+	defer s.Close()
+	if _, ok := s.Get("a"); !ok {
+		t.Errorf("Expected the complete frames to be replayed")
+	}
+	if info, _ := os.Stat(path); info.Size() != intact.Size() {
+		t.Errorf("Expected the partial frame to be cut off, size %d instead of %d", info.Size(), intact.Size())
+	}
+}
+
+func TestAofRejectsDamagedLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hypercacheio.aof")
+	os.WriteFile(path, []byte{0xff, 1, 2, 3}, 0644)
+
+	s, err := newAofStore(newMemoryStore(4), path, fsyncNo)
+	if err != nil {
+		t.Fatalf("Failed to open the log: %v", err)
+	}
+	defer s.Close()
+	if err := s.Load(); err == nil {
+		t.Errorf("Expected an unknown frame to be refused")
+	}
+}
+
+func TestAofRewriteCompactsLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hypercacheio.aof")
+	s := openAof(t, path)
+	var hot uint64
+	for i := 0; i < 100; i++ {
+		hot = s.Set("hot", []byte("i:1;"), 0, 0).Version
+		s.Set("gone", []byte("i:1;"), 0, 0)
+		s.Delete("gone")
+	}
+	before := s.Stats().Aof.Size
+
+	if err := s.Rewrite(); err != nil {
+		t.Fatalf("Rewrite failed: %v", err)
+	}
+	stats := s.Stats().Aof
+	if stats.Size >= before || stats.Rewrites != 1 || stats.BaseSize != stats.Size {
+		t.Errorf("Expected the log to shrink from %d bytes, got %+v", before, stats)
+	}
+
+	// Writes after the rewrite go to the new file
+	s.Set("after", []byte("i:1;"), 0, 0)
+	s.Close()
+
+	s = openAof(t, path)
+	defer s.Close()
+	if item, ok := s.Get("hot"); !ok || item.Version != hot {
+		t.Errorf("Expected hot at version %d after the rewrite, got %+v", hot, item)
+	}
+	if _, ok := s.Get("after"); !ok || s.Len() != 2 {
+		t.Errorf("Expected hot and after to be replayed, got %d keys", s.Len())
+	}
+}
+
+func TestAofLogsInWriteOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hypercacheio.aof")
+	s := openAof(t, path)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if (w+i)%5 == 0 {
+					s.Delete("contended")
+					continue
+				}
+				s.Set("contended", []byte(fmt.Sprintf("i:%d;", w*1000+i)), 0, 0)
+			}
+		}(w)
+	}
+	wg.Wait()
+	want, live := s.Get("contended")
+	s.Close()
+
+	s = openAof(t, path)
+	defer s.Close()
+	if got, ok := s.Get("contended"); ok != live || string(got.Value) != string(want.Value) {
+		t.Errorf("Expected the replay to end with %q (%v), got %q (%v)", want.Value, live, got.Value, ok)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// -------------------------------------------------------------
+// SQLite Backups
+// -------------------------------------------------------------
+//
+// A backup is a consistent copy of the SQLite file taken while the server
+// keeps running. The write-behind queue is flushed first, so the copy holds
+// every write acknowledged before the backup started, then VACUUM INTO
+// copies the database inside a single read transaction. Writers carry on
+// meanwhile; the copy is compacted and needs no WAL file next to it. It is
+// written next to its final name and renamed into place, so a backup on
+// disk is always complete. Encrypted values stay sealed in the copy.
+//
+// VACUUM INTO reports no progress, so the size of the file being written is
+// compared with the live pages of the database instead.
+
+const backupWatchInterval = 250 * time.Millisecond
+
+var (
+	backupDir string
+
+	// backupMutex keeps backups from running concurrently
+	backupMutex sync.Mutex
+
+	errBackupRunning = errors.New("a backup is already running")
+
+	backupState struct {
+		sync.Mutex
+		progress BackupProgress
+	}
+)
+
+type BackupInfo struct {
+	Path     string `json:"path,omitempty"`
+	Created  int64  `json:"created"`
+	Size     int64  `json:"size"`
+	Duration int64  `json:"duration_ms"`
+}
+
+type BackupProgress struct {
+	Running   bool        `json:"running"`
+	Path      string      `json:"path,omitempty"`
+	Started   int64       `json:"started,omitempty"`
+	Written   int64       `json:"written"`
+	Estimated int64       `json:"estimated"`
+	Last      *BackupInfo `json:"last,omitempty"`
+}
+
+// backupper is implemented by the storage engines that persist to SQLite.
+type backupper interface {
+	Backup(path string) (BackupInfo, error)
+}
+
+// Backup writes a consistent copy of the SQLite file to path.
+func (s *sqliteStore) Backup(path string) (BackupInfo, error) {
+	if !backupMutex.TryLock() {
+		return BackupInfo{}, errBackupRunning
+	}
+	defer backupMutex.Unlock()
+	s.queue.flush()
+	return backupSqlite(s.db, path)
+}
+
+// backupSqlite copies db to path with VACUUM INTO. Callers must hold
+// backupMutex.
+func backupSqlite(db *sql.DB, path string) (BackupInfo, error) {
+	started := time.Now()
+	var pages, free, pageSize int64
+	db.QueryRow("PRAGMA page_count").Scan(&pages)
+	db.QueryRow("PRAGMA freelist_count").Scan(&free)
+	db.QueryRow("PRAGMA page_size").Scan(&pageSize)
+
+	// VACUUM INTO refuses to write over a file, even one left by a crash
+	tmpPath := path + ".tmp"
+	os.Remove(tmpPath)
+	defer os.Remove(tmpPath) // A no-op once renamed
+
+	setBackupProgress(func(p *BackupProgress) {
+		*p = BackupProgress{Running: true, Path: path, Started: started.Unix(), Estimated: (pages - free) * pageSize, Last: p.Last}
+	})
+	stop := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		watchBackup(tmpPath, stop)
+	}()
+	_, err := db.Exec("VACUUM INTO ?", tmpPath)
+	close(stop)
+	<-watched
+
+	if err == nil {
+		err = syncFile(tmpPath)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	var info BackupInfo
+	if err == nil {
+		syncDir(filepath.Dir(path))
+		var stat os.FileInfo
+		if stat, err = os.Stat(path); err == nil {
+			info = BackupInfo{Path: path, Created: started.Unix(), Size: stat.Size(), Duration: time.Since(started).Milliseconds()}
+		}
+	}
+	setBackupProgress(func(p *BackupProgress) {
+		p.Running = false
+		if err == nil {
+			p.Written, p.Last = info.Size, &info
+		}
+	})
+	return info, err
+}
+
+// watchBackup records how much of the backup at path has been written until
+// stop is closed.
+func watchBackup(path string, stop chan struct{}) {
+	ticker := time.NewTicker(backupWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if stat, err := os.Stat(path); err == nil {
+				setBackupProgress(func(p *BackupProgress) { p.Written = stat.Size() })
+			}
+		}
+	}
+}
+
+func setBackupProgress(fn func(p *BackupProgress)) {
+	backupState.Lock()
+	fn(&backupState.progress)
+	backupState.Unlock()
+}
+
+func backupProgress() BackupProgress {
+	backupState.Lock()
+	defer backupState.Unlock()
+	return backupState.progress
+}
+
+func syncFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// backupName returns the file name of a backup taken at t.
+func backupName(t time.Time) string {
+	return "hypercacheio-" + t.UTC().Format("20060102T150405Z") + ".sqlite"
+}
+
+// -------------------------------------------------------------
+// Backup HTTP Handlers
+// -------------------------------------------------------------
+
+// handleBackup streams a backup as a download on GET and writes one to
+// --backup-dir on POST. Only the main API token may use it.
+func handleBackup(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	b, ok := storage.(backupper)
+	if !ok {
+		writeJSONStatus(w, http.StatusServiceUnavailable, map[string]string{"error": "Backups need the sqlite or tiered storage engine"})
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		downloadBackup(w, b)
+	case "POST":
+		if backupDir == "" {
+			writeJSONStatus(w, http.StatusServiceUnavailable, map[string]string{"error": "Backups need --backup-dir"})
+			return
+		}
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			name = backupName(time.Now())
+		}
+		if filepath.Base(name) != name || name == "." || name == ".." {
+			writeJSONStatus(w, http.StatusBadRequest, map[string]string{"error": "name must be a file name inside --backup-dir"})
+			return
+		}
+		if err := os.MkdirAll(backupDir, 0755); err != nil {
+			writeJSONStatus(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		path := filepath.Join(backupDir, name)
+		if _, err := os.Stat(path); err == nil {
+			writeJSONStatus(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("%s already exists", path)})
+			return
+		}
+		info, err := b.Backup(path)
+		if err != nil {
+			writeBackupError(w, err)
+			return
+		}
+		log.Printf("Wrote backup %s (%d bytes in %dms)", info.Path, info.Size, info.Duration)
+		writeJSON(w, info)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// downloadBackup writes a backup to a temporary file and streams it.
+func downloadBackup(w http.ResponseWriter, b backupper) {
+	dir := backupDir
+	if dir == "" {
+		dir = os.TempDir()
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		writeJSONStatus(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	created := time.Now()
+	path := filepath.Join(dir, fmt.Sprintf("hypercacheio-download-%d.sqlite", created.UnixNano()))
+	defer os.Remove(path)
+
+	info, err := b.Backup(path)
+	if err != nil {
+		writeBackupError(w, err)
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		writeJSONStatus(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+backupName(created)+`"`)
+	w.Header().Set("Content-Length", fmt.Sprint(info.Size))
+	if _, err := io.Copy(w, file); err != nil {
+		log.Printf("Backup download aborted: %v", err)
+		return
+	}
+	log.Printf("Streamed a backup of %d bytes", info.Size)
+}
+
+func writeBackupError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if err == errBackupRunning {
+		status = http.StatusConflict
+	}
+	writeJSONStatus(w, status, map[string]string{"error": err.Error()})
+}
+
+// handleBackupStatus reports the progress of the running backup and the
+// last one that completed.
+func handleBackupStatus(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, backupProgress())
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupBackups(t *testing.T) *sqliteStore {
+	conn, err := openSqlite(filepath.Join(t.TempDir(), "live.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	if _, err := migrate(conn, false); err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+	writeBehindEnabled, writeInterval = true, time.Hour // Nothing is written unless flushed
+	s := newSqliteStore(newMemoryStore(4), conn)
+	storage, backupDir = s, t.TempDir()
+	t.Cleanup(func() {
+		s.Close()
+		conn.Close()
+		writeInterval = 100 * time.Millisecond
+		storage, backupDir = newMemoryStore(defaultShards), ""
+	})
+	return s
+}
+
+// backupKeys counts the items in the backup at path.
+func backupKeys(t *testing.T, path string) int {
+	conn, err := openSqlite(path)
+	if err != nil {
+		t.Fatalf("Failed to open the backup: %v", err)
+	}
+	defer conn.Close()
+	var count int
+	if err := conn.QueryRow("SELECT COUNT(*) FROM cache").Scan(&count); err != nil {
+		t.Fatalf("Failed to read the backup: %v", err)
+	}
+	return count
+}
+
+func TestBackupIncludesQueuedWrites(t *testing.T) {
+	s := setupBackups(t)
+	s.Set("a", []byte("i:1;"), 0, 0)
+	s.Set("b", []byte("i:2;"), 0, 0)
+
+	path := filepath.Join(backupDir, "copy.sqlite")
+	info, err := s.Backup(path)
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if stat, _ := os.Stat(path); stat == nil || stat.Size() != info.Size {
+		t.Errorf("Expected the reported size to match the file, got %d", info.Size)
+	}
+	if n := backupKeys(t, path); n != 2 {
+		t.Errorf("Expected the queued writes in the backup, got %d keys", n)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Expected no temporary file to be left behind")
+	}
+	if p := backupProgress(); p.Running || p.Last == nil || p.Last.Path != path || p.Written != info.Size {
+		t.Errorf("Expected the finished backup in the progress, got %+v", p)
+	}
+}
+
+func TestHandleBackup(t *testing.T) {
+	s := setupBackups(t)
+	s.Set("a", []byte("i:1;"), 0, 0)
+
+	rr := httptest.NewRecorder()
+	handleBackup(rr, httptest.NewRequest("GET", "/api/hypercacheio/admin/backup", nil))
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Body.String(), "SQLite format 3\x00") {
+		t.Fatalf("Expected a SQLite file, got %d", rr.Code)
+	}
+	if length := rr.Header().Get("Content-Length"); length != fmt.Sprint(rr.Body.Len()) {
+		t.Errorf("Expected a Content-Length of %d, got %s", rr.Body.Len(), length)
+	}
+	if files, _ := os.ReadDir(backupDir); len(files) != 0 {
+		t.Errorf("Expected the download to leave nothing behind, found %d files", len(files))
+	}
+
+	rr = httptest.NewRecorder()
+	handleBackup(rr, httptest.NewRequest("POST", "/api/hypercacheio/admin/backup?name=nightly.sqlite", nil))
+	var info BackupInfo
+	json.Unmarshal(rr.Body.Bytes(), &info)
+	if rr.Code != http.StatusOK || info.Path != filepath.Join(backupDir, "nightly.sqlite") || info.Size == 0 {
+		t.Fatalf("Expected the backup to be written, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if n := backupKeys(t, info.Path); n != 1 {
+		t.Errorf("Expected 1 key in the backup, got %d", n)
+	}
+
+	rr = httptest.NewRecorder()
+	handleBackup(rr, httptest.NewRequest("POST", "/api/hypercacheio/admin/backup?name=nightly.sqlite", nil))
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Expected an existing backup not to be overwritten, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	handleBackup(rr, httptest.NewRequest("POST", "/api/hypercacheio/admin/backup?name=../escape.sqlite", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected a path outside --backup-dir to be rejected, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	handleBackupStatus(rr, httptest.NewRequest("GET", "/api/hypercacheio/admin/backup/status", nil))
+	var progress BackupProgress
+	json.Unmarshal(rr.Body.Bytes(), &progress)
+	if progress.Running || progress.Last == nil || progress.Last.Size != info.Size {
+		t.Errorf("Expected the last backup in the status, got %s", rr.Body.String())
+	}
+
+	storage = newMemoryStore(4)
+	rr = httptest.NewRecorder()
+	handleBackup(rr, httptest.NewRequest("GET", "/api/hypercacheio/admin/backup", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the memory engine to have no backups, got %d", rr.Code)
+	}
+}
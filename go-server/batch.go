@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/yvasiyarov/php_session_decoder/php_serialize"
+)
+
+// -------------------------------------------------------------
+// Batch Operations (many / put-many)
+// -------------------------------------------------------------
+
+type BatchItem struct {
+	Key        string
+	Value      []byte
+	Expiration int64
+	Version    uint64 // 0 assigns the next version for the key
+}
+
+type ManyPayload struct {
+	Keys []string `json:"keys"`
+}
+
+type PutManyPayload struct {
+	Values map[string]interface{} `json:"values"`
+	TTL    *int                   `json:"ttl"`
+}
+
+// getManyLocal reads all keys. Missing and expired
+// keys are returned as nil; the cleanup timer takes care of expired ones.
+func getManyLocal(keys []string) map[string][]byte {
+	result := make(map[string][]byte, len(keys))
+	now := time.Now().Unix()
+
+	for _, key := range keys {
+		item, ok := storage.Get(key)
+		if !ok || (item.Expiration > 0 && item.Expiration < now) {
+			result[key] = nil
+			continue
+		}
+		result[key] = item.Value
+	}
+
+	return result
+}
+
+// setManyLocal stores all items locking each shard once and replicates them
+// as one OpSetMany frame.
+func setManyLocal(items []BatchItem, broadcast bool) {
+	storage.SetMany(items)
+
+	if broadcast {
+		broadcastSetMany(items)
+	}
+}
+
+// replicateMany applies a batch received from a peer item by item, skipping
+// the items whose key already holds a newer version.
+func replicateMany(items []BatchItem) {
+	for _, item := range items {
+		replicateSet(item.Key, item.Value, item.Expiration, item.Version, nil)
+	}
+}
+
+// broadcastSetMany sends a batch as one SETMANY frame with the values as
+// stored. Legacy peers cannot read it and get one SET per item with its
+// decoded value instead.
+func broadcastSetMany(items []BatchItem) {
+	frames := make(map[byte][]byte, 2) // Per protocol, encoded when first needed
+	frame := func(protocol byte) []byte {
+		if encoded, ok := frames[protocol]; ok {
+			return encoded
+		}
+		var buf bytes.Buffer
+		if protocol >= opProtocol(OpSetMany) {
+			if err := writeSetManyFrame(&buf, items); err != nil {
+				log.Printf("Failed to encode SETMANY frame: %v", err)
+			}
+		} else {
+			for _, item := range items {
+				writePeerSetFrame(&buf, protocol, OpSet, item.Key, decodeValue(item.Value), item.Expiration, item.Version)
+			}
+		}
+		frames[protocol] = buf.Bytes()
+		return frames[protocol]
+	}
+
+	peersMutex.Lock()
+	defer peersMutex.Unlock()
+	for addr, conn := range peers {
+		_, err := conn.Write(frame(peerProtocols[conn]))
+		if err != nil {
+			log.Printf("Failed to broadcast SETMANY to %s: %v", addr, err)
+		} else {
+			statsMutex.Lock()
+			stats.TotalBroadcasts++
+			statsMutex.Unlock()
+		}
+	}
+}
+
+// writeSetManyFrame encodes a batch as:
+// op | count u32 | count x (keyLen u16 | valLen u32 | exp u32 | version u64 | key | val)
+func writeSetManyFrame(w io.Writer, items []BatchItem) error {
+	header := make([]byte, 5)
+	header[0] = OpSetMany
+	binary.BigEndian.PutUint32(header[1:5], uint32(len(items)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		itemHeader := make([]byte, 18)
+		binary.BigEndian.PutUint16(itemHeader[0:2], uint16(len(item.Key)))
+		binary.BigEndian.PutUint32(itemHeader[2:6], uint32(len(item.Value)))
+		binary.BigEndian.PutUint32(itemHeader[6:10], uint32(item.Expiration))
+		binary.BigEndian.PutUint64(itemHeader[10:18], item.Version)
+		if _, err := w.Write(itemHeader); err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte(item.Key)); err != nil {
+			return err
+		}
+		if _, err := w.Write(item.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readSetManyFrame(r *bufio.Reader) ([]BatchItem, error) {
+	header := make([]byte, 4) // We already read the Op byte
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	count := binary.BigEndian.Uint32(header)
+
+	// The count comes from a peer or a file, so it must not size an
+	// allocation before the items have actually arrived
+	items := make([]BatchItem, 0, min(count, framePrealloc))
+	for i := uint32(0); i < count; i++ {
+		// Items share the SET frame layout after the op byte
+		key, val, exp, version, err := readSetFrame(r)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, BatchItem{Key: key, Value: val, Expiration: exp, Version: version})
+	}
+	return items, nil
+}
+
+// -------------------------------------------------------------
+// Batch HTTP Handlers
+// -------------------------------------------------------------
+
+func handleMany(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	var payload ManyPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	ns := requestNamespace(r)
+	keys := make([]string, 0, len(payload.Keys))
+	for _, key := range payload.Keys {
+		keys = append(keys, namespacedKey(ns, key))
+	}
+
+	data := make(map[string]interface{}, len(payload.Keys))
+	for key, val := range getManyLocal(keys) {
+		_, key = splitKey(key)
+		if val == nil {
+			data[key] = nil
+			continue
+		}
+		decoder := php_serialize.NewUnSerializer(string(val))
+		parsed, err := decoder.Decode()
+		if err != nil {
+			data[key] = nil
+			continue
+		}
+		data[key] = parsed
+	}
+
+	writeJSON(w, map[string]interface{}{"data": data})
+}
+
+func handlePutMany(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	var payload PutManyPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	var expiration int64
+	if payload.TTL != nil && *payload.TTL > 0 {
+		expiration = time.Now().Unix() + int64(*payload.TTL)
+	}
+
+	ns := requestNamespace(r)
+	items := make([]BatchItem, 0, len(payload.Values))
+	for key, value := range payload.Values {
+		if key == "" {
+			continue
+		}
+		encoded, err := php_serialize.Serialize(value)
+		if err != nil {
+			http.Error(w, "Serialization failed", http.StatusInternalServerError)
+			return
+		}
+		items = append(items, BatchItem{Key: namespacedKey(ns, key), Value: []byte(encoded), Expiration: expiration})
+	}
+
+	sizes := make(map[string]int, len(items))
+	for _, item := range items {
+		sizes[item.Key] = len(item.Value)
+	}
+	if !allowWrite(w, r, sizes) {
+		return
+	}
+
+	setManyLocal(items, true)
+	writeJSON(w, map[string]interface{}{"success": true, "count": len(items)})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandlePutManyAndMany(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	body := `{"values": {"a": "first", "b": "second"}, "ttl": 60}`
+	req, _ := http.NewRequest("POST", "/api/hypercacheio/put-many", bytes.NewBufferString(body))
+	rr := httptest.NewRecorder()
+	handlePutMany(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handlePutMany returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM cache").Scan(&count)
+	if count != 2 {
+		t.Errorf("Expected 2 persisted rows, got %d", count)
+	}
+
+	req2, _ := http.NewRequest("POST", "/api/hypercacheio/many", bytes.NewBufferString(`{"keys": ["a", "b", "missing"]}`))
+	rr2 := httptest.NewRecorder()
+	handleMany(rr2, req2)
+
+	var resp map[string]map[string]interface{}
+	json.Unmarshal(rr2.Body.Bytes(), &resp)
+	data := resp["data"]
+	if data["a"] != "first" || data["b"] != "second" {
+		t.Errorf("handleMany returned wrong data: %v", data)
+	}
+	if v, ok := data["missing"]; !ok || v != nil {
+		t.Errorf("Expected missing key to be returned as null, got %v (present: %v)", v, ok)
+	}
+}
+
+func TestSetManyFrameRoundTrip(t *testing.T) {
+	items := []BatchItem{
+		{Key: "k1", Value: []byte("i:1;"), Expiration: 0},
+		{Key: "k2", Value: []byte(`s:2:"v2";`), Expiration: 1700000000},
+	}
+
+	var buf bytes.Buffer
+	if err := writeSetManyFrame(&buf, items); err != nil {
+		t.Fatalf("Failed to write SETMANY frame: %v", err)
+	}
+
+	reader := bufio.NewReader(&buf)
+	if op, _ := reader.ReadByte(); op != OpSetMany {
+		t.Fatalf("Expected OpSetMany, got %d", op)
+	}
+	decoded, err := readSetManyFrame(reader)
+	if err != nil {
+		t.Fatalf("Failed to read SETMANY frame: %v", err)
+	}
+	if len(decoded) != 2 || decoded[1].Key != "k2" || string(decoded[1].Value) != `s:2:"v2";` || decoded[1].Expiration != 1700000000 {
+		t.Errorf("SETMANY frame did not round-trip: %+v", decoded)
+	}
+}
+
+func TestSetManyFrameCountDoesNotSizeAllocations(t *testing.T) {
+	// A frame claiming 4 billion items but carrying none
+	reader := bufio.NewReader(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}))
+	if _, err := readSetManyFrame(reader); err == nil {
+		t.Errorf("Expected a truncated frame to fail")
+	}
+}
+
+func TestLegacyPeersGetBatchesAsSets(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	peersMutex.Lock()
+	peers["legacy"] = local
+	peerProtocols[local] = replLegacy
+	peersMutex.Unlock()
+	defer func() {
+		peersMutex.Lock()
+		delete(peers, "legacy")
+		delete(peerProtocols, local)
+		peersMutex.Unlock()
+	}()
+
+	go broadcastSetMany([]BatchItem{{Key: "a", Value: []byte("i:1;")}, {Key: "b", Value: []byte("i:2;")}})
+	reader := bufio.NewReader(remote)
+	for _, want := range []string{"a", "b"} {
+		if op, _ := reader.ReadByte(); op != OpSet {
+			t.Fatalf("Expected a plain SET for a legacy peer, got op %d", op)
+		}
+		if key, _, _, _, err := readPeerSetFrame(reader, replLegacy); err != nil || key != want {
+			t.Errorf("Expected %s, got %q, %v", want, key, err)
+		}
+	}
+}
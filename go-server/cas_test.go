@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func putWithHeaders(body string, headers map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/api/hypercacheio/cache/doc", bytes.NewBufferString(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rr := httptest.NewRecorder()
+	handleCache(rr, req)
+	return rr
+}
+
+func TestVersionsAndETag(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	first, _ := parseETag(putWithHeaders(`{"value": "v1"}`, nil).Header().Get("ETag"))
+	second, _ := parseETag(putWithHeaders(`{"value": "v2"}`, nil).Header().Get("ETag"))
+	if first == 0 || second <= first {
+		t.Fatalf("Expected every write to get a newer version, got %d then %d", first, second)
+	}
+
+	req, _ := http.NewRequest("GET", "/api/hypercacheio/cache/doc", nil)
+	rr := httptest.NewRecorder()
+	handleCache(rr, req)
+
+	var resp map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp["version"] != float64(second) {
+		t.Errorf("Expected version %d after two writes, got %v", second, resp["version"])
+	}
+	if etag := rr.Header().Get("ETag"); etag != formatETag(second) {
+		t.Errorf("Expected ETag %s, got %v", formatETag(second), etag)
+	}
+
+	var persisted int64
+	db.QueryRow("SELECT version FROM cache WHERE key = ?", "doc").Scan(&persisted)
+	if uint64(persisted) != second {
+		t.Errorf("Expected persisted version %d, got %d", second, persisted)
+	}
+}
+
+func TestVersionsAreNotReusedAfterDelete(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	before := setLocal("doc", []byte(`s:2:"v1";`), 0, false)
+	delLocal("doc", false)
+	if after := setLocal("doc", []byte(`s:2:"v2";`), 0, false); after <= before {
+		t.Errorf("Expected a key written again after a delete to get a newer version, got %d then %d", before, after)
+	}
+	expired := setLocal("doc", []byte(`s:2:"v3";`), time.Now().Unix()-1, false)
+	if after := setLocal("doc", []byte(`s:2:"v4";`), 0, false); after <= expired {
+		t.Errorf("Expected a key written again after it expired to get a newer version, got %d then %d", expired, after)
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	// expected_version 0 only succeeds when the key is absent
+	rr := putWithHeaders(`{"value": "v1", "expected_version": 0}`, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected create with expected_version 0 to succeed, got %v", rr.Code)
+	}
+	created := rr.Header().Get("ETag")
+	if rr := putWithHeaders(`{"value": "v1", "expected_version": 0}`, nil); rr.Code != http.StatusConflict {
+		t.Errorf("Expected %v for stale expected_version, got %v", http.StatusConflict, rr.Code)
+	}
+
+	rr = putWithHeaders(`{"value": "v2"}`, map[string]string{"If-Match": created})
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected If-Match with current version to succeed, got %v", rr.Code)
+	}
+	current := rr.Header().Get("ETag")
+
+	rr = putWithHeaders(`{"value": "v3"}`, map[string]string{"If-Match": created})
+	if rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected %v for stale If-Match, got %v", http.StatusPreconditionFailed, rr.Code)
+	}
+	if etag := rr.Header().Get("ETag"); etag != current {
+		t.Errorf("Expected failed write to report current ETag %s, got %v", current, etag)
+	}
+
+	val, _ := getLocal("doc")
+	if string(val) != `s:2:"v2";` {
+		t.Errorf("Failed conditional write modified the value: %s", val)
+	}
+}
+
+func TestReplicatedWritesNeverMoveBack(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	local := setLocal("doc", []byte(`s:5:"local";`), 0, false)
+	replicateSet("doc", []byte(`s:5:"stale";`), 0, local-1, nil)
+	if item, _ := getItemLocal("doc"); string(item.Value) != `s:5:"local";` || item.Version != local {
+		t.Errorf("Expected an older replicated write to be skipped, got %+v", item)
+	}
+
+	remote := local + 1<<30
+	replicateSet("doc", []byte(`s:6:"remote";`), 0, remote, nil)
+	if item, _ := getItemLocal("doc"); string(item.Value) != `s:6:"remote";` || item.Version != remote {
+		t.Errorf("Expected a newer replicated write to keep its version, got %+v", item)
+	}
+	if next := setLocal("doc", []byte(`s:5:"again";`), 0, false); next <= remote {
+		t.Errorf("Expected the next local write to be newer than the replicated one, got %d after %d", next, remote)
+	}
+}
+
+func TestLegacyPeersGetSetFramesWithoutVersion(t *testing.T) {
+	var buf bytes.Buffer
+	writePeerSetFrame(&buf, replLegacy, OpSet, "doc", []byte("i:1;"), 0, 42)
+	if buf.Len() != 11+len("doc")+len("i:1;") {
+		t.Fatalf("Expected the legacy layout, got %d bytes", buf.Len())
+	}
+	reader := bufio.NewReader(&buf)
+	reader.ReadByte()
+	key, val, _, version, err := readPeerSetFrame(reader, replLegacy)
+	if err != nil || key != "doc" || string(val) != "i:1;" || version != 0 {
+		t.Errorf("Expected the legacy frame to read back without a version, got %q %q %d %v", key, val, version, err)
+	}
+
+	// A hello from a newer server settles on the protocol this one speaks
+	reader = bufio.NewReader(bytes.NewReader([]byte{helloFlag | (replProtocol + 1)}))
+	if protocol, err := readHelloFrame(reader); err != nil || protocol != replProtocol {
+		t.Errorf("Expected protocol %d, got %d, %v", replProtocol, protocol, err)
+	}
+	reader = bufio.NewReader(bytes.NewReader([]byte{OpSet}))
+	if _, err := readHelloFrame(reader); err == nil {
+		t.Errorf("Expected a hello without the flag to be refused")
+	}
+}
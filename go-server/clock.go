@@ -0,0 +1,70 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------------------------------------------------
+// Version Clock
+// -------------------------------------------------------------
+//
+// Item versions come from one hybrid logical clock per node rather than from
+// a counter per key, so a key that is deleted or expires and is written again
+// never reuses a version a client may still hold, and a restarted node
+// carries on above the versions it handed out before as long as its wall
+// clock does not go back. A version is laid out as
+//
+//	milliseconds << 20 | logical << 12 | node
+//
+// where logical orders writes within the same millisecond and node is a tag
+// derived from the node id, so two nodes only assign the same version when
+// their ids hash to the same tag. Versions stay below 2^63, which the SQLite
+// column and PHP integers need.
+//
+// Versions read from disk or received from peers move the clock past them,
+// so the next local write is newer than anything the node has seen.
+
+const (
+	clockNodeBits    = 12
+	clockLogicalBits = 8
+)
+
+type versionClock struct {
+	last atomic.Uint64 // milliseconds << clockLogicalBits | logical
+	node uint64
+}
+
+var versions versionClock
+
+// next returns a version newer than every version issued or observed so far.
+func (c *versionClock) next() uint64 {
+	wall := uint64(time.Now().UnixMilli()) << clockLogicalBits
+	for {
+		last := c.last.Load()
+		tick := max(last+1, wall)
+		if c.last.CompareAndSwap(last, tick) {
+			return tick<<clockNodeBits | c.node
+		}
+	}
+}
+
+// observe moves the clock past version.
+func (c *versionClock) observe(version uint64) {
+	tick := version >> clockNodeBits
+	for {
+		last := c.last.Load()
+		if tick <= last || c.last.CompareAndSwap(last, tick) {
+			return
+		}
+	}
+}
+
+// setNode tags the versions issued from now on with a hash of the node id.
+// It must be called before the node serves any write.
+func (c *versionClock) setNode(id string) {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	c.node = uint64(h.Sum32()) & (1<<clockNodeBits - 1)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// -------------------------------------------------------------
+// Value Compression
+// -------------------------------------------------------------
+//
+// With --compression, values of at least --compress-min-size bytes are
+// compressed when they are stored, as long as that makes them smaller. A
+// compressed value is the codecMagic header, a codec byte and the compressed
+// bytes, so it describes itself wherever it goes: the keyspace, the write-
+// behind queue, the append-only log, snapshots and replication frames carry
+// it as is, and every node can read it whatever its own setting. Reads
+// through the keyspace return the plain value, so clients never see it.
+//
+// The SQLite file is shared with the PHP store, which cannot read compressed
+// values, so they are only written to it with --compress-sqlite.
+//
+// Peers that can read compressed values say so with the OpHello frame that
+// negotiates the replication protocol when a link comes up; older servers
+// ignore it and keep receiving plain values.
+
+const (
+	compressionNone   = "none"
+	compressionZstd   = "zstd"
+	compressionSnappy = "snappy"
+
+	codecMagic  = "\x00hcz"
+	codecZstd   = 'z'
+	codecSnappy = 's'
+)
+
+var (
+	compression     = compressionNone
+	compressMinSize = "1kb"
+	compressMin     = int64(1024)
+	compressSqlite  bool
+
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+
+	compressionCounters struct {
+		compressed      atomic.Uint64
+		incompressible  atomic.Uint64
+		bytesIn         atomic.Uint64
+		bytesOut        atomic.Uint64
+		compressNanos   atomic.Uint64
+		decompressed    atomic.Uint64
+		decompressNanos atomic.Uint64
+		errors          atomic.Uint64
+	}
+)
+
+type CompressionStats struct {
+	Codec           string  `json:"codec"`
+	MinSize         int64   `json:"min_size"`
+	Sqlite          bool    `json:"sqlite"`
+	Compressed      uint64  `json:"compressed"`
+	Incompressible  uint64  `json:"incompressible"`
+	BytesIn         uint64  `json:"bytes_in"`
+	BytesOut        uint64  `json:"bytes_out"`
+	Ratio           float64 `json:"ratio"`
+	CompressNanos   uint64  `json:"compress_ns"`
+	Decompressed    uint64  `json:"decompressed"`
+	DecompressNanos uint64  `json:"decompress_ns"`
+	Errors          uint64  `json:"errors"`
+}
+
+func validCompression(codec string) bool {
+	switch codec {
+	case compressionNone, compressionZstd, compressionSnappy:
+		return true
+	}
+	return false
+}
+
+func initZstd() {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+		zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	})
+}
+
+// isEncoded reports whether val is a compressed value.
+func isEncoded(val []byte) bool {
+	if len(val) <= len(codecMagic) || string(val[:len(codecMagic)]) != codecMagic {
+		return false
+	}
+	codec := val[len(codecMagic)]
+	return codec == codecZstd || codec == codecSnappy
+}
+
+// encodeValue returns val compressed with the configured codec, or val
+// itself when it is small, already compressed or does not shrink.
+func encodeValue(val []byte) []byte {
+	if compression == compressionNone || int64(len(val)) < compressMin || isEncoded(val) {
+		return val
+	}
+	start := time.Now()
+	out := make([]byte, 0, len(val)/2+len(codecMagic)+1)
+	out = append(out, codecMagic...)
+	switch compression {
+	case compressionZstd:
+		initZstd()
+		out = zstdEncoder.EncodeAll(val, append(out, codecZstd))
+	case compressionSnappy:
+		out = append(append(out, codecSnappy), snappy.Encode(nil, val)...)
+	}
+	compressionCounters.compressNanos.Add(uint64(time.Since(start)))
+
+	if len(out) >= len(val) {
+		compressionCounters.incompressible.Add(1)
+		return val
+	}
+	compressionCounters.compressed.Add(1)
+	compressionCounters.bytesIn.Add(uint64(len(val)))
+	compressionCounters.bytesOut.Add(uint64(len(out)))
+	return out
+}
+
+// decodeValue returns the plain form of a value. A value that fails to
+// decompress is returned as is, it was stored plain.
+func decodeValue(val []byte) []byte {
+	if !isEncoded(val) {
+		return val
+	}
+	start := time.Now()
+	payload := val[len(codecMagic)+1:]
+	var plain []byte
+	var err error
+	switch val[len(codecMagic)] {
+	case codecZstd:
+		initZstd()
+		plain, err = zstdDecoder.DecodeAll(payload, nil)
+	case codecSnappy:
+		plain, err = snappy.Decode(nil, payload)
+	}
+	compressionCounters.decompressNanos.Add(uint64(time.Since(start)))
+	if err != nil {
+		compressionCounters.errors.Add(1)
+		return val
+	}
+	compressionCounters.decompressed.Add(1)
+	return plain
+}
+
+// decodedLen returns the length of val once decoded, read from the header
+// of the compressed data where it has one.
+func decodedLen(val []byte) int {
+	if !isEncoded(val) {
+		return len(val)
+	}
+	payload := val[len(codecMagic)+1:]
+	switch val[len(codecMagic)] {
+	case codecZstd:
+		var header zstd.Header
+		if header.Decode(payload) == nil && header.HasFCS {
+			return int(header.FrameContentSize)
+		}
+	case codecSnappy:
+		if n, err := snappy.DecodedLen(payload); err == nil {
+			return n
+		}
+	}
+	return len(decodeValue(val))
+}
+
+// wireValue returns val as sent to a peer: compressed only if it reads them.
+func wireValue(val []byte, compressed bool) []byte {
+	if compressed {
+		return encodeValue(val)
+	}
+	return decodeValue(val)
+}
+
+// sendHello tells a peer that compressed values can be sent on conn.
+func sendHello(conn net.Conn) error {
+	_, err := conn.Write([]byte{OpHello, helloFlag | replProtocol})
+	return err
+}
+
+// readHelloFrame returns the protocol of a link from the hello of its peer.
+func readHelloFrame(r *bufio.Reader) (byte, error) {
+	payload, err := r.ReadByte()
+	if err != nil {
+		return replLegacy, err
+	}
+	if payload&helloFlag == 0 {
+		return replLegacy, fmt.Errorf("invalid hello payload %#x", payload)
+	}
+	return min(payload&^helloFlag, replProtocol), nil
+}
+
+func compressionStats() CompressionStats {
+	c := &compressionCounters
+	st := CompressionStats{
+		Codec:           compression,
+		MinSize:         compressMin,
+		Sqlite:          compressSqlite,
+		Compressed:      c.compressed.Load(),
+		Incompressible:  c.incompressible.Load(),
+		BytesIn:         c.bytesIn.Load(),
+		BytesOut:        c.bytesOut.Load(),
+		CompressNanos:   c.compressNanos.Load(),
+		Decompressed:    c.decompressed.Load(),
+		DecompressNanos: c.decompressNanos.Load(),
+		Errors:          c.errors.Load(),
+	}
+	if st.BytesOut > 0 {
+		st.Ratio = float64(st.BytesIn) / float64(st.BytesOut)
+	}
+	return st
+}
+
+// parseCompression validates the compression flags.
+func parseCompression() error {
+	if !validCompression(compression) {
+		return fmt.Errorf("invalid --compression %q (expected none, zstd or snappy)", compression)
+	}
+	min, err := parseByteSize(compressMinSize)
+	if err != nil {
+		return fmt.Errorf("invalid --compress-min-size: %w", err)
+	}
+	compressMin = min
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func setupCompression(t *testing.T, codec string) []byte {
+	compression, compressMin = codec, 64
+	t.Cleanup(func() {
+		compression, compressMin, compressSqlite = compressionNone, 1024, false
+		storage = newMemoryStore(defaultShards)
+	})
+	return []byte(`s:2000:"` + strings.Repeat("<div>fragment</div>", 105) + `";`)
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	for _, codec := range []string{compressionZstd, compressionSnappy} {
+		val := setupCompression(t, codec)
+		encoded := encodeValue(val)
+		if !isEncoded(encoded) || len(encoded) >= len(val) {
+			t.Errorf("%s: expected a smaller encoded value, got %d of %d bytes", codec, len(encoded), len(val))
+		}
+		if !bytes.Equal(decodeValue(encoded), val) {
+			t.Errorf("%s: expected the value back", codec)
+		}
+		if n := decodedLen(encoded); n != len(val) {
+			t.Errorf("%s: expected a decoded length of %d, got %d", codec, len(val), n)
+		}
+		if small := []byte("i:1;"); !bytes.Equal(encodeValue(small), small) {
+			t.Errorf("%s: expected values below the threshold to stay plain", codec)
+		}
+	}
+	if plain := []byte("\x00hczgarbage"); !bytes.Equal(decodeValue(plain), plain) {
+		t.Errorf("Expected a value that fails to decode to be returned as is")
+	}
+}
+
+func TestCompressedValuesReadPlain(t *testing.T) {
+	val := setupCompression(t, compressionZstd)
+	storage = newMemoryStore(4)
+	before := compressionStats()
+
+	item := storage.Set("fragment", val, 0, 0)
+	if !isEncoded(item.Value) || !bytes.Equal(decodeValue(item.Value), val) {
+		t.Errorf("Expected Set to return the value as stored")
+	}
+	if used := storage.Memory(); used >= int64(len(val)) {
+		t.Errorf("Expected the value to be accounted compressed, got %d bytes", used)
+	}
+	if got, _ := storage.Get("fragment"); !bytes.Equal(got.Value, val) {
+		t.Errorf("Expected Get to return the plain value")
+	}
+	storage.Scan("", "", func(st keyState) bool {
+		if !bytes.Equal(decodeValue(st.item.Value), val) {
+			t.Errorf("Expected Scan to return a value decodeValue restores")
+		}
+		return true
+	})
+	if after := compressionStats(); after.Compressed != before.Compressed+1 || after.Ratio <= 1 {
+		t.Errorf("Expected the compression to be counted, got %+v", after)
+	}
+}
+
+func TestSqliteKeepsPlainValuesUnlessAsked(t *testing.T) {
+	val := setupCompression(t, compressionSnappy)
+	conn, err := openSqlite(filepath.Join(t.TempDir(), "compressed.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	defer conn.Close()
+	migrate(conn, false)
+	writeBehind := writeBehindEnabled
+	writeBehindEnabled = false // Each write must reach SQLite with the setting it was made under
+	t.Cleanup(func() { writeBehindEnabled = writeBehind })
+
+	stored := func(key string) []byte {
+		var v []byte
+		conn.QueryRow("SELECT value FROM cache WHERE key = ?", key).Scan(&v)
+		return v
+	}
+	s := newSqliteStore(newMemoryStore(4), conn)
+	s.Set("plain", val, 0, 0)
+	compressSqlite = true
+	s.Set("packed", val, 0, 0)
+	s.Close()
+
+	if !bytes.Equal(stored("plain"), val) {
+		t.Errorf("Expected SQLite to get the plain value the PHP store reads")
+	}
+	if !isEncoded(stored("packed")) {
+		t.Errorf("Expected a compressed value with --compress-sqlite")
+	}
+
+	reloaded := newSqliteStore(newMemoryStore(4), conn)
+	defer reloaded.Close()
+	reloaded.Load()
+	if item, _ := reloaded.Get("packed"); !bytes.Equal(item.Value, val) {
+		t.Errorf("Expected the compressed row to load as the plain value")
+	}
+}
+
+func TestFullDumpCompressesForCapablePeers(t *testing.T) {
+	val := setupCompression(t, compressionZstd)
+	storage = newMemoryStore(4)
+	storage.Set("fragment", val, 0, 0)
+
+	for _, protocol := range []byte{replLegacy, replVersions} {
+		compressed := protocol >= replVersions
+		local, remote := net.Pipe()
+		go func() {
+			sendFullDump(local, protocol)
+			local.Close()
+		}()
+		reader := bufio.NewReader(remote)
+		if op, _ := reader.ReadByte(); op != OpSyncItem {
+			t.Fatalf("Expected a SYNC item, got op %d", op)
+		}
+		_, wire, _, _, err := readPeerSetFrame(reader, protocol)
+		if err != nil {
+			t.Fatalf("Failed to read the SYNC item: %v", err)
+		}
+		if isEncoded(wire) != compressed || !bytes.Equal(decodeValue(wire), val) {
+			t.Errorf("compressed=%v: expected the value in the right form, got %d bytes", compressed, len(wire))
+		}
+		remote.Close()
+	}
+}
+
+func TestBroadcastSendsTheStoredValue(t *testing.T) {
+	val := setupCompression(t, compressionZstd)
+	storage = newMemoryStore(4)
+
+	type received struct {
+		protocol byte
+		wire     []byte
+		err      error
+	}
+	results := make(chan received, 2)
+	for _, protocol := range []byte{replLegacy, replVersions} {
+		local, remote := net.Pipe()
+		name := fmt.Sprintf("peer-%d", protocol)
+		peersMutex.Lock()
+		peers[name] = local
+		peerProtocols[local] = protocol
+		peersMutex.Unlock()
+		t.Cleanup(func() {
+			peersMutex.Lock()
+			delete(peers, name)
+			delete(peerProtocols, local)
+			peersMutex.Unlock()
+			remote.Close()
+		})
+		go func() {
+			reader := bufio.NewReader(remote)
+			if op, err := reader.ReadByte(); err != nil || op != OpSet {
+				results <- received{protocol: protocol, err: fmt.Errorf("expected a SET, got op %d", op)}
+				return
+			}
+			_, wire, _, _, err := readPeerSetFrame(reader, protocol)
+			results <- received{protocol, wire, err}
+		}()
+	}
+
+	compressed := compressionStats().Compressed
+	setLocal("fragment", val, 0, true)
+	for range 2 {
+		r := <-results
+		if r.err != nil {
+			t.Fatalf("protocol %d: %v", r.protocol, r.err)
+		}
+		if isEncoded(r.wire) != (r.protocol >= replVersions) || !bytes.Equal(decodeValue(r.wire), val) {
+			t.Errorf("protocol %d: expected the value in the right form, got %d bytes", r.protocol, len(r.wire))
+		}
+	}
+	if n := compressionStats().Compressed - compressed; n != 1 {
+		t.Errorf("Expected the value to be compressed once, got %d", n)
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/yvasiyarov/php_session_decoder/php_serialize"
+)
+
+// -------------------------------------------------------------
+// Conflict-free Replicated Counters (PN-Counter)
+// -------------------------------------------------------------
+//
+// Every node only ever grows its own positive and negative slot, so two
+// replicas merge by taking the per-slot maximum. A replication frame carries
+// just the originating node's slot, which makes frames idempotent and lets
+// peers converge after a partition once the full sync has been replayed.
+// The counter total is mirrored into the regular cache as a PHP int, so
+// plain GET requests keep working.
+//
+// Slots only grow, so a counter that expires or is deleted cannot restart
+// from zero by lowering them. Each counter carries an epoch instead, taken
+// from the node clock when it is created: slots of a newer epoch replace
+// every slot of an older one, and slots of an older epoch are ignored.
+// A node only starts an epoch when it holds no live counter, so a newer epoch
+// reaching a node whose counter is still live means two nodes created the
+// counter at the same time. The node then carries its own slot over into the
+// newer epoch and replicates it, so no increment is lost.
+
+// Counter state lives in the shard of its key, so the counter and its
+// mirrored cache value always change together.
+
+type PNCounter struct {
+	Epoch uint64            `json:"epoch"`
+	Pos   map[string]uint64 `json:"pos"`
+	Neg   map[string]uint64 `json:"neg"`
+}
+
+func newPNCounter() *PNCounter {
+	return &PNCounter{Pos: make(map[string]uint64), Neg: make(map[string]uint64)}
+}
+
+func (c *PNCounter) clone() *PNCounter {
+	copied := newPNCounter()
+	copied.Epoch = c.Epoch
+	for node, v := range c.Pos {
+		copied.Pos[node] = v
+	}
+	for node, v := range c.Neg {
+		copied.Neg[node] = v
+	}
+	return copied
+}
+
+// Value returns the counter total across all nodes.
+func (c *PNCounter) Value() int64 {
+	var total int64
+	for _, v := range c.Pos {
+		total += int64(v)
+	}
+	for _, v := range c.Neg {
+		total -= int64(v)
+	}
+	return total
+}
+
+// Add applies a delta to the given node's slots. It leaves the counter
+// unchanged and reports false when the total would leave the int64 range or
+// the slot would overflow.
+func (c *PNCounter) Add(node string, delta int64) bool {
+	if _, ok := addInt64(c.Value(), delta); !ok {
+		return false
+	}
+	slots := c.Pos
+	if delta < 0 {
+		slots = c.Neg
+	}
+	magnitude := uint64(delta)
+	if delta < 0 {
+		magnitude = uint64(-delta) // Also right for math.MinInt64
+	}
+	if slots[node]+magnitude < slots[node] {
+		return false
+	}
+	slots[node] += magnitude
+	return true
+}
+
+// Merge folds a slot of the given epoch into the counter and reports whether
+// anything changed.
+func (c *PNCounter) Merge(epoch uint64, node string, pos, neg uint64) bool {
+	switch {
+	case epoch < c.Epoch:
+		return false
+	case epoch > c.Epoch:
+		c.Epoch = epoch
+		clear(c.Pos)
+		clear(c.Neg)
+	}
+	changed := false
+	if pos > c.Pos[node] {
+		c.Pos[node] = pos
+		changed = true
+	}
+	if neg > c.Neg[node] {
+		c.Neg[node] = neg
+		changed = true
+	}
+	return changed
+}
+
+// counterStep is what a local increment changed: the new total, the slot of
+// this node and the mirrored item to replicate.
+type counterStep struct {
+	value           int64
+	epoch, pos, neg uint64
+	mirror          CacheItem
+}
+
+// incrCounter applies a delta on behalf of this node and replicates the slot. A TTL is only applied when the counter is created.
+// It reports false, changing nothing, when the counter would overflow.
+func incrCounter(key string, delta int64, ttl *int) (int64, bool) {
+	var step counterStep
+	ok := false
+	storage.Update(key, func(tx *itemTx) bool {
+		step, ok = addCounterLocked(tx, delta, ttl)
+		return ok
+	})
+	if !ok {
+		return 0, false
+	}
+
+	broadcastCounter(key, nodeID, step.epoch, step.pos, step.neg, step.mirror)
+
+	return step.value, true
+}
+
+// addCounterLocked applies a delta to the counter of tx, starting a new one
+// when the key holds no live counter. It reports false, changing nothing,
+// when the counter would overflow.
+func addCounterLocked(tx *itemTx, delta int64, ttl *int) (counterStep, bool) {
+	now := time.Now().Unix()
+	c, ok := tx.Counter()
+	item, exists := tx.Item()
+	if !ok || !exists || (item.Expiration > 0 && item.Expiration < now) {
+		c = newPNCounter()
+		c.Epoch = versions.next()
+		tx.SetCounter(c)
+		item.Expiration = 0
+		if ttl != nil && *ttl > 0 {
+			item.Expiration = now + int64(*ttl)
+		}
+	}
+	if !c.Add(nodeID, delta) {
+		return counterStep{}, false // Only a live counter can overflow
+	}
+	step := counterStep{value: c.Value(), epoch: c.Epoch, pos: c.Pos[nodeID], neg: c.Neg[nodeID]}
+	encoded, _ := php_serialize.Serialize(step.value)
+	step.mirror = tx.Store([]byte(encoded), item.Expiration, 0)
+	return step, true
+}
+
+// mergeCounter applies a slot received from a peer. A slot of a newer epoch
+// restarts the counter with the expiration the peer gave it; if the counter
+// it replaces is still live, this node's slot is carried over and replicated.
+func mergeCounter(key, node string, epoch, pos, neg uint64, expiration int64) {
+	var carried *counterStep
+	storage.Update(key, func(tx *itemTx) bool {
+		c, ok := tx.Counter()
+		item, exists := tx.Item()
+		var ownPos, ownNeg uint64
+		if !ok {
+			c = newPNCounter()
+			tx.SetCounter(c)
+		} else if epoch > c.Epoch && exists && node != nodeID && (item.Expiration == 0 || item.Expiration > time.Now().Unix()) {
+			ownPos, ownNeg = c.Pos[nodeID], c.Neg[nodeID]
+		}
+		if !ok || epoch > c.Epoch {
+			item.Expiration = expiration
+		}
+		if !c.Merge(epoch, node, pos, neg) && ok {
+			return false
+		}
+		if ownPos > 0 || ownNeg > 0 {
+			c.Pos[nodeID] += ownPos
+			c.Neg[nodeID] += ownNeg
+			carried = &counterStep{epoch: c.Epoch, pos: c.Pos[nodeID], neg: c.Neg[nodeID]}
+		}
+		encoded, _ := php_serialize.Serialize(c.Value())
+		mirror := tx.Store([]byte(encoded), item.Expiration, 0)
+		if carried != nil {
+			carried.mirror = mirror
+		}
+		return true
+	})
+
+	if carried != nil {
+		broadcastCounter(key, nodeID, carried.epoch, carried.pos, carried.neg, carried.mirror)
+	}
+}
+
+// -------------------------------------------------------------
+// Counter Frames
+// -------------------------------------------------------------
+
+// broadcastCounter sends a slot to every peer. Legacy peers cannot merge
+// slots, so they get the mirrored total, as stored by mirror, as a plain SET
+// instead.
+func broadcastCounter(key, node string, epoch, pos, neg uint64, mirror CacheItem) {
+	peersMutex.Lock()
+	defer peersMutex.Unlock()
+	for addr, conn := range peers {
+		var err error
+		if peerProtocols[conn] >= opProtocol(OpCounter) {
+			err = writeCounterFrame(conn, key, node, epoch, pos, neg, mirror.Expiration)
+		} else {
+			err = writePeerSetFrame(conn, replLegacy, OpSet, key, decodeValue(mirror.Value), mirror.Expiration, 0)
+		}
+		if err != nil {
+			log.Printf("Failed to broadcast COUNTER to %s: %v", addr, err)
+		} else {
+			statsMutex.Lock()
+			stats.TotalBroadcasts++
+			statsMutex.Unlock()
+		}
+	}
+}
+
+// writeCounterFrame encodes one node's slot of a counter:
+// op | keyLen u16 | nodeLen u16 | epoch u64 | pos u64 | neg u64 | exp u32 | key | node
+func writeCounterFrame(w io.Writer, key, node string, epoch, pos, neg uint64, exp int64) error {
+	header := make([]byte, 33)
+	header[0] = OpCounter
+	binary.BigEndian.PutUint16(header[1:3], uint16(len(key)))
+	binary.BigEndian.PutUint16(header[3:5], uint16(len(node)))
+	binary.BigEndian.PutUint64(header[5:13], epoch)
+	binary.BigEndian.PutUint64(header[13:21], pos)
+	binary.BigEndian.PutUint64(header[21:29], neg)
+	binary.BigEndian.PutUint32(header[29:33], uint32(exp))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(key)); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(node)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func readCounterFrame(r *bufio.Reader) (string, string, uint64, uint64, uint64, int64, error) {
+	header := make([]byte, 32) // We already read the Op byte
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", "", 0, 0, 0, 0, err
+	}
+	keyLen := binary.BigEndian.Uint16(header[0:2])
+	nodeLen := binary.BigEndian.Uint16(header[2:4])
+	epoch := binary.BigEndian.Uint64(header[4:12])
+	pos := binary.BigEndian.Uint64(header[12:20])
+	neg := binary.BigEndian.Uint64(header[20:28])
+	exp := int64(binary.BigEndian.Uint32(header[28:32]))
+
+	keyBytes := make([]byte, keyLen)
+	if _, err := io.ReadFull(r, keyBytes); err != nil {
+		return "", "", 0, 0, 0, 0, err
+	}
+	nodeBytes := make([]byte, nodeLen)
+	if _, err := io.ReadFull(r, nodeBytes); err != nil {
+		return "", "", 0, 0, 0, 0, err
+	}
+	return string(keyBytes), string(nodeBytes), epoch, pos, neg, exp, nil
+}
+
+// writeCounterDump sends every slot of the counter of tx, if any.
+func writeCounterDump(w io.Writer, st keyState) {
+	c := st.counter
+	if c == nil {
+		return
+	}
+	nodes := make(map[string]bool)
+	for node := range c.Pos {
+		nodes[node] = true
+	}
+	for node := range c.Neg {
+		nodes[node] = true
+	}
+	for node := range nodes {
+		writeCounterFrame(w, st.key, node, c.Epoch, c.Pos[node], c.Neg[node], st.item.Expiration)
+	}
+}
+
+// -------------------------------------------------------------
+// Counter HTTP Handler
+// -------------------------------------------------------------
+
+func handleCounter(w http.ResponseWriter, r *http.Request) {
+	key := namespacedKey(requestNamespace(r), strings.TrimPrefix(r.URL.Path, "/api/hypercacheio/counter/"))
+	if key == "" {
+		http.Error(w, "Key required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		var resp map[string]interface{}
+		storage.View(key, func(tx *itemTx) {
+			c, ok := tx.Counter()
+			item, _ := tx.Item()
+			if ok && (item.Expiration == 0 || item.Expiration > time.Now().Unix()) {
+				resp = map[string]interface{}{
+					"value":      c.Value(),
+					"slots":      c,
+					"expiration": item.Expiration,
+				}
+			}
+		})
+
+		if resp == nil {
+			writeJSON(w, map[string]interface{}{"value": nil})
+			return
+		}
+		writeJSON(w, resp)
+
+	case "POST":
+		body, _ := io.ReadAll(r.Body)
+		var payload IncrPayload
+		if len(body) > 0 {
+			if err := json.Unmarshal(body, &payload); err != nil {
+				http.Error(w, "Invalid payload", http.StatusBadRequest)
+				return
+			}
+		}
+		delta := int64(1)
+		if payload.Value != "" {
+			d, err := payload.Value.Int64()
+			if err != nil {
+				http.Error(w, "Counter delta must be an integer", http.StatusBadRequest)
+				return
+			}
+			delta = d
+		}
+		if !allowWrite(w, r, map[string]int{key: 0}) {
+			return
+		}
+		value, ok := incrCounter(key, delta, payload.TTL)
+		if !ok {
+			http.Error(w, `{"error": "Counter would overflow"}`, http.StatusUnprocessableEntity)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"value": value})
+
+	case "DELETE":
+		delLocal(key, true)
+		writeJSON(w, map[string]bool{"success": true})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPNCounterConverges(t *testing.T) {
+	a, b := newPNCounter(), newPNCounter()
+
+	// Concurrent increments on two partitioned nodes
+	a.Add("node-a", 5)
+	a.Add("node-a", -2)
+	b.Add("node-b", 10)
+
+	// Exchange slots, including duplicated and out-of-order deliveries
+	b.Merge(0, "node-a", a.Pos["node-a"], a.Neg["node-a"])
+	a.Merge(0, "node-b", b.Pos["node-b"], b.Neg["node-b"])
+	a.Merge(0, "node-b", 3, 0)
+	b.Merge(0, "node-a", a.Pos["node-a"], a.Neg["node-a"])
+
+	if a.Value() != 13 || b.Value() != 13 {
+		t.Errorf("Expected both replicas to converge on 13, got %d and %d", a.Value(), b.Value())
+	}
+}
+
+func TestCounterFrameMerge(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	nodeID = "node-a"
+
+	incrCounter("visits", 4, nil)
+
+	var buf bytes.Buffer
+	writeCounterFrame(&buf, "visits", "node-b", counterEpoch(t, "visits"), 7, 1, 0)
+
+	reader := bufio.NewReader(&buf)
+	if op, _ := reader.ReadByte(); op != OpCounter {
+		t.Fatalf("Expected OpCounter, got %d", op)
+	}
+	key, node, epoch, pos, neg, exp, err := readCounterFrame(reader)
+	if err != nil {
+		t.Fatalf("Failed to read COUNTER frame: %v", err)
+	}
+	mergeCounter(key, node, epoch, pos, neg, exp)
+
+	item, _ := storage.Get("visits")
+	stored := string(item.Value)
+	if stored != "i:10;" {
+		t.Errorf("Expected mirrored value 'i:10;', got %v", stored)
+	}
+
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM cache_counters WHERE key = ?", "visits").Scan(&count)
+	if count != 2 {
+		t.Errorf("Expected 2 persisted counter slots, got %d", count)
+	}
+}
+
+func TestHandleCounterRoutesIncr(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	nodeID = "node-a"
+
+	req, _ := http.NewRequest("POST", "/api/hypercacheio/counter/likes", bytes.NewBufferString(`{"value": 3}`))
+	handleCounter(httptest.NewRecorder(), req)
+
+	// Plain increments on a counter key are applied to the CRDT
+	resp := doIncr(t, "/api/hypercacheio/decr/likes", `{"value": 1}`)
+	if resp["value"] != float64(2) {
+		t.Errorf("Expected 2 after decrement, got %v", resp["value"])
+	}
+
+	req2, _ := http.NewRequest("GET", "/api/hypercacheio/counter/likes", nil)
+	rr2 := httptest.NewRecorder()
+	handleCounter(rr2, req2)
+
+	var getResp map[string]interface{}
+	json.Unmarshal(rr2.Body.Bytes(), &getResp)
+	if getResp["value"] != float64(2) {
+		t.Errorf("Expected counter value 2, got %v", getResp["value"])
+	}
+
+	// Overwriting the key turns it back into a plain value
+	setLocal("likes", []byte("i:100;"), 0, false)
+	if isCounter("likes") {
+		t.Errorf("Counter state survived a plain SET")
+	}
+}
+
+// isCounter reports whether key holds a CRDT counter.
+func isCounter(key string) bool {
+	ok := false
+	storage.View(key, func(tx *itemTx) {
+		_, ok = tx.Counter()
+	})
+	return ok
+}
+
+func counterEpoch(t *testing.T, key string) uint64 {
+	t.Helper()
+	var epoch uint64
+	storage.View(key, func(tx *itemTx) {
+		if c, ok := tx.Counter(); ok {
+			epoch = c.Epoch
+		}
+	})
+	return epoch
+}
+
+func TestCounterRestartsAfterExpiry(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	nodeID = "node-a"
+
+	// Both nodes counted under the first epoch, then the counter expired
+	incrCounter("visits", 5, nil)
+	old := counterEpoch(t, "visits")
+	mergeCounter("visits", "node-b", old, 3, 0, 0)
+	storage.Expire("visits", time.Now().Unix()-1)
+
+	if value, _ := incrCounter("visits", 1, nil); value != 1 {
+		t.Fatalf("Expected the counter to restart at 1, got %d", value)
+	}
+	restarted := counterEpoch(t, "visits")
+	if restarted <= old {
+		t.Fatalf("Expected a newer epoch after the restart, got %d after %d", restarted, old)
+	}
+
+	// A late slot of the old epoch is ignored
+	mergeCounter("visits", "node-b", old, 9, 0, 0)
+	if item, _ := storage.Get("visits"); string(item.Value) != "i:1;" {
+		t.Errorf("Expected a slot of the old epoch to be ignored, got %s", item.Value)
+	}
+
+	// A peer still holding the expired counter restarts when the new slot arrives
+	peer := newPNCounter()
+	peer.Epoch = old
+	peer.Add("node-a", 5)
+	if !peer.Merge(restarted, "node-a", 1, 0) || peer.Value() != 1 {
+		t.Errorf("Expected a slot of the new epoch to replace the old slots, got %d", peer.Value())
+	}
+
+	var rows int
+	db.QueryRow("SELECT COUNT(*) FROM cache_counters WHERE key = ?", "visits").Scan(&rows)
+	if rows != 1 {
+		t.Errorf("Expected only the slot of the new epoch to be persisted, got %d rows", rows)
+	}
+}
+
+func TestReplicationClosesOnOpsItCannotRead(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	var slot bytes.Buffer
+	writeCounterFrame(&slot, "visits", "node-b", 1, 7, 0, 0)
+	for name, frames := range map[string][]byte{
+		"unknown op":        append([]byte{OpHello, helloFlag | replProtocol}, 0x7f),
+		"op not negotiated": slot.Bytes(),
+	} {
+		local, remote := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			handleReplicationConn(local)
+			close(done)
+		}()
+		go io.Copy(io.Discard, remote) // The hello reply
+		remote.Write(frames)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Errorf("%s: Expected the link to be closed", name)
+		}
+		remote.Close()
+	}
+	if _, ok := storage.Get("visits"); ok {
+		t.Errorf("Expected the slot of a legacy link to be refused")
+	}
+}
+
+type counterSlot struct {
+	node            string
+	epoch, pos, neg uint64
+}
+
+// counterFrames registers a peer and returns the slots broadcast to it.
+func counterFrames(t *testing.T) <-chan counterSlot {
+	local, remote := net.Pipe()
+	peersMutex.Lock()
+	peers["peer"] = local
+	peerProtocols[local] = replProtocol
+	peersMutex.Unlock()
+	t.Cleanup(func() {
+		peersMutex.Lock()
+		delete(peers, "peer")
+		delete(peerProtocols, local)
+		peersMutex.Unlock()
+		remote.Close()
+	})
+
+	frames := make(chan counterSlot, 16)
+	go func() {
+		reader := bufio.NewReader(remote)
+		for {
+			if op, err := reader.ReadByte(); err != nil || op != OpCounter {
+				return
+			}
+			_, node, epoch, pos, neg, _, err := readCounterFrame(reader)
+			if err != nil {
+				return
+			}
+			frames <- counterSlot{node, epoch, pos, neg}
+		}
+	}()
+	return frames
+}
+
+func TestConcurrentIncrementsOfAFreshKeyConverge(t *testing.T) {
+	defer func(s Store, id string) { storage, nodeID = s, id }(storage, nodeID)
+	nodes := []Store{newMemoryStore(4), newMemoryStore(4)}
+	names := []string{"node-a", "node-b"}
+	on := func(i int) {
+		storage, nodeID = nodes[i], names[i]
+	}
+	frames := counterFrames(t)
+	next := func() counterSlot {
+		select {
+		case f := <-frames:
+			return f
+		case <-time.After(time.Second):
+			t.Fatalf("Expected a COUNTER frame")
+			return counterSlot{}
+		}
+	}
+	deliver := func(to int, f counterSlot) {
+		on(to)
+		mergeCounter("visits", f.node, f.epoch, f.pos, f.neg, 0)
+	}
+
+	// Both nodes increment the key before either has heard of the other
+	on(0)
+	doIncr(t, "/api/hypercacheio/incr/visits", `{"value": 1}`)
+	fromA := next()
+	on(1)
+	doIncr(t, "/api/hypercacheio/incr/visits", `{"value": 1}`)
+	fromB := next()
+
+	// The node whose epoch lost carries its increment over and replicates it
+	deliver(0, fromB)
+	carried := next()
+	deliver(1, fromA)
+	deliver(1, carried)
+
+	for i := range nodes {
+		on(i)
+		if item, _ := storage.Get("visits"); string(item.Value) != "i:2;" {
+			t.Errorf("Expected %s to count both increments, got %s", names[i], item.Value)
+		}
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// -------------------------------------------------------------
+// Encryption at Rest
+// -------------------------------------------------------------
+//
+// With --encryption-key-file, values are sealed with AES-256-GCM before they
+// are written to SQLite, the append-only log or a snapshot, and opened when
+// they are read back. Memory and replication links keep plain values. A
+// sealed value describes itself:
+//
+//	magic "\x00hce" | mode u8 | key id [4] | nonce [12] | ciphertext
+//
+// The key id is derived from the key, so a value sealed with a key missing
+// from the key file is recognised before anything is decrypted. The name the
+// value is stored under is authenticated with it, so a sealed value cannot
+// be moved to another key.
+//
+// With --encrypt-keys the name is a keyed hash of the key instead and the key
+// travels inside the ciphertext. Tag names, counter node ids and the
+// cache_locks table, which holds lock owners rather than payloads, stay plain.
+//
+// The key file holds one 32 byte key per line, hex or base64 encoded. The
+// first key seals, the others only open. To rotate, put the new key first,
+// keep the old one below it and restart: rows and log frames sealed with an
+// older key are re-sealed in the background. Snapshots are never rewritten,
+// so an old key has to stay as long as snapshots sealed with it are kept.
+
+const (
+	sealMagic       = "\x00hce"
+	sealValues      = 'v'
+	sealKeys        = 'k'
+	sealKeyIDSize   = 4
+	sealHeaderSize  = len(sealMagic) + 1 + sealKeyIDSize
+	hashedKeyPrefix = "hck:"
+	reencryptChunk  = 256
+)
+
+var (
+	encryptionKeyFile string
+	encryptKeys       bool
+
+	// sealing is the loaded key file, nil without encryption
+	sealing *keyring
+
+	encryptionCounters struct {
+		sealed       atomic.Uint64
+		opened       atomic.Uint64
+		failures     atomic.Uint64
+		stale        atomic.Uint64
+		reencrypted  atomic.Uint64
+		reencrypting atomic.Bool
+	}
+)
+
+type sealKey struct {
+	id   [sealKeyIDSize]byte
+	aead cipher.AEAD
+}
+
+// keyring holds the keys of the key file, the first one sealing.
+type keyring struct {
+	active  *sealKey
+	byID    map[[sealKeyIDSize]byte]*sealKey
+	hashKey []byte
+}
+
+type EncryptionStats struct {
+	Enabled      bool   `json:"enabled"`
+	KeyID        string `json:"key_id,omitempty"`
+	Keys         int    `json:"keys"`
+	HashedKeys   bool   `json:"hashed_keys"`
+	Sealed       uint64 `json:"sealed"`
+	Opened       uint64 `json:"opened"`
+	Failures     uint64 `json:"failures"`
+	Stale        uint64 `json:"stale"`
+	Reencrypted  uint64 `json:"reencrypted"`
+	Reencrypting bool   `json:"reencrypting"`
+}
+
+// parseKeyFile decodes the keys of a key file. Blank lines and lines
+// starting with # are skipped.
+func parseKeyFile(data []byte) ([][]byte, error) {
+	keys := make([][]byte, 0)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := hex.DecodeString(line)
+		if err != nil {
+			key, err = base64.StdEncoding.DecodeString(line)
+		}
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("line %d: expected a 32 byte key, hex or base64 encoded", i+1)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no keys found")
+	}
+	return keys, nil
+}
+
+func newKeyring(keys [][]byte) (*keyring, error) {
+	ring := &keyring{byID: make(map[[sealKeyIDSize]byte]*sealKey)}
+	for _, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k := &sealKey{aead: aead}
+		copy(k.id[:], keyedHash(key, "hypercacheio key id"))
+		if _, dup := ring.byID[k.id]; dup {
+			return nil, fmt.Errorf("key %x is listed twice", k.id)
+		}
+		ring.byID[k.id] = k
+		if ring.active == nil {
+			ring.active = k
+			ring.hashKey = keyedHash(key, "hypercacheio key hash")
+		}
+	}
+	return ring, nil
+}
+
+func keyedHash(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// parseEncryption validates the encryption flags and loads the key file.
+func parseEncryption() error {
+	if encryptionKeyFile == "" {
+		if encryptKeys {
+			return errors.New("--encrypt-keys needs --encryption-key-file")
+		}
+		return nil
+	}
+	data, err := os.ReadFile(encryptionKeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot read --encryption-key-file: %w", err)
+	}
+	keys, err := parseKeyFile(data)
+	if err != nil {
+		return fmt.Errorf("invalid --encryption-key-file %s: %w", encryptionKeyFile, err)
+	}
+	sealing, err = newKeyring(keys)
+	return err
+}
+
+// sealHeader returns the header of values sealed with the active key, nil
+// without encryption.
+func sealHeader() []byte {
+	if sealing == nil {
+		return nil
+	}
+	mode := byte(sealValues)
+	if encryptKeys {
+		mode = sealKeys
+	}
+	return append(append([]byte(sealMagic), mode), sealing.active.id[:]...)
+}
+
+// isSealed reports whether val is a sealed value.
+func isSealed(val []byte) bool {
+	return len(val) > sealHeaderSize && string(val[:len(sealMagic)]) == sealMagic
+}
+
+// diskKey returns the name key is written under.
+func diskKey(key string) string {
+	if sealing == nil || !encryptKeys {
+		return key
+	}
+	mac := hmac.New(sha256.New, sealing.hashKey)
+	mac.Write([]byte(key))
+	return hashedKeyPrefix + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sealValue returns the name key is written under and val sealed for it, or
+// val itself without encryption.
+func sealValue(key string, val []byte) (string, []byte) {
+	name := diskKey(key)
+	header := sealHeader()
+	if header == nil {
+		return name, val
+	}
+	plain := val
+	if encryptKeys {
+		plain = binary.AppendUvarint(make([]byte, 0, len(key)+len(val)+binary.MaxVarintLen64), uint64(len(key)))
+		plain = append(append(plain, key...), val...)
+	}
+	aead := sealing.active.aead
+	out := make([]byte, len(header)+aead.NonceSize(), len(header)+aead.NonceSize()+len(plain)+aead.Overhead())
+	copy(out, header)
+	nonce := out[len(header):]
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err) // The system random source is gone
+	}
+	encryptionCounters.sealed.Add(1)
+	return name, aead.Seal(out, nonce, plain, []byte(name))
+}
+
+// openValue returns the key and plain value of a value stored under name.
+// Values that are not sealed are returned as they are.
+func openValue(name string, val []byte) (string, []byte, error) {
+	if !isSealed(val) {
+		return name, val, nil
+	}
+	key, plain, err := openSealed(name, val)
+	if err != nil {
+		encryptionCounters.failures.Add(1)
+		return name, nil, err
+	}
+	encryptionCounters.opened.Add(1)
+	return key, plain, nil
+}
+
+func openSealed(name string, val []byte) (string, []byte, error) {
+	if sealing == nil {
+		return "", nil, fmt.Errorf("%s is encrypted, start the server with --encryption-key-file", name)
+	}
+	mode := val[len(sealMagic)]
+	var id [sealKeyIDSize]byte
+	copy(id[:], val[len(sealMagic)+1:sealHeaderSize])
+	k, ok := sealing.byID[id]
+	if !ok {
+		return "", nil, fmt.Errorf("%s was sealed with key %x, which is not in the key file", name, id)
+	}
+	rest := val[sealHeaderSize:]
+	if len(rest) < k.aead.NonceSize() {
+		return "", nil, fmt.Errorf("%s: sealed value too short", name)
+	}
+	plain, err := k.aead.Open(nil, rest[:k.aead.NonceSize()], rest[k.aead.NonceSize():], []byte(name))
+	if err != nil {
+		return "", nil, fmt.Errorf("%s does not decrypt with key %x, it is damaged", name, id)
+	}
+	switch mode {
+	case sealValues:
+		return name, plain, nil
+	case sealKeys:
+		length, n := binary.Uvarint(plain)
+		if n <= 0 || uint64(len(plain)-n) < length {
+			return "", nil, fmt.Errorf("%s: damaged sealed key", name)
+		}
+		return string(plain[n : n+int(length)]), plain[n+int(length):], nil
+	}
+	return "", nil, fmt.Errorf("%s: unknown seal mode %q", name, mode)
+}
+
+// sealedNames maps the names found on disk back to their keys while a log or
+// snapshot is read, and counts the values not sealed with the active key.
+// Only hashed names need an entry.
+type sealedNames struct {
+	keys   map[string]string
+	header []byte
+	stale  int
+}
+
+func newSealedNames() *sealedNames {
+	return &sealedNames{keys: make(map[string]string), header: sealHeader()}
+}
+
+func (n *sealedNames) open(name string, val []byte) (string, []byte, error) {
+	key, plain, err := openValue(name, val)
+	if err != nil {
+		return key, nil, err
+	}
+	if key != name {
+		n.keys[name] = key
+	}
+	if n.header != nil && !bytes.HasPrefix(val, n.header) {
+		n.stale++
+	}
+	return key, plain, nil
+}
+
+// key returns the key written under name.
+func (n *sealedNames) key(name string) string {
+	if key, ok := n.keys[name]; ok {
+		return key
+	}
+	return name
+}
+
+// -------------------------------------------------------------
+// SQLite Encryption
+// -------------------------------------------------------------
+
+// checkSqliteEncryption makes sure every sealed row of db can be opened with
+// the key file, so a wrong key stops the server before anything is loaded.
+// It reports whether any row is stored under a hashed key.
+func checkSqliteEncryption(db *sql.DB) (bool, error) {
+	rows, err := db.Query("SELECT DISTINCT substr(value, 1, ?) FROM cache WHERE substr(value, 1, ?) = ?",
+		sealHeaderSize, len(sealMagic), []byte(sealMagic))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	hashed := false
+	for rows.Next() {
+		var header []byte
+		if err := rows.Scan(&header); err != nil || len(header) != sealHeaderSize {
+			continue
+		}
+		hashed = hashed || header[len(sealMagic)] == sealKeys
+		if sealing == nil {
+			return hashed, errors.New("the SQLite file is encrypted, start the server with --encryption-key-file")
+		}
+		var id [sealKeyIDSize]byte
+		copy(id[:], header[len(sealMagic)+1:])
+		if _, ok := sealing.byID[id]; !ok {
+			return hashed, fmt.Errorf("the SQLite file holds values sealed with key %x, which is not in %s: the key file does not match", id, encryptionKeyFile)
+		}
+	}
+	return hashed, rows.Err()
+}
+
+// startReencrypt re-seals the rows not sealed with the active key in the
+// background. Close waits for it.
+func (s *sqliteStore) startReencrypt() {
+	header := sealHeader()
+	if header == nil {
+		return
+	}
+	var stale int64
+	s.db.QueryRow("SELECT COUNT(*) FROM cache WHERE substr(value, 1, ?) != ?", len(header), header).Scan(&stale)
+	if stale == 0 {
+		return
+	}
+	encryptionCounters.stale.Store(uint64(stale))
+	encryptionCounters.reencrypting.Store(true)
+	log.Printf("Re-sealing %d SQLite rows with key %x in the background", stale, sealing.active.id)
+	s.reencrypting.Add(1)
+	go s.reencrypt(header)
+}
+
+// staleRow is a row of the cache table not sealed with the active key.
+type staleRow struct {
+	name  string
+	value []byte
+}
+
+// reencrypt re-seals stale rows a chunk at a time, between write-behind
+// batches. A row whose name changes with the key hash is rewritten from
+// memory, which holds every key with the sqlite engine; the tiered engine
+// never hashes keys.
+func (s *sqliteStore) reencrypt(header []byte) {
+	defer s.reencrypting.Done()
+	defer encryptionCounters.reencrypting.Store(false)
+
+	from := ""
+	for !s.closing.Load() {
+		rows, err := s.readStaleRows(header, from)
+		if err != nil {
+			log.Printf("Re-sealing SQLite rows failed: %v", err)
+			return
+		}
+		if len(rows) == 0 {
+			break
+		}
+		s.queue.exclusive(false, func(ex execer) {
+			for _, r := range rows {
+				key, val, err := openValue(r.name, r.value)
+				if err != nil {
+					log.Printf("Skipping a row that cannot be re-sealed: %v", err)
+					continue
+				}
+				if name, sealed := sealValue(key, val); name == r.name {
+					// A write since the row was read already sealed it. Rows
+					// of the PHP store hold TEXT, hence the cast
+					ex.Exec("UPDATE cache SET value = ? WHERE key = ? AND CAST(value AS BLOB) = ?", sealed, name, r.value)
+				} else {
+					s.renameRow(ex, r.name, key)
+				}
+				encryptionCounters.reencrypted.Add(1)
+			}
+		})
+		from = rows[len(rows)-1].name
+	}
+	log.Printf("Re-sealed %d SQLite rows", encryptionCounters.reencrypted.Load())
+}
+
+func (s *sqliteStore) readStaleRows(header []byte, from string) ([]staleRow, error) {
+	rows, err := s.db.Query("SELECT key, value FROM cache WHERE key > ? AND substr(value, 1, ?) != ? ORDER BY key LIMIT ?",
+		from, len(header), header, reencryptChunk)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stale := make([]staleRow, 0, reencryptChunk)
+	for rows.Next() {
+		var r staleRow
+		if err := rows.Scan(&r.name, &r.value); err != nil {
+			return stale, err
+		}
+		stale = append(stale, r)
+	}
+	return stale, rows.Err()
+}
+
+// renameRow drops what is stored under name and writes key again from memory.
+func (s *sqliteStore) renameRow(ex execer, name, key string) {
+	ex.Exec("DELETE FROM cache WHERE key = ?", name)
+	ex.Exec("DELETE FROM cache_counters WHERE key = ?", name)
+	ex.Exec("DELETE FROM cache_tags WHERE key = ?", name)
+
+	var st keyState
+	var tags []string
+	s.keys.View(key, func(tx *itemTx) {
+		if _, live := tx.Live(); live {
+			st, tags = snapshot(tx), tx.Tags()
+		}
+	})
+	if st.exists {
+		persistState(ex, st)
+		persistTags(ex, key, tags)
+	}
+}
+
+func encryptionStats() EncryptionStats {
+	c := &encryptionCounters
+	st := EncryptionStats{
+		Enabled:      sealing != nil,
+		HashedKeys:   sealing != nil && encryptKeys,
+		Sealed:       c.sealed.Load(),
+		Opened:       c.opened.Load(),
+		Failures:     c.failures.Load(),
+		Stale:        c.stale.Load(),
+		Reencrypted:  c.reencrypted.Load(),
+		Reencrypting: c.reencrypting.Load(),
+	}
+	if sealing != nil {
+		st.KeyID = hex.EncodeToString(sealing.active.id[:])
+		st.Keys = len(sealing.byID)
+	}
+	return st
+}
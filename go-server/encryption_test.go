@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func setupEncryption(t *testing.T, keys ...[]byte) {
+	t.Helper()
+	ring, err := newKeyring(keys)
+	if err != nil {
+		t.Fatalf("Failed to create the keyring: %v", err)
+	}
+	sealing = ring
+	t.Cleanup(func() {
+		sealing, encryptKeys = nil, false
+		storage = newMemoryStore(defaultShards)
+	})
+}
+
+func openEncryptedSqlite(t *testing.T) *sql.DB {
+	conn, err := openSqlite(filepath.Join(t.TempDir(), "encrypted.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	if _, err := migrate(conn, false); err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func reloadSqlite(t *testing.T, conn *sql.DB) *sqliteStore {
+	s := newSqliteStore(newMemoryStore(4), conn)
+	storage = s
+	if err := s.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	return s
+}
+
+func TestParseKeyFile(t *testing.T) {
+	file := "# rotated in March\n" + hex.EncodeToString(testKey(1)) + "\n\n" + base64.StdEncoding.EncodeToString(testKey(2)) + "\n"
+	keys, err := parseKeyFile([]byte(file))
+	if err != nil || len(keys) != 2 || !bytes.Equal(keys[1], testKey(2)) {
+		t.Fatalf("Expected two keys, got %d: %v", len(keys), err)
+	}
+	if _, err := parseKeyFile([]byte("c2hvcnQ=\n")); err == nil {
+		t.Errorf("Expected a short key to be rejected")
+	}
+	if _, err := parseKeyFile([]byte("# nothing\n")); err == nil {
+		t.Errorf("Expected an empty key file to be rejected")
+	}
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	setupEncryption(t, testKey(1))
+	val := []byte(`s:6:"secret";`)
+
+	name, sealed := sealValue("session:1", val)
+	if name != "session:1" || !isSealed(sealed) || bytes.Contains(sealed, val) {
+		t.Fatalf("Expected a sealed value under the key itself, got %q", name)
+	}
+	if key, plain, err := openValue(name, sealed); err != nil || key != "session:1" || !bytes.Equal(plain, val) {
+		t.Errorf("Expected the value back, got %q, %q, %v", key, plain, err)
+	}
+	if _, _, err := openValue("session:2", sealed); err == nil {
+		t.Errorf("Expected a value moved to another key not to open")
+	}
+
+	encryptKeys = true
+	name, sealed = sealValue("session:1", val)
+	if !strings.HasPrefix(name, hashedKeyPrefix) || strings.Contains(name, "session") {
+		t.Errorf("Expected a hashed name, got %q", name)
+	}
+	if key, plain, err := openValue(name, sealed); err != nil || key != "session:1" || !bytes.Equal(plain, val) {
+		t.Errorf("Expected the key and value back, got %q, %q, %v", key, plain, err)
+	}
+
+	setupEncryption(t, testKey(2))
+	if _, _, err := openValue(name, sealed); err == nil || !strings.Contains(err.Error(), "not in the key file") {
+		t.Errorf("Expected an unknown key to be reported, got %v", err)
+	}
+	sealing = nil
+	if _, _, err := openValue(name, sealed); err == nil {
+		t.Errorf("Expected a sealed value not to open without a key file")
+	}
+}
+
+func TestSqliteEncryptsValuesAndKeys(t *testing.T) {
+	setupEncryption(t, testKey(1))
+	encryptKeys = true
+	conn := openEncryptedSqlite(t)
+
+	s := reloadSqlite(t, conn)
+	s.Set("session:1", []byte(`s:6:"secret";`), 0, 0)
+	s.SetTags("session:1", []string{"users"})
+	s.Set("hits", []byte("i:0;"), 0, 0)
+	incrCounter("hits", 3, nil)
+	s.Close()
+
+	var plain int
+	conn.QueryRow("SELECT COUNT(*) FROM cache WHERE key LIKE 'session%' OR key = 'hits' OR CAST(value AS TEXT) LIKE '%secret%'").Scan(&plain)
+	if plain != 0 {
+		t.Errorf("Expected neither keys nor values in the clear, found %d rows", plain)
+	}
+
+	s = reloadSqlite(t, conn)
+	defer s.Close()
+	if item, ok := s.Get("session:1"); !ok || string(item.Value) != `s:6:"secret";` {
+		t.Errorf("Expected session:1 to load, got %+v", item)
+	}
+	if keys := s.TaggedKeys("users"); len(keys) != 1 {
+		t.Errorf("Expected the tags to load under the hashed name, got %v", keys)
+	}
+	if v, _ := incrCounter("hits", 1, nil); v != 4 {
+		t.Errorf("Expected the counter to load under the hashed name, got %d", v)
+	}
+}
+
+func TestSqliteKeyRotation(t *testing.T) {
+	setupEncryption(t, testKey(1))
+	conn := openEncryptedSqlite(t)
+	s := reloadSqlite(t, conn)
+	for _, key := range []string{"a", "b", "c"} {
+		s.Set(key, []byte("i:1;"), 0, 0)
+	}
+	s.SetTags("b", []string{"group"})
+	s.Close()
+
+	setupEncryption(t, testKey(3))
+	if _, err := checkSqliteEncryption(conn); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("Expected a wrong key to stop the server, got %v", err)
+	}
+	sealing = nil
+	if _, err := checkSqliteEncryption(conn); err == nil {
+		t.Fatalf("Expected a missing key file to stop the server")
+	}
+
+	// The new key first, the old one below it
+	setupEncryption(t, testKey(2), testKey(1))
+	if _, err := checkSqliteEncryption(conn); err != nil {
+		t.Fatalf("Expected the old key to still open the file: %v", err)
+	}
+	s = reloadSqlite(t, conn)
+	s.reencrypting.Wait()
+	s.Close()
+
+	setupEncryption(t, testKey(2))
+	if _, err := checkSqliteEncryption(conn); err != nil {
+		t.Fatalf("Expected every row to be re-sealed with the new key: %v", err)
+	}
+
+	// Hashing keys renames the rows, their tags go along
+	encryptKeys = true
+	s = reloadSqlite(t, conn)
+	s.reencrypting.Wait()
+	s.Close()
+	if hashed, _ := checkSqliteEncryption(conn); !hashed {
+		t.Errorf("Expected the rows to be renamed")
+	}
+	s = reloadSqlite(t, conn)
+	defer s.Close()
+	if s.Len() != 3 || len(s.TaggedKeys("group")) != 1 {
+		t.Errorf("Expected all 3 keys and the tags of b, got %d keys", s.Len())
+	}
+}
+
+func TestAofAndSnapshotsAreSealed(t *testing.T) {
+	setupEncryption(t, testKey(1))
+	encryptKeys = true
+	path := filepath.Join(t.TempDir(), "hypercacheio.aof")
+	s := openAof(t, path)
+	s.Set("session:1", []byte(`s:6:"secret";`), 0, 0)
+	s.SetTags("session:1", []string{"users"})
+	s.Set("gone", []byte("i:1;"), 0, 0)
+	s.Delete("gone")
+	s.Close()
+
+	data, _ := os.ReadFile(path)
+	if bytes.Contains(data, []byte("secret")) || bytes.Contains(data, []byte("session")) {
+		t.Errorf("Expected the log to hold neither keys nor values in the clear")
+	}
+	s = openAof(t, path)
+	if item, ok := s.Get("session:1"); !ok || string(item.Value) != `s:6:"secret";` || len(s.TaggedKeys("users")) != 1 {
+		t.Errorf("Expected session:1 and its tags to be replayed, got %+v", item)
+	}
+	if _, ok := s.Get("gone"); ok {
+		t.Errorf("Expected gone to stay deleted")
+	}
+	s.Close()
+
+	dir := setupSnapshots(t)
+	storage.Set("session:1", []byte(`s:6:"secret";`), 0, 0)
+	info, err := writeSnapshot(dir)
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if data, _ := os.ReadFile(info.Path); bytes.Contains(data, []byte("secret")) {
+		t.Errorf("Expected the snapshot to hold no values in the clear")
+	}
+	storage.Flush()
+	if _, err := restoreSnapshot(info.Path); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if item, ok := storage.Get("session:1"); !ok || string(item.Value) != `s:6:"secret";` {
+		t.Errorf("Expected session:1 to be restored, got %+v", item)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"container/heap"
+	"log"
+	"time"
+)
+
+// -------------------------------------------------------------
+// Expiration Index
+// -------------------------------------------------------------
+//
+// Every shard keeps its expiring keys in a min-heap ordered by expiration, so
+// a sweep only looks at keys that are actually due. Entries are never updated
+// in place: a new expiration pushes a new entry and outdated ones are skipped
+// when they surface. A heap is compacted once stale entries dominate it.
+
+var (
+	sweepInterval = 30 * time.Second
+	sweepBatch    = 1000 // Heap entries examined per shard lock acquisition
+)
+
+type expiryEntry struct {
+	key        string
+	expiration int64
+}
+
+type expiryHeap []expiryEntry
+
+func (h expiryHeap) Len() int            { return len(h) }
+func (h expiryHeap) Less(i, j int) bool  { return h[i].expiration < h[j].expiration }
+func (h expiryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h, x.(expiryEntry)) }
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// scheduleExpiryLocked records a new expiration of key. Callers must hold
+// the shard lock.
+func (sh *shard) scheduleExpiryLocked(key string, expiration int64) {
+	if expiration <= 0 {
+		return
+	}
+	heap.Push(&sh.expirations, expiryEntry{key: key, expiration: expiration})
+	if sh.expirations.Len() > 2*len(sh.items)+1024 {
+		sh.compactExpiriesLocked()
+	}
+}
+
+// compactExpiriesLocked drops entries that no longer match their key.
+func (sh *shard) compactExpiriesLocked() {
+	live := sh.expirations[:0]
+	for _, entry := range sh.expirations {
+		if sh.expiryCurrent(entry) {
+			live = append(live, entry)
+		}
+	}
+	sh.expirations = live
+	heap.Init(&sh.expirations)
+}
+
+// expiryCurrent reports whether entry still describes the expiration of its key.
+func (sh *shard) expiryCurrent(entry expiryEntry) bool {
+	item, ok := sh.items[entry.key]
+	return ok && item.Expiration == entry.expiration
+}
+
+// sweepLocked pops up to batch due entries and removes the keys they still
+// describe. It returns the number of removed keys and examined entries.
+// Callers must hold the shard lock.
+func (sh *shard) sweepLocked(now int64, batch int) (int, int) {
+	removed, examined := 0, 0
+	for examined < batch && sh.expirations.Len() > 0 {
+		next := sh.expirations[0]
+		if next.expiration >= now {
+			break
+		}
+		heap.Pop(&sh.expirations)
+		examined++
+		if sh.expiryCurrent(next) {
+			sh.removeLocked(next.key)
+			removed++
+		}
+	}
+	return removed, examined
+}
+
+func startCleanupTimer() {
+	ticker := time.NewTicker(sweepInterval)
+	go func() {
+		for range ticker.C {
+			cleanupExpired()
+		}
+	}()
+}
+
+// cleanupExpired removes due keys in batches of sweepBatch heap entries,
+// releasing the shard lock between batches so requests are never blocked for long.
+func cleanupExpired() {
+	start := time.Now()
+	now := start.Unix()
+	count := storage.Sweep(now, sweepBatch)
+
+	elapsed := time.Since(start)
+	statsMutex.Lock()
+	stats.Sweeps++
+	stats.SweptItems += uint64(count)
+	stats.LastSweepMicros = elapsed.Microseconds()
+	if stats.LastSweepMicros > stats.MaxSweepMicros {
+		stats.MaxSweepMicros = stats.LastSweepMicros
+	}
+	statsMutex.Unlock()
+
+	if count > 0 {
+		log.Printf("Background cleanup: removed %d expired items in %s", count, elapsed)
+	}
+}
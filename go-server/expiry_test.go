@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCleanupExpiredInBatches(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	sweepBatch = 2
+	defer func() { sweepBatch = 1000 }()
+
+	now := time.Now().Unix()
+	for i := 0; i < 5; i++ {
+		setLocal(fmt.Sprintf("due:%d", i), []byte("i:1;"), now-10, false)
+	}
+	setLocal("later", []byte("i:1;"), now+60, false)
+	// Rewriting a key as permanent leaves a stale heap entry behind
+	setLocal("rewritten", []byte("i:1;"), now-10, false)
+	setLocal("rewritten", []byte("i:2;"), 0, false)
+
+	cleanupExpired()
+
+	remaining := storage.Len()
+	if remaining != 2 {
+		t.Errorf("Expected later and rewritten to remain, got %d items", remaining)
+	}
+	if _, ok := getLocal("rewritten"); !ok {
+		t.Errorf("Expected a stale expiration entry to be ignored")
+	}
+	if stats.Sweeps == 0 || stats.SweptItems < 5 {
+		t.Errorf("Expected sweep metrics to be recorded, got %+v", stats)
+	}
+}
+
+func TestExpiryFollowsTouchAndCompacts(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	now := time.Now().Unix()
+	setLocal("session", []byte("i:1;"), 0, false)
+	touchLocal("session", now-1, false)
+	cleanupExpired()
+	if _, ok := storage.Get("session"); ok {
+		t.Errorf("Expected a touched expiration to be swept")
+	}
+
+	for i := 0; i < 5000; i++ {
+		setLocal("hot", []byte("i:1;"), now+int64(i)+1, false)
+	}
+	sh := testKeyspace().shardFor("hot")
+	sh.mu.RLock()
+	size, items := sh.expirations.Len(), len(sh.items)
+	sh.mu.RUnlock()
+	if size > 2*items+1025 {
+		t.Errorf("Expected stale expiration entries to be compacted, heap holds %d", size)
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yvasiyarov/php_session_decoder/php_serialize"
+)
+
+// -------------------------------------------------------------
+// Export / Import
+// -------------------------------------------------------------
+//
+// The keyspace is exported and imported as JSON Lines, one key per line:
+//
+//	{"key":"users:1","value":"czo1OiJoZWxsbyI7","expiration":1767225600,"lock":false,"version":3,"tags":["users"]}
+//	{"key":"users:2","php":{"name":"Ada"},"expiration":0,"lock":false,"version":1}
+//
+// key is the key as stored, namespace included, and is what the prefix
+// filters match. value is the stored bytes in base64: the PHP-serialized
+// value for items, the owner for locks ("lock:<name>" keys). With decode the
+// PHP value of items is exported as php instead, where it can be represented
+// as JSON; import serializes php back. expiration is a Unix timestamp, 0 for
+// none. Counters are exported with their current value. version and tags are
+// optional on import.
+
+const (
+	importOverwrite    = "overwrite"
+	importSkipExisting = "skip-existing"
+
+	importReplicate = "replicate"
+	importLocalOnly = "local-only"
+
+	// importErrorLimit caps the line errors reported by an import
+	importErrorLimit = 100
+)
+
+type exportLine struct {
+	Key        string          `json:"key"`
+	Value      *string         `json:"value,omitempty"`
+	PHP        json.RawMessage `json:"php,omitempty"`
+	Expiration int64           `json:"expiration"`
+	Lock       bool            `json:"lock"`
+	Version    uint64          `json:"version,omitempty"`
+	Tags       []string        `json:"tags,omitempty"`
+}
+
+type ImportResult struct {
+	Imported int           `json:"imported"`
+	Skipped  int           `json:"skipped"`
+	Rejected int           `json:"rejected"`
+	Errors   []ImportError `json:"errors"`
+}
+
+type ImportError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// keyFilter selects keys by prefix and optionally drops expired items.
+type keyFilter struct {
+	prefixes    []string
+	skipExpired bool
+	now         int64
+}
+
+func newKeyFilter(r *http.Request) keyFilter {
+	query := r.URL.Query()
+	skipExpired, _ := strconv.ParseBool(query.Get("skip_expired"))
+	return keyFilter{prefixes: query["prefix"], skipExpired: skipExpired, now: time.Now().Unix()}
+}
+
+func (f keyFilter) matchKey(key string) bool {
+	if len(f.prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range f.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f keyFilter) expired(expiration int64) bool {
+	return f.skipExpired && expiration > 0 && expiration < f.now
+}
+
+// requireAdmin answers 403 to tenants, admin endpoints see every namespace.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if requestTenant(r) != nil {
+		writeJSONStatus(w, http.StatusForbidden, map[string]string{"error": "Admin endpoints need the main API token"})
+		return false
+	}
+	return true
+}
+
+// handleExport streams the keyspace as JSON Lines in key order.
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	filter := newKeyFilter(r)
+	decode, _ := strconv.ParseBool(r.URL.Query().Get("decode"))
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+	flusher, _ := w.(http.Flusher)
+
+	written := 0
+	export := func(st keyState) bool {
+		if filter.expired(st.item.Expiration) {
+			return true
+		}
+		line := exportLine{Key: st.key, Expiration: st.item.Expiration, Version: st.item.Version, Tags: st.tags}
+		_, line.Lock = lockName(st.key)
+		value := decodeValue(st.item.Value)
+		if decode && !line.Lock {
+			line.PHP = decodedJSON(value)
+		}
+		if line.PHP == nil {
+			encoded := base64.StdEncoding.EncodeToString(value)
+			line.Value = &encoded
+		}
+
+		encoded, err := json.Marshal(line)
+		if err != nil {
+			return true
+		}
+		out.Write(encoded)
+		if err := out.WriteByte('\n'); err != nil {
+			return false // The client went away
+		}
+		if written++; written%1000 == 0 && flusher != nil {
+			out.Flush()
+			flusher.Flush()
+		}
+		return true
+	}
+
+	if len(filter.prefixes) == 0 {
+		storage.Scan("", "", export)
+		return
+	}
+	for _, prefix := range dedupePrefixes(filter.prefixes) {
+		storage.Scan("", prefix, export)
+	}
+}
+
+// dedupePrefixes drops prefixes covered by another one, so no key is
+// exported twice.
+func dedupePrefixes(prefixes []string) []string {
+	sorted := append([]string(nil), prefixes...)
+	sort.Strings(sorted)
+	kept := make([]string, 0, len(sorted))
+	for _, p := range sorted {
+		if len(kept) > 0 && strings.HasPrefix(p, kept[len(kept)-1]) {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return kept
+}
+
+// decodedJSON returns the PHP value of raw as JSON, or nil when it cannot be
+// imported back unchanged, so the line falls back to value.
+func decodedJSON(raw []byte) json.RawMessage {
+	decoder := php_serialize.NewUnSerializer(string(raw))
+	parsed, err := decoder.Decode()
+	if err != nil {
+		return nil
+	}
+	value, ok := jsonValue(parsed)
+	if !ok {
+		return nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	return encoded
+}
+
+// jsonValue turns PHP arrays, whose keys may be integers, into JSON objects.
+// It reports false for objects, which JSON cannot name the class of, and for
+// floats, which come back as integers when they have no fraction.
+func jsonValue(value php_serialize.PhpValue) (interface{}, bool) {
+	switch v := value.(type) {
+	case nil, bool, int, string:
+		return v, true
+	case php_serialize.PhpArray:
+		object := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			converted, ok := jsonValue(item)
+			if !ok {
+				return nil, false
+			}
+			object[fmt.Sprint(key)] = converted
+		}
+		return object, true
+	}
+	return nil, false
+}
+
+// handleImport reads JSON Lines written by handleExport. mode decides what
+// happens to keys that already hold a live item, replication whether the
+// imported keys are sent to peers. Lines that cannot be imported are
+// reported without stopping the import.
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	mode := query.Get("mode")
+	if mode == "" {
+		mode = importOverwrite
+	}
+	replication := query.Get("replication")
+	if replication == "" {
+		replication = importReplicate
+	}
+	if mode != importOverwrite && mode != importSkipExisting {
+		http.Error(w, "Invalid mode (expected overwrite or skip-existing)", http.StatusBadRequest)
+		return
+	}
+	if replication != importReplicate && replication != importLocalOnly {
+		http.Error(w, "Invalid replication (expected replicate or local-only)", http.StatusBadRequest)
+		return
+	}
+
+	result := importLines(r.Body, newKeyFilter(r), mode == importSkipExisting, replication == importReplicate)
+	writeJSON(w, result)
+}
+
+func importLines(body io.Reader, filter keyFilter, skipExisting, broadcast bool) ImportResult {
+	result := ImportResult{Errors: make([]ImportError, 0)}
+	fail := func(line int, err error) {
+		result.Rejected++
+		if len(result.Errors) < importErrorLimit {
+			result.Errors = append(result.Errors, ImportError{Line: line, Error: err.Error()})
+		}
+	}
+
+	reader := bufio.NewReader(body)
+	for number := 1; ; number++ {
+		raw, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(raw)) > 0 {
+			switch imported, lineErr := importLine(raw, filter, skipExisting, broadcast); {
+			case lineErr != nil:
+				fail(number, lineErr)
+			case imported:
+				result.Imported++
+			default:
+				result.Skipped++
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				fail(number, err)
+			}
+			break
+		}
+	}
+	return result
+}
+
+// importLine stores one line and reports whether it was imported.
+func importLine(raw []byte, filter keyFilter, skipExisting, broadcast bool) (bool, error) {
+	var line exportLine
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&line); err != nil {
+		return false, err
+	}
+	if line.Key == "" {
+		return false, fmt.Errorf("key required")
+	}
+	if _, isLock := lockName(line.Key); isLock != line.Lock {
+		return false, fmt.Errorf("lock flag does not match key %q", line.Key)
+	}
+	if !filter.matchKey(line.Key) || filter.expired(line.Expiration) {
+		return false, nil
+	}
+
+	var val []byte
+	switch {
+	case line.Value != nil:
+		decoded, err := base64.StdEncoding.DecodeString(*line.Value)
+		if err != nil {
+			return false, fmt.Errorf("value: %w", err)
+		}
+		val = decoded
+	case line.PHP != nil && !line.Lock:
+		var value interface{}
+		phpDecoder := json.NewDecoder(bytes.NewReader(line.PHP))
+		phpDecoder.UseNumber()
+		if err := phpDecoder.Decode(&value); err != nil {
+			return false, fmt.Errorf("php: %w", err)
+		}
+		encoded, err := php_serialize.Serialize(phpValue(value))
+		if err != nil {
+			return false, fmt.Errorf("php: %w", err)
+		}
+		val = []byte(encoded)
+	default:
+		return false, fmt.Errorf("value or php required")
+	}
+	if memoryFull(int64(len(line.Key) + len(val))) {
+		return false, fmt.Errorf("memory limit reached")
+	}
+
+	if skipExisting {
+		item, added := storage.Add(line.Key, val, line.Expiration)
+		if !added {
+			return false, nil
+		}
+		if broadcast {
+			broadcastSet(line.Key, item.Value, line.Expiration, item.Version)
+		}
+	} else {
+		setLocalVersion(line.Key, val, line.Expiration, line.Version, broadcast)
+	}
+	if len(line.Tags) > 0 {
+		tagLocal(line.Key, line.Tags, broadcast)
+	}
+	return true, nil
+}
+
+// phpValue turns decoded JSON into values php_serialize encodes like PHP
+// would: integers stay integers and objects become arrays.
+func phpValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return int(i)
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		array := make(php_serialize.PhpArray, len(v))
+		for key, item := range v {
+			if i, err := strconv.Atoi(key); err == nil && strconv.Itoa(i) == key {
+				array[i] = phpValue(item) // PHP turns numeric string keys into integers
+			} else {
+				array[key] = phpValue(item)
+			}
+		}
+		return array
+	case []interface{}:
+		array := make(php_serialize.PhpArray, len(v))
+		for i, item := range v {
+			array[i] = phpValue(item)
+		}
+		return array
+	}
+	return value
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func exportBody(t *testing.T, query string) string {
+	rr := httptest.NewRecorder()
+	handleExport(rr, httptest.NewRequest("GET", "/api/hypercacheio/admin/export"+query, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Export failed with %d: %s", rr.Code, rr.Body.String())
+	}
+	return rr.Body.String()
+}
+
+func importBody(t *testing.T, query, body string) ImportResult {
+	rr := httptest.NewRecorder()
+	handleImport(rr, httptest.NewRequest("POST", "/api/hypercacheio/admin/import"+query, strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Import failed with %d: %s", rr.Code, rr.Body.String())
+	}
+	var result ImportResult
+	json.Unmarshal(rr.Body.Bytes(), &result)
+	return result
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	storage = newMemoryStore(4)
+	defer func() { storage = newMemoryStore(defaultShards) }()
+
+	storage.Set("users:1", []byte(`s:3:"Ada";`), time.Now().Unix()+60, 4)
+	storage.SetTags("users:1", []string{"users"})
+	storage.Set(lockKey("job"), []byte("owner"), 0, 0)
+	storage.Set("stale", []byte("i:1;"), time.Now().Unix()-1, 0)
+
+	all := exportBody(t, "")
+	if lines := strings.Count(all, "\n"); lines != 3 {
+		t.Errorf("Expected 3 lines, got %d:\n%s", lines, all)
+	}
+	if live := exportBody(t, "?skip_expired=1"); strings.Contains(live, "stale") {
+		t.Errorf("Expected expired items to be skipped, got:\n%s", live)
+	}
+
+	storage.Flush()
+	result := importBody(t, "?replication=local-only", all)
+	if result.Imported != 3 || result.Rejected != 0 {
+		t.Errorf("Expected 3 imported keys, got %+v", result)
+	}
+	if item, ok := storage.Get("users:1"); !ok || string(item.Value) != `s:3:"Ada";` || item.Version != 4 {
+		t.Errorf("Expected users:1 with its value and version, got %+v", item)
+	}
+	if keys := storage.TaggedKeys(indexedTag("users:1", "users")); len(keys) != 1 {
+		t.Errorf("Expected the tags to be imported, got %v", keys)
+	}
+	if item, ok := storage.Get(lockKey("job")); !ok || string(item.Value) != "owner" {
+		t.Errorf("Expected the lock owner to be imported as is, got %q", item.Value)
+	}
+}
+
+func TestExportDecodesPhpValues(t *testing.T) {
+	storage = newMemoryStore(4)
+	defer func() { storage = newMemoryStore(defaultShards) }()
+	storage.Set("user", []byte(`a:2:{s:4:"name";s:3:"Ada";i:0;i:7;}`), 0, 0)
+
+	var line map[string]interface{}
+	json.Unmarshal([]byte(exportBody(t, "?decode=1")), &line)
+	php, _ := line["php"].(map[string]interface{})
+	if php["name"] != "Ada" || php["0"] != float64(7) || line["value"] != nil {
+		t.Errorf("Expected the decoded array, got %v", line)
+	}
+
+	result := importBody(t, "", `{"key":"count","php":5,"expiration":0,"lock":false}`+"\n"+`{"key":"list","php":[1,"a"],"expiration":0,"lock":false}`)
+	if result.Imported != 2 {
+		t.Fatalf("Expected both lines to be imported, got %+v", result)
+	}
+	if item, _ := storage.Get("count"); string(item.Value) != "i:5;" {
+		t.Errorf("Expected an integer to stay an integer, got %s", item.Value)
+	}
+	if item, _ := storage.Get("list"); !bytes.Contains(item.Value, []byte(`i:0;i:1;`)) {
+		t.Errorf("Expected a list to become an array with integer keys, got %s", item.Value)
+	}
+}
+
+func TestExportKeepsObjectsAndFloatsEncoded(t *testing.T) {
+	storage = newMemoryStore(4)
+	defer func() { storage = newMemoryStore(defaultShards) }()
+	values := map[string]string{
+		"object": `a:1:{s:4:"user";O:4:"User":1:{s:4:"name";s:3:"Ada";}}`,
+		"float":  `a:1:{s:5:"price";d:2;}`,
+	}
+	for key, value := range values {
+		storage.Set(key, []byte(value), 0, 0)
+	}
+
+	all := exportBody(t, "?decode=1")
+	for _, raw := range strings.Split(strings.TrimSpace(all), "\n") {
+		var line exportLine
+		json.Unmarshal([]byte(raw), &line)
+		if line.PHP != nil || line.Value == nil {
+			t.Errorf("Expected %s to be exported as value, got %s", line.Key, raw)
+		}
+	}
+
+	storage.Flush()
+	importBody(t, "", all)
+	for key, value := range values {
+		if item, _ := storage.Get(key); string(item.Value) != value {
+			t.Errorf("Expected %s to round-trip unchanged, got %s", key, item.Value)
+		}
+	}
+}
+
+func TestImportModesAndFilters(t *testing.T) {
+	storage = newMemoryStore(4)
+	defer func() { storage = newMemoryStore(defaultShards) }()
+	storage.Set("a:1", []byte("i:1;"), 0, 0)
+
+	body := strings.Join([]string{
+		`{"key":"a:1","value":"aToyOw==","expiration":0,"lock":false}`,
+		`{"key":"a:2","value":"aToyOw==","expiration":0,"lock":false}`,
+		`{"key":"b:1","value":"aToyOw==","expiration":0,"lock":false}`,
+		`not json`,
+		`{"key":"lock:x","value":"aToyOw==","expiration":0,"lock":false}`,
+	}, "\n")
+	result := importBody(t, "?mode=skip-existing&prefix=a:&prefix=lock:", body)
+	if result.Imported != 1 || result.Skipped != 2 || result.Rejected != 2 {
+		t.Errorf("Expected 1 imported, 2 skipped and 2 rejected lines, got %+v", result)
+	}
+	if len(result.Errors) != 2 || result.Errors[0].Line != 4 {
+		t.Errorf("Expected errors for lines 4 and 5, got %+v", result.Errors)
+	}
+	if item, _ := storage.Get("a:1"); string(item.Value) != "i:1;" {
+		t.Errorf("Expected skip-existing to keep a:1, got %s", item.Value)
+	}
+	if _, ok := storage.Get("b:1"); ok {
+		t.Errorf("Expected b:1 to be filtered out")
+	}
+
+	rr := httptest.NewRecorder()
+	handleImport(rr, httptest.NewRequest("POST", "/api/hypercacheio/admin/import?mode=merge", strings.NewReader("")))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown mode to be rejected, got %d", rr.Code)
+	}
+}
+
+func TestExportNeedsMainToken(t *testing.T) {
+	rr := httptest.NewRecorder()
+	req := withTenant(httptest.NewRequest("GET", "/api/hypercacheio/admin/export", nil), &Tenant{Name: "shop"})
+	handleExport(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected tenants to be refused, got %d", rr.Code)
+	}
+}
@@ -3,6 +3,7 @@ module github.com/iperamuna/hypercacheio-server
 go 1.24.0
 
 require (
+	github.com/klauspost/compress v1.18.0
 	github.com/yvasiyarov/php_session_decoder v0.0.0-20180803065642-a065a3b0b7d1
 	modernc.org/sqlite v1.46.1
 )
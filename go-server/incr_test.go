@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func doIncr(t *testing.T, path string, body string) map[string]interface{} {
+	req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+	rr := httptest.NewRecorder()
+	handleIncr(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handleIncr returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var resp map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	return resp
+}
+
+func TestHandleIncrDecr(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	resp := doIncr(t, "/api/hypercacheio/incr/hits", `{"initial": 10, "ttl": 60}`)
+	if resp["value"] != float64(11) {
+		t.Errorf("Expected 11 after first increment, got %v", resp["value"])
+	}
+
+	resp = doIncr(t, "/api/hypercacheio/decr/hits", `{"value": 5}`)
+	if resp["value"] != float64(6) {
+		t.Errorf("Expected 6 after decrement, got %v", resp["value"])
+	}
+
+	item, _ := storage.Get("hits")
+	stored := string(item.Value)
+	if stored != "i:6;" {
+		t.Errorf("Expected PHP-serialized int 'i:6;', got %v", stored)
+	}
+
+	resp = doIncr(t, "/api/hypercacheio/incr/hits", `{"value": 0.5}`)
+	if resp["value"] != 6.5 {
+		t.Errorf("Expected float 6.5, got %v", resp["value"])
+	}
+}
+
+func TestHandleIncrRejectsNonNumeric(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	setLocal("name", []byte(`s:5:"hello";`), 0, false)
+
+	req, _ := http.NewRequest("POST", "/api/hypercacheio/incr/name", bytes.NewBufferString(""))
+	rr := httptest.NewRecorder()
+	handleIncr(rr, req)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected %v for non-numeric value, got %v", http.StatusUnprocessableEntity, rr.Code)
+	}
+}
+
+func TestHandleIncrIsAtomic(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("POST", "/api/hypercacheio/incr/counter", bytes.NewBufferString(""))
+			handleIncr(httptest.NewRecorder(), req)
+		}()
+	}
+	wg.Wait()
+
+	resp := doIncr(t, "/api/hypercacheio/incr/counter", `{"value": 0}`)
+	if resp["value"] != float64(50) {
+		t.Errorf("Expected 50 after concurrent increments, got %v", resp["value"])
+	}
+}
+
+func TestHandleIncrOverflowsToFloat(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	nodeID = "node-a"
+
+	// A plain integer and a counter both turn into a float, as in PHP
+	setLocal("plain", []byte("i:9223372036854775807;"), 0, false)
+	doIncr(t, "/api/hypercacheio/incr/counted", `{"value": 9223372036854775807}`)
+	for _, key := range []string{"plain", "counted"} {
+		resp := doIncr(t, "/api/hypercacheio/incr/"+key, `{"value": 1}`)
+		if resp["value"] != 9223372036854775808.0 {
+			t.Errorf("%s: Expected the sum as a float, got %v", key, resp["value"])
+		}
+		if isCounter(key) {
+			t.Errorf("%s: Expected no counter state under a float", key)
+		}
+	}
+
+	resp := doIncr(t, "/api/hypercacheio/decr/fresh", `{"value": -9223372036854775808}`)
+	if resp["value"] != 9223372036854775808.0 {
+		t.Errorf("Expected decrementing by the smallest int64 to give a float, got %v", resp["value"])
+	}
+
+	handleCounter(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/hypercacheio/counter/likes", bytes.NewBufferString(`{"value": 9223372036854775807}`)))
+	rr := httptest.NewRecorder()
+	handleCounter(rr, httptest.NewRequest("POST", "/api/hypercacheio/counter/likes", bytes.NewBufferString(`{"value": 1}`)))
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected %v for a counter that would overflow, got %v", http.StatusUnprocessableEntity, rr.Code)
+	}
+}
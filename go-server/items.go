@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yvasiyarov/php_session_decoder/php_serialize"
+)
+
+// -------------------------------------------------------------
+// Paginated Key Listing (/items)
+// -------------------------------------------------------------
+//
+// The listing walks the ordered key indexes of the shards in bounded chunks
+// and releases their locks between chunks, so large keyspaces never block
+// writers for the duration of a response. Values are only decoded for the
+// items of the page, and only when they are listed.
+
+const (
+	itemsDefaultLimit = 100
+	itemsMaxLimit     = 1000
+)
+
+type itemsQuery struct {
+	matcher   *keyMatcher
+	locksOnly bool
+	values    bool
+	byExpiry  bool
+	limit     int
+	cursor    string
+}
+
+type listedItem struct {
+	key  string
+	item CacheItem // Its value as stored
+}
+
+func parseItemsQuery(r *http.Request) (*itemsQuery, error) {
+	q := r.URL.Query()
+	query := &itemsQuery{limit: itemsDefaultLimit, values: true}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid limit")
+		}
+		if limit > itemsMaxLimit {
+			limit = itemsMaxLimit
+		}
+		query.limit = limit
+	}
+	if v := q.Get("values"); v != "" {
+		query.values, _ = strconv.ParseBool(v)
+	}
+	query.locksOnly, _ = strconv.ParseBool(q.Get("locks"))
+
+	switch q.Get("sort") {
+	case "", "key":
+	case "expiration":
+		query.byExpiry = true
+	default:
+		return nil, fmt.Errorf("invalid sort")
+	}
+
+	ns := requestNamespace(r)
+	var err error
+	if pattern := q.Get("pattern"); pattern != "" {
+		query.matcher, err = newKeyMatcher(matchPattern, ns, pattern)
+	} else {
+		query.matcher, err = newKeyMatcher(matchPrefix, ns, q.Get("prefix"))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern")
+	}
+	if query.locksOnly && query.matcher.prefix == "" {
+		query.matcher.prefix = "lock:" // Only scan the lock range of the index
+	}
+
+	if v := q.Get("cursor"); v != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+		query.cursor = string(decoded)
+	}
+	return query, nil
+}
+
+func (q *itemsQuery) accepts(key string) bool {
+	if _, isLock := lockName(key); q.locksOnly && !isLock {
+		return false
+	}
+	return q.matcher.Match(key)
+}
+
+// scanMatching calls fn in key order for every live matching key at or after
+// from. fn returning false stops the scan.
+func (q *itemsQuery) scanMatching(from string, fn func(listedItem) bool) {
+	now := time.Now().Unix()
+	storage.Scan(from, q.matcher.ScanPrefix(), func(st keyState) bool {
+		if (st.item.Expiration > 0 && st.item.Expiration < now) || !q.accepts(st.key) {
+			return true
+		}
+		return fn(listedItem{key: st.key, item: st.item})
+	})
+}
+
+// pageByKey returns up to limit items in key order after the cursor.
+func (q *itemsQuery) pageByKey() ([]listedItem, string) {
+	from := ""
+	if strings.HasPrefix(q.cursor, "k:") {
+		from = q.cursor[2:] + "\x00"
+	}
+
+	page := make([]listedItem, 0, q.limit)
+	more := false
+	q.scanMatching(from, func(entry listedItem) bool {
+		if len(page) == q.limit {
+			more = true
+			return false
+		}
+		page = append(page, entry)
+		return true
+	})
+
+	next := ""
+	if more {
+		next = "k:" + page[len(page)-1].key
+	}
+	return page, next
+}
+
+// pageByExpiry returns up to limit items ordered by expiration (permanent
+// keys last). Ordering needs every matching key, so only keys and
+// expirations are gathered, and the items of the page are read afterwards.
+func (q *itemsQuery) pageByExpiry() ([]listedItem, string) {
+	all := make([]listedItem, 0)
+	q.scanMatching("", func(entry listedItem) bool {
+		all = append(all, listedItem{key: entry.key, item: CacheItem{Expiration: entry.item.Expiration}})
+		return true
+	})
+	sort.Slice(all, func(i, j int) bool {
+		return expiryLess(all[i], all[j])
+	})
+
+	start := 0
+	if strings.HasPrefix(q.cursor, "e:") {
+		parts := strings.SplitN(q.cursor[2:], ":", 2)
+		if len(parts) == 2 {
+			exp, _ := strconv.ParseInt(parts[0], 10, 64)
+			after := listedItem{key: parts[1], item: CacheItem{Expiration: exp}}
+			start = sort.Search(len(all), func(i int) bool {
+				return expiryLess(after, all[i])
+			})
+		}
+	}
+
+	end := min(start+q.limit, len(all))
+	next := ""
+	if end < len(all) {
+		last := all[end-1]
+		next = fmt.Sprintf("e:%d:%s", last.item.Expiration, last.key)
+	}
+	return q.readPage(all[start:end]), next
+}
+
+// readPage reads the items of page in one scan over the key range they span
+// and drops the keys that went away since they were gathered.
+func (q *itemsQuery) readPage(page []listedItem) []listedItem {
+	if len(page) == 0 {
+		return page
+	}
+	positions := make(map[string]int, len(page))
+	first, last := page[0].key, page[0].key
+	for i, entry := range page {
+		positions[entry.key] = i
+		first, last = min(first, entry.key), max(last, entry.key)
+	}
+
+	found := make([]bool, len(page))
+	q.scanMatching(first, func(entry listedItem) bool {
+		if entry.key > last {
+			return false
+		}
+		if i, ok := positions[entry.key]; ok {
+			page[i], found[i] = entry, true
+		}
+		return true
+	})
+
+	read := page[:0]
+	for i, entry := range page {
+		if found[i] {
+			read = append(read, entry)
+		}
+	}
+	return read
+}
+
+func expiryLess(a, b listedItem) bool {
+	ea, eb := a.item.Expiration, b.item.Expiration
+	if ea != eb {
+		if ea == 0 {
+			return false
+		}
+		if eb == 0 {
+			return true
+		}
+		return ea < eb
+	}
+	return a.key < b.key
+}
+
+func handleItems(w http.ResponseWriter, r *http.Request) {
+	query, err := parseItemsQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var page []listedItem
+	var next string
+	if query.byExpiry {
+		page, next = query.pageByExpiry()
+	} else {
+		page, next = query.pageByKey()
+	}
+
+	items := make([]map[string]interface{}, 0, len(page))
+	for _, entry := range page {
+		_, isLock := lockName(entry.key)
+		_, key := splitKey(entry.key)
+		listed := map[string]interface{}{
+			"key":        key,
+			"expiration": entry.item.Expiration,
+			"is_lock":    isLock,
+			"version":    entry.item.Version,
+			"size":       decodedLen(entry.item.Value),
+		}
+
+		if query.values {
+			value := decodeValue(entry.item.Value)
+			if isLock {
+				listed["value"] = string(value)
+			} else {
+				decoder := php_serialize.NewUnSerializer(string(value))
+				parsed, err := decoder.Decode()
+				if err == nil {
+					listed["value"] = parsed
+				} else {
+					listed["value"] = "[Binary Data]"
+				}
+			}
+		}
+		items = append(items, listed)
+	}
+
+	if next != "" {
+		w.Header().Set("X-Hypercacheio-Next-Cursor", base64.RawURLEncoding.EncodeToString([]byte(next)))
+	}
+	writeJSON(w, items)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func listItems(t *testing.T, query string) ([]map[string]interface{}, string) {
+	req, _ := http.NewRequest("GET", "/api/hypercacheio/items?"+query, nil)
+	rr := httptest.NewRecorder()
+	handleItems(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handleItems returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var items []map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &items)
+	return items, rr.Header().Get("X-Hypercacheio-Next-Cursor")
+}
+
+func TestHandleItemsPagination(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	for i := 0; i < 25; i++ {
+		setLocal(fmt.Sprintf("page:%02d", i), []byte("i:1;"), 0, false)
+	}
+	setLocal("other", []byte("i:1;"), 0, false)
+
+	seen := make(map[string]bool)
+	cursor, pages := "", 0
+	for {
+		items, next := listItems(t, "prefix=page:&limit=10&values=0&cursor="+cursor)
+		pages++
+		for _, item := range items {
+			key := item["key"].(string)
+			if seen[key] {
+				t.Errorf("Key %s returned twice", key)
+			}
+			seen[key] = true
+			if _, ok := item["value"]; ok {
+				t.Errorf("Expected values to be omitted")
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	if pages != 3 || len(seen) != 25 {
+		t.Errorf("Expected 25 keys over 3 pages, got %d keys over %d pages", len(seen), pages)
+	}
+}
+
+func TestHandleItemsLocksAndExpirySort(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	now := time.Now().Unix()
+	setLocal("late", []byte("i:1;"), now+300, false)
+	setLocal("early", []byte("i:1;"), now+60, false)
+	setLocal("forever", []byte("i:1;"), 0, false)
+	setLocal("lock:job", []byte("owner"), now+30, false)
+
+	locks, _ := listItems(t, "locks=1")
+	if len(locks) != 1 || locks[0]["key"] != "lock:job" || locks[0]["value"] != "owner" {
+		t.Errorf("Expected only the lock, got %v", locks)
+	}
+
+	first, next := listItems(t, "sort=expiration&limit=2")
+	rest, _ := listItems(t, "sort=expiration&limit=2&cursor="+next)
+	order := []interface{}{first[0]["key"], first[1]["key"], rest[0]["key"], rest[1]["key"]}
+	if fmt.Sprint(order) != "[lock:job early late forever]" {
+		t.Errorf("Unexpected expiration order: %v", order)
+	}
+}
+
+func TestHandleItemsDecodesOnlyListedValues(t *testing.T) {
+	val := setupCompression(t, compressionZstd)
+	storage = newMemoryStore(4)
+	for i := 0; i < 5; i++ {
+		setLocal(fmt.Sprintf("page:%d", i), val, time.Now().Unix()+int64(60*(i+1)), false)
+	}
+
+	before := compressionStats().Decompressed
+	items, _ := listItems(t, "values=0")
+	if len(items) != 5 || items[0]["size"] != float64(len(val)) {
+		t.Fatalf("Expected 5 items with their plain size, got %v", items)
+	}
+	if after := compressionStats().Decompressed; after != before {
+		t.Errorf("Expected no value to be decompressed without values, got %d", after-before)
+	}
+
+	items, _ = listItems(t, "sort=expiration&limit=2")
+	if len(items) != 2 || items[0]["key"] != "page:0" || items[1]["value"] == nil {
+		t.Fatalf("Expected the 2 earliest items with their values, got %v", items)
+	}
+	if after := compressionStats().Decompressed; after != before+2 {
+		t.Errorf("Expected only the 2 listed values to be decompressed, got %d", after-before)
+	}
+}
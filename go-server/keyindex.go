@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+)
+
+// -------------------------------------------------------------
+// Ordered Key Index (skip list)
+// -------------------------------------------------------------
+//
+// keyIndex keeps every cache key in lexical order so prefix scans and
+// cursor-based listings only touch the matching range instead of walking
+// the whole map. Every shard keeps one, guarded by the shard lock.
+
+const indexMaxLevel = 24
+
+type keyIndex struct {
+	head   *indexNode
+	level  int
+	length int
+	rnd    *rand.Rand
+}
+
+type indexNode struct {
+	key  string
+	next []*indexNode
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{
+		head:  &indexNode{next: make([]*indexNode, indexMaxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+func (ix *keyIndex) Len() int {
+	return ix.length
+}
+
+func (ix *keyIndex) randomLevel() int {
+	level := 1
+	for level < indexMaxLevel && ix.rnd.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
+
+// Insert adds key and reports whether it was not already present.
+func (ix *keyIndex) Insert(key string) bool {
+	update := make([]*indexNode, indexMaxLevel)
+	node := ix.head
+	for i := ix.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+	if next := node.next[0]; next != nil && next.key == key {
+		return false
+	}
+
+	level := ix.randomLevel()
+	if level > ix.level {
+		for i := ix.level; i < level; i++ {
+			update[i] = ix.head
+		}
+		ix.level = level
+	}
+	created := &indexNode{key: key, next: make([]*indexNode, level)}
+	for i := 0; i < level; i++ {
+		created.next[i] = update[i].next[i]
+		update[i].next[i] = created
+	}
+	ix.length++
+	return true
+}
+
+// Delete removes key and reports whether it was present.
+func (ix *keyIndex) Delete(key string) bool {
+	update := make([]*indexNode, indexMaxLevel)
+	node := ix.head
+	for i := ix.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+	target := node.next[0]
+	if target == nil || target.key != key {
+		return false
+	}
+	for i := 0; i < ix.level; i++ {
+		if update[i].next[i] != target {
+			break
+		}
+		update[i].next[i] = target.next[i]
+	}
+	for ix.level > 1 && ix.head.next[ix.level-1] == nil {
+		ix.level--
+	}
+	ix.length--
+	return true
+}
+
+// Ascend calls fn for every key >= from in order until fn returns false.
+func (ix *keyIndex) Ascend(from string, fn func(key string) bool) {
+	node := ix.head
+	for i := ix.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < from {
+			node = node.next[i]
+		}
+	}
+	for node = node.next[0]; node != nil; node = node.next[0] {
+		if !fn(node.key) {
+			return
+		}
+	}
+}
+
+// AscendPrefix calls fn for every key starting with prefix until fn returns false.
+func (ix *keyIndex) AscendPrefix(prefix string, fn func(key string) bool) {
+	ix.Ascend(prefix, func(key string) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		return fn(key)
+	})
+}
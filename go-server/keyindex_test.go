@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestKeyIndexOrderAndPrefix(t *testing.T) {
+	ix := newKeyIndex()
+	for _, k := range []string{"user:3", "post:1", "user:1", "user:2", "usr", "post:2"} {
+		ix.Insert(k)
+	}
+	if ix.Insert("user:1") {
+		t.Errorf("Insert reported a duplicate key as new")
+	}
+	ix.Delete("user:2")
+
+	var got []string
+	ix.AscendPrefix("user:", func(key string) bool {
+		got = append(got, key)
+		return true
+	})
+	if fmt.Sprint(got) != "[user:1 user:3]" {
+		t.Errorf("Unexpected prefix scan: %v", got)
+	}
+	if ix.Len() != 5 {
+		t.Errorf("Expected 5 keys, got %d", ix.Len())
+	}
+}
+
+func TestKeyIndexLargeInsertDelete(t *testing.T) {
+	ix := newKeyIndex()
+	for i := 0; i < 5000; i++ {
+		ix.Insert(fmt.Sprintf("k%05d", (i*7919)%5000))
+	}
+	for i := 0; i < 5000; i += 2 {
+		ix.Delete(fmt.Sprintf("k%05d", i))
+	}
+
+	prev, count := "", 0
+	ix.Ascend("", func(key string) bool {
+		if key <= prev {
+			t.Fatalf("Keys out of order: %s after %s", key, prev)
+		}
+		prev = key
+		count++
+		return true
+	})
+	if count != 2500 || ix.Len() != 2500 {
+		t.Errorf("Expected 2500 keys, iterated %d (Len %d)", count, ix.Len())
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// -------------------------------------------------------------
+// Prefix & Pattern Deletion
+// -------------------------------------------------------------
+
+const (
+	matchPrefix  byte = 0
+	matchPattern byte = 1
+)
+
+// keyMatcher selects the keys of one namespace by prefix or glob pattern.
+// Prefixes and patterns apply to client-facing keys; the literal prefix of a
+// pattern bounds the scan of the ordered key index.
+type keyMatcher struct {
+	ns     string
+	prefix string
+	re     *regexp.Regexp
+}
+
+func newKeyMatcher(kind byte, ns, expr string) (*keyMatcher, error) {
+	if kind == matchPrefix {
+		return &keyMatcher{ns: ns, prefix: expr}, nil
+	}
+	re, err := globToRegexp(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &keyMatcher{ns: ns, prefix: globLiteralPrefix(expr), re: re}, nil
+}
+
+// Match reports whether the internal key belongs to m.
+func (m *keyMatcher) Match(key string) bool {
+	ns, userKey := splitKey(key)
+	if ns != m.ns {
+		return false
+	}
+	if m.re != nil {
+		return m.re.MatchString(userKey)
+	}
+	return strings.HasPrefix(userKey, m.prefix)
+}
+
+// ScanPrefix is the internal key prefix shared by every key m can match.
+func (m *keyMatcher) ScanPrefix() string {
+	return namespaceScanPrefix(m.ns, m.prefix)
+}
+
+// globToRegexp supports *, ? and [...] character classes ([!...] negates).
+func globToRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+func globLiteralPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// deleteMatchingLocal removes every key of ns matching expr, one shard at a
+// time, and replicates the operation as one OpDelMatch frame.
+func deleteMatchingLocal(kind byte, ns, expr string, broadcast bool) (int, error) {
+	matcher, err := newKeyMatcher(kind, ns, expr)
+	if err != nil {
+		return 0, err
+	}
+
+	// Legacy peers cannot read OpDelMatch. A flush of the default namespace
+	// of a store holding no other namespace is a plain flush for them,
+	// anything else a DEL for every removed key.
+	whole := kind == matchPrefix && ns == "" && expr == "" && onlyDefaultNamespace()
+	removed := storage.DeleteMatching(matcher.ScanPrefix(), matcher.Match)
+
+	if broadcast {
+		var frame bytes.Buffer
+		writeDelMatchFrame(&frame, kind, ns, expr)
+		broadcastFrame("DELMATCH", frame.Bytes(), func() []byte {
+			if whole {
+				return []byte{OpFlush}
+			}
+			return delFrames(removed)
+		})
+	}
+	return len(removed), nil
+}
+
+// onlyDefaultNamespace reports whether every key is in the default namespace.
+func onlyDefaultNamespace() bool {
+	for ns := range storage.NamespaceUsage() {
+		if ns != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// writeDelMatchFrame encodes: op | kind u8 | nsLen u16 | ns | exprLen u16 | expr
+func writeDelMatchFrame(w io.Writer, kind byte, ns, expr string) error {
+	if _, err := w.Write([]byte{OpDelMatch, kind}); err != nil {
+		return err
+	}
+	if err := writeString16(w, ns); err != nil {
+		return err
+	}
+	return writeString16(w, expr)
+}
+
+func readDelMatchFrame(r *bufio.Reader) (byte, string, string, error) {
+	kind, err := r.ReadByte() // We already read the Op byte
+	if err != nil {
+		return 0, "", "", err
+	}
+	ns, err := readString16(r)
+	if err != nil {
+		return 0, "", "", err
+	}
+	expr, err := readString16(r)
+	if err != nil {
+		return 0, "", "", err
+	}
+	return kind, ns, expr, nil
+}
+
+// -------------------------------------------------------------
+// Keys HTTP Handler
+// -------------------------------------------------------------
+
+func handleKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "DELETE":
+		prefix := r.URL.Query().Get("prefix")
+		pattern := r.URL.Query().Get("pattern")
+
+		kind, expr := matchPrefix, prefix
+		if pattern != "" {
+			kind, expr = matchPattern, pattern
+		}
+		// An empty selector would wipe everything; DELETE /cache/ exists for that
+		if expr == "" || (prefix != "" && pattern != "") {
+			http.Error(w, "Exactly one of prefix or pattern is required", http.StatusBadRequest)
+			return
+		}
+
+		removed, err := deleteMatchingLocal(kind, requestNamespace(r), expr, true)
+		if err != nil {
+			http.Error(w, "Invalid pattern", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"success": true, "removed": removed})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func deleteKeys(t *testing.T, query string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("DELETE", "/api/hypercacheio/keys?"+query, nil)
+	rr := httptest.NewRecorder()
+	handleKeys(rr, req)
+	return rr
+}
+
+func TestDeleteKeysByPrefixAndPattern(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	for _, k := range []string{"user:1:profile", "user:1:avatar", "user:2:profile", "users", "post:1"} {
+		setLocal(k, []byte("i:1;"), 0, false)
+	}
+
+	rr := deleteKeys(t, "prefix=user:1:")
+	var resp map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp["removed"] != float64(2) {
+		t.Errorf("Expected 2 keys removed by prefix, got %v", resp["removed"])
+	}
+
+	rr = deleteKeys(t, "pattern=user:?:prof*")
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp["removed"] != float64(1) {
+		t.Errorf("Expected 1 key removed by pattern, got %v", resp["removed"])
+	}
+
+	for _, k := range []string{"users", "post:1"} {
+		if _, ok := getLocal(k); !ok {
+			t.Errorf("Key %s should not have been removed", k)
+		}
+	}
+
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM cache").Scan(&count)
+	if count != 2 {
+		t.Errorf("Expected 2 persisted rows to remain, got %d", count)
+	}
+
+	if rr := deleteKeys(t, ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected %v without a selector, got %v", http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestLegacyPeersGetWhatTheyCanRead(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	local, remote := net.Pipe()
+	defer remote.Close()
+	peersMutex.Lock()
+	peers["legacy"] = local
+	peerProtocols[local] = replLegacy
+	peersMutex.Unlock()
+	defer func() {
+		peersMutex.Lock()
+		delete(peers, "legacy")
+		delete(peerProtocols, local)
+		peersMutex.Unlock()
+	}()
+	reader := bufio.NewReader(remote)
+	expectDels := func(what, prefix string, n int) {
+		for i := 0; i < n; i++ {
+			if op, _ := reader.ReadByte(); op != OpDel {
+				t.Fatalf("%s: Expected a DEL, got op %d", what, op)
+			}
+			if key, err := readDelFrame(reader); err != nil || !strings.HasPrefix(key, prefix) {
+				t.Errorf("%s: Expected a key starting with %s, got %q, %v", what, prefix, key, err)
+			}
+		}
+	}
+
+	for _, k := range []string{"user:1", "user:2", "post:1"} {
+		setLocal(k, []byte("i:1;"), 0, false)
+	}
+	storeLocal("group:1", []byte("i:1;"), 0, []string{"group"}, nil, false)
+
+	go deleteMatchingLocal(matchPrefix, "", "user:", true)
+	expectDels("prefix delete", "user:", 2)
+
+	go flushTagLocal(indexedTag("group:1", "group"), true)
+	expectDels("tag flush", "group:", 1)
+
+	expiration := time.Now().Unix() + 60
+	go touchLocal("post:1", expiration, true)
+	if op, _ := reader.ReadByte(); op != OpSet {
+		t.Fatalf("touch: Expected a SET, got op %d", op)
+	}
+	if key, val, exp, _, err := readPeerSetFrame(reader, replLegacy); err != nil || key != "post:1" || string(val) != "i:1;" || exp != expiration {
+		t.Errorf("touch: Expected post:1 with the new expiration, got %q %q %d %v", key, val, exp, err)
+	}
+
+	go flushNamespaceLocal("", true)
+	if op, _ := reader.ReadByte(); op != OpFlush {
+		t.Errorf("namespace flush: Expected a FLUSH, got op %d", op)
+	}
+}
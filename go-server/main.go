@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"database/sql"
 	"encoding/binary"
 	"encoding/json"
@@ -9,11 +10,16 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/yvasiyarov/php_session_decoder/php_serialize"
@@ -28,8 +34,40 @@ const (
 	OpSyncItem byte = 4
 	OpSyncEnd  byte = 5
 	OpFlush    byte = 6
+	OpCounter  byte = 7
+	OpSetMany  byte = 8
+	OpTouch    byte = 9
+	OpTags     byte = 10
+	OpTagFlush byte = 11
+	OpDelMatch byte = 12
+	OpHello    byte = 13
+	OpSetTags  byte = 14
 )
 
+// Replication protocol versions, sent as the payload byte of OpHello. Each
+// link speaks the lower version of its two ends; peers that never send a
+// hello speak replLegacy, whose SET and SYNC items carry no version. The
+// payload has helloFlag set so servers that predate the hello skip it like
+// any other byte they do not know.
+const (
+	replLegacy   byte = 0
+	replVersions byte = 1 // Versioned SET and SYNC items, compressed values and every op after OpFlush
+	replProtocol      = replVersions
+
+	helloFlag byte = 0x80
+)
+
+// opProtocol returns the protocol a link must speak to carry op. Nothing is
+// sent to a peer that cannot read it, and a link that carries an op it did
+// not negotiate, or one this server does not know, is closed.
+func opProtocol(op byte) byte {
+	switch op {
+	case OpSet, OpDel, OpSyncReq, OpSyncItem, OpSyncEnd, OpFlush, OpHello:
+		return replLegacy
+	}
+	return replVersions
+}
+
 var (
 	port         int
 	host         string
@@ -44,16 +82,18 @@ var (
 	haMode       bool
 	peerAddrs    string
 	replPort     int
+	nodeID       string
+	tenantsFile  string
+	maxMemoryArg string
+	shardCount   int
+	storageName  string
 
 	db *sql.DB
 
-	// In-memory cache
-	cache      = make(map[string]CacheItem)
-	cacheMutex sync.RWMutex
-
 	// Peer connections
-	peers      = make(map[string]net.Conn)
-	peersMutex sync.Mutex
+	peers         = make(map[string]net.Conn)
+	peerProtocols = make(map[net.Conn]byte) // Protocol negotiated with each peer
+	peersMutex    sync.Mutex
 
 	// Stats
 	stats      Stats
@@ -64,17 +104,32 @@ type Stats struct {
 	TotalBroadcasts uint64 `json:"total_broadcasts"`
 	TotalReceived   uint64 `json:"total_received"`
 	SyncRequests    uint64 `json:"sync_requests_received"`
+	Evictions       uint64 `json:"evictions"`
+	EvictedBytes    uint64 `json:"evicted_bytes"`
+	Sweeps          uint64 `json:"sweeps"`
+	SweptItems      uint64 `json:"swept_items"`
+	LastSweepMicros int64  `json:"last_sweep_us"`
+	MaxSweepMicros  int64  `json:"max_sweep_us"`
 }
 
 type CacheItem struct {
 	Value      []byte
-	Expiration int64 // Unix timestamp, 0 for forever
+	Expiration int64  // Unix timestamp, 0 for forever
+	Version    uint64 // From the node clock, new on every write, used for compare-and-swap
 }
 
 type Payload struct {
-	Value interface{} `json:"value"`
-	TTL   *int        `json:"ttl"`
-	Owner string      `json:"owner"`
+	Value           interface{} `json:"value"`
+	TTL             *int        `json:"ttl"`
+	Owner           string      `json:"owner"`
+	ExpectedVersion *uint64     `json:"expected_version"`
+	Tags            []string    `json:"tags"` // nil leaves existing tags untouched, [] clears them
+}
+
+type IncrPayload struct {
+	Value   json.Number `json:"value"`   // Delta, defaults to 1
+	Initial json.Number `json:"initial"` // Starting value when the key is missing, defaults to 0
+	TTL     *int        `json:"ttl"`     // Applied only when the key is created
 }
 
 func main() {
@@ -87,11 +142,46 @@ func main() {
 	flag.StringVar(&sslKey, "key", "", "SSL Key path")
 	flag.StringVar(&artisanPath, "artisan", "php artisan", "Path to artisan command")
 	flag.StringVar(&sqlitePath, "sqlite-path", "", "Path to SQLite database (optional persistence)")
-	flag.StringVar(&cachePrefix, "prefix", "", "Cache prefix")
+	flag.StringVar(&cachePrefix, "prefix", "", "Deprecated and ignored: the PHP store sends its cache prefix as the namespace header")
+	flag.StringVar(&defaultNamespace, "namespace", "", "Namespace of requests without a namespace header (empty keeps keys unchanged and readable by the PHP store)")
 	flag.BoolVar(&directSqlite, "direct-sqlite", true, "Use internal caching logic")
 	flag.BoolVar(&haMode, "ha-mode", true, "Enable HA mode")
 	flag.StringVar(&peerAddrs, "peers", "", "Comma-separated list of peer addresses (host:port) for TCP replication")
 	flag.IntVar(&replPort, "repl-port", 7400, "Port to listen for incoming replication")
+	flag.StringVar(&nodeID, "node-id", "", "Unique node identifier used for CRDT counters (defaults to hostname:repl-port)")
+	flag.StringVar(&tenantsFile, "tenants", "", "Path to a JSON file defining tenants, their tokens and quotas")
+	flag.StringVar(&maxMemoryArg, "max-memory", "", "Memory budget for cached items, e.g. 512mb (0 or empty means unlimited)")
+	flag.StringVar(&evictionPolicy, "eviction-policy", policyLRU, "Eviction policy when the memory budget is exceeded: lru, lfu, volatile-ttl or noeviction")
+	flag.BoolVar(&replicateEvictions, "replicate-evictions", false, "Delete evicted items from SQLite and replicate evictions to peers as deletes")
+	flag.StringVar(&compression, "compression", compression, "Compression of stored values: none, zstd or snappy")
+	flag.StringVar(&compressMinSize, "compress-min-size", compressMinSize, "Values smaller than this are never compressed, e.g. 1kb")
+	flag.BoolVar(&compressSqlite, "compress-sqlite", false, "Write compressed values to SQLite too (the PHP store cannot read them)")
+	flag.StringVar(&encryptionKeyFile, "encryption-key-file", "", "File of AES-256 keys, one per line, to encrypt persisted values with; the first one encrypts")
+	flag.BoolVar(&encryptKeys, "encrypt-keys", false, "Store keys as keyed hashes in SQLite, the append-only log and snapshots (needs --encryption-key-file)")
+	flag.DurationVar(&sweepInterval, "sweep-interval", sweepInterval, "How often expired items are swept")
+	flag.IntVar(&sweepBatch, "sweep-batch", sweepBatch, "Maximum expired items removed per lock acquisition during a sweep")
+	flag.IntVar(&shardCount, "shards", defaultShards, "Number of hash shards the in-memory store is split into")
+	flag.StringVar(&storageName, "storage", "", "Storage engine: memory, sqlite, aof or tiered (defaults to sqlite when --sqlite-path is set)")
+	flag.IntVar(&warmUp, "warm-up", 0, "Most recently used keys the tiered storage engine loads from SQLite on startup")
+	flag.BoolVar(&writeBehindEnabled, "write-behind", writeBehindEnabled, "Persist SQLite writes asynchronously in batches instead of in the request path")
+	flag.IntVar(&writeBatch, "write-batch", writeBatch, "Maximum keys written per SQLite transaction by the write-behind queue")
+	flag.DurationVar(&writeInterval, "write-interval", writeInterval, "How often the write-behind queue is flushed to SQLite")
+	flag.StringVar(&sqliteJournalMode, "sqlite-journal-mode", sqliteJournalMode, "SQLite journal mode: wal, delete, truncate, persist, memory or off")
+	flag.StringVar(&sqliteSynchronous, "sqlite-synchronous", sqliteSynchronous, "SQLite synchronous mode: off, normal, full or extra")
+	flag.DurationVar(&sqliteBusyTimeout, "sqlite-busy-timeout", sqliteBusyTimeout, "How long SQLite waits for a lock held by another connection or process")
+	flag.StringVar(&sqliteMmapSize, "sqlite-mmap-size", sqliteMmapSize, "Bytes of the SQLite file to memory-map, e.g. 256mb (0 disables mmap)")
+	flag.StringVar(&sqliteCacheSize, "sqlite-cache-size", sqliteCacheSize, "SQLite page cache size per connection, e.g. 64mb")
+	flag.StringVar(&aofPath, "aof-path", "", "Append-only log of the aof storage engine (defaults to hypercacheio.aof next to --sqlite-path)")
+	flag.StringVar(&aofFsync, "aof-fsync", aofFsync, "When the append-only log is synced to disk: always, everysec or no")
+	flag.StringVar(&aofRewriteMinSize, "aof-rewrite-min-size", aofRewriteMinSize, "Size the append-only log must reach before it is rewritten, e.g. 64mb")
+	flag.IntVar(&aofRewritePercentage, "aof-rewrite-percentage", aofRewritePercentage, "Growth since the last rewrite, in percent, that triggers a rewrite of the append-only log")
+	flag.StringVar(&snapshotDir, "snapshot-dir", "", "Directory snapshots are written to (defaults to snapshots/ next to --sqlite-path)")
+	flag.StringVar(&backupDir, "backup-dir", "", "Directory SQLite backups are written to (defaults to backups/ next to --sqlite-path)")
+	flag.DurationVar(&snapshotInterval, "snapshot-interval", 0, "How often a snapshot is written, 0 to only take them through the admin endpoint")
+	flag.IntVar(&snapshotRetain, "snapshot-retain", snapshotRetain, "Number of snapshots kept, 0 keeps all")
+	flag.StringVar(&restoreFrom, "restore-from", "", "Replace the store with this snapshot on startup")
+	flag.BoolVar(&migrateDryRun, "migrate-dry-run", false, "Report the SQLite migrations that would run, roll them back and exit")
+	flag.BoolVar(&sqliteQuickCheck, "sqlite-quick-check", sqliteQuickCheck, "Run PRAGMA quick_check on startup and refuse to start on a damaged file")
 	flag.Parse()
 
 	// 2. Fallback to environment variables if flags are not set
@@ -104,6 +194,12 @@ func main() {
 	if cachePrefix == "" {
 		cachePrefix = os.Getenv("HYPERCACHEIO_CACHE_PREFIX")
 	}
+	if defaultNamespace == "" {
+		defaultNamespace = strings.ReplaceAll(os.Getenv("HYPERCACHEIO_GO_NAMESPACE"), namespaceSep, "")
+	}
+	if storageName == "" {
+		storageName = os.Getenv("HYPERCACHEIO_GO_STORAGE")
+	}
 	if peerAddrs == "" {
 		peerAddrs = os.Getenv("HYPERCACHEIO_PEER_ADDRS")
 	}
@@ -116,24 +212,146 @@ func main() {
 	if host == "127.0.0.1" && os.Getenv("HYPERCACHEIO_GO_HOST") != "" {
 		host = os.Getenv("HYPERCACHEIO_GO_HOST")
 	}
+	if nodeID == "" {
+		nodeID = os.Getenv("HYPERCACHEIO_NODE_ID")
+	}
+	if nodeID == "" {
+		hostName, _ := os.Hostname()
+		nodeID = fmt.Sprintf("%s:%d", hostName, replPort)
+	}
+	versions.setNode(nodeID)
+
+	if tenantsFile == "" {
+		tenantsFile = os.Getenv("HYPERCACHEIO_GO_TENANTS_FILE")
+	}
+	if maxMemoryArg == "" {
+		maxMemoryArg = os.Getenv("HYPERCACHEIO_GO_MAX_MEMORY")
+	}
+	if evictionPolicy == policyLRU && os.Getenv("HYPERCACHEIO_GO_EVICTION_POLICY") != "" {
+		evictionPolicy = os.Getenv("HYPERCACHEIO_GO_EVICTION_POLICY")
+	}
 
 	if apiToken == "" {
 		log.Fatal("API Token is required (via --token flag or HYPERCACHEIO_API_TOKEN environment variable)")
 	}
 
-	// Initialize SQLite if provided (optional persistence)
-	if sqlitePath != "" && directSqlite {
+	if maxMemoryArg != "" {
 		var err error
-		db, err = sql.Open("sqlite", sqlitePath)
+		maxMemory, err = parseByteSize(maxMemoryArg)
+		if err != nil {
+			log.Fatalf("Invalid --max-memory: %s", err)
+		}
+	}
+	if sweepInterval <= 0 || sweepBatch <= 0 {
+		log.Fatal("--sweep-interval and --sweep-batch must be positive")
+	}
+	if shardCount <= 0 {
+		log.Fatal("--shards must be positive")
+	}
+	if writeBatch <= 0 || writeInterval <= 0 {
+		log.Fatal("--write-batch and --write-interval must be positive")
+	}
+	if err := parseCompression(); err != nil {
+		log.Fatal(err)
+	}
+	if compression != compressionNone {
+		log.Printf("Compression: %s for values of %d bytes or more", compression, compressMin)
+	}
+	if err := parseEncryption(); err != nil {
+		log.Fatal(err)
+	}
+	if sealing != nil {
+		log.Printf("Encryption at rest: key %x of %d, hashed keys: %v", sealing.active.id, len(sealing.byID), encryptKeys)
+	}
+	if !validFsyncPolicy(aofFsync) {
+		log.Fatalf("Invalid --aof-fsync %q (expected always, everysec or no)", aofFsync)
+	}
+	if !validEvictionPolicy(evictionPolicy) {
+		log.Fatalf("Invalid --eviction-policy %q (expected lru, lfu, volatile-ttl or noeviction)", evictionPolicy)
+	}
+	if maxMemory > 0 {
+		log.Printf("Memory limit: %d bytes, eviction policy: %s", maxMemory, evictionPolicy)
+		if replicateEvictions {
+			startEvictionReplicator()
+		}
+	}
+
+	if tenantsFile != "" {
+		if err := loadTenants(tenantsFile); err != nil {
+			log.Fatalf("Failed to load tenants: %s", err)
+		}
+		log.Printf("Loaded %d tenants from %s", len(tenantList), tenantsFile)
+	}
+
+	if storageName == "" {
+		storageName = storageMemory
+		if sqlitePath != "" && directSqlite {
+			storageName = storageSqlite
+		}
+	}
+	if snapshotDir == "" && sqlitePath != "" {
+		snapshotDir = filepath.Join(filepath.Dir(sqlitePath), "snapshots")
+	}
+	if backupDir == "" && sqlitePath != "" {
+		backupDir = filepath.Join(filepath.Dir(sqlitePath), "backups")
+	}
+	if storageName == storageAof && aofPath == "" && sqlitePath != "" {
+		aofPath = filepath.Join(filepath.Dir(sqlitePath), "hypercacheio.aof")
+	}
+
+	// Initialize SQLite if the storage engine persists to it
+	if (storageName == storageSqlite || storageName == storageTiered) && sqlitePath != "" {
+		var err error
+		db, err = openSqlite(sqlitePath)
 		if err != nil {
 			log.Fatalf("Failed to open SQLite database: %s", err)
 		}
-		db.SetMaxOpenConns(10)
+		if migrateDryRun {
+			pending, err := migrate(db, true)
+			if err != nil {
+				log.Fatalf("SQLite migrations would fail: %s", err)
+			}
+			for _, m := range pending {
+				log.Printf("Pending SQLite migration %d: %s", m.version, m.name)
+			}
+			log.Printf("%d pending SQLite migrations, schema version %d is the latest", len(pending), latestSchemaVersion())
+			os.Exit(0)
+		}
 		if err := initSqlite(); err != nil {
-			log.Fatalf("Failed to initialize SQLite schema: %s", err)
+			log.Fatalf("Failed to migrate SQLite schema: %s", err)
+		}
+		hashed, err := checkSqliteEncryption(db)
+		if err != nil {
+			log.Fatalf("Cannot read the SQLite file: %s", err)
+		}
+		if hashed && storageName == storageTiered {
+			log.Fatal("The SQLite file holds hashed keys, start it once with --storage=sqlite and without --encrypt-keys to restore them")
 		}
 		log.Printf("SQLite persistence enabled: %s", sqlitePath)
-		loadFromSqlite()
+	}
+
+	engine, err := newStore(storageName, shardCount)
+	if err != nil {
+		log.Fatalf("Invalid --storage: %s", err)
+	}
+	storage = engine
+	if err := storage.Load(); err != nil {
+		log.Fatalf("Failed to load persisted data: %s", err)
+	}
+	log.Printf("Storage engine: %s (%d shards)", storageName, shardCount)
+
+	if restoreFrom != "" {
+		info, err := restoreSnapshot(restoreFrom)
+		if err != nil {
+			log.Fatalf("Failed to restore snapshot: %s", err)
+		}
+		log.Printf("Restored %d keys from snapshot %s taken at %s", info.Keys, info.Path, time.Unix(info.Created, 0).UTC().Format(time.RFC3339))
+	}
+	if snapshotInterval > 0 {
+		if snapshotDir == "" {
+			log.Fatal("--snapshot-interval needs --snapshot-dir")
+		}
+		startSnapshotScheduler()
 	}
 
 	// Start replication listener and connect to peers if HA mode is enabled
@@ -157,26 +375,64 @@ func main() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/hypercacheio/cache/", handleCache)
 	mux.HandleFunc("/api/hypercacheio/add/", handleAdd)
+	mux.HandleFunc("/api/hypercacheio/incr/", handleIncr)
+	mux.HandleFunc("/api/hypercacheio/decr/", handleIncr)
+	mux.HandleFunc("/api/hypercacheio/counter/", handleCounter)
+	mux.HandleFunc("/api/hypercacheio/many", handleMany)
+	mux.HandleFunc("/api/hypercacheio/put-many", handlePutMany)
+	mux.HandleFunc("/api/hypercacheio/touch/", handleTouch)
+	mux.HandleFunc("/api/hypercacheio/ttl/", handleTTL)
+	mux.HandleFunc("/api/hypercacheio/tags/", handleTags)
+	mux.HandleFunc("/api/hypercacheio/keys", handleKeys)
 	mux.HandleFunc("/api/hypercacheio/lock/", handleLock)
 	mux.HandleFunc("/api/hypercacheio/ping", handlePing)
 	mux.HandleFunc("/api/hypercacheio/items", handleItems)
+	mux.HandleFunc("/api/hypercacheio/admin/snapshots", handleSnapshots)
+	mux.HandleFunc("/api/hypercacheio/admin/export", handleExport)
+	mux.HandleFunc("/api/hypercacheio/admin/import", handleImport)
+	mux.HandleFunc("/api/hypercacheio/admin/backup", handleBackup)
+	mux.HandleFunc("/api/hypercacheio/admin/backup/status", handleBackupStatus)
 
 	serverAddr := fmt.Sprintf("%s:%d", host, port)
 	log.Printf("Starting Hypercacheio HTTP API on %s", serverAddr)
 
-	var err error
+	server := &http.Server{Addr: serverAddr, Handler: authMiddleware(mux)}
+	stopped := make(chan struct{})
+	go shutdownOnSignal(server, stopped)
+
 	if sslEnabled {
 		if sslCert == "" || sslKey == "" {
 			log.Fatal("SSL Certificate and Key are required when SSL is enabled")
 		}
-		err = http.ListenAndServeTLS(serverAddr, sslCert, sslKey, authMiddleware(mux))
+		err = server.ListenAndServeTLS(sslCert, sslKey)
 	} else {
-		err = http.ListenAndServe(serverAddr, authMiddleware(mux))
+		err = server.ListenAndServe()
 	}
 
-	if err != nil {
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Server failed: %s", err)
 	}
+	<-stopped
+}
+
+// shutdownOnSignal stops accepting requests on SIGINT or SIGTERM, waits for
+// in-flight ones and makes every accepted write durable before exiting.
+func shutdownOnSignal(server *http.Server, stopped chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("Received %s, shutting down", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("HTTP shutdown: %v", err)
+	}
+	if err := storage.Close(); err != nil {
+		log.Printf("Failed to close storage: %v", err)
+	}
+	log.Printf("Storage drained, bye")
+	close(stopped)
 }
 
 // -------------------------------------------------------------
@@ -205,6 +461,7 @@ func startReplicationListener() {
 func handleReplicationConn(conn net.Conn) {
 	defer conn.Close()
 	reader := bufio.NewReader(conn)
+	protocol := replLegacy // Until the peer says hello
 
 	for {
 		op, err := reader.ReadByte()
@@ -219,14 +476,33 @@ func handleReplicationConn(conn net.Conn) {
 		stats.TotalReceived++
 		statsMutex.Unlock()
 
+		if opProtocol(op) > protocol {
+			log.Printf("Closing replication link from %s: op %d was not negotiated", conn.RemoteAddr(), op)
+			return
+		}
+
 		switch op {
 		case OpSet:
-			key, val, exp, err := readSetFrame(reader)
+			key, val, exp, version, err := readPeerSetFrame(reader, protocol)
 			if err != nil {
 				log.Printf("Failed to read SET frame: %v", err)
 				return
 			}
-			setLocal(key, val, exp, false)
+			replicateSet(key, val, exp, version, nil)
+		case OpSetTags:
+			key, val, exp, version, tags, err := readSetTagsFrame(reader)
+			if err != nil {
+				log.Printf("Failed to read SETTAGS frame: %v", err)
+				return
+			}
+			replicateSet(key, val, exp, version, tags)
+		case OpSetMany:
+			items, err := readSetManyFrame(reader)
+			if err != nil {
+				log.Printf("Failed to read SETMANY frame: %v", err)
+				return
+			}
+			replicateMany(items)
 		case OpDel:
 			key, err := readDelFrame(reader)
 			if err != nil {
@@ -234,15 +510,59 @@ func handleReplicationConn(conn net.Conn) {
 				return
 			}
 			delLocal(key, false)
+		case OpTouch:
+			key, exp, err := readTouchFrame(reader)
+			if err != nil {
+				log.Printf("Failed to read TOUCH frame: %v", err)
+				return
+			}
+			touchLocal(key, exp, false)
+		case OpTags:
+			key, tags, err := readTagsFrame(reader)
+			if err != nil {
+				log.Printf("Failed to read TAGS frame: %v", err)
+				return
+			}
+			tagLocal(key, tags, false)
+		case OpTagFlush:
+			tag, err := readTagFlushFrame(reader)
+			if err != nil {
+				log.Printf("Failed to read TAGFLUSH frame: %v", err)
+				return
+			}
+			flushTagLocal(tag, false)
+		case OpDelMatch:
+			kind, ns, expr, err := readDelMatchFrame(reader)
+			if err != nil {
+				log.Printf("Failed to read DELMATCH frame: %v", err)
+				return
+			}
+			deleteMatchingLocal(kind, ns, expr, false)
 		case OpFlush:
 			log.Printf("Received FLUSH from peer")
 			flushLocal(false)
+		case OpCounter:
+			key, node, epoch, pos, neg, exp, err := readCounterFrame(reader)
+			if err != nil {
+				log.Printf("Failed to read COUNTER frame: %v", err)
+				return
+			}
+			mergeCounter(key, node, epoch, pos, neg, exp)
 		case OpSyncReq:
 			log.Printf("Received SYNC request from peer %s", conn.RemoteAddr())
 			statsMutex.Lock()
 			stats.SyncRequests++
 			statsMutex.Unlock()
-			sendFullDump(conn)
+			sendFullDump(conn, protocol)
+		case OpHello:
+			if protocol, err = readHelloFrame(reader); err != nil {
+				log.Printf("Failed to read HELLO frame: %v", err)
+				return
+			}
+			sendHello(conn)
+		default:
+			log.Printf("Closing replication link from %s: unknown op %d", conn.RemoteAddr(), op)
+			return
 		}
 	}
 }
@@ -258,18 +578,18 @@ func maintainPeerConnection(addr string) {
 
 		log.Printf("Connected to peer %s. Initiating sync...", addr)
 
-		peersMutex.Lock()
-		peers[addr] = conn
-		peersMutex.Unlock()
-
-		// Request sync
+		// Offer our protocol, then request sync. The peer only receives
+		// writes once it has answered, so they use the protocol it speaks.
+		sendHello(conn)
 		sendSyncRequest(conn)
 
 		// Handle incoming messages from peer
-		handlePeerResponses(conn)
+		handlePeerResponses(conn, addr)
+		conn.Close()
 
 		peersMutex.Lock()
 		delete(peers, addr)
+		delete(peerProtocols, conn)
 		peersMutex.Unlock()
 
 		log.Printf("Connection to peer %s lost. Retrying in 5s...", addr)
@@ -277,8 +597,20 @@ func maintainPeerConnection(addr string) {
 	}
 }
 
-func handlePeerResponses(conn net.Conn) {
+// handlePeerResponses reads what the peer at addr sends back. A peer that
+// speaks the hello answers it before anything else; any other first frame
+// means it never will, so the link stays on the legacy protocol.
+func handlePeerResponses(conn net.Conn, addr string) {
 	reader := bufio.NewReader(conn)
+	protocol := replLegacy
+	registered := false
+	register := func() {
+		peersMutex.Lock()
+		peers[addr] = conn
+		peerProtocols[conn] = protocol
+		peersMutex.Unlock()
+		registered = true
+	}
 	for {
 		op, err := reader.ReadByte()
 		if err != nil {
@@ -289,26 +621,79 @@ func handlePeerResponses(conn net.Conn) {
 		stats.TotalReceived++
 		statsMutex.Unlock()
 
+		if op == OpHello && !registered {
+			if protocol, err = readHelloFrame(reader); err != nil {
+				return
+			}
+			register()
+			continue
+		}
+		if !registered {
+			register()
+		}
+		if opProtocol(op) > protocol {
+			log.Printf("Closing replication link to %s: op %d was not negotiated", addr, op)
+			return
+		}
+
 		switch op {
 		case OpSyncItem:
-			key, val, exp, err := readSetFrame(reader)
+			key, val, exp, version, err := readPeerSetFrame(reader, protocol)
 			if err == nil {
-				setLocal(key, val, exp, false)
+				replicateSet(key, val, exp, version, nil)
 			}
 		case OpSyncEnd:
 			log.Printf("Bootstrap sync completed from %s", conn.RemoteAddr())
 		case OpSet:
-			key, val, exp, err := readSetFrame(reader)
+			key, val, exp, version, err := readPeerSetFrame(reader, protocol)
 			if err == nil {
-				setLocal(key, val, exp, false)
+				replicateSet(key, val, exp, version, nil)
+			}
+		case OpSetTags:
+			key, val, exp, version, tags, err := readSetTagsFrame(reader)
+			if err == nil {
+				replicateSet(key, val, exp, version, tags)
+			}
+		case OpSetMany:
+			items, err := readSetManyFrame(reader)
+			if err == nil {
+				replicateMany(items)
 			}
 		case OpDel:
 			key, err := readDelFrame(reader)
 			if err == nil {
 				delLocal(key, false)
 			}
+		case OpTouch:
+			key, exp, err := readTouchFrame(reader)
+			if err == nil {
+				touchLocal(key, exp, false)
+			}
+		case OpTags:
+			key, tags, err := readTagsFrame(reader)
+			if err == nil {
+				tagLocal(key, tags, false)
+			}
+		case OpTagFlush:
+			tag, err := readTagFlushFrame(reader)
+			if err == nil {
+				flushTagLocal(tag, false)
+			}
+		case OpDelMatch:
+			kind, ns, expr, err := readDelMatchFrame(reader)
+			if err == nil {
+				deleteMatchingLocal(kind, ns, expr, false)
+			}
 		case OpFlush:
 			flushLocal(false)
+		case OpCounter:
+			key, node, epoch, pos, neg, exp, err := readCounterFrame(reader)
+			if err == nil {
+				mergeCounter(key, node, epoch, pos, neg, exp)
+			}
+		default:
+			log.Printf("Closing replication link to %s: unknown op %d", addr, op)
+			return
 		}
 	}
 }
@@ -317,25 +702,43 @@ func sendSyncRequest(conn net.Conn) {
 	conn.Write([]byte{OpSyncReq})
 }
 
-func sendFullDump(conn net.Conn) {
-	cacheMutex.RLock()
-	defer cacheMutex.RUnlock()
-
-	log.Printf("Sending full dump (%d items) to %s", len(cache), conn.RemoteAddr())
-	for k, v := range cache {
-		if v.Expiration > 0 && v.Expiration < time.Now().Unix() {
-			continue
+// sendFullDump sends every live key in the protocol the peer speaks.
+func sendFullDump(conn net.Conn, protocol byte) {
+	log.Printf("Sending full dump (%d items) to %s", storage.Len(), conn.RemoteAddr())
+	compressed := protocol >= replVersions
+	now := time.Now().Unix()
+	storage.Range(func(st keyState) bool {
+		switch {
+		case st.counter != nil && protocol >= opProtocol(OpCounter):
+			writeCounterDump(conn, st) // Sent as slots so the peer can merge them
+		case st.live(now):
+			writePeerSetFrame(conn, protocol, OpSyncItem, st.key, wireValue(st.item.Value, compressed), st.item.Expiration, st.item.Version)
 		}
-		writeSetFrame(conn, OpSyncItem, k, v.Value, v.Expiration)
-	}
+		if protocol >= opProtocol(OpTags) {
+			writeTagsDump(conn, st)
+		}
+		return true
+	})
 	conn.Write([]byte{OpSyncEnd})
 }
 
-func broadcastSet(key string, val []byte, expiration int64) {
+// broadcastSet sends a write to every peer. val is the value as stored, which
+// peers read as is; legacy peers cannot read compressed values and get it
+// decoded.
+func broadcastSet(key string, val []byte, expiration int64, version uint64) {
 	peersMutex.Lock()
 	defer peersMutex.Unlock()
+	var plain []byte
 	for addr, conn := range peers {
-		err := writeSetFrame(conn, OpSet, key, val, expiration)
+		protocol := peerProtocols[conn]
+		wire := val
+		if protocol < replVersions {
+			if plain == nil {
+				plain = decodeValue(val)
+			}
+			wire = plain
+		}
+		err := writePeerSetFrame(conn, protocol, OpSet, key, wire, expiration, version)
 		if err != nil {
 			log.Printf("Failed to broadcast SET to %s: %v", addr, err)
 		} else {
@@ -380,7 +783,44 @@ func broadcastFlush() {
 // Frame Encoding/Decoding
 // -------------------------------------------------------------
 
-func writeSetFrame(w io.Writer, op byte, key string, val []byte, exp int64) error {
+// framePrealloc caps the slices preallocated from counts read off the wire
+// or from a file; longer lists grow as their entries arrive.
+const framePrealloc = 256
+
+// writeSetFrame encodes a SET or SYNC item:
+// op | keyLen u16 | valLen u32 | exp u32 | version u64 | key | val
+func writeSetFrame(w io.Writer, op byte, key string, val []byte, exp int64, version uint64) error {
+	keyBytes := []byte(key)
+	header := make([]byte, 19)
+	header[0] = op
+	binary.BigEndian.PutUint16(header[1:3], uint16(len(keyBytes)))
+	binary.BigEndian.PutUint32(header[3:7], uint32(len(val)))
+	binary.BigEndian.PutUint32(header[7:11], uint32(exp))
+	binary.BigEndian.PutUint64(header[11:19], version)
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(keyBytes); err != nil {
+		return err
+	}
+	if _, err := w.Write(val); err != nil {
+		return err
+	}
+	return nil
+}
+
+func readSetFrame(r *bufio.Reader) (string, []byte, int64, uint64, error) {
+	return readPeerSetFrame(r, replVersions)
+}
+
+// writePeerSetFrame encodes a SET or SYNC item for a peer speaking protocol.
+// Legacy peers read it without the version:
+// op | keyLen u16 | valLen u32 | exp u32 | key | val
+func writePeerSetFrame(w io.Writer, protocol, op byte, key string, val []byte, exp int64, version uint64) error {
+	if protocol >= replVersions {
+		return writeSetFrame(w, op, key, val, exp, version)
+	}
 	keyBytes := []byte(key)
 	header := make([]byte, 11)
 	header[0] = op
@@ -400,24 +840,34 @@ func writeSetFrame(w io.Writer, op byte, key string, val []byte, exp int64) erro
 	return nil
 }
 
-func readSetFrame(r *bufio.Reader) (string, []byte, int64, error) {
-	header := make([]byte, 10) // We already read the Op byte
+// readPeerSetFrame reads a SET or SYNC item sent in protocol. Items of
+// legacy peers come without a version and read as version 0.
+func readPeerSetFrame(r *bufio.Reader, protocol byte) (string, []byte, int64, uint64, error) {
+	size := 10 // We already read the Op byte
+	if protocol >= replVersions {
+		size = 18
+	}
+	header := make([]byte, size)
 	if _, err := io.ReadFull(r, header); err != nil {
-		return "", nil, 0, err
+		return "", nil, 0, 0, err
 	}
 	keyLen := binary.BigEndian.Uint16(header[0:2])
 	valLen := binary.BigEndian.Uint32(header[2:6])
 	exp := int64(binary.BigEndian.Uint32(header[6:10]))
+	var version uint64
+	if protocol >= replVersions {
+		version = binary.BigEndian.Uint64(header[10:18])
+	}
 
 	keyBytes := make([]byte, keyLen)
 	if _, err := io.ReadFull(r, keyBytes); err != nil {
-		return "", nil, 0, err
+		return "", nil, 0, 0, err
 	}
 	val := make([]byte, valLen)
 	if _, err := io.ReadFull(r, val); err != nil {
-		return "", nil, 0, err
+		return "", nil, 0, 0, err
 	}
-	return string(keyBytes), val, exp, nil
+	return string(keyBytes), val, exp, version, nil
 }
 
 func writeDelFrame(w io.Writer, key string) error {
@@ -451,128 +901,148 @@ func readDelFrame(r *bufio.Reader) (string, error) {
 // Core Cache Operations
 // -------------------------------------------------------------
 
-func setLocal(key string, val []byte, expiration int64, broadcast bool) {
-	cacheMutex.Lock()
-	cache[key] = CacheItem{Value: val, Expiration: expiration}
-	cacheMutex.Unlock()
+func setLocal(key string, val []byte, expiration int64, broadcast bool) uint64 {
+	return setLocalVersion(key, val, expiration, 0, broadcast)
+}
+
+// setLocalVersion stores an item with the given version, or with the next
+// version of the node clock when it is 0.
+func setLocalVersion(key string, val []byte, expiration int64, version uint64, broadcast bool) uint64 {
+	item := storage.Set(key, val, expiration, version)
+
+	if broadcast {
+		broadcastSet(key, item.Value, expiration, item.Version)
+	}
+	return item.Version
+}
 
-	if db != nil {
-		var exp interface{}
-		if expiration > 0 {
-			exp = expiration
+// replicateSet applies a write received from a peer, together with its tags
+// unless they are nil. It keeps the version of the origin node unless the key
+// already holds that version or a newer one, so a delayed frame cannot move a
+// key back. Legacy peers send no version; their writes take the next version
+// of the node clock.
+func replicateSet(key string, val []byte, expiration int64, version uint64, tags []string) {
+	storage.Update(key, func(tx *itemTx) bool {
+		if item, live := tx.Live(); live && version != 0 && item.Version >= version {
+			return false
+		}
+		tx.Store(val, expiration, version)
+		tx.DropCounter()
+		if tags != nil {
+			tx.SetTags(tags)
 		}
-		db.Exec("REPLACE INTO cache(key, value, expiration) VALUES(?, ?, ?)", key, val, exp)
+		return true
+	})
+}
+
+// storeLocal writes an item and, unless tags is nil, its tags under one shard
+// lock, so neither readers nor persistence ever see one without the other.
+// With expected set it only writes if the live version of key equals it, 0
+// meaning the key must not exist. It returns the new version, or the current
+// one when the write is refused, and replicates the write as one frame.
+func storeLocal(key string, val []byte, expiration int64, tags []string, expected *uint64, broadcast bool) (uint64, bool) {
+	var stored CacheItem
+	var current uint64
+	written := false
+	storage.Update(key, func(tx *itemTx) bool {
+		if item, live := tx.Live(); live {
+			current = item.Version
+		}
+		if expected != nil && current != *expected {
+			return false
+		}
+		stored = tx.Store(val, expiration, 0)
+		tx.DropCounter()
+		if tags != nil {
+			tx.SetTags(tags)
+			tags = append([]string{}, tx.Tags()...)
+		}
+		written = true
+		return true
+	})
+	if !written {
+		return current, false
 	}
 
 	if broadcast {
-		broadcastSet(key, val, expiration)
+		if tags != nil {
+			broadcastSetTags(key, stored.Value, expiration, stored.Version, tags)
+		} else {
+			broadcastSet(key, stored.Value, expiration, stored.Version)
+		}
+	}
+	return stored.Version, true
+}
+
+// casLocal stores an item only if the live version of key equals expected.
+// An expected version of 0 means the key must not exist.
+func casLocal(key string, val []byte, expiration int64, expected uint64) (uint64, bool) {
+	version, ok := storage.CompareAndSwap(key, val, expiration, expected)
+	if !ok {
+		return version, false
 	}
+	broadcastSet(key, val, expiration, version)
+	return version, true
 }
 
 func getLocal(key string) ([]byte, bool) {
-	cacheMutex.RLock()
-	item, ok := cache[key]
-	cacheMutex.RUnlock()
+	item, ok := getItemLocal(key)
+	return item.Value, ok
+}
 
+func getItemLocal(key string) (CacheItem, bool) {
+	item, ok := storage.Get(key)
 	if !ok {
-		return nil, false
+		return CacheItem{}, false
 	}
 	if item.Expiration > 0 && item.Expiration < time.Now().Unix() {
 		delLocal(key, true)
-		return nil, false
+		return CacheItem{}, false
 	}
-	return item.Value, true
+	return item, true
 }
 
 func delLocal(key string, broadcast bool) {
-	cacheMutex.Lock()
-	delete(cache, key)
-	cacheMutex.Unlock()
-
-	if db != nil {
-		db.Exec("DELETE FROM cache WHERE key = ?", key)
-	}
+	storage.Delete(key)
 
 	if broadcast {
 		broadcastDel(key)
 	}
 }
 
-func flushLocal(broadcast bool) {
-	cacheMutex.Lock()
-	cache = make(map[string]CacheItem)
-	cacheMutex.Unlock()
+// removal records which derived state went away with a key, so durable
+// storage can be cleaned up once the shard lock has been released.
+type removal struct {
+	key     string
+	counter bool
+	tags    bool
+}
 
-	if db != nil {
-		db.Exec("DELETE FROM cache")
-	}
+func flushLocal(broadcast bool) {
+	storage.Flush()
+	evictionMutex.Lock()
+	evictionQueue = nil
+	evictionMutex.Unlock()
 
 	if broadcast {
 		broadcastFlush()
 	}
 }
 
-func loadFromSqlite() {
-	if db == nil {
-		return
+// lockName returns the lock name for an in-memory lock key ("lock:<name>"),
+// qualified by the namespace of the key.
+func lockName(key string) (string, bool) {
+	ns, userKey := splitKey(key)
+	if strings.HasPrefix(userKey, "lock:") {
+		return namespacedKey(ns, strings.TrimPrefix(userKey, "lock:")), true
 	}
-	rows, err := db.Query("SELECT key, value, expiration FROM cache")
-	if err != nil {
-		log.Printf("Failed to load from SQLite: %v", err)
-		return
-	}
-	defer rows.Close()
-
-	count := 0
-	for rows.Next() {
-		var k string
-		var v []byte
-		var exp sql.NullInt64
-		if err := rows.Scan(&k, &v, &exp); err == nil {
-			expiration := int64(0)
-			if exp.Valid {
-				expiration = exp.Int64
-			}
-			if expiration == 0 || expiration > time.Now().Unix() {
-				cache[k] = CacheItem{Value: v, Expiration: expiration}
-				count++
-			}
-		}
-	}
-	log.Printf("Loaded %d items from SQLite persistence", count)
+	return "", false
 }
 
-func startCleanupTimer() {
-	ticker := time.NewTicker(30 * time.Second)
-	go func() {
-		for range ticker.C {
-			cleanupExpired()
-		}
-	}()
-}
-
-func cleanupExpired() {
-	now := time.Now().Unix()
-	count := 0
-	
-	cacheMutex.Lock()
-	for k, v := range cache {
-		if v.Expiration > 0 && v.Expiration < now {
-			delete(cache, k)
-			count++
-		}
-	}
-	cacheMutex.Unlock()
-
-	if count > 0 {
-		log.Printf("Background cleanup: removed %d expired items", count)
-		if db != nil {
-			_, err := db.Exec("DELETE FROM cache WHERE expiration > 0 AND expiration < ?", now)
-			if err != nil {
-				log.Printf("Failed to cleanup SQLite expired items: %v", err)
-			}
-		}
-	}
+// lockKey returns the in-memory key of a lock name stored by lockName.
+func lockKey(name string) string {
+	ns, userName := splitKey(name)
+	return namespacedKey(ns, "lock:"+userName)
 }
 
 // -------------------------------------------------------------
@@ -583,15 +1053,20 @@ func authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		token := r.Header.Get("X-Hypercacheio-Token")
 		if token != apiToken {
-			http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
-			return
+			tenant, ok := tenantByToken[token]
+			if !ok {
+				http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+				return
+			}
+			r = withTenant(r, tenant)
 		}
 		next.ServeHTTP(w, r)
 	})
 }
 
 func handleCache(w http.ResponseWriter, r *http.Request) {
-	key := strings.TrimPrefix(r.URL.Path, "/api/hypercacheio/cache/")
+	ns := requestNamespace(r)
+	key := namespacedKey(ns, strings.TrimPrefix(r.URL.Path, "/api/hypercacheio/cache/"))
 
 	switch r.Method {
 	case "GET":
@@ -599,19 +1074,24 @@ func handleCache(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Key required", http.StatusBadRequest)
 			return
 		}
-		val, ok := getLocal(key)
+		item, ok := getItemLocal(key)
 		if !ok {
 			writeJSON(w, map[string]interface{}{"data": nil})
 			return
 		}
 
-		decoder := php_serialize.NewUnSerializer(string(val))
+		decoder := php_serialize.NewUnSerializer(string(item.Value))
 		parsed, err := decoder.Decode()
 		if err != nil {
 			writeJSON(w, map[string]interface{}{"data": nil})
 			return
 		}
-		writeJSON(w, map[string]interface{}{"data": parsed})
+		resp := map[string]interface{}{"data": parsed, "version": item.Version}
+		if withMeta, _ := strconv.ParseBool(r.URL.Query().Get("with_meta")); withMeta {
+			resp["meta"] = itemMeta(item)
+		}
+		w.Header().Set("ETag", formatETag(item.Version))
+		writeJSON(w, resp)
 
 	case "POST":
 		body, _ := io.ReadAll(r.Body)
@@ -631,13 +1111,39 @@ func handleCache(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Serialization failed", http.StatusInternalServerError)
 			return
 		}
+		if !allowWrite(w, r, map[string]int{key: len(encoded)}) {
+			return
+		}
 
-		setLocal(key, []byte(encoded), expiration, true)
-		writeJSON(w, map[string]bool{"success": true})
+		// Conditional write: If-Match answers 412, expected_version answers 409
+		if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+			expected, ok := parseETag(ifMatch)
+			if !ok {
+				http.Error(w, "Invalid If-Match header", http.StatusBadRequest)
+				return
+			}
+			version, stored := storeLocal(key, []byte(encoded), expiration, payload.Tags, &expected, true)
+			w.Header().Set("ETag", formatETag(version))
+			if !stored {
+				writeJSONStatus(w, http.StatusPreconditionFailed, map[string]interface{}{"success": false, "version": version})
+				return
+			}
+			writeJSON(w, map[string]interface{}{"success": true, "version": version})
+			return
+		}
+
+		version, stored := storeLocal(key, []byte(encoded), expiration, payload.Tags, payload.ExpectedVersion, true)
+		if !stored {
+			writeJSONStatus(w, http.StatusConflict, map[string]interface{}{"success": false, "version": version})
+			return
+		}
+		w.Header().Set("ETag", formatETag(version))
+		writeJSON(w, map[string]interface{}{"success": true, "version": version})
 
 	case "DELETE":
 		if key == "" {
-			flushLocal(true)
+			// Only the namespace of the request is flushed
+			flushNamespaceLocal(ns, true)
 			writeJSON(w, map[string]bool{"success": true})
 		} else {
 			delLocal(key, true)
@@ -647,19 +1153,13 @@ func handleCache(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleAdd(w http.ResponseWriter, r *http.Request) {
-	key := strings.TrimPrefix(r.URL.Path, "/api/hypercacheio/add/")
+	key := namespacedKey(requestNamespace(r), strings.TrimPrefix(r.URL.Path, "/api/hypercacheio/add/"))
 	body, _ := io.ReadAll(r.Body)
 	var payload Payload
 	json.Unmarshal(body, &payload)
 
-	// Atomic Check-and-Set using Mutex
-	cacheMutex.Lock()
-	item, ok := cache[key]
-	exists := ok && (item.Expiration == 0 || item.Expiration > time.Now().Unix())
-
-	if exists {
-		cacheMutex.Unlock()
-		writeJSON(w, map[string]bool{"added": false})
+	encoded, _ := php_serialize.Serialize(payload.Value)
+	if !allowWrite(w, r, map[string]int{key: len(encoded)}) {
 		return
 	}
 
@@ -668,46 +1168,203 @@ func handleAdd(w http.ResponseWriter, r *http.Request) {
 		expiration = time.Now().Unix() + int64(*payload.TTL)
 	}
 
-	encoded, _ := php_serialize.Serialize(payload.Value)
-	// We are still holding the lock, so we can set it safely.
-	cache[key] = CacheItem{Value: []byte(encoded), Expiration: expiration}
-	cacheMutex.Unlock()
+	// Tags are stored with the value, which must not exist yet
+	if payload.Tags != nil {
+		absent := uint64(0)
+		_, added := storeLocal(key, []byte(encoded), expiration, payload.Tags, &absent, true)
+		writeJSON(w, map[string]bool{"added": added})
+		return
+	}
 
-	// Persistence and Broadcast (outside the lock for performance)
-	if db != nil {
-		var exp interface{}
-		if expiration > 0 {
-			exp = expiration
-		}
-		db.Exec("REPLACE INTO cache(key, value, expiration) VALUES(?, ?, ?)", key, encoded, exp)
+	// Atomic Check-and-Set under the shard lock
+	added, ok := storage.Add(key, []byte(encoded), expiration)
+	if !ok {
+		writeJSON(w, map[string]bool{"added": false})
+		return
 	}
-	broadcastSet(key, []byte(encoded), expiration)
+
+	// Broadcast outside the lock for performance
+	broadcastSet(key, added.Value, expiration, added.Version)
 
 	writeJSON(w, map[string]bool{"added": true})
 }
 
+func handleIncr(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/api/hypercacheio/incr/")
+	sign := int64(1)
+	if strings.HasPrefix(r.URL.Path, "/api/hypercacheio/decr/") {
+		key = strings.TrimPrefix(r.URL.Path, "/api/hypercacheio/decr/")
+		sign = -1
+	}
+	if key == "" {
+		http.Error(w, "Key required", http.StatusBadRequest)
+		return
+	}
+	key = namespacedKey(requestNamespace(r), key)
+
+	body, _ := io.ReadAll(r.Body)
+	var payload IncrPayload
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &payload); err != nil {
+			http.Error(w, "Invalid payload", http.StatusBadRequest)
+			return
+		}
+	}
+	delta, err := parseNumber(payload.Value, 1)
+	if err != nil {
+		http.Error(w, "Invalid delta", http.StatusBadRequest)
+		return
+	}
+	initial, err := parseNumber(payload.Initial, 0)
+	if err != nil {
+		http.Error(w, "Invalid initial value", http.StatusBadRequest)
+		return
+	}
+	// Numbers take a few bytes; the quota mostly guards the key count here
+	if !allowWrite(w, r, map[string]int{key: 0}) {
+		return
+	}
+
+	// Atomic read-modify-write under the exclusive shard lock. Integer deltas
+	// go through a CRDT counter, which converges across peers, when the key
+	// holds one or does not exist yet; an initial value would be counted once
+	// by every node creating the counter, so it keeps the plain path. A
+	// counter that would overflow becomes a plain float, as in PHP.
+	var result interface{}
+	var encoded string
+	var stored CacheItem
+	var step *counterStep
+	storage.Update(key, func(tx *itemTx) bool {
+		now := time.Now().Unix()
+		item, ok := tx.Item()
+		live := ok && (item.Expiration == 0 || item.Expiration > now)
+		_, counted := tx.Counter()
+		d, isInt := delta.(int64)
+		if isInt && (sign > 0 || d != math.MinInt64) && ((live && counted) || (!live && initial == int64(0))) {
+			if s, ok := addCounterLocked(tx, sign*d, payload.TTL); ok {
+				step = &s
+				return true
+			}
+		}
+
+		var current interface{}
+		expiration := item.Expiration
+		if live {
+			if current, err = decodeNumber(item.Value); err != nil {
+				return false
+			}
+		} else {
+			current = initial
+			expiration = 0
+			if payload.TTL != nil && *payload.TTL > 0 {
+				expiration = now + int64(*payload.TTL)
+			}
+		}
+
+		result = addNumbers(current, delta, sign)
+		encoded, _ = php_serialize.Serialize(result)
+		tx.DropCounter()
+		stored = tx.Store([]byte(encoded), expiration, 0)
+		return true
+	})
+	if step != nil {
+		broadcastCounter(key, nodeID, step.epoch, step.pos, step.neg, step.mirror)
+		writeJSON(w, map[string]interface{}{"value": step.value})
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error": "Value is not numeric"}`, http.StatusUnprocessableEntity)
+		return
+	}
+
+	broadcastSet(key, stored.Value, stored.Expiration, stored.Version)
+
+	writeJSON(w, map[string]interface{}{"value": result})
+}
+
+// parseNumber converts a JSON number to int64 when possible, float64 otherwise.
+func parseNumber(n json.Number, def int64) (interface{}, error) {
+	if n == "" {
+		return def, nil
+	}
+	if i, err := n.Int64(); err == nil {
+		return i, nil
+	}
+	return n.Float64()
+}
+
+// decodeNumber reads a PHP-serialized int, float or numeric string.
+// Integral floats are treated as ints, since JSON values stored through
+// handleCache are always decoded as floats.
+func decodeNumber(raw []byte) (interface{}, error) {
+	decoder := php_serialize.NewUnSerializer(string(raw))
+	parsed, err := decoder.Decode()
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := parsed.(type) {
+	case int:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v), nil
+		}
+		return v, nil
+	case string:
+		if i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+			return i, nil
+		}
+		return strconv.ParseFloat(strings.TrimSpace(v), 64)
+	}
+	return nil, fmt.Errorf("value of type %T is not numeric", parsed)
+}
+
+// addNumbers returns current + sign*delta, staying in int64 unless either
+// side is a float or the result overflows, which PHP turns into a float too.
+func addNumbers(current, delta interface{}, sign int64) interface{} {
+	ci, cInt := current.(int64)
+	di, dInt := delta.(int64)
+	if cInt && dInt && (sign > 0 || di != math.MinInt64) {
+		if sum, ok := addInt64(ci, sign*di); ok {
+			return sum
+		}
+	}
+	return toFloat(current) + float64(sign)*toFloat(delta)
+}
+
+// addInt64 returns a + b and reports whether it fits in an int64.
+func addInt64(a, b int64) (int64, bool) {
+	sum := a + b
+	return sum, (a >= 0) != (b >= 0) || (sum >= 0) == (a >= 0)
+}
+
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
 func handleLock(w http.ResponseWriter, r *http.Request) {
-	key := "lock:" + strings.TrimPrefix(r.URL.Path, "/api/hypercacheio/lock/")
+	key := namespacedKey(requestNamespace(r), "lock:"+strings.TrimPrefix(r.URL.Path, "/api/hypercacheio/lock/"))
 
 	switch r.Method {
 	case "POST":
 		body, _ := io.ReadAll(r.Body)
 		var payload Payload
 		json.Unmarshal(body, &payload)
-
-		// Atomic Lock Acquisition
-		cacheMutex.Lock()
-		item, exists := cache[key]
-		if exists && (item.Expiration == 0 || item.Expiration > time.Now().Unix()) {
-			// Check if same owner
-			if string(item.Value) == payload.Owner {
-				// Extend TTL if needed? Laravel usually doesn't re-acquire to extend within the same request
-				cacheMutex.Unlock()
-				writeJSON(w, map[string]bool{"acquired": true})
-				return
-			}
-			cacheMutex.Unlock()
-			writeJSON(w, map[string]bool{"acquired": false})
+		if !allowWrite(w, r, map[string]int{key: len(payload.Owner)}) {
 			return
 		}
 
@@ -715,11 +1372,27 @@ func handleLock(w http.ResponseWriter, r *http.Request) {
 		if payload.TTL != nil && *payload.TTL > 0 {
 			expiration = time.Now().Unix() + int64(*payload.TTL)
 		}
-		cache[key] = CacheItem{Value: []byte(payload.Owner), Expiration: expiration}
-		cacheMutex.Unlock()
+
+		// Atomic Lock Acquisition
+		var lock CacheItem
+		held, acquired := false, false
+		storage.Update(key, func(tx *itemTx) bool {
+			if item, exists := tx.Live(); exists {
+				// Check if same owner
+				// Extend TTL if needed? Laravel usually doesn't re-acquire to extend within the same request
+				held, acquired = true, string(item.Value) == payload.Owner
+				return false
+			}
+			lock = tx.Store([]byte(payload.Owner), expiration, 0)
+			return true
+		})
+		if held {
+			writeJSON(w, map[string]bool{"acquired": acquired})
+			return
+		}
 
 		// Broadcast
-		broadcastSet(key, []byte(payload.Owner), expiration)
+		broadcastSet(key, lock.Value, expiration, lock.Version)
 		writeJSON(w, map[string]bool{"acquired": true})
 
 	case "DELETE":
@@ -727,16 +1400,19 @@ func handleLock(w http.ResponseWriter, r *http.Request) {
 		var payload Payload
 		json.Unmarshal(body, &payload)
 
-		cacheMutex.Lock()
-		item, exists := cache[key]
-		if exists && string(item.Value) == payload.Owner {
-			delete(cache, key)
-			cacheMutex.Unlock()
+		released := false
+		storage.Update(key, func(tx *itemTx) bool {
+			if item, exists := tx.Item(); exists && string(item.Value) == payload.Owner {
+				tx.Remove()
+				released = true
+			}
+			return released
+		})
+		if released {
 			broadcastDel(key)
 			writeJSON(w, map[string]bool{"released": true})
 			return
 		}
-		cacheMutex.Unlock()
 		writeJSON(w, map[string]bool{"released": false})
 	}
 }
@@ -760,72 +1436,39 @@ func handlePing(w http.ResponseWriter, r *http.Request) {
 	currentStats := stats
 	statsMutex.Unlock()
 
-	writeJSON(w, map[string]interface{}{
+	resp := map[string]interface{}{
 		"message":          "pong",
 		"role":             role,
 		"hostname":         hostName,
 		"time":             time.Now().Unix(),
 		"peers":            peerList,
-		"items_count":      len(cache),
+		"items_count":      storage.Len(),
+		"namespaces":       namespaceStats(),
 		"ha_mode":          haMode,
 		"replication_port": replPort,
+		"node_id":          nodeID,
+		"memory":           memoryStats(),
+		"storage":          storage.Stats(),
+		"compression":      compressionStats(),
+		"encryption":       encryptionStats(),
 		"stats":            currentStats,
-	})
-}
-
-func handleItems(w http.ResponseWriter, r *http.Request) {
-	cacheMutex.RLock()
-	defer cacheMutex.RUnlock()
-
-	type Item struct {
-		Key        string      `json:"key"`
-		Value      interface{} `json:"value"`
-		Expiration int64       `json:"expiration"`
-		IsLock     bool        `json:"is_lock"`
 	}
 
-	items := make([]Item, 0, len(cache))
-	now := time.Now().Unix()
-	
-	for k, v := range cache {
-		if v.Expiration > 0 && v.Expiration < now {
-			continue
-		}
-		
-		isLock := strings.HasPrefix(k, "lock:")
-
-		var parsedValue interface{}
-		if isLock {
-			parsedValue = string(v.Value)
-		} else {
-			decoder := php_serialize.NewUnSerializer(string(v.Value))
-			parsed, err := decoder.Decode()
-			if err == nil {
-				parsedValue = parsed
-			} else {
-				parsedValue = "[Binary Data]"
-			}
-		}
-
-		items = append(items, Item{
-			Key:        k,
-			Value:      parsedValue,
-			Expiration: v.Expiration,
-			IsLock:     isLock,
-		})
+	// Tenants only see their own usage, never other namespaces
+	if tenant := requestTenant(r); tenant != nil {
+		own := tenant.stats()
+		resp["items_count"] = own.Items
+		resp["tenant"] = own
+		delete(resp, "namespaces")
+	} else if len(tenantList) > 0 {
+		resp["tenants"] = tenantStats()
 	}
-
-	writeJSON(w, items)
+	writeJSON(w, resp)
 }
 
+// initSqlite upgrades the schema of db to the latest version.
 func initSqlite() error {
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS cache(
-			key TEXT PRIMARY KEY,
-			value BLOB NOT NULL,
-			expiration INTEGER
-		);
-	`)
+	_, err := migrate(db, false)
 	return err
 }
 
@@ -833,3 +1476,20 @@ func writeJSON(w http.ResponseWriter, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(data)
 }
+
+func writeJSONStatus(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func formatETag(version uint64) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// parseETag accepts both quoted and bare versions, as well as weak ETags.
+func parseETag(tag string) (uint64, bool) {
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+	version, err := strconv.ParseUint(strings.Trim(tag, `"`), 10, 64)
+	return version, err == nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------------------------------------------------
+// Memory Limit & Eviction
+// -------------------------------------------------------------
+//
+// Memory use is an estimate, not a measurement of the heap: every item
+// accounts for its key, its value as stored and a fixed overhead standing in
+// for the map entry, the key index node and its access metadata. Counters,
+// tags and the Go runtime are not counted, so the process uses more than
+// --max-memory. When the estimate exceeds --max-memory, the write evicts
+// other keys right after releasing its shard lock: a sample of candidates is
+// drawn across the shards and the worst one according to the policy goes,
+// as Redis does. Locks and keys without a TTL under volatile-ttl are not
+// candidates, but still count toward a bounded scan, so a keyspace without
+// candidates is never walked in full. LFU hit counts halve for every
+// lfuDecayPeriod a key goes unused, so keys that were hot long ago age out.
+//
+// Evictions are local by default; SQLite keeps the evicted items. With
+// --replicate-evictions they are deleted from SQLite and replicated as
+// deletes instead.
+
+const (
+	itemOverhead     = 96 // Estimated cost of a map entry, index node and access metadata
+	evictionSamples  = 16
+	evictionScan     = evictionSamples * 8 // Entries looked at per pick, candidates or not
+	lfuDecayPeriod   = time.Minute
+	policyLRU        = "lru"
+	policyLFU        = "lfu"
+	policyVolatile   = "volatile-ttl"
+	policyNoEviction = "noeviction"
+)
+
+var (
+	maxMemory          int64
+	evictionPolicy     = policyLRU
+	replicateEvictions bool
+
+	evictionMutex  sync.Mutex
+	evictionQueue  []removal // Guarded by evictionMutex
+	evictionSignal = make(chan struct{}, 1)
+)
+
+// accessMeta is updated with atomics so reads can record it under the read lock.
+type accessMeta struct {
+	lastAccess atomic.Int64
+	hits       atomic.Uint32
+}
+
+func (m *accessMeta) touch() {
+	now := time.Now().UnixNano()
+	if hits := m.frequency(now); hits < ^uint32(0) {
+		m.hits.Store(hits + 1)
+	}
+	m.lastAccess.Store(now)
+}
+
+// frequency returns the hit count halved for every lfuDecayPeriod since the
+// last access.
+func (m *accessMeta) frequency(now int64) uint32 {
+	idle := (now - m.lastAccess.Load()) / int64(lfuDecayPeriod)
+	if idle >= 32 {
+		return 0
+	}
+	return m.hits.Load() >> idle
+}
+
+// parseByteSize parses sizes such as "1048576", "512kb", "64mb" or "2g".
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		factor int64
+	}{{"gb", 1 << 30}, {"g", 1 << 30}, {"mb", 1 << 20}, {"m", 1 << 20}, {"kb", 1 << 10}, {"k", 1 << 10}, {"b", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, multiplier = strings.TrimSuffix(s, unit.suffix), unit.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+func validEvictionPolicy(policy string) bool {
+	switch policy {
+	case policyLRU, policyLFU, policyVolatile, policyNoEviction:
+		return true
+	}
+	return false
+}
+
+// recordAccessLocked marks key as used. Callers must hold the shard lock, a
+// read lock is enough. Access metadata is only kept with a memory limit.
+func (sh *shard) recordAccessLocked(key string) {
+	if meta, ok := sh.access[key]; ok {
+		meta.touch()
+	}
+}
+
+// trackAccessLocked starts or stops tracking key. Callers must hold the shard lock.
+func (sh *shard) trackAccessLocked(key string, live bool) {
+	if !live {
+		delete(sh.access, key)
+		return
+	}
+	if maxMemory <= 0 {
+		return
+	}
+	meta, ok := sh.access[key]
+	if !ok {
+		meta = &accessMeta{}
+		sh.access[key] = meta
+	}
+	meta.touch()
+}
+
+// evict removes keys other than keep until the memory limit is met or
+// nothing evictable is left. Callers must not hold any shard lock.
+func (s *shardedStore) evict(keep string) {
+	if maxMemory <= 0 || evictionPolicy == policyNoEviction {
+		return
+	}
+	evicted, freed := 0, int64(0)
+	removals := make([]removal, 0)
+	for s.Memory() > maxMemory {
+		sh, victim, ok := s.pickVictim(keep)
+		if !ok {
+			break
+		}
+		sh.mu.Lock()
+		if item, exists := sh.items[victim]; exists && !s.isPinned(victim) {
+			freed += int64(itemSize(victim, item) + itemOverhead)
+			removals = append(removals, sh.removeLocked(victim))
+			evicted++
+		}
+		sh.mu.Unlock()
+	}
+	if evicted == 0 {
+		return
+	}
+
+	statsMutex.Lock()
+	stats.Evictions += uint64(evicted)
+	stats.EvictedBytes += uint64(freed)
+	statsMutex.Unlock()
+
+	if replicateEvictions {
+		evictionMutex.Lock()
+		evictionQueue = append(evictionQueue, removals...)
+		evictionMutex.Unlock()
+		select {
+		case evictionSignal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// pickVictim samples keys across the shards, starting at a random one, and
+// returns the best eviction candidate for the configured policy. It looks at
+// no more than evictionScan entries, whether they are candidates or not.
+func (s *shardedStore) pickVictim(keep string) (*shard, string, bool) {
+	var victimShard *shard
+	victim, found := "", false
+	var best CacheItem
+	var bestMeta *accessMeta
+	sampled, scanned := 0, 0
+
+	start := rand.Intn(len(s.shards))
+	for i := 0; i < len(s.shards) && sampled < evictionSamples && scanned < evictionScan; i++ {
+		sh := s.shards[(start+i)%len(s.shards)]
+		sh.mu.RLock()
+		for key, item := range sh.items {
+			if sampled == evictionSamples || scanned == evictionScan {
+				break
+			}
+			scanned++
+			if key == keep {
+				continue
+			}
+			if _, isLock := lockName(key); isLock {
+				continue
+			}
+			if evictionPolicy == policyVolatile && item.Expiration == 0 {
+				continue
+			}
+			if s.isPinned(key) {
+				continue
+			}
+			sampled++
+
+			meta := sh.access[key]
+			if !found || worseCandidate(item, meta, best, bestMeta) {
+				victimShard, victim, best, bestMeta, found = sh, key, item, meta, true
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return victimShard, victim, found
+}
+
+func (s *shardedStore) isPinned(key string) bool {
+	return s.pinned != nil && s.pinned(key)
+}
+
+// worseCandidate reports whether a should be evicted before b.
+func worseCandidate(a CacheItem, am *accessMeta, b CacheItem, bm *accessMeta) bool {
+	if evictionPolicy == policyVolatile {
+		return a.Expiration < b.Expiration
+	}
+	if am == nil || bm == nil {
+		return am == nil && bm != nil // Untracked items were never read
+	}
+	if evictionPolicy == policyLFU {
+		now := time.Now().UnixNano()
+		if af, bf := am.frequency(now), bm.frequency(now); af != bf {
+			return af < bf
+		}
+	}
+	return am.lastAccess.Load() < bm.lastAccess.Load()
+}
+
+func (s *shardedStore) HotKeys(n int) []string {
+	type used struct {
+		key  string
+		last int64
+	}
+	all := make([]used, 0)
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for key, meta := range sh.access {
+			if _, isLock := lockName(key); !isLock {
+				all = append(all, used{key: key, last: meta.lastAccess.Load()})
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].last > all[j].last })
+	if len(all) > n {
+		all = all[:n]
+	}
+	keys := make([]string, len(all))
+	for i, u := range all {
+		keys[i] = u.key
+	}
+	return keys
+}
+
+// memoryFull reports whether a write growing the cache by grow bytes has to
+// be rejected: always once the limit is exceeded, and before it would be
+// exceeded under noeviction.
+func memoryFull(grow int64) bool {
+	if maxMemory <= 0 {
+		return false
+	}
+	used := storage.Memory()
+	if used > maxMemory {
+		return true
+	}
+	return evictionPolicy == policyNoEviction && grow > 0 && used+grow > maxMemory
+}
+
+// startEvictionReplicator deletes evicted items from disk and replicates
+// them as deletes, outside of any shard lock.
+func startEvictionReplicator() {
+	go func() {
+		for range evictionSignal {
+			drainEvictions()
+		}
+	}()
+}
+
+func drainEvictions() {
+	evictionMutex.Lock()
+	queued := evictionQueue
+	evictionQueue = nil
+	evictionMutex.Unlock()
+
+	if len(queued) == 0 {
+		return
+	}
+	storage.Discard(queued)
+	for _, r := range queued {
+		broadcastDel(r.key)
+	}
+	log.Printf("Replicated %d evictions", len(queued))
+}
+
+type MemoryStats struct {
+	Used   int64  `json:"used"`
+	Max    int64  `json:"max"`
+	Policy string `json:"policy"`
+}
+
+func memoryStats() MemoryStats {
+	return MemoryStats{Used: storage.Memory(), Max: maxMemory, Policy: evictionPolicy}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func setupMemoryLimit(t *testing.T, policy string, items int) {
+	maxMemory = int64(items * (1 + len("i:1;") + itemOverhead))
+	evictionPolicy = policy
+	t.Cleanup(func() {
+		maxMemory = 0
+		evictionPolicy = policyLRU
+		replicateEvictions = false
+	})
+}
+
+func TestParseByteSize(t *testing.T) {
+	cases := map[string]int64{"1024": 1024, "512kb": 512 << 10, "64MB": 64 << 20, "2g": 2 << 30, "100b": 100}
+	for input, want := range cases {
+		if got, err := parseByteSize(input); err != nil || got != want {
+			t.Errorf("parseByteSize(%q) = %d, %v; want %d", input, got, err, want)
+		}
+	}
+	if _, err := parseByteSize("lots"); err == nil {
+		t.Errorf("Expected an error for an invalid size")
+	}
+}
+
+func TestEvictionLRU(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	setupMemoryLimit(t, policyLRU, 3)
+
+	for _, key := range []string{"a", "b", "c"} {
+		setLocal(key, []byte("i:1;"), 0, false)
+		time.Sleep(time.Millisecond)
+	}
+	getLocal("a")
+	time.Sleep(time.Millisecond)
+	setLocal("d", []byte("i:1;"), 0, false)
+
+	if _, ok := getLocal("b"); ok {
+		t.Errorf("Expected the least recently used key to be evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, ok := getLocal(key); !ok {
+			t.Errorf("Expected %s to survive eviction", key)
+		}
+	}
+	if used := memoryStats().Used; used > maxMemory {
+		t.Errorf("Memory in use %d exceeds the limit %d", used, maxMemory)
+	}
+	if stats.Evictions == 0 || len(evictionQueue) != 0 {
+		t.Errorf("Expected a counted, local-only eviction")
+	}
+}
+
+func TestEvictionLFUAndVolatileTTL(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	setupMemoryLimit(t, policyLFU, 3)
+
+	for _, key := range []string{"a", "b", "c"} {
+		setLocal(key, []byte("i:1;"), 0, false)
+	}
+	for i := 0; i < 5; i++ {
+		getLocal("a")
+		getLocal("c")
+	}
+	setLocal("d", []byte("i:1;"), 0, false)
+	if _, ok := getLocal("b"); ok {
+		t.Errorf("Expected the least frequently used key to be evicted")
+	}
+
+	flushLocal(false)
+	evictionPolicy = policyVolatile
+	now := time.Now().Unix()
+	setLocal("p", []byte("i:1;"), 0, false)
+	setLocal("l", []byte("i:1;"), now+100, false)
+	setLocal("s", []byte("i:1;"), now+50, false)
+	setLocal("n", []byte("i:1;"), now+200, false)
+	if _, ok := getLocal("s"); ok {
+		t.Errorf("Expected the key closest to expiry to be evicted")
+	}
+	if _, ok := getLocal("p"); !ok {
+		t.Errorf("Expected permanent keys to survive volatile-ttl eviction")
+	}
+}
+
+func TestLFUHitsDecay(t *testing.T) {
+	var hot, recent accessMeta
+	for i := 0; i < 100; i++ {
+		hot.touch()
+	}
+	recent.touch()
+	recent.touch()
+
+	// An hour without a read halves the hits sixty times
+	hot.lastAccess.Add(-int64(time.Hour))
+	if worseCandidate(CacheItem{}, &recent, CacheItem{}, &hot) {
+		t.Errorf("Expected a key hot an hour ago to be evicted before a recently used one")
+	}
+	if f := hot.frequency(time.Now().UnixNano()); f != 0 {
+		t.Errorf("Expected the old hits to have decayed, got %d", f)
+	}
+}
+
+func TestEvictionScanIsBounded(t *testing.T) {
+	setupMemoryLimit(t, policyLRU, 1)
+	keys := newShardedStore(4)
+	for i := 0; i < evictionScan*4; i++ {
+		keys.Update(fmt.Sprintf("pinned:%d", i), func(tx *itemTx) {
+			tx.Store([]byte("i:1;"), 0, 0)
+		})
+	}
+
+	// Keys that are no candidates still use up the scan
+	looked := 0
+	keys.pinned = func(string) bool {
+		looked++
+		return true
+	}
+	if _, _, found := keys.pickVictim(""); found || looked > evictionScan {
+		t.Errorf("Expected at most %d keys looked at and none picked, looked at %d", evictionScan, looked)
+	}
+}
+
+func TestEvictionSkipsLocksAndReplicatesWhenConfigured(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	setupMemoryLimit(t, policyLRU, 2)
+	replicateEvictions = true
+
+	setLocal("lock:job", []byte("ownr"), 0, false)
+	setLocal("a", []byte("i:1;"), 0, false)
+	setLocal("b", []byte("i:1;"), 0, false)
+
+	if _, ok := getLocal("lock:job"); !ok {
+		t.Errorf("Expected locks never to be evicted")
+	}
+	if len(evictionQueue) != 1 || evictionQueue[0].key != "a" {
+		t.Errorf("Expected the eviction of a to be queued for replication, got %v", evictionQueue)
+	}
+	drainEvictions()
+	if len(evictionQueue) != 0 {
+		t.Errorf("Expected the eviction queue to be drained")
+	}
+}
+
+func TestNoEvictionRejectsWrites(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	setupMemoryLimit(t, policyNoEviction, 1)
+
+	setLocal("a", []byte("i:1;"), 0, false)
+	req, _ := http.NewRequest("POST", "/api/hypercacheio/cache/b", bytes.NewBufferString(`{"value": 1}`))
+	rr := httptest.NewRecorder()
+	handleCache(rr, req)
+	if rr.Code != http.StatusInsufficientStorage {
+		t.Errorf("Expected 507 under noeviction, got %v", rr.Code)
+	}
+	if _, ok := getLocal("a"); !ok {
+		t.Errorf("Expected noeviction to keep existing keys")
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// -------------------------------------------------------------
+// Schema Migrations
+// -------------------------------------------------------------
+//
+// The SQLite file is shared with the PHP store, which creates the cache and
+// cache_locks tables on its own, and with older servers that created the rest
+// without recording what they did. Every migration is therefore written to
+// be safe on a file that already has some of its changes. The version of the
+// file is the highest entry in schema_version; a file without the table is at
+// version 0. Pending migrations run in a single transaction, so a failure
+// leaves the file exactly as it was.
+
+var migrateDryRun bool
+
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{1, "create cache and cache_locks", execMigration(`
+		CREATE TABLE IF NOT EXISTS cache(
+			key TEXT PRIMARY KEY,
+			value BLOB NOT NULL,
+			expiration INTEGER
+		);
+		CREATE TABLE IF NOT EXISTS cache_locks(
+			key TEXT PRIMARY KEY,
+			owner TEXT NOT NULL,
+			expiration INTEGER
+		);
+	`)},
+	{2, "add cache.version", addColumn("cache", "version", "INTEGER NOT NULL DEFAULT 0")},
+	{3, "create cache_counters", execMigration(`
+		CREATE TABLE IF NOT EXISTS cache_counters(
+			key TEXT NOT NULL,
+			node TEXT NOT NULL,
+			pos INTEGER NOT NULL DEFAULT 0,
+			neg INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY(key, node)
+		);
+	`)},
+	{4, "create cache_tags", execMigration(`
+		CREATE TABLE IF NOT EXISTS cache_tags(
+			tag TEXT NOT NULL,
+			key TEXT NOT NULL,
+			PRIMARY KEY(tag, key)
+		);
+		CREATE INDEX IF NOT EXISTS cache_tags_key ON cache_tags(key);
+	`)},
+	{5, "index cache.expiration", execMigration(`
+		CREATE INDEX IF NOT EXISTS cache_expiration ON cache(expiration);
+	`)},
+	{6, "create cache_hot", execMigration(`
+		CREATE TABLE IF NOT EXISTS cache_hot(
+			key TEXT PRIMARY KEY,
+			rank INTEGER NOT NULL
+		);
+	`)},
+	{7, "add cache_counters.epoch", addColumn("cache_counters", "epoch", "INTEGER NOT NULL DEFAULT 0")},
+}
+
+func execMigration(statements string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(statements)
+		return err
+	}
+}
+
+// addColumn adds a column unless the file already has it.
+func addColumn(table, column, definition string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		exists, err := hasColumn(tx, table, column)
+		if err != nil || exists {
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+		return err
+	}
+}
+
+func hasColumn(tx *sql.Tx, table, column string) (bool, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// schemaVersion returns the version recorded in the file.
+func schemaVersion(tx *sql.Tx) (int, error) {
+	var version int
+	err := tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+// migrate brings the schema of conn up to date and returns the migrations it
+// applied. With dryRun set they are run and rolled back, which reports what
+// an upgrade would do and proves it would succeed. A file written by a newer
+// server is refused rather than guessed at.
+func migrate(conn *sql.DB, dryRun bool) ([]migration, error) {
+	tx, err := conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_version(
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at INTEGER NOT NULL
+	)`); err != nil {
+		return nil, err
+	}
+	current, err := schemaVersion(tx)
+	if err != nil {
+		return nil, err
+	}
+	if latest := latestSchemaVersion(); current > latest {
+		return nil, fmt.Errorf("schema version %d is newer than the latest version %d this server knows, upgrade the server", current, latest)
+	}
+
+	applied := make([]migration, 0)
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := m.up(tx); err != nil {
+			return nil, fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		if _, err := tx.Exec("INSERT INTO schema_version(version, name, applied_at) VALUES(?, ?, ?)", m.version, m.name, time.Now().Unix()); err != nil {
+			return nil, err
+		}
+		applied = append(applied, m)
+	}
+	if dryRun {
+		return applied, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	for _, m := range applied {
+		log.Printf("Applied SQLite migration %d: %s", m.version, m.name)
+	}
+	return applied, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func openMigrationDB(t *testing.T) *sql.DB {
+	conn, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	conn.SetMaxOpenConns(1) // Every connection to :memory: is a database of its own
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func recordedVersion(conn *sql.DB) int {
+	var version int
+	conn.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version
+}
+
+func TestMigrateUpgradesPhpFileInPlace(t *testing.T) {
+	conn := openMigrationDB(t)
+	// The schema created by the PHP InteractsWithSqlite trait
+	conn.Exec(`
+		CREATE TABLE cache(key TEXT PRIMARY KEY, value BLOB NOT NULL, expiration INTEGER);
+		CREATE TABLE cache_locks(key TEXT PRIMARY KEY, owner TEXT NOT NULL, expiration INTEGER);
+	`)
+	conn.Exec("INSERT INTO cache(key, value, expiration) VALUES('kept', 'i:1;', NULL)")
+
+	applied, err := migrate(conn, false)
+	if err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+	if len(applied) != len(migrations) || recordedVersion(conn) != latestSchemaVersion() {
+		t.Errorf("Expected every migration to be recorded, applied %d, version %d", len(applied), recordedVersion(conn))
+	}
+	var version int
+	if err := conn.QueryRow("SELECT version FROM cache WHERE key = 'kept'").Scan(&version); err != nil || version != 0 {
+		t.Errorf("Expected the existing row to keep its data with version 0, got %d, %v", version, err)
+	}
+
+	// Running again is a no-op
+	if applied, err := migrate(conn, false); err != nil || len(applied) != 0 {
+		t.Errorf("Expected nothing left to migrate, got %d, %v", len(applied), err)
+	}
+}
+
+func TestMigrateUpgradesUnversionedGoFile(t *testing.T) {
+	conn := openMigrationDB(t)
+	// A server from before migrations created every table without recording it
+	conn.Exec(`
+		CREATE TABLE cache(key TEXT PRIMARY KEY, value BLOB NOT NULL, expiration INTEGER, version INTEGER NOT NULL DEFAULT 0);
+		CREATE TABLE cache_locks(key TEXT PRIMARY KEY, owner TEXT NOT NULL, expiration INTEGER);
+		CREATE TABLE cache_counters(key TEXT NOT NULL, node TEXT NOT NULL, pos INTEGER NOT NULL DEFAULT 0, neg INTEGER NOT NULL DEFAULT 0, PRIMARY KEY(key, node));
+	`)
+	if _, err := migrate(conn, false); err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+	if recordedVersion(conn) != latestSchemaVersion() {
+		t.Errorf("Expected version %d, got %d", latestSchemaVersion(), recordedVersion(conn))
+	}
+}
+
+func TestMigrateDryRunLeavesFileUntouched(t *testing.T) {
+	conn := openMigrationDB(t)
+	pending, err := migrate(conn, true)
+	if err != nil || len(pending) != len(migrations) {
+		t.Fatalf("Expected every migration to be pending, got %d, %v", len(pending), err)
+	}
+	var tables int
+	conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'").Scan(&tables)
+	if tables != 0 {
+		t.Errorf("Expected a dry run to create nothing, found %d tables", tables)
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	conn := openMigrationDB(t)
+	if _, err := migrate(conn, false); err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+	conn.Exec("INSERT INTO schema_version(version, name, applied_at) VALUES(?, 'from the future', 0)", latestSchemaVersion()+1)
+	if _, err := migrate(conn, false); err == nil {
+		t.Errorf("Expected a newer schema to be refused")
+	}
+}
+
+func TestMigrateRollsBackOnFailure(t *testing.T) {
+	defer func(saved []migration) { migrations = saved }(migrations)
+	migrations = append(migrations[:len(migrations):len(migrations)], migration{
+		version: latestSchemaVersion() + 1,
+		name:    "broken",
+		up:      func(tx *sql.Tx) error { return errors.New("boom") },
+	})
+
+	conn := openMigrationDB(t)
+	if _, err := migrate(conn, false); err == nil {
+		t.Fatalf("Expected the broken migration to fail")
+	}
+	var tables int
+	conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'").Scan(&tables)
+	if tables != 0 {
+		t.Errorf("Expected the earlier migrations to be rolled back too, found %d tables", tables)
+	}
+}
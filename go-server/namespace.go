@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// -------------------------------------------------------------
+// Namespaces
+// -------------------------------------------------------------
+//
+// A namespace is part of the internal key ("\x1f<ns>\x1f<key>"), so SQLite
+// rows, replication frames, counters and tags carry it without any changes
+// of their own. Keys of the default (empty) namespace are stored unchanged,
+// which keeps data written before namespaces existed, and rows the PHP store
+// reads, usable. Requests use the default namespace unless a tenant token,
+// the namespace header or --namespace says otherwise. The PHP store sends
+// its cache prefix in the namespace header, so apps sharing a server stay
+// apart; --prefix is only accepted so older service files keep starting.
+
+const (
+	namespaceHeader = "X-Hypercacheio-Namespace"
+	namespaceSep    = "\x1f"
+)
+
+// defaultNamespace is the namespace of requests that name none, empty
+// unless --namespace is given.
+var defaultNamespace string
+
+// Every shard tracks items and bytes per namespace for /ping and tenant
+// quotas, guarded by the shard lock.
+type usage struct {
+	Items int   `json:"items"`
+	Bytes int64 `json:"bytes"`
+}
+
+// itemSize is the number of bytes an item accounts for: its key and value.
+func itemSize(key string, item CacheItem) int {
+	return len(key) + len(item.Value)
+}
+
+// accountLocked adjusts the usage of the namespace of key and the memory in
+// use. Callers must hold the shard lock.
+func (sh *shard) accountLocked(key string, items, bytes int) {
+	ns, _ := splitKey(key)
+	u, ok := sh.usage[ns]
+	if !ok {
+		u = &usage{}
+		sh.usage[ns] = u
+	}
+	u.Items += items
+	u.Bytes += int64(bytes)
+	sh.memory.Add(int64(bytes + items*itemOverhead))
+	if u.Items <= 0 {
+		delete(sh.usage, ns)
+	}
+}
+
+// usageOf returns the usage of ns.
+func usageOf(ns string) usage {
+	return storage.Usage(ns)
+}
+
+// requestNamespace returns the namespace of a request: the namespace of its
+// tenant, then the namespace header when present, otherwise --namespace.
+func requestNamespace(r *http.Request) string {
+	if tenant := requestTenant(r); tenant != nil {
+		return tenant.namespace()
+	}
+	if values, ok := r.Header[http.CanonicalHeaderKey(namespaceHeader)]; ok && len(values) > 0 {
+		return strings.ReplaceAll(values[0], namespaceSep, "")
+	}
+	return defaultNamespace
+}
+
+// namespacedKey returns the internal key of key in ns. An empty key stays
+// empty so handlers can keep checking for a missing key.
+func namespacedKey(ns, key string) string {
+	if ns == "" || key == "" {
+		return key
+	}
+	return namespaceSep + ns + namespaceSep + key
+}
+
+// splitKey returns the namespace and the client-facing key of an internal key.
+func splitKey(key string) (string, string) {
+	if !strings.HasPrefix(key, namespaceSep) {
+		return "", key
+	}
+	end := strings.Index(key[1:], namespaceSep)
+	if end < 0 {
+		return "", key
+	}
+	return key[1 : end+1], key[end+2:]
+}
+
+// namespaceScanPrefix bounds an index scan for user keys starting with prefix.
+// The default namespace cannot be bounded, as its keys carry no marker.
+func namespaceScanPrefix(ns, prefix string) string {
+	if ns == "" {
+		return prefix
+	}
+	return namespaceSep + ns + namespaceSep + prefix
+}
+
+// flushNamespaceLocal removes every key of ns and replicates the flush.
+func flushNamespaceLocal(ns string, broadcast bool) int {
+	removed, _ := deleteMatchingLocal(matchPrefix, ns, "", broadcast)
+	return removed
+}
+
+// namespaceStats returns a copy of the per-namespace item counts.
+func namespaceStats() map[string]int {
+	totals := storage.NamespaceUsage()
+	counts := make(map[string]int, len(totals))
+	for ns, u := range totals {
+		counts[ns] = u.Items
+	}
+	return counts
+}
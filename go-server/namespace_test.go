@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func nsRequest(t *testing.T, handler http.HandlerFunc, method, path, ns, body string) map[string]interface{} {
+	req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+	if ns != "" {
+		req.Header.Set(namespaceHeader, ns)
+	}
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("%s %s returned wrong status code: got %v want %v", method, path, rr.Code, http.StatusOK)
+	}
+	var resp map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	return resp
+}
+
+func TestNamespaceIsolationAndFlush(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	nsRequest(t, handleCache, "POST", "/api/hypercacheio/cache/user", "app1", `{"value": "one"}`)
+	nsRequest(t, handleCache, "POST", "/api/hypercacheio/cache/user", "app2", `{"value": "two"}`)
+	nsRequest(t, handleCache, "POST", "/api/hypercacheio/cache/user", "", `{"value": "default"}`)
+
+	for ns, want := range map[string]string{"app1": "one", "app2": "two", "": "default"} {
+		resp := nsRequest(t, handleCache, "GET", "/api/hypercacheio/cache/user", ns, "")
+		if resp["data"] != want {
+			t.Errorf("Namespace %q returned %v, want %v", ns, resp["data"], want)
+		}
+	}
+
+	counts := namespaceStats()
+	if counts["app1"] != 1 || counts["app2"] != 1 || counts[""] != 1 {
+		t.Errorf("Unexpected namespace counts: %v", counts)
+	}
+
+	// Flushing app1 must leave the other namespaces alone
+	nsRequest(t, handleCache, "DELETE", "/api/hypercacheio/cache/", "app1", "")
+	if resp := nsRequest(t, handleCache, "GET", "/api/hypercacheio/cache/user", "app1", ""); resp["data"] != nil {
+		t.Errorf("Expected app1 to be flushed, got %v", resp["data"])
+	}
+	if resp := nsRequest(t, handleCache, "GET", "/api/hypercacheio/cache/user", "app2", ""); resp["data"] != "two" {
+		t.Errorf("Expected app2 to survive the flush, got %v", resp["data"])
+	}
+	if resp := nsRequest(t, handleCache, "GET", "/api/hypercacheio/cache/user", "", ""); resp["data"] != "default" {
+		t.Errorf("Expected the default namespace to survive the flush, got %v", resp["data"])
+	}
+	if _, ok := namespaceStats()["app1"]; ok {
+		t.Errorf("Expected app1 to disappear from the namespace counts")
+	}
+}
+
+func TestCachePrefixKeepsKeysReadable(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	// Rows written before namespaces existed, or by the PHP store
+	db.Exec("INSERT INTO cache(key, value, expiration) VALUES(?, ?, NULL)", "greeting", "s:2:\"hi\";")
+	db.Exec("INSERT INTO cache_locks(key, owner, expiration) VALUES(?, ?, NULL)", "jobs", "a")
+	restartStorage(t)
+
+	if resp := nsRequest(t, handleCache, "GET", "/api/hypercacheio/cache/greeting", "", ""); resp["data"] != "hi" {
+		t.Errorf("Expected an existing row to stay readable with a cache prefix, got %v", resp["data"])
+	}
+	if resp := nsRequest(t, handleLock, "POST", "/api/hypercacheio/lock/jobs", "", `{"owner": "b", "ttl": 60}`); resp["acquired"] != false {
+		t.Errorf("Expected an existing lock to stay held, got %v", resp["acquired"])
+	}
+	nsRequest(t, handleCache, "POST", "/api/hypercacheio/cache/fresh", "", `{"value": 1}`)
+	if n := countRows("SELECT COUNT(*) FROM cache WHERE key = ?", "fresh"); n != 1 {
+		t.Errorf("Expected a new row under the plain key the PHP store reads")
+	}
+	nsRequest(t, handleCache, "DELETE", "/api/hypercacheio/cache/", "", "")
+	if n := countRows("SELECT COUNT(*) FROM cache"); n != 0 {
+		t.Errorf("Expected a flush to remove the existing rows, %d left", n)
+	}
+}
+
+func TestNamespaceFlag(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	defaultNamespace = "app1"
+	defer func() { defaultNamespace = "" }()
+
+	nsRequest(t, handleCache, "POST", "/api/hypercacheio/cache/greeting", "", `{"value": "hi"}`)
+	if _, ok := getLocal(namespacedKey("app1", "greeting")); !ok {
+		t.Errorf("Expected the key to be stored in the --namespace namespace")
+	}
+	if resp := nsRequest(t, handleCache, "GET", "/api/hypercacheio/cache/greeting", "other", ""); resp["data"] != nil {
+		t.Errorf("Expected the header namespace to override --namespace, got %v", resp["data"])
+	}
+}
+
+func TestNamespaceLocksPersistAndTagsIsolate(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	nsRequest(t, handleLock, "POST", "/api/hypercacheio/lock/jobs", "app1", `{"owner": "a", "ttl": 60}`)
+	if resp := nsRequest(t, handleLock, "POST", "/api/hypercacheio/lock/jobs", "app2", `{"owner": "b", "ttl": 60}`); resp["acquired"] != true {
+		t.Errorf("Expected locks of different namespaces not to conflict")
+	}
+
+	flushLocal(false)
+	db.Exec("REPLACE INTO cache_locks(key, owner) VALUES(?, ?)", namespacedKey("app1", "jobs"), "a")
+	restartStorage(t)
+	items, _ := listItemsIn(t, "app1", "locks=1")
+	if len(items) != 1 || items[0]["key"] != "lock:jobs" || items[0]["value"] != "a" {
+		t.Errorf("Expected the app1 lock to be restored, got %v", items)
+	}
+
+	nsRequest(t, handleCache, "POST", "/api/hypercacheio/cache/post", "app1", `{"value": 1, "tags": ["posts"]}`)
+	nsRequest(t, handleCache, "POST", "/api/hypercacheio/cache/post", "app2", `{"value": 2, "tags": ["posts"]}`)
+	nsRequest(t, handleTags, "DELETE", "/api/hypercacheio/tags/posts", "app1", "")
+	if resp := nsRequest(t, handleCache, "GET", "/api/hypercacheio/cache/post", "app2", ""); resp["data"] != float64(2) {
+		t.Errorf("Expected the app2 tag to survive an app1 tag flush, got %v", resp["data"])
+	}
+}
+
+func TestDelMatchFrameCarriesNamespace(t *testing.T) {
+	var buf bytes.Buffer
+	writeDelMatchFrame(&buf, matchPattern, "app1", "user:*")
+	reader := bufio.NewReader(&buf)
+	if op, _ := reader.ReadByte(); op != OpDelMatch {
+		t.Fatalf("Expected OpDelMatch, got %d", op)
+	}
+	kind, ns, expr, err := readDelMatchFrame(reader)
+	if err != nil || kind != matchPattern || ns != "app1" || expr != "user:*" {
+		t.Errorf("Unexpected frame: %d %q %q %v", kind, ns, expr, err)
+	}
+}
+
+func listItemsIn(t *testing.T, ns, query string) ([]map[string]interface{}, string) {
+	req, _ := http.NewRequest("GET", "/api/hypercacheio/items?"+query, nil)
+	req.Header.Set(namespaceHeader, ns)
+	rr := httptest.NewRecorder()
+	handleItems(rr, req)
+	var items []map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &items)
+	return items, rr.Header().Get("X-Hypercacheio-Next-Cursor")
+}
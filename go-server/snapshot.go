@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// -------------------------------------------------------------
+// Snapshots
+// -------------------------------------------------------------
+//
+// A snapshot is a point-in-time copy of the whole store: items, locks,
+// counter slots and tags, taken with every shard read-locked and written out
+// after the locks are released. The file is written next to its final name
+// and renamed into place, so a snapshot on disk is always complete. Layout:
+//
+//	magic "HCIOSNAP" | format u16 | created i64 | frames | keys u64 | crc32c u32
+//
+// The frames are replication frames, sealed as in the append-only log. The
+// CRC-32C covers everything before it and is verified before a restore
+// touches the store.
+
+const (
+	snapshotMagic  = "HCIOSNAP"
+	snapshotFormat = 1
+	snapshotHeader = len(snapshotMagic) + 2 + 8
+	snapshotFooter = 8 + 4
+)
+
+var (
+	snapshotDir      string
+	snapshotInterval time.Duration
+	snapshotRetain   = 5
+	restoreFrom      string
+
+	// snapshotMutex keeps snapshots from running concurrently
+	snapshotMutex sync.Mutex
+
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type SnapshotInfo struct {
+	Path     string `json:"path"`
+	Created  int64  `json:"created"`
+	Keys     uint64 `json:"keys"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+// frozenKey is a key copied out of a frozen keyspace.
+type frozenKey struct {
+	state keyState
+	tags  []string
+}
+
+// writeSnapshot writes a snapshot of storage to dir and prunes old ones.
+func writeSnapshot(dir string) (SnapshotInfo, error) {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+
+	// Values and tag slices are replaced rather than modified in place, so
+	// the copies can be written out after the locks are gone
+	keys := make([]frozenKey, 0, storage.Len())
+	created := time.Now()
+	storage.Freeze(func(tx *itemTx) bool {
+		if _, live := tx.Live(); live {
+			keys = append(keys, frozenKey{state: snapshot(tx), tags: tx.Tags()})
+		}
+		return true
+	})
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return SnapshotInfo{}, err
+	}
+	path := filepath.Join(dir, "hypercacheio-"+created.UTC().Format("20060102T150405.000000000Z")+".snap")
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	defer os.Remove(tmpPath) // A no-op once renamed
+
+	sum := crc32.New(castagnoli)
+	buffered := bufio.NewWriter(io.MultiWriter(file, sum))
+	out := &countingWriter{w: buffered}
+
+	header := make([]byte, snapshotHeader)
+	copy(header, snapshotMagic)
+	binary.BigEndian.PutUint16(header[8:10], snapshotFormat)
+	binary.BigEndian.PutUint64(header[10:18], uint64(created.Unix()))
+	out.Write(header)
+	for _, k := range keys {
+		writeStateFrames(out, k.state)
+		if len(k.tags) > 0 {
+			writeTagsFrame(out, diskKey(k.state.key), k.tags)
+		}
+	}
+	count := make([]byte, 8)
+	binary.BigEndian.PutUint64(count, uint64(len(keys)))
+	out.Write(count)
+	if out.err == nil {
+		out.err = buffered.Flush()
+	}
+	checksum := sum.Sum(nil)
+	if out.err == nil {
+		_, out.err = file.Write(checksum)
+	}
+	if out.err == nil {
+		out.err = file.Sync()
+	}
+	if err := file.Close(); out.err == nil {
+		out.err = err
+	}
+	if out.err == nil {
+		out.err = os.Rename(tmpPath, path)
+	}
+	if out.err != nil {
+		return SnapshotInfo{}, out.err
+	}
+	syncDir(dir)
+
+	info := SnapshotInfo{
+		Path:     path,
+		Created:  created.Unix(),
+		Keys:     uint64(len(keys)),
+		Size:     out.n + int64(len(checksum)),
+		Checksum: hex.EncodeToString(checksum),
+	}
+	pruneSnapshots(dir, snapshotRetain)
+	return info, nil
+}
+
+// snapshotFiles returns the snapshots in dir, oldest first.
+func snapshotFiles(dir string) []string {
+	paths, _ := filepath.Glob(filepath.Join(dir, "hypercacheio-*.snap"))
+	sort.Strings(paths)
+	return paths
+}
+
+// pruneSnapshots removes all but the newest retain snapshots, 0 keeping all.
+func pruneSnapshots(dir string, retain int) {
+	if retain <= 0 {
+		return
+	}
+	paths := snapshotFiles(dir)
+	for len(paths) > retain {
+		if err := os.Remove(paths[0]); err != nil {
+			log.Printf("Failed to remove old snapshot %s: %v", paths[0], err)
+		}
+		paths = paths[1:]
+	}
+}
+
+// readSnapshotInfo describes the snapshot in file from its header and
+// footer alone, without verifying the checksum.
+func readSnapshotInfo(file *os.File) (SnapshotInfo, error) {
+	info := SnapshotInfo{Path: file.Name()}
+	stat, err := file.Stat()
+	if err != nil {
+		return info, err
+	}
+	info.Size = stat.Size()
+	if info.Size < int64(snapshotHeader+snapshotFooter) {
+		return info, fmt.Errorf("too short")
+	}
+
+	header := make([]byte, snapshotHeader)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return info, err
+	}
+	if string(header[:8]) != snapshotMagic {
+		return info, fmt.Errorf("not a snapshot")
+	}
+	if format := binary.BigEndian.Uint16(header[8:10]); format != snapshotFormat {
+		return info, fmt.Errorf("unsupported format %d", format)
+	}
+	info.Created = int64(binary.BigEndian.Uint64(header[10:18]))
+
+	footer := make([]byte, snapshotFooter)
+	if _, err := file.ReadAt(footer, info.Size-int64(snapshotFooter)); err != nil {
+		return info, err
+	}
+	info.Keys = binary.BigEndian.Uint64(footer[:8])
+	info.Checksum = hex.EncodeToString(footer[8:])
+	return info, nil
+}
+
+// openSnapshot checks the header and checksum of a snapshot and returns its
+// description and a reader positioned at the first frame. The reader ends
+// where the footer begins.
+func openSnapshot(path string) (SnapshotInfo, *os.File, *bufio.Reader, error) {
+	info := SnapshotInfo{Path: path}
+	file, err := os.Open(path)
+	if err != nil {
+		return info, nil, nil, err
+	}
+	fail := func(format string, args ...interface{}) (SnapshotInfo, *os.File, *bufio.Reader, error) {
+		file.Close()
+		return info, nil, nil, fmt.Errorf("snapshot %s: "+format, append([]interface{}{path}, args...)...)
+	}
+
+	if info, err = readSnapshotInfo(file); err != nil {
+		return fail("%v", err)
+	}
+	sum := crc32.New(castagnoli)
+	if _, err := io.CopyN(sum, file, info.Size-4); err != nil {
+		return fail("%v", err)
+	}
+	if hex.EncodeToString(sum.Sum(nil)) != info.Checksum {
+		return fail("checksum mismatch, the file is damaged")
+	}
+
+	if _, err := file.Seek(int64(snapshotHeader), io.SeekStart); err != nil {
+		return fail("%v", err)
+	}
+	frames := io.LimitReader(file, info.Size-int64(snapshotHeader+snapshotFooter))
+	return info, file, bufio.NewReader(frames), nil
+}
+
+// listSnapshots describes the snapshots in dir, oldest first, from their
+// headers and footers. Checksums are reported, not verified.
+func listSnapshots(dir string) []SnapshotInfo {
+	snapshots := make([]SnapshotInfo, 0)
+	for _, path := range snapshotFiles(dir) {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Printf("Skipping snapshot %s: %v", path, err)
+			continue
+		}
+		info, err := readSnapshotInfo(file)
+		file.Close()
+		if err != nil {
+			log.Printf("Skipping snapshot %s: %v", path, err)
+			continue
+		}
+		snapshots = append(snapshots, info)
+	}
+	return snapshots
+}
+
+// restoreSnapshot replaces the contents of storage with a snapshot. The
+// snapshot is verified first, so a damaged file leaves the store untouched.
+// Restored keys go through the storage engine and are persisted like any
+// other write.
+func restoreSnapshot(path string) (SnapshotInfo, error) {
+	info, file, reader, err := openSnapshot(path)
+	if err != nil {
+		return info, err
+	}
+	defer file.Close()
+
+	storage.Flush()
+	names := newSealedNames()
+	var keys uint64
+	for {
+		op, err := reader.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return info, err
+		}
+		switch op {
+		case OpSet:
+			name, sealed, exp, version, err := readSetFrame(reader)
+			if err != nil {
+				return info, err
+			}
+			key, val, err := names.open(name, sealed)
+			if err != nil {
+				return info, fmt.Errorf("snapshot %s: %w", path, err)
+			}
+			storage.Update(key, func(tx *itemTx) bool {
+				tx.Store(val, exp, version)
+				tx.DropCounter()
+				return true
+			})
+			keys++
+		case OpCounter:
+			name, node, epoch, pos, neg, _, err := readCounterFrame(reader)
+			if err != nil {
+				return info, err
+			}
+			storage.Update(names.key(name), func(tx *itemTx) bool {
+				c, ok := tx.Counter()
+				if !ok {
+					c = newPNCounter()
+					tx.SetCounter(c)
+				}
+				c.Merge(epoch, node, pos, neg)
+				return true
+			})
+		case OpTags:
+			name, tags, err := readTagsFrame(reader)
+			if err != nil {
+				return info, err
+			}
+			storage.SetTags(names.key(name), tags)
+		default:
+			return info, fmt.Errorf("snapshot %s: unknown op %d", path, op)
+		}
+	}
+	if keys != info.Keys {
+		return info, fmt.Errorf("snapshot %s: restored %d keys, expected %d", path, keys, info.Keys)
+	}
+	return info, nil
+}
+
+// startSnapshotScheduler writes a snapshot every snapshotInterval.
+func startSnapshotScheduler() {
+	go func() {
+		ticker := time.NewTicker(snapshotInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			info, err := writeSnapshot(snapshotDir)
+			if err != nil {
+				log.Printf("Scheduled snapshot failed: %v", err)
+				continue
+			}
+			log.Printf("Wrote snapshot %s (%d keys, %d bytes)", info.Path, info.Keys, info.Size)
+		}
+	}()
+}
+
+// -------------------------------------------------------------
+// Snapshot HTTP Handler
+// -------------------------------------------------------------
+
+// handleSnapshots lists the snapshots on GET and takes one on POST. Only the
+// main API token may use it; a snapshot spans every namespace, so tenant
+// tokens are refused.
+func handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if snapshotDir == "" {
+		writeJSONStatus(w, http.StatusServiceUnavailable, map[string]string{"error": "Snapshots need --snapshot-dir"})
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, map[string]interface{}{"snapshots": listSnapshots(snapshotDir)})
+	case "POST":
+		info, err := writeSnapshot(snapshotDir)
+		if err != nil {
+			writeJSONStatus(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		log.Printf("Wrote snapshot %s (%d keys, %d bytes)", info.Path, info.Keys, info.Size)
+		writeJSON(w, info)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
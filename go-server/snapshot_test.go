@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func setupSnapshots(t *testing.T) string {
+	storage = newMemoryStore(4)
+	snapshotDir = t.TempDir()
+	t.Cleanup(func() {
+		storage = newMemoryStore(defaultShards)
+		snapshotDir, snapshotRetain = "", 5
+	})
+	return snapshotDir
+}
+
+func TestSnapshotRestoresPointInTime(t *testing.T) {
+	dir := setupSnapshots(t)
+	storage.Set("item", []byte("s:5:\"hello\";"), time.Now().Unix()+60, 7)
+	storage.SetTags("item", []string{"greetings"})
+	storage.Set(lockKey("job"), []byte("owner"), 0, 0)
+	incrCounter("hits", 4, nil)
+	storage.Set("expired", []byte("i:1;"), time.Now().Unix()-1, 0)
+
+	info, err := writeSnapshot(dir)
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if info.Keys != 3 || info.Checksum == "" {
+		t.Errorf("Expected 3 live keys with a checksum, got %+v", info)
+	}
+	if stat, err := os.Stat(info.Path); err != nil || stat.Size() != info.Size {
+		t.Errorf("Expected a %d byte file at %s, got %v", info.Size, info.Path, err)
+	}
+
+	// Later writes are undone by the restore
+	storage.Set("later", []byte("i:1;"), 0, 0)
+	storage.Delete("item")
+
+	if _, err := restoreSnapshot(info.Path); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if _, ok := storage.Get("later"); ok || storage.Len() != 3 {
+		t.Errorf("Expected exactly the snapshot keys, got %d keys", storage.Len())
+	}
+	if item, ok := storage.Get("item"); !ok || item.Version != 7 || item.Expiration == 0 {
+		t.Errorf("Expected item with its version and expiration, got %+v", item)
+	}
+	if tags := storage.TaggedKeys(indexedTag("item", "greetings")); len(tags) != 1 {
+		t.Errorf("Expected the tags of item to be restored, got %v", tags)
+	}
+	if item, ok := storage.Get(lockKey("job")); !ok || string(item.Value) != "owner" {
+		t.Errorf("Expected the lock to be restored")
+	}
+	storage.View("hits", func(tx *itemTx) {
+		if c, ok := tx.Counter(); !ok || c.Value() != 4 {
+			t.Errorf("Expected the counter to be restored")
+		}
+	})
+}
+
+func TestSnapshotRejectsDamagedFile(t *testing.T) {
+	dir := setupSnapshots(t)
+	storage.Set("item", []byte("i:1;"), 0, 0)
+	info, err := writeSnapshot(dir)
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	data, _ := os.ReadFile(info.Path)
+	data[snapshotHeader+3] ^= 0xff
+	os.WriteFile(info.Path, data, 0644)
+
+	storage.Set("current", []byte("i:1;"), 0, 0)
+	if _, err := restoreSnapshot(info.Path); err == nil {
+		t.Errorf("Expected a checksum mismatch")
+	}
+	if _, ok := storage.Get("current"); !ok {
+		t.Errorf("Expected a failed restore to leave the store untouched")
+	}
+
+	// Listing reads only the header and footer
+	if listed := listSnapshots(dir); len(listed) != 1 || listed[0].Keys != 1 || listed[0].Checksum != info.Checksum {
+		t.Errorf("Expected the snapshot to be listed from its footer, got %+v", listed)
+	}
+}
+
+func TestSnapshotRetention(t *testing.T) {
+	dir := setupSnapshots(t)
+	snapshotRetain = 2
+	for i := 0; i < 3; i++ {
+		if _, err := writeSnapshot(dir); err != nil {
+			t.Fatalf("Snapshot failed: %v", err)
+		}
+	}
+	if files := snapshotFiles(dir); len(files) != 2 {
+		t.Errorf("Expected 2 snapshots to be kept, got %v", files)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(leftovers) != 0 {
+		t.Errorf("Expected no temporary files, got %v", leftovers)
+	}
+}
+
+func TestHandleSnapshots(t *testing.T) {
+	setupSnapshots(t)
+	storage.Set("item", []byte("i:1;"), 0, 0)
+
+	rr := httptest.NewRecorder()
+	handleSnapshots(rr, httptest.NewRequest("POST", "/api/hypercacheio/admin/snapshots", nil))
+	var created SnapshotInfo
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	if rr.Code != http.StatusOK || created.Keys != 1 {
+		t.Fatalf("Expected a snapshot of 1 key, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	handleSnapshots(rr, httptest.NewRequest("GET", "/api/hypercacheio/admin/snapshots", nil))
+	var listed struct {
+		Snapshots []SnapshotInfo `json:"snapshots"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &listed)
+	if len(listed.Snapshots) != 1 || listed.Snapshots[0].Checksum != created.Checksum {
+		t.Errorf("Expected the snapshot to be listed, got %s", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	req := withTenant(httptest.NewRequest("POST", "/api/hypercacheio/admin/snapshots", nil), &Tenant{Name: "shop"})
+	handleSnapshots(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected tenants to be refused, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------------------------------------------------
+// SQLite Engine
+// -------------------------------------------------------------
+//
+// sqliteStore serves every read from memory and persists writes to the
+// SQLite file shared with the PHP store through its write-behind queue.
+// Items go to the cache table, locks to cache_locks, counter slots to
+// cache_counters and tags to cache_tags.
+
+type sqliteStore struct {
+	*memoryStore
+	db    *sql.DB
+	queue *writeBehind
+
+	reencrypting sync.WaitGroup
+	closing      atomic.Bool
+}
+
+func newSqliteStore(mem *memoryStore, db *sql.DB) *sqliteStore {
+	s := &sqliteStore{
+		memoryStore: mem,
+		db:          db,
+		queue:       newWriteBehind(db, writeBatch, writeInterval, writeBehindEnabled),
+	}
+	mem.persist = s.queue.put
+	mem.flushed = s.queue.discard
+	return s
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// The write methods below queue the new state of a key under its shard lock
+// through memoryStore.persist and only wait for the queue once the lock has
+// been released.
+
+func (s *sqliteStore) Set(key string, val []byte, expiration int64, version uint64) CacheItem {
+	item := s.memoryStore.Set(key, val, expiration, version)
+	s.queue.settle()
+	return item
+}
+
+func (s *sqliteStore) Add(key string, val []byte, expiration int64) (CacheItem, bool) {
+	item, added := s.memoryStore.Add(key, val, expiration)
+	if added {
+		s.queue.settle()
+	}
+	return item, added
+}
+
+func (s *sqliteStore) CompareAndSwap(key string, val []byte, expiration int64, expected uint64) (uint64, bool) {
+	version, swapped := s.memoryStore.CompareAndSwap(key, val, expiration, expected)
+	if swapped {
+		s.queue.settle()
+	}
+	return version, swapped
+}
+
+func (s *sqliteStore) Update(key string, fn func(tx *itemTx) bool) {
+	if _, changed := s.update(key, fn); changed {
+		s.queue.settle()
+	}
+}
+
+func (s *sqliteStore) SetMany(items []BatchItem) {
+	s.memoryStore.SetMany(items)
+	s.queue.settle()
+}
+
+func (s *sqliteStore) SetTags(key string, tags []string) ([]string, bool) {
+	tags, found := s.memoryStore.SetTags(key, tags)
+	if found {
+		s.queue.settle()
+	}
+	return tags, found
+}
+
+func (s *sqliteStore) Expire(key string, expiration int64) bool {
+	ok := s.memoryStore.Expire(key, expiration)
+	if ok {
+		s.queue.settle()
+	}
+	return ok
+}
+
+func (s *sqliteStore) Delete(key string) {
+	s.memoryStore.Delete(key)
+	s.queue.settle()
+}
+
+func (s *sqliteStore) DeleteMatching(prefix string, match func(key string) bool) []string {
+	removed := s.memoryStore.DeleteMatching(prefix, match)
+	s.queue.settle()
+	return removed
+}
+
+func (s *sqliteStore) DeleteTagged(tag string) []string {
+	removed := s.memoryStore.DeleteTagged(tag)
+	s.queue.settle()
+	return removed
+}
+
+// Flush holds off batches until the tables are emptied. Writes queued before
+// the keyspace is cleared are dropped under its shard locks; later writes
+// stay queued and are written after the DELETEs.
+func (s *sqliteStore) Flush() {
+	s.queue.exclusive(true, func(ex execer) {
+		s.memoryStore.Flush()
+		ex.Exec("DELETE FROM cache")
+		ex.Exec("DELETE FROM cache_locks")
+		ex.Exec("DELETE FROM cache_counters")
+		ex.Exec("DELETE FROM cache_tags")
+	})
+}
+
+func (s *sqliteStore) Sweep(now int64, batch int) int {
+	count := s.memoryStore.Sweep(now, batch)
+	if count == 0 {
+		return 0
+	}
+
+	s.queue.exclusive(false, func(ex execer) {
+		sweepSqlite(ex, now)
+	})
+	return count
+}
+
+// sweepSqlite deletes rows that expired before now and what belonged to them.
+func sweepSqlite(ex execer, now int64) {
+	ex.Exec("DELETE FROM cache WHERE expiration > 0 AND expiration < ?", now)
+	ex.Exec("DELETE FROM cache_locks WHERE expiration > 0 AND expiration < ?", now)
+	ex.Exec("DELETE FROM cache_counters WHERE key NOT IN (SELECT key FROM cache)")
+	ex.Exec("DELETE FROM cache_tags WHERE key NOT IN (SELECT key FROM cache)")
+}
+
+// Discard queues the removal of keys already gone from memory.
+func (s *sqliteStore) Discard(removals []removal) {
+	for _, r := range removals {
+		s.queue.put(keyState{key: r.key, dropped: r})
+	}
+	s.queue.settle()
+}
+
+// Close stops re-sealing rows and drains the write-behind queue.
+func (s *sqliteStore) Close() error {
+	s.closeQueue()
+	return nil
+}
+
+func (s *sqliteStore) closeQueue() {
+	s.closing.Store(true)
+	s.reencrypting.Wait()
+	s.queue.close()
+}
+
+func (s *sqliteStore) Stats() StorageStats {
+	return StorageStats{Engine: storageSqlite, WriteBehind: s.queue.stats(), Sqlite: sqliteStats(s.db, sqlitePath)}
+}
+
+func (s *sqliteStore) Load() error {
+	names, err := s.loadItems()
+	if err != nil {
+		return err
+	}
+	s.loadCounters(names)
+	s.loadTags(names)
+	s.startReencrypt()
+	return nil
+}
+
+// -------------------------------------------------------------
+// SQLite Persistence
+// -------------------------------------------------------------
+
+// persistState writes a key as captured under its shard lock.
+func persistState(ex execer, st keyState) {
+	if !st.exists {
+		persistRemoval(ex, st.dropped)
+		return
+	}
+	val := st.item.Value
+	if !compressSqlite {
+		val = decodeValue(val) // The PHP store reads the same rows
+	}
+	persistSetWith(ex, st.key, val, st.item.Expiration, st.item.Version)
+	if st.dropped.counter {
+		ex.Exec("DELETE FROM cache_counters WHERE key = ?", diskKey(st.key))
+	}
+	if st.counter != nil {
+		// Slots of an earlier epoch belong to a counter that was restarted
+		ex.Exec("DELETE FROM cache_counters WHERE key = ? AND epoch < ?", diskKey(st.key), int64(st.counter.Epoch))
+		for node, pos := range st.counter.Pos {
+			persistCounterSlot(ex, st.key, node, st.counter.Epoch, pos, st.counter.Neg[node])
+		}
+		for node, neg := range st.counter.Neg {
+			if _, ok := st.counter.Pos[node]; !ok {
+				persistCounterSlot(ex, st.key, node, st.counter.Epoch, 0, neg)
+			}
+		}
+	}
+}
+
+// persistSetWith writes an item. Locks go to the cache_locks table shared
+// with the PHP store, everything else to the cache table.
+func persistSetWith(ex execer, key string, val []byte, expiration int64, version uint64) {
+	var exp interface{}
+	if expiration > 0 {
+		exp = expiration
+	}
+	if name, ok := lockName(key); ok {
+		ex.Exec("REPLACE INTO cache_locks(key, owner, expiration) VALUES(?, ?, ?)", name, string(val), exp)
+		return
+	}
+	name, val := sealValue(key, val)
+	ex.Exec("REPLACE INTO cache(key, value, expiration, version) VALUES(?, ?, ?, ?)", name, val, exp, int64(version))
+}
+
+func persistDelWith(ex execer, key string) {
+	if name, ok := lockName(key); ok {
+		ex.Exec("DELETE FROM cache_locks WHERE key = ?", name)
+		return
+	}
+	ex.Exec("DELETE FROM cache WHERE key = ?", diskKey(key))
+}
+
+func persistRemoval(ex execer, r removal) {
+	persistDelWith(ex, r.key)
+	if r.counter {
+		ex.Exec("DELETE FROM cache_counters WHERE key = ?", diskKey(r.key))
+	}
+	if r.tags {
+		ex.Exec("DELETE FROM cache_tags WHERE key = ?", diskKey(r.key))
+	}
+}
+
+func persistCounterSlot(ex execer, key, node string, epoch, pos, neg uint64) {
+	ex.Exec("REPLACE INTO cache_counters(key, node, epoch, pos, neg) VALUES(?, ?, ?, ?, ?)", diskKey(key), node, int64(epoch), int64(pos), int64(neg))
+}
+
+func persistTags(ex execer, key string, tags []string) {
+	name := diskKey(key)
+	ex.Exec("DELETE FROM cache_tags WHERE key = ?", name)
+	for _, tag := range tags {
+		ex.Exec("INSERT INTO cache_tags(tag, key) VALUES(?, ?)", tag, name)
+	}
+}
+
+// -------------------------------------------------------------
+// SQLite Loading
+// -------------------------------------------------------------
+
+// loadItems restores live items and locks. It returns the keys of the items
+// stored under hashed names.
+func (s *sqliteStore) loadItems() (*sealedNames, error) {
+	names := newSealedNames()
+	rows, err := s.db.Query("SELECT key, value, expiration, version FROM cache")
+	if err != nil {
+		return names, err
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var name string
+		var sealed []byte
+		var exp sql.NullInt64
+		var version int64
+		if err := rows.Scan(&name, &sealed, &exp, &version); err == nil {
+			k, v, err := names.open(name, sealed)
+			if err != nil {
+				log.Printf("Skipping a SQLite row: %v", err)
+				continue
+			}
+			expiration := int64(0)
+			if exp.Valid {
+				expiration = exp.Int64
+			}
+			if expiration == 0 || expiration > time.Now().Unix() {
+				s.keys.Update(k, func(tx *itemTx) {
+					tx.Store(v, expiration, uint64(version))
+				})
+				count++
+			}
+		}
+	}
+	log.Printf("Loaded %d items from SQLite persistence", count)
+
+	lockRows, err := s.db.Query("SELECT key, owner, expiration FROM cache_locks")
+	if err != nil {
+		return names, err
+	}
+	defer lockRows.Close()
+
+	locks := 0
+	for lockRows.Next() {
+		var name, owner string
+		var exp sql.NullInt64
+		if err := lockRows.Scan(&name, &owner, &exp); err == nil {
+			expiration := int64(0)
+			if exp.Valid {
+				expiration = exp.Int64
+			}
+			if expiration == 0 || expiration > time.Now().Unix() {
+				s.keys.Update(lockKey(name), func(tx *itemTx) {
+					tx.Store([]byte(owner), expiration, 0)
+				})
+				locks++
+			}
+		}
+	}
+	log.Printf("Restored %d locks from SQLite persistence", locks)
+	return names, nil
+}
+
+// loadCounters restores counter slots for keys that are still live in the
+// cache. It must run after the items have been loaded.
+func (s *sqliteStore) loadCounters(names *sealedNames) {
+	rows, err := s.db.Query("SELECT key, node, epoch, pos, neg FROM cache_counters")
+	if err != nil {
+		log.Printf("Failed to load counters from SQLite: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	restored := 0
+	for rows.Next() {
+		var key, node string
+		var epoch, pos, neg sql.NullInt64
+		if err := rows.Scan(&key, &node, &epoch, &pos, &neg); err != nil {
+			continue
+		}
+		s.keys.Update(names.key(key), func(tx *itemTx) {
+			if _, live := tx.Item(); !live {
+				return
+			}
+			c, ok := tx.Counter()
+			if !ok {
+				c = newPNCounter()
+				tx.SetCounter(c)
+				restored++
+			}
+			c.Merge(uint64(epoch.Int64), node, uint64(pos.Int64), uint64(neg.Int64))
+		})
+	}
+	log.Printf("Restored %d counters from SQLite persistence", restored)
+}
+
+// loadTags restores the tag index for keys that are still live in the cache.
+// It must run after the items have been loaded.
+func (s *sqliteStore) loadTags(names *sealedNames) {
+	rows, err := s.db.Query("SELECT key, tag FROM cache_tags ORDER BY key")
+	if err != nil {
+		log.Printf("Failed to load tags from SQLite: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	loaded := make(map[string][]string)
+	for rows.Next() {
+		var key, tag string
+		if err := rows.Scan(&key, &tag); err != nil {
+			continue
+		}
+		loaded[names.key(key)] = append(loaded[names.key(key)], tag)
+	}
+	restored := 0
+	for key, tags := range loaded {
+		s.keys.Update(key, func(tx *itemTx) {
+			if _, live := tx.Item(); live {
+				tx.SetTags(tags)
+				restored++
+			}
+		})
+	}
+	log.Printf("Restored tags of %d keys from SQLite persistence", restored)
+}
@@ -39,8 +39,15 @@ func setupTestDB(t *testing.T) (*sql.DB, func()) {
 
 	// Override the global db variable in main.go
 	db = tDB
+	if err := initSqlite(); err != nil {
+		t.Fatalf("Failed to upgrade test schema: %v", err)
+	}
 	cachePrefix = "test_prefix:"
-	cache = make(map[string]CacheItem)
+	writeBehind := writeBehindEnabled
+	writeBehindEnabled = false // Tests check SQLite right after writing
+	t.Cleanup(func() { writeBehindEnabled = writeBehind })
+	storage = newSqliteStore(newMemoryStore(defaultShards), db)
+	flushLocal(false) // Reset SQLite and the eviction queue
 
 	cleanup := func() {
 		tDB.Close()
@@ -182,31 +189,27 @@ func TestCleanupExpired(t *testing.T) {
 
 	now := time.Now().Unix()
 
-	cacheMutex.Lock()
 	// Item 1: Not expired
-	cache["valid"] = CacheItem{Value: []byte("value"), Expiration: now + 60}
+	storeItem("valid", []byte("value"), now+60)
 	// Item 2: Expired
-	cache["expired"] = CacheItem{Value: []byte("value"), Expiration: now - 60}
+	storeItem("expired", []byte("value"), now-60)
 	// Item 3: No expiration
-	cache["permanent"] = CacheItem{Value: []byte("value"), Expiration: 0}
-	cacheMutex.Unlock()
+	storeItem("permanent", []byte("value"), 0)
 
 	// Initial count
-	if len(cache) != 3 {
-		t.Errorf("Expected 3 items, got %d", len(cache))
+	if storage.Len() != 3 {
+		t.Errorf("Expected 3 items, got %d", storage.Len())
 	}
 
 	cleanupExpired()
 
-	if len(cache) != 2 {
-		t.Errorf("Expected 2 items after cleanup, got %d", len(cache))
+	if storage.Len() != 2 {
+		t.Errorf("Expected 2 items after cleanup, got %d", storage.Len())
 	}
 
-	cacheMutex.RLock()
-	if _, exists := cache["expired"]; exists {
+	if _, exists := storage.Get("expired"); exists {
 		t.Errorf("Expired item still exists in cache")
 	}
-	cacheMutex.RUnlock()
 }
 
 func TestHandleItemsFiltering(t *testing.T) {
@@ -215,10 +218,8 @@ func TestHandleItemsFiltering(t *testing.T) {
 
 	now := time.Now().Unix()
 
-	cacheMutex.Lock()
-	cache["valid"] = CacheItem{Value: []byte("s:5:\"value\";"), Expiration: now + 60}
-	cache["expired"] = CacheItem{Value: []byte("s:5:\"value\";"), Expiration: now - 60}
-	cacheMutex.Unlock()
+	storeItem("valid", []byte("s:5:\"value\";"), now+60)
+	storeItem("expired", []byte("s:5:\"value\";"), now-60)
 
 	req, _ := http.NewRequest("GET", "/api/hypercacheio/items", nil)
 	rr := httptest.NewRecorder()
@@ -240,3 +241,42 @@ func TestHandleItemsFiltering(t *testing.T) {
 		t.Errorf("Expected key 'valid', got %v", items[0]["key"])
 	}
 }
+
+func TestLockPersistence(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ttl := 60
+	body, _ := json.Marshal(Payload{Owner: "owner-1", TTL: &ttl})
+	req, _ := http.NewRequest("POST", "/api/hypercacheio/lock/jobs", bytes.NewBuffer(body))
+	rr := httptest.NewRecorder()
+	handleLock(rr, req)
+
+	var owner string
+	if err := db.QueryRow("SELECT owner FROM cache_locks WHERE key = ?", "jobs").Scan(&owner); err != nil {
+		t.Fatalf("Lock was not persisted to cache_locks: %v", err)
+	}
+	if owner != "owner-1" {
+		t.Errorf("Expected persisted owner 'owner-1', got %v", owner)
+	}
+
+	// Simulate a restart
+	restartStorage(t)
+
+	item, exists := storage.Get("lock:jobs")
+	if !exists || string(item.Value) != "owner-1" {
+		t.Fatalf("Lock was not restored from SQLite")
+	}
+
+	// Release
+	body, _ = json.Marshal(Payload{Owner: "owner-1"})
+	req2, _ := http.NewRequest("DELETE", "/api/hypercacheio/lock/jobs", bytes.NewBuffer(body))
+	rr2 := httptest.NewRecorder()
+	handleLock(rr2, req2)
+
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM cache_locks").Scan(&count)
+	if count != 0 {
+		t.Errorf("Expected released lock to be removed from cache_locks, got %d rows", count)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// -------------------------------------------------------------
+// SQLite Connection Tuning
+// -------------------------------------------------------------
+//
+// The database is opened in WAL mode by default so readers never block the
+// write-behind queue and the PHP store can keep reading while Go writes.
+// Per-connection pragmas are passed in the DSN, so every pooled connection
+// gets them, not just the first. The file is checked with quick_check before
+// anything is loaded from it.
+
+var (
+	sqliteJournalMode = "wal"
+	sqliteSynchronous = "normal"
+	sqliteBusyTimeout = 5 * time.Second
+	sqliteMmapSize    = "256mb"
+	sqliteCacheSize   = "64mb"
+	sqliteQuickCheck  = true
+)
+
+const sqliteMaxOpenConns = 10
+
+// quickCheckLimit caps the problems quick_check reports.
+const quickCheckLimit = 10
+
+// sqliteDSN returns the DSN opening path with the configured pragmas.
+func sqliteDSN(path string) (string, error) {
+	journal := strings.ToLower(sqliteJournalMode)
+	switch journal {
+	case "wal", "delete", "truncate", "persist", "memory", "off":
+	default:
+		return "", fmt.Errorf("invalid journal mode %q (expected wal, delete, truncate, persist, memory or off)", sqliteJournalMode)
+	}
+	synchronous := strings.ToLower(sqliteSynchronous)
+	switch synchronous {
+	case "off", "normal", "full", "extra":
+	default:
+		return "", fmt.Errorf("invalid synchronous mode %q (expected off, normal, full or extra)", sqliteSynchronous)
+	}
+	if sqliteBusyTimeout < 0 {
+		return "", fmt.Errorf("busy timeout must not be negative")
+	}
+	mmap, err := parseByteSize(sqliteMmapSize)
+	if err != nil {
+		return "", fmt.Errorf("invalid mmap size: %w", err)
+	}
+	cache, err := parseByteSize(sqliteCacheSize)
+	if err != nil {
+		return "", fmt.Errorf("invalid cache size: %w", err)
+	}
+
+	pragmas := url.Values{}
+	pragmas.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", sqliteBusyTimeout.Milliseconds()))
+	pragmas.Add("_pragma", fmt.Sprintf("journal_mode(%s)", journal))
+	pragmas.Add("_pragma", fmt.Sprintf("synchronous(%s)", synchronous))
+	pragmas.Add("_pragma", fmt.Sprintf("mmap_size(%d)", mmap))
+	// A negative cache_size is a size in KiB rather than a page count
+	pragmas.Add("_pragma", fmt.Sprintf("cache_size(%d)", -cache/1024))
+	// Take the write lock up front so a transaction never fails to upgrade
+	pragmas.Set("_txlock", "immediate")
+	return path + "?" + pragmas.Encode(), nil
+}
+
+// openSqlite opens and checks the database at path and makes sure the
+// schema exists.
+func openSqlite(path string) (*sql.DB, error) {
+	dsn, err := sqliteDSN(path)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetMaxOpenConns(sqliteMaxOpenConns)
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot open %s: %w", path, err)
+	}
+	if sqliteQuickCheck {
+		if err := quickCheck(conn); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s failed its integrity check, restore it from a backup or move it away to start empty: %w", path, err)
+		}
+	}
+	return conn, nil
+}
+
+// quickCheck runs PRAGMA quick_check and returns the problems it found.
+func quickCheck(conn *sql.DB) error {
+	rows, err := conn.Query(fmt.Sprintf("PRAGMA quick_check(%d)", quickCheckLimit))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	problems := make([]string, 0)
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return err
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("quick_check: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+type SqliteStats struct {
+	Path        string `json:"path"`
+	FileSize    int64  `json:"file_size"`
+	WalSize     int64  `json:"wal_size"`
+	PageSize    int64  `json:"page_size"`
+	PageCount   int64  `json:"page_count"`
+	FreePages   int64  `json:"free_pages"`
+	JournalMode string `json:"journal_mode"`
+	OpenConns   int    `json:"open_connections"`
+	InUseConns  int    `json:"in_use_connections"`
+}
+
+func sqliteStats(conn *sql.DB, path string) *SqliteStats {
+	stats := &SqliteStats{Path: path}
+	if info, err := os.Stat(path); err == nil {
+		stats.FileSize = info.Size()
+	}
+	if info, err := os.Stat(path + "-wal"); err == nil {
+		stats.WalSize = info.Size()
+	}
+	conn.QueryRow("PRAGMA page_size").Scan(&stats.PageSize)
+	conn.QueryRow("PRAGMA page_count").Scan(&stats.PageCount)
+	conn.QueryRow("PRAGMA freelist_count").Scan(&stats.FreePages)
+	conn.QueryRow("PRAGMA journal_mode").Scan(&stats.JournalMode)
+	pool := conn.Stats()
+	stats.OpenConns, stats.InUseConns = pool.OpenConnections, pool.InUse
+	return stats
+}
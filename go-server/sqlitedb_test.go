@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSqliteDSNRejectsInvalidPragmas(t *testing.T) {
+	defer func(journal, synchronous, mmap string) {
+		sqliteJournalMode, sqliteSynchronous, sqliteMmapSize = journal, synchronous, mmap
+	}(sqliteJournalMode, sqliteSynchronous, sqliteMmapSize)
+
+	for _, set := range []func(){
+		func() { sqliteJournalMode = "wall" },
+		func() { sqliteSynchronous = "sometimes" },
+		func() { sqliteMmapSize = "lots" },
+	} {
+		sqliteJournalMode, sqliteSynchronous, sqliteMmapSize = "wal", "normal", "0"
+		set()
+		if _, err := sqliteDSN("cache.sqlite"); err == nil {
+			t.Errorf("Expected an invalid setting to be rejected")
+		}
+	}
+}
+
+func TestOpenSqliteAppliesPragmasToEveryConnection(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hypercacheio.sqlite")
+	conn, err := openSqlite(path)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer conn.Close()
+	conn.Exec("CREATE TABLE t(x)")
+
+	ctx := context.Background()
+	first, _ := conn.Conn(ctx)
+	second, _ := conn.Conn(ctx)
+	defer first.Close()
+	defer second.Close()
+	for i, c := range []*sql.Conn{first, second} {
+		var timeout, synchronous int
+		var journal string
+		c.QueryRowContext(ctx, "PRAGMA busy_timeout").Scan(&timeout)
+		c.QueryRowContext(ctx, "PRAGMA synchronous").Scan(&synchronous)
+		c.QueryRowContext(ctx, "PRAGMA journal_mode").Scan(&journal)
+		if timeout != 5000 || synchronous != 1 || journal != "wal" {
+			t.Errorf("Connection %d: expected busy_timeout 5000, synchronous NORMAL and WAL, got %d, %d, %s", i, timeout, synchronous, journal)
+		}
+	}
+
+	stats := sqliteStats(conn, path)
+	if stats.FileSize == 0 || stats.PageCount == 0 || stats.PageSize == 0 || stats.JournalMode != "wal" {
+		t.Errorf("Expected file and page stats, got %+v", stats)
+	}
+}
+
+func TestOpenSqliteRejectsDamagedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hypercacheio.sqlite")
+	conn, err := openSqlite(path)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	conn.Exec("CREATE TABLE t(x TEXT)")
+	conn.Exec("CREATE INDEX t_x ON t(x)")
+	for i := 0; i < 200; i++ {
+		conn.Exec("INSERT INTO t(x) VALUES(?)", strings.Repeat("x", 100)+string(rune('a'+i%26)))
+	}
+	conn.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	conn.Close()
+
+	// Scribble over the pages after the schema
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte(strings.Repeat("\xff", 8192)), 4096*2)
+	file.Close()
+
+	_, err = openSqlite(path)
+	if err == nil || !strings.Contains(err.Error(), "integrity check") {
+		t.Errorf("Expected the damaged file to fail its integrity check, got %v", err)
+	}
+}
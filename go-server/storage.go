@@ -0,0 +1,412 @@
+package main
+
+import (
+	"fmt"
+)
+
+// -------------------------------------------------------------
+// Storage Engines
+// -------------------------------------------------------------
+//
+// The HTTP and replication layers only talk to a Store. The memory engine
+// keeps everything in the sharded keyspace; the sqlite engine adds write-
+// through persistence to the SQLite file shared with the PHP store and
+// restores it on startup; the aof engine appends every write to a log that is
+// replayed on startup; the tiered engine keeps only a hot tier in memory and
+// the rest in SQLite. The engine is picked with --storage.
+
+const (
+	storageMemory = "memory"
+	storageSqlite = "sqlite"
+)
+
+var storage Store = newMemoryStore(defaultShards)
+
+// Store is a storage engine. Write methods are applied to memory first and
+// handed to the persistence of the engine before the shard lock is released,
+// so the states of a key reach disk in the order they were applied. A reader
+// may still see a write shortly before it reaches disk.
+type Store interface {
+	// Get returns the item stored under key, expired or not, and records the access.
+	Get(key string) (CacheItem, bool)
+	// View runs fn with read access to key.
+	View(key string, fn func(tx *itemTx))
+	// Scan calls fn in key order with the item and tags of every key that
+	// starts with prefix and is >= from, without holding any lock while fn
+	// runs. Values are handed out as stored, to be decoded with decodeValue,
+	// and counter state is left out.
+	Scan(from, prefix string, fn func(st keyState) bool)
+	// Range calls fn with a copy of every key, taken one shard at a time,
+	// without holding any lock while fn runs.
+	Range(fn func(st keyState) bool)
+	// Freeze runs fn for every key with all shards read-locked, so fn sees a
+	// single point in time. Writers wait until it returns.
+	Freeze(fn func(tx *itemTx) bool)
+	// TaggedKeys returns the keys carrying a namespaced tag.
+	TaggedKeys(tag string) []string
+
+	// Set stores an item with the given version, or the next one of the node
+	// clock when it is 0, replacing any counter state of the key. It returns
+	// the item as stored, its value possibly compressed.
+	Set(key string, val []byte, expiration int64, version uint64) CacheItem
+	// Add stores an item only if key holds no live item and returns it as
+	// stored.
+	Add(key string, val []byte, expiration int64) (CacheItem, bool)
+	// CompareAndSwap stores an item only if the live version of key equals
+	// expected, 0 meaning the key must not exist. It returns the new version
+	// on success and the current one otherwise.
+	CompareAndSwap(key string, val []byte, expiration int64, expected uint64) (uint64, bool)
+	// Update runs fn with write access to key and persists the resulting
+	// state of the key when fn reports a change.
+	Update(key string, fn func(tx *itemTx) bool)
+	// SetMany stores all items and fills in their versions and their values
+	// as stored.
+	SetMany(items []BatchItem)
+	// SetTags replaces the tags of an existing key and returns the normalized tags.
+	SetTags(key string, tags []string) ([]string, bool)
+	// Expire changes the expiration of a live key without a new version.
+	Expire(key string, expiration int64) bool
+	// Delete removes key together with its counter state and tags.
+	Delete(key string)
+	// DeleteMatching removes every key starting with prefix accepted by match
+	// and returns the removed keys.
+	DeleteMatching(prefix string, match func(key string) bool) []string
+	// DeleteTagged removes every key carrying the namespaced tag and returns
+	// the removed keys.
+	DeleteTagged(tag string) []string
+	// Flush removes every key.
+	Flush()
+	// Sweep removes items that expired before now, examining at most batch
+	// expiration entries per shard lock.
+	Sweep(now int64, batch int) int
+	// Discard makes removals the keyspace already applied, such as
+	// replicated evictions, durable.
+	Discard(removals []removal)
+	// Load restores durable state on startup.
+	Load() error
+	// Close makes every accepted write durable before shutdown.
+	Close() error
+	Stats() StorageStats
+
+	Len() int
+	Memory() int64
+	Usage(ns string) usage
+	NamespaceUsage() map[string]usage
+}
+
+// newStore returns the engine called name.
+func newStore(name string, shards int) (Store, error) {
+	switch name {
+	case storageMemory:
+		return newMemoryStore(shards), nil
+	case storageSqlite:
+		if db == nil {
+			return nil, fmt.Errorf("the sqlite storage engine needs --sqlite-path")
+		}
+		return newSqliteStore(newMemoryStore(shards), db), nil
+	case storageAof:
+		if aofPath == "" {
+			return nil, fmt.Errorf("the aof storage engine needs --aof-path")
+		}
+		return newAofStore(newMemoryStore(shards), aofPath, aofFsync)
+	case storageTiered:
+		if db == nil {
+			return nil, fmt.Errorf("the tiered storage engine needs --sqlite-path")
+		}
+		return newTieredStore(newMemoryStore(shards), db)
+	}
+	return nil, fmt.Errorf("unknown storage engine %q (expected memory, sqlite, aof or tiered)", name)
+}
+
+type StorageStats struct {
+	Engine      string            `json:"engine"`
+	WriteBehind *WriteBehindStats `json:"write_behind,omitempty"`
+	Sqlite      *SqliteStats      `json:"sqlite,omitempty"`
+	Aof         *AofStats         `json:"aof,omitempty"`
+	Tiers       *TierStats        `json:"tiers,omitempty"`
+}
+
+// keyState is a copy of a key taken under its shard lock, so it can be made
+// durable once the lock has been released.
+type keyState struct {
+	key     string
+	item    CacheItem // As stored, its value possibly compressed
+	exists  bool
+	counter *PNCounter // Copy of the counter state, nil for plain keys
+	dropped removal    // Counter state and tags that went away
+	tags    []string   // The tags of the key
+	tagged  bool       // The write replaced the tags of the key
+}
+
+// live reports whether the state holds an item that has not expired by now.
+func (st keyState) live(now int64) bool {
+	return st.exists && (st.item.Expiration == 0 || st.item.Expiration >= now)
+}
+
+// plain returns the written item with the value given to the write.
+func snapshot(tx *itemTx) keyState {
+	st := keyState{key: tx.key, dropped: removal{key: tx.key, counter: tx.droppedCounter, tags: tx.droppedTags}}
+	st.item, st.exists = tx.Stored()
+	st.tags, st.tagged = tx.Tags(), tx.taggedTags
+	if c, ok := tx.Counter(); ok {
+		st.counter = c.clone()
+	}
+	return st
+}
+
+// -------------------------------------------------------------
+// Memory Engine
+// -------------------------------------------------------------
+
+type memoryStore struct {
+	keys keyspace
+
+	// persist, when set, receives the new state of every key written through
+	// the store while the shard lock of the key is still held, so the states
+	// of a key reach it in the order they were applied. It must not block on
+	// anything that takes a shard lock.
+	persist func(st keyState)
+
+	// flushed, when set, is called while a flush still holds every shard
+	// lock, so persistence can drop or log it before any later write.
+	flushed func()
+}
+
+func newMemoryStore(shards int) *memoryStore {
+	return &memoryStore{keys: newShardedStore(shards)}
+}
+
+// record captures the state of tx and hands it to persist. Callers must be
+// inside an Update callback.
+func (m *memoryStore) record(tx *itemTx) keyState {
+	st := snapshot(tx)
+	if m.persist != nil {
+		m.persist(st)
+	}
+	return st
+}
+
+// recordRemoval hands a removal to persist. Callers must hold the shard lock
+// of the removed key.
+func (m *memoryStore) recordRemoval(r removal) {
+	if m.persist != nil {
+		m.persist(keyState{key: r.key, dropped: r})
+	}
+}
+
+func (m *memoryStore) Get(key string) (CacheItem, bool) {
+	return m.keys.Get(key)
+}
+
+func (m *memoryStore) View(key string, fn func(tx *itemTx)) {
+	m.keys.View(key, fn)
+}
+
+func (m *memoryStore) Scan(from, prefix string, fn func(st keyState) bool) {
+	m.keys.Ascend(from, prefix, fn)
+}
+
+func (m *memoryStore) Range(fn func(st keyState) bool) {
+	m.keys.Range(fn)
+}
+
+func (m *memoryStore) Freeze(fn func(tx *itemTx) bool) {
+	m.keys.Freeze(fn)
+}
+
+func (m *memoryStore) TaggedKeys(tag string) []string {
+	return m.keys.TaggedKeys(tag)
+}
+
+func (m *memoryStore) Set(key string, val []byte, expiration int64, version uint64) CacheItem {
+	return m.set(key, val, expiration, version).item
+}
+
+func (m *memoryStore) set(key string, val []byte, expiration int64, version uint64) keyState {
+	var st keyState
+	m.keys.Update(key, func(tx *itemTx) {
+		tx.Store(val, expiration, version)
+		tx.DropCounter()
+		st = m.record(tx)
+	})
+	return st
+}
+
+func (m *memoryStore) Add(key string, val []byte, expiration int64) (CacheItem, bool) {
+	st, added := m.add(key, val, expiration)
+	if !added {
+		return CacheItem{}, false
+	}
+	return st.item, true
+}
+
+func (m *memoryStore) add(key string, val []byte, expiration int64) (keyState, bool) {
+	var st keyState
+	added := false
+	m.keys.Update(key, func(tx *itemTx) {
+		if _, exists := tx.Live(); exists {
+			return
+		}
+		tx.Store(val, expiration, 0)
+		tx.DropCounter()
+		st, added = m.record(tx), true
+	})
+	return st, added
+}
+
+func (m *memoryStore) CompareAndSwap(key string, val []byte, expiration int64, expected uint64) (uint64, bool) {
+	st, current, ok := m.compareAndSwap(key, val, expiration, expected)
+	if !ok {
+		return current, false
+	}
+	return st.item.Version, true
+}
+
+func (m *memoryStore) compareAndSwap(key string, val []byte, expiration int64, expected uint64) (keyState, uint64, bool) {
+	var st keyState
+	var current uint64
+	swapped := false
+	m.keys.Update(key, func(tx *itemTx) {
+		if item, ok := tx.Live(); ok {
+			current = item.Version
+		}
+		if current != expected {
+			return
+		}
+		tx.Store(val, expiration, 0)
+		tx.DropCounter()
+		st, swapped = m.record(tx), true
+	})
+	return st, current, swapped
+}
+
+func (m *memoryStore) Update(key string, fn func(tx *itemTx) bool) {
+	m.update(key, fn)
+}
+
+func (m *memoryStore) update(key string, fn func(tx *itemTx) bool) (keyState, bool) {
+	var st keyState
+	changed := false
+	m.keys.Update(key, func(tx *itemTx) {
+		if changed = fn(tx); changed {
+			st = m.record(tx)
+		}
+	})
+	return st, changed
+}
+
+func (m *memoryStore) SetMany(items []BatchItem) {
+	m.setMany(items)
+}
+
+func (m *memoryStore) setMany(items []BatchItem) []keyState {
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = item.Key
+	}
+	states := make([]keyState, len(items))
+	m.keys.UpdateMany(keys, func(i int, tx *itemTx) {
+		item := items[i]
+		stored := tx.Store(item.Value, item.Expiration, item.Version)
+		items[i].Value, items[i].Version = stored.Value, stored.Version
+		tx.DropCounter()
+		states[i] = m.record(tx)
+	})
+	return states
+}
+
+func (m *memoryStore) SetTags(key string, tags []string) ([]string, bool) {
+	found := false
+	m.keys.Update(key, func(tx *itemTx) {
+		if _, found = tx.Item(); found {
+			tx.SetTags(tags)
+			tags = tx.Tags()
+			m.record(tx)
+		}
+	})
+	return tags, found
+}
+
+func (m *memoryStore) Expire(key string, expiration int64) bool {
+	_, ok := m.expire(key, expiration)
+	return ok
+}
+
+func (m *memoryStore) expire(key string, expiration int64) (keyState, bool) {
+	var st keyState
+	ok := false
+	m.keys.Update(key, func(tx *itemTx) {
+		if _, ok = tx.Live(); ok {
+			tx.SetExpiration(expiration)
+			st = m.record(tx)
+		}
+	})
+	return st, ok
+}
+
+func (m *memoryStore) Delete(key string) {
+	m.delete(key)
+}
+
+func (m *memoryStore) delete(key string) removal {
+	var removed removal
+	m.keys.Update(key, func(tx *itemTx) {
+		removed = tx.Remove()
+		m.recordRemoval(removed)
+	})
+	return removed
+}
+
+func (m *memoryStore) DeleteMatching(prefix string, match func(key string) bool) []string {
+	return removedKeys(m.keys.RemoveMatching(prefix, match, m.recordRemoval))
+}
+
+func (m *memoryStore) DeleteTagged(tag string) []string {
+	return removedKeys(m.keys.RemoveTagged(tag, m.recordRemoval))
+}
+
+func removedKeys(removals []removal) []string {
+	keys := make([]string, len(removals))
+	for i, r := range removals {
+		keys[i] = r.key
+	}
+	return keys
+}
+
+func (m *memoryStore) Flush() {
+	m.keys.Flush(m.flushed)
+}
+
+func (m *memoryStore) Sweep(now int64, batch int) int {
+	return m.keys.SweepExpired(now, batch)
+}
+
+func (m *memoryStore) Discard(removals []removal) {}
+
+func (m *memoryStore) Load() error {
+	return nil
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
+
+func (m *memoryStore) Stats() StorageStats {
+	return StorageStats{Engine: storageMemory}
+}
+
+func (m *memoryStore) Len() int {
+	return m.keys.Len()
+}
+
+func (m *memoryStore) Memory() int64 {
+	return m.keys.Memory()
+}
+
+func (m *memoryStore) Usage(ns string) usage {
+	return m.keys.Usage(ns)
+}
+
+func (m *memoryStore) NamespaceUsage() map[string]usage {
+	return m.keys.NamespaceUsage()
+}
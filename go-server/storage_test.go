@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStorageEngines(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	engines := map[string]Store{
+		storageMemory: newMemoryStore(4),
+		storageSqlite: newSqliteStore(newMemoryStore(4), db),
+	}
+	var swapped uint64
+	for name, engine := range engines {
+		first := engine.Set("a", []byte("i:1;"), 0, 0).Version
+		if _, added := engine.Add("a", []byte("i:2;"), 0); added {
+			t.Errorf("%s: Expected Add to keep the live key", name)
+		}
+		if version, ok := engine.CompareAndSwap("a", []byte("i:3;"), 0, first); !ok || version <= first {
+			t.Errorf("%s: Expected a swap to a version newer than %d, got %d, %v", name, first, version, ok)
+		} else if name == storageSqlite {
+			swapped = version
+		}
+		if !engine.Expire("a", time.Now().Unix()+60) {
+			t.Errorf("%s: Expected Expire to find the key", name)
+		}
+		engine.Set("b", []byte("i:1;"), 0, 0)
+		engine.Delete("b")
+
+		keys := make([]string, 0)
+		engine.Scan("", "", func(st keyState) bool {
+			keys = append(keys, st.key)
+			return true
+		})
+		if len(keys) != 1 || keys[0] != "a" {
+			t.Errorf("%s: Expected only a to remain, got %v", name, keys)
+		}
+	}
+
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM cache WHERE key = ? AND version = ? AND expiration > 0", "a", int64(swapped)).Scan(&count)
+	if count != 1 {
+		t.Errorf("Expected the sqlite engine to persist a, got %d rows", count)
+	}
+
+	// Only the sqlite engine writes through
+	engines[storageMemory].Set("memory-only", []byte("i:1;"), 0, 0)
+	db.QueryRow("SELECT COUNT(*) FROM cache WHERE key = ?", "memory-only").Scan(&count)
+	if count != 0 {
+		t.Errorf("Expected the memory engine not to touch SQLite")
+	}
+}
+
+func TestNewStore(t *testing.T) {
+	db = nil
+	if _, err := newStore(storageSqlite, 4); err == nil {
+		t.Errorf("Expected the sqlite engine to require a database")
+	}
+	if _, err := newStore("redis", 4); err == nil {
+		t.Errorf("Expected an unknown engine to be rejected")
+	}
+	if engine, err := newStore(storageMemory, 4); err != nil || engine.Load() != nil {
+		t.Errorf("Expected the memory engine to start empty, got %v", err)
+	}
+}
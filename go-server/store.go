@@ -0,0 +1,554 @@
+package main
+
+import (
+	"hash/maphash"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------------------------------------------------
+// Sharded Keyspace
+// -------------------------------------------------------------
+//
+// The keyspace is split into hash shards with a lock each, so requests for
+// different keys rarely contend. Everything derived from a key (its index
+// entry, expiration, access metadata, counter and tags) lives in the shard of
+// that key, so single-key operations stay atomic under one shard lock.
+// Operations spanning many keys are atomic per shard only.
+//
+// The tag index maps tags to keys of any shard and has a mutex of its own.
+// It is only ever taken while holding a shard lock, never the other way round.
+
+const defaultShards = 64
+
+// keyspace is the in-memory part of the storage engines.
+type keyspace interface {
+	// Get returns the item stored under key, expired or not, and records the access.
+	Get(key string) (CacheItem, bool)
+	// View runs fn with read access to key.
+	View(key string, fn func(tx *itemTx))
+	// Update runs fn with write access to key, then evicts other keys if the
+	// memory limit is exceeded.
+	Update(key string, fn func(tx *itemTx))
+	// UpdateMany runs fn for every key, locking each shard once. i is the
+	// position of the key in keys.
+	UpdateMany(keys []string, fn func(i int, tx *itemTx))
+	// Ascend calls fn in key order with the item and tags of every key that
+	// starts with prefix and is >= from, without holding any lock while fn
+	// runs. Values are handed out as stored and counter state is left out.
+	Ascend(from, prefix string, fn func(st keyState) bool)
+	// RemoveMatching removes every key starting with prefix accepted by match
+	// and calls removed for each under its shard lock.
+	RemoveMatching(prefix string, match func(key string) bool, removed func(r removal)) []removal
+	// Range calls fn with a copy of every key, taken one shard at a time,
+	// without holding any lock while fn runs.
+	Range(fn func(st keyState) bool)
+	// Freeze runs fn for every key with all shards read-locked, so fn sees a
+	// single point in time. Writers wait until it returns.
+	Freeze(fn func(tx *itemTx) bool)
+	// TaggedKeys returns the keys carrying a namespaced tag.
+	TaggedKeys(tag string) []string
+	// RemoveTagged removes every key carrying the namespaced tag while the
+	// shards of all of them are locked, so the removal happens at one point
+	// in time, and calls removed, if set, for each under the locks.
+	RemoveTagged(tag string, removed func(r removal)) []removal
+	// HotKeys returns up to n keys other than locks, most recently used first.
+	HotKeys(n int) []string
+	// SweepExpired removes items that expired before now, examining at most
+	// batch expiration entries per shard lock.
+	SweepExpired(now int64, batch int) int
+	// Flush removes every key and calls locked, if set, while every shard is
+	// still locked, so no write can land between the two.
+	Flush(locked func())
+	Len() int
+	Memory() int64
+	Usage(ns string) usage
+	NamespaceUsage() map[string]usage
+}
+
+type shardedStore struct {
+	seed   maphash.Seed
+	shards []*shard
+	tags   *tagIndex
+
+	// pinned, when set, reports keys that must not be evicted. It is called
+	// under a shard lock.
+	pinned func(key string) bool
+}
+
+type shard struct {
+	mu    sync.RWMutex
+	store *shardedStore
+
+	items       map[string]CacheItem
+	order       *keyIndex
+	expirations expiryHeap
+	access      map[string]*accessMeta
+	counters    map[string]*PNCounter
+	keyTags     map[string][]string
+	usage       map[string]*usage
+	memory      atomic.Int64
+}
+
+func newShardedStore(n int) *shardedStore {
+	if n < 1 {
+		n = 1
+	}
+	s := &shardedStore{seed: maphash.MakeSeed(), shards: make([]*shard, n), tags: newTagIndex()}
+	for i := range s.shards {
+		s.shards[i] = newShard(s)
+	}
+	return s
+}
+
+func newShard(store *shardedStore) *shard {
+	return &shard{
+		store:    store,
+		items:    make(map[string]CacheItem),
+		order:    newKeyIndex(),
+		access:   make(map[string]*accessMeta),
+		counters: make(map[string]*PNCounter),
+		keyTags:  make(map[string][]string),
+		usage:    make(map[string]*usage),
+	}
+}
+
+func (s *shardedStore) shardFor(key string) *shard {
+	return s.shards[s.shardIndex(key)]
+}
+
+func (s *shardedStore) shardIndex(key string) int {
+	return int(maphash.String(s.seed, key) % uint64(len(s.shards)))
+}
+
+func (s *shardedStore) Get(key string) (CacheItem, bool) {
+	sh := s.shardFor(key)
+	sh.mu.RLock()
+	item, ok := sh.items[key]
+	sh.recordAccessLocked(key)
+	sh.mu.RUnlock()
+	item.Value = decodeValue(item.Value)
+	return item, ok
+}
+
+func (s *shardedStore) View(key string, fn func(tx *itemTx)) {
+	sh := s.shardFor(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	fn(&itemTx{shard: sh, key: key})
+}
+
+func (s *shardedStore) Update(key string, fn func(tx *itemTx)) {
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	fn(&itemTx{shard: sh, key: key})
+	sh.mu.Unlock()
+	s.evict(key)
+}
+
+func (s *shardedStore) UpdateMany(keys []string, fn func(i int, tx *itemTx)) {
+	byShard := make(map[*shard][]int)
+	for i, key := range keys {
+		sh := s.shardFor(key)
+		byShard[sh] = append(byShard[sh], i)
+	}
+	for _, sh := range s.shards {
+		positions, ok := byShard[sh]
+		if !ok {
+			continue
+		}
+		sh.mu.Lock()
+		for _, i := range positions {
+			fn(i, &itemTx{shard: sh, key: keys[i]})
+		}
+		sh.mu.Unlock()
+	}
+	if len(keys) > 0 {
+		s.evict(keys[len(keys)-1])
+	}
+}
+
+// ascendChunk is the number of keys taken from all shards per merge round.
+const ascendChunk = 1024
+
+func (s *shardedStore) Ascend(from, prefix string, fn func(st keyState) bool) {
+	if from < prefix {
+		from = prefix
+	}
+
+	for {
+		// Take the next keys of every shard, then hand out only those below
+		// the smallest cut-off, as a shard that filled its chunk may hold
+		// more keys before the others' next ones.
+		chunk := ascendChunk/len(s.shards) + 1
+		merged := make([]keyState, 0, ascendChunk)
+		limit, bounded := "", false
+		for _, sh := range s.shards {
+			taken := 0
+			sh.mu.RLock()
+			sh.order.Ascend(from, func(key string) bool {
+				if !strings.HasPrefix(key, prefix) || taken == chunk {
+					return false
+				}
+				taken++
+				merged = append(merged, keyState{key: key, item: sh.items[key], exists: true, tags: sh.keyTags[key]})
+				return true
+			})
+			sh.mu.RUnlock()
+
+			if taken == chunk {
+				last := merged[len(merged)-1].key
+				if !bounded || last < limit {
+					limit, bounded = last, true
+				}
+			}
+		}
+		sort.Slice(merged, func(i, j int) bool { return merged[i].key < merged[j].key })
+
+		for _, e := range merged {
+			if bounded && e.key > limit {
+				break
+			}
+			if !fn(e) {
+				return
+			}
+		}
+		if !bounded {
+			return
+		}
+		from = limit + "\x00"
+	}
+}
+
+func (s *shardedStore) RemoveMatching(prefix string, match func(key string) bool, removed func(r removal)) []removal {
+	removals := make([]removal, 0)
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		matched := make([]string, 0)
+		sh.order.AscendPrefix(prefix, func(key string) bool {
+			if match(key) {
+				matched = append(matched, key)
+			}
+			return true
+		})
+		for _, key := range matched {
+			r := sh.removeLocked(key)
+			removed(r)
+			removals = append(removals, r)
+		}
+		sh.mu.Unlock()
+	}
+	return removals
+}
+
+func (s *shardedStore) Range(fn func(st keyState) bool) {
+	for _, sh := range s.shards {
+		// Values and tag slices are replaced rather than modified in place,
+		// so the copies stay valid once the lock is gone
+		sh.mu.RLock()
+		states := make([]keyState, 0, len(sh.items))
+		for key := range sh.items {
+			states = append(states, snapshot(&itemTx{shard: sh, key: key}))
+		}
+		sh.mu.RUnlock()
+		for _, st := range states {
+			if !fn(st) {
+				return
+			}
+		}
+	}
+}
+
+func (s *shardedStore) Freeze(fn func(tx *itemTx) bool) {
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		defer sh.mu.RUnlock()
+	}
+	for _, sh := range s.shards {
+		for key := range sh.items {
+			if !fn(&itemTx{shard: sh, key: key}) {
+				return
+			}
+		}
+	}
+}
+
+func (s *shardedStore) TaggedKeys(tag string) []string {
+	return s.tags.keysOf(tag)
+}
+
+func (s *shardedStore) RemoveTagged(tag string, removed func(r removal)) []removal {
+	keys := s.tags.keysOf(tag)
+	for {
+		// Shards are locked in index order, like Flush does
+		held := make([]bool, len(s.shards))
+		for _, key := range keys {
+			held[s.shardIndex(key)] = true
+		}
+		for i, sh := range s.shards {
+			if held[i] {
+				sh.mu.Lock()
+			}
+		}
+
+		// The index only changes under the lock of the tagged key's shard,
+		// so once every key it lists is in a held shard it stays put
+		keys = s.tags.keysOf(tag)
+		covered := true
+		for _, key := range keys {
+			if !held[s.shardIndex(key)] {
+				covered = false
+				break
+			}
+		}
+		var removals []removal
+		if covered {
+			removals = make([]removal, 0, len(keys))
+			for _, key := range keys {
+				r := s.shardFor(key).removeLocked(key)
+				if removed != nil {
+					removed(r)
+				}
+				removals = append(removals, r)
+			}
+		}
+		for i, sh := range s.shards {
+			if held[i] {
+				sh.mu.Unlock()
+			}
+		}
+		if covered {
+			return removals
+		}
+	}
+}
+
+func (s *shardedStore) SweepExpired(now int64, batch int) int {
+	removed := 0
+	for _, sh := range s.shards {
+		for {
+			sh.mu.Lock()
+			n, examined := sh.sweepLocked(now, batch)
+			sh.mu.Unlock()
+			removed += n
+			if examined < batch {
+				break
+			}
+		}
+	}
+	return removed
+}
+
+func (s *shardedStore) Flush(locked func()) {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+	}
+	for _, sh := range s.shards {
+		sh.items = make(map[string]CacheItem)
+		sh.order = newKeyIndex()
+		sh.expirations = nil
+		sh.access = make(map[string]*accessMeta)
+		sh.counters = make(map[string]*PNCounter)
+		sh.keyTags = make(map[string][]string)
+		sh.usage = make(map[string]*usage)
+		sh.memory.Store(0)
+	}
+	s.tags.reset()
+	if locked != nil {
+		locked()
+	}
+	for _, sh := range s.shards {
+		sh.mu.Unlock()
+	}
+}
+
+func (s *shardedStore) Len() int {
+	total := 0
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		total += len(sh.items)
+		sh.mu.RUnlock()
+	}
+	return total
+}
+
+// Memory returns the bytes accounted for by all shards. It takes no locks,
+// so eviction can consult it while holding a shard lock.
+func (s *shardedStore) Memory() int64 {
+	var total int64
+	for _, sh := range s.shards {
+		total += sh.memory.Load()
+	}
+	return total
+}
+
+func (s *shardedStore) Usage(ns string) usage {
+	var total usage
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		if u, ok := sh.usage[ns]; ok {
+			total.Items += u.Items
+			total.Bytes += u.Bytes
+		}
+		sh.mu.RUnlock()
+	}
+	return total
+}
+
+func (s *shardedStore) NamespaceUsage() map[string]usage {
+	totals := make(map[string]usage)
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for ns, u := range sh.usage {
+			total := totals[ns]
+			total.Items += u.Items
+			total.Bytes += u.Bytes
+			totals[ns] = total
+		}
+		sh.mu.RUnlock()
+	}
+	return totals
+}
+
+// -------------------------------------------------------------
+// Shard Internals
+// -------------------------------------------------------------
+
+// storeLocked writes an item, compressing its value if it is worth it. A
+// version of 0 takes the next version of the node clock, any other version
+// moves the clock past it. It returns the item with the value as given.
+// Callers must hold the shard lock.
+func (sh *shard) storeLocked(key string, val []byte, expiration int64, version uint64) CacheItem {
+	old, exists := sh.items[key]
+	if version == 0 {
+		version = versions.next()
+	} else {
+		versions.observe(version)
+	}
+	item := CacheItem{Value: encodeValue(val), Expiration: expiration, Version: version}
+	if exists {
+		sh.accountLocked(key, 0, len(item.Value)-len(old.Value))
+	} else {
+		sh.order.Insert(key)
+		sh.accountLocked(key, 1, itemSize(key, item))
+	}
+	sh.items[key] = item
+	sh.scheduleExpiryLocked(key, expiration)
+	sh.trackAccessLocked(key, true)
+	return item
+}
+
+// removeLocked deletes key together with its counter state and tags.
+// Callers must hold the shard lock.
+func (sh *shard) removeLocked(key string) removal {
+	if old, exists := sh.items[key]; exists {
+		sh.accountLocked(key, -1, -itemSize(key, old))
+	}
+	delete(sh.items, key)
+	sh.order.Delete(key)
+	sh.trackAccessLocked(key, false)
+	return removal{key: key, counter: sh.dropCounterLocked(key), tags: sh.untagLocked(key)}
+}
+
+func (sh *shard) dropCounterLocked(key string) bool {
+	if _, ok := sh.counters[key]; ok {
+		delete(sh.counters, key)
+		return true
+	}
+	return false
+}
+
+// -------------------------------------------------------------
+// Item Transactions
+// -------------------------------------------------------------
+
+// itemTx gives access to one key while its shard is locked. It must not be
+// used after the View or Update callback returns.
+type itemTx struct {
+	shard *shard
+	key   string
+
+	droppedCounter bool
+	droppedTags    bool
+	taggedTags     bool
+}
+
+func (tx *itemTx) Key() string {
+	return tx.key
+}
+
+// Item returns the stored item, expired or not.
+func (tx *itemTx) Item() (CacheItem, bool) {
+	item, ok := tx.shard.items[tx.key]
+	item.Value = decodeValue(item.Value)
+	return item, ok
+}
+
+// Stored returns the item as stored, its value possibly compressed.
+func (tx *itemTx) Stored() (CacheItem, bool) {
+	item, ok := tx.shard.items[tx.key]
+	return item, ok
+}
+
+// Live returns the item unless it is missing or expired.
+func (tx *itemTx) Live() (CacheItem, bool) {
+	item, ok := tx.shard.items[tx.key]
+	if !ok || (item.Expiration > 0 && item.Expiration < time.Now().Unix()) {
+		return CacheItem{}, false
+	}
+	item.Value = decodeValue(item.Value)
+	return item, true
+}
+
+// Store writes val and returns the item as stored, its value possibly
+// compressed, so it can be replicated without compressing it again.
+func (tx *itemTx) Store(val []byte, expiration int64, version uint64) CacheItem {
+	return tx.shard.storeLocked(tx.key, val, expiration, version)
+}
+
+// SetExpiration changes the expiration of an existing item without a new version.
+func (tx *itemTx) SetExpiration(expiration int64) {
+	item, ok := tx.shard.items[tx.key]
+	if !ok {
+		return
+	}
+	item.Expiration = expiration
+	tx.shard.items[tx.key] = item
+	tx.shard.scheduleExpiryLocked(tx.key, expiration)
+}
+
+func (tx *itemTx) Remove() removal {
+	r := tx.shard.removeLocked(tx.key)
+	tx.droppedCounter = tx.droppedCounter || r.counter
+	tx.droppedTags = tx.droppedTags || r.tags
+	return r
+}
+
+func (tx *itemTx) Counter() (*PNCounter, bool) {
+	c, ok := tx.shard.counters[tx.key]
+	return c, ok
+}
+
+func (tx *itemTx) SetCounter(c *PNCounter) {
+	tx.shard.counters[tx.key] = c
+}
+
+// DropCounter forgets the counter state and reports whether there was one.
+func (tx *itemTx) DropCounter() bool {
+	dropped := tx.shard.dropCounterLocked(tx.key)
+	tx.droppedCounter = tx.droppedCounter || dropped
+	return dropped
+}
+
+func (tx *itemTx) Tags() []string {
+	return tx.shard.keyTags[tx.key]
+}
+
+// SetTags replaces the tags of the key.
+func (tx *itemTx) SetTags(tags []string) {
+	tx.shard.setTagsLocked(tx.key, tags)
+	tx.taggedTags = true
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// testKeyspace returns the keyspace of the storage engine set up by setupTestDB.
+func testKeyspace() *shardedStore {
+	return storage.(*sqliteStore).keys.(*shardedStore)
+}
+
+// storeItem writes an item straight into the keyspace, bypassing persistence.
+func storeItem(key string, val []byte, expiration int64) {
+	testKeyspace().Update(key, func(tx *itemTx) {
+		tx.Store(val, expiration, 0)
+	})
+}
+
+// restartStorage simulates a restart by loading a new engine from SQLite.
+func restartStorage(t *testing.T) {
+	storage = newSqliteStore(newMemoryStore(defaultShards), db)
+	if err := storage.Load(); err != nil {
+		t.Fatalf("Failed to load from SQLite: %v", err)
+	}
+}
+
+func TestStoreAscendMergesShards(t *testing.T) {
+	store := newShardedStore(8)
+	for i := 0; i < 3000; i++ {
+		store.Update(fmt.Sprintf("k:%05d", i), func(tx *itemTx) {
+			tx.Store([]byte("i:1;"), 0, 0)
+		})
+	}
+	store.Update("other", func(tx *itemTx) {
+		tx.Store([]byte("i:1;"), 0, 0)
+	})
+
+	previous, seen := "", 0
+	store.Ascend("k:00100", "k:", func(st keyState) bool {
+		if st.key <= previous {
+			t.Fatalf("Keys out of order: %s after %s", st.key, previous)
+		}
+		previous = st.key
+		seen++
+		return true
+	})
+	if seen != 2900 {
+		t.Errorf("Expected 2900 keys from k:00100 on, got %d", seen)
+	}
+}
+
+func TestStoreUpdateIsAtomicPerKey(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				storage.Update("shared", func(tx *itemTx) bool {
+					item, _ := tx.Item()
+					n, _ := strconv.Atoi(string(item.Value))
+					tx.Store([]byte(strconv.Itoa(n+1)), 0, 0)
+					return true
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if item, _ := storage.Get("shared"); string(item.Value) != "800" {
+		t.Errorf("Expected 800 updates, got %s", item.Value)
+	}
+}
+
+func TestStoreRangeHoldsNoLockWhileVisiting(t *testing.T) {
+	keys := newShardedStore(1)
+	for i := 0; i < 3; i++ {
+		keys.Update(fmt.Sprintf("key:%d", i), func(tx *itemTx) {
+			tx.Store([]byte("i:1;"), 0, 0)
+		})
+	}
+
+	// A writer in the callback would deadlock on a held shard lock
+	visited := 0
+	keys.Range(func(st keyState) bool {
+		keys.Update(st.key, func(tx *itemTx) {
+			tx.Store([]byte("i:2;"), 0, 0)
+		})
+		if string(st.item.Value) != "i:1;" || !st.exists {
+			t.Errorf("Expected a copy taken before the write, got %q", st.item.Value)
+		}
+		visited++
+		return true
+	})
+	if visited != 3 {
+		t.Errorf("Expected 3 keys visited, got %d", visited)
+	}
+}
+
+func TestStoreAccountsAcrossShards(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	expected := int64(0)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("k%d", i)
+		setLocal(key, []byte("i:1;"), 0, false)
+		if !strings.HasPrefix(key, "k1") {
+			expected += int64(len(key) + len("i:1;") + itemOverhead)
+		}
+	}
+	removed, _ := deleteMatchingLocal(matchPrefix, "", "k1", false)
+
+	if removed != 11 || storage.Len() != 89 {
+		t.Errorf("Expected 11 removed and 89 left, got %d and %d", removed, storage.Len())
+	}
+	if used := usageOf(""); used.Items != 89 {
+		t.Errorf("Expected usage of 89 items, got %+v", used)
+	}
+	if storage.Memory() != expected {
+		t.Errorf("Expected %d bytes in use, got %d", expected, storage.Memory())
+	}
+}
+
+// BenchmarkStoreParallel mixes reads and writes over a shared keyspace. Run
+// it with -cpu 1,2,4,8 to see throughput scale with GOMAXPROCS once the
+// store is split into shards.
+func BenchmarkStoreParallel(b *testing.B) {
+	keys := make([]string, 4096)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("bench:%d", i)
+	}
+	value := []byte("s:5:\"value\";")
+
+	for _, shards := range []int{1, defaultShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			store := newShardedStore(shards)
+			for _, key := range keys {
+				store.Update(key, func(tx *itemTx) {
+					tx.Store(value, 0, 0)
+				})
+			}
+
+			var next atomic.Uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := next.Add(1) * 7919
+				for pb.Next() {
+					key := keys[i%uint64(len(keys))]
+					if i%4 == 0 {
+						store.Update(key, func(tx *itemTx) {
+							tx.Store(value, 0, 0)
+						})
+					} else {
+						store.Get(key)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
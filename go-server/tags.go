@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// -------------------------------------------------------------
+// Cache Tags
+// -------------------------------------------------------------
+//
+// Tags are only changed by an explicit assignment (a write carrying "tags",
+// or a replicated OpSetTags or OpTags frame) and are dropped with the key
+// itself. A write carrying tags stores them with the value under one shard
+// lock and replicates both in one OpSetTags frame. The tags
+// of a key live in its shard; the index from tags to keys spans all shards and
+// is guarded by a mutex of its own, taken while holding a shard lock.
+// The tag index is keyed by namespaced tags, so equal tag names in different
+// namespaces never share keys.
+
+type tagIndex struct {
+	mu   sync.Mutex
+	keys map[string]map[string]struct{} // namespaced tag -> keys
+}
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{keys: make(map[string]map[string]struct{})}
+}
+
+func (ix *tagIndex) add(key string, tags []string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for _, tag := range tags {
+		tag = indexedTag(key, tag)
+		keys, ok := ix.keys[tag]
+		if !ok {
+			keys = make(map[string]struct{})
+			ix.keys[tag] = keys
+		}
+		keys[key] = struct{}{}
+	}
+}
+
+func (ix *tagIndex) remove(key string, tags []string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for _, tag := range tags {
+		tag = indexedTag(key, tag)
+		delete(ix.keys[tag], key)
+		if len(ix.keys[tag]) == 0 {
+			delete(ix.keys, tag)
+		}
+	}
+}
+
+// keysOf returns the keys carrying the namespaced tag.
+func (ix *tagIndex) keysOf(tag string) []string {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	keys := make([]string, 0, len(ix.keys[tag]))
+	for key := range ix.keys[tag] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (ix *tagIndex) len() int {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	return len(ix.keys)
+}
+
+func (ix *tagIndex) reset() {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.keys = make(map[string]map[string]struct{})
+}
+
+// indexedTag returns the tag index entry of tag for the namespace of key.
+func indexedTag(key, tag string) string {
+	ns, _ := splitKey(key)
+	return namespacedKey(ns, tag)
+}
+
+// setTagsLocked replaces the tags of key. Callers must hold the shard lock.
+func (sh *shard) setTagsLocked(key string, tags []string) {
+	sh.untagLocked(key)
+	tags = normalizeTags(tags)
+	if len(tags) == 0 {
+		return
+	}
+	sh.keyTags[key] = tags
+	sh.store.tags.add(key, tags)
+}
+
+// untagLocked removes key from the tag index and reports whether it had tags.
+// Callers must hold the shard lock.
+func (sh *shard) untagLocked(key string) bool {
+	tags, ok := sh.keyTags[key]
+	if !ok {
+		return false
+	}
+	sh.store.tags.remove(key, tags)
+	delete(sh.keyTags, key)
+	return true
+}
+
+func normalizeTags(tags []string) []string {
+	seen := make(map[string]bool, len(tags))
+	result := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		result = append(result, tag)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// tagLocal assigns tags to an existing key and replicates them.
+func tagLocal(key string, tags []string, broadcast bool) {
+	tags, found := storage.SetTags(key, tags)
+	if !found {
+		return
+	}
+
+	if broadcast {
+		broadcastTags(key, tags)
+	}
+}
+
+// flushTagLocal removes every key carrying the namespaced tag at once and
+// replicates the whole operation as one OpTagFlush frame.
+func flushTagLocal(tag string, broadcast bool) int {
+	removed := storage.DeleteTagged(tag)
+
+	if broadcast {
+		broadcastTagFlush(tag, removed)
+	}
+	return len(removed)
+}
+
+// -------------------------------------------------------------
+// Tag Frames
+// -------------------------------------------------------------
+
+func broadcastTags(key string, tags []string) {
+	var frame bytes.Buffer
+	writeTagsFrame(&frame, key, tags)
+	broadcastFrame("TAGS", frame.Bytes(), nil)
+}
+
+// broadcastSetTags sends a write together with its tags, the value as stored.
+// Legacy peers cannot read tags and get a plain SET of the decoded value
+// instead.
+func broadcastSetTags(key string, val []byte, expiration int64, version uint64, tags []string) {
+	peersMutex.Lock()
+	defer peersMutex.Unlock()
+	var plain []byte
+	for addr, conn := range peers {
+		var err error
+		if peerProtocols[conn] >= opProtocol(OpSetTags) {
+			err = writeSetTagsFrame(conn, key, val, expiration, version, tags)
+		} else {
+			if plain == nil {
+				plain = decodeValue(val)
+			}
+			err = writePeerSetFrame(conn, replLegacy, OpSet, key, plain, expiration, 0)
+		}
+		if err != nil {
+			log.Printf("Failed to broadcast SETTAGS to %s: %v", addr, err)
+		} else {
+			statsMutex.Lock()
+			stats.TotalBroadcasts++
+			statsMutex.Unlock()
+		}
+	}
+}
+
+// broadcastTagFlush replicates a tag flush. Legacy peers cannot read it and
+// get a DEL for every key it removed instead.
+func broadcastTagFlush(tag string, removed []string) {
+	var frame bytes.Buffer
+	writeTagFlushFrame(&frame, tag)
+	broadcastFrame("TAGFLUSH", frame.Bytes(), func() []byte {
+		return delFrames(removed)
+	})
+}
+
+// delFrames encodes a DEL frame for every key.
+func delFrames(keys []string) []byte {
+	var frames bytes.Buffer
+	for _, key := range keys {
+		writeDelFrame(&frames, key)
+	}
+	return frames.Bytes()
+}
+
+// broadcastFrame writes a pre-encoded frame to every peer that can read it.
+// Legacy peers get what legacy returns instead, encoded once for all of
+// them; with legacy nil, or when it returns nothing, they miss the frame.
+func broadcastFrame(name string, frame []byte, legacy func() []byte) {
+	peersMutex.Lock()
+	defer peersMutex.Unlock()
+	var fallback []byte
+	encoded := false
+	for addr, conn := range peers {
+		out := frame
+		if peerProtocols[conn] < opProtocol(frame[0]) {
+			if legacy == nil {
+				continue
+			}
+			if !encoded {
+				fallback, encoded = legacy(), true
+			}
+			if len(fallback) == 0 {
+				continue
+			}
+			out = fallback
+		}
+		_, err := conn.Write(out)
+		if err != nil {
+			log.Printf("Failed to broadcast %s to %s: %v", name, addr, err)
+		} else {
+			statsMutex.Lock()
+			stats.TotalBroadcasts++
+			statsMutex.Unlock()
+		}
+	}
+}
+
+// writeTagsFrame encodes: op | keyLen u16 | count u16 | key | count x (tagLen u16 | tag)
+func writeTagsFrame(w io.Writer, key string, tags []string) error {
+	header := make([]byte, 5)
+	header[0] = OpTags
+	binary.BigEndian.PutUint16(header[1:3], uint16(len(key)))
+	binary.BigEndian.PutUint16(header[3:5], uint16(len(tags)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(key)); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err := writeString16(w, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readTagsFrame(r *bufio.Reader) (string, []string, error) {
+	header := make([]byte, 4) // We already read the Op byte
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", nil, err
+	}
+	keyLen := binary.BigEndian.Uint16(header[0:2])
+	count := binary.BigEndian.Uint16(header[2:4])
+
+	keyBytes := make([]byte, keyLen)
+	if _, err := io.ReadFull(r, keyBytes); err != nil {
+		return "", nil, err
+	}
+	tags := make([]string, 0, min(count, framePrealloc))
+	for i := uint16(0); i < count; i++ {
+		tag, err := readString16(r)
+		if err != nil {
+			return "", nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return string(keyBytes), tags, nil
+}
+
+// writeSetTagsFrame encodes a write with the tags it assigns, a SET frame
+// followed by the tags:
+// ... | count u16 | count x (tagLen u16 | tag)
+func writeSetTagsFrame(w io.Writer, key string, val []byte, exp int64, version uint64, tags []string) error {
+	if err := writeSetFrame(w, OpSetTags, key, val, exp, version); err != nil {
+		return err
+	}
+	count := make([]byte, 2)
+	binary.BigEndian.PutUint16(count, uint16(len(tags)))
+	if _, err := w.Write(count); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err := writeString16(w, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readSetTagsFrame(r *bufio.Reader) (string, []byte, int64, uint64, []string, error) {
+	key, val, exp, version, err := readSetFrame(r)
+	if err != nil {
+		return "", nil, 0, 0, nil, err
+	}
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", nil, 0, 0, nil, err
+	}
+	count := binary.BigEndian.Uint16(header)
+	tags := make([]string, 0, min(count, framePrealloc))
+	for i := uint16(0); i < count; i++ {
+		tag, err := readString16(r)
+		if err != nil {
+			return "", nil, 0, 0, nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return key, val, exp, version, tags, nil
+}
+
+// writeTagFlushFrame encodes: op | tagLen u16 | tag
+func writeTagFlushFrame(w io.Writer, tag string) error {
+	if _, err := w.Write([]byte{OpTagFlush}); err != nil {
+		return err
+	}
+	return writeString16(w, tag)
+}
+
+func readTagFlushFrame(r *bufio.Reader) (string, error) {
+	return readString16(r)
+}
+
+func writeString16(w io.Writer, s string) error {
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(s)))
+	if _, err := w.Write(length); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte(s))
+	return err
+}
+
+func readString16(r *bufio.Reader) (string, error) {
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return "", err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// writeTagsDump sends the tags of the key of tx, if any.
+func writeTagsDump(w io.Writer, st keyState) {
+	if len(st.tags) > 0 {
+		writeTagsFrame(w, st.key, st.tags)
+	}
+}
+
+// -------------------------------------------------------------
+// Tag HTTP Handler
+// -------------------------------------------------------------
+
+func handleTags(w http.ResponseWriter, r *http.Request) {
+	tag := strings.TrimPrefix(r.URL.Path, "/api/hypercacheio/tags/")
+	if tag == "" {
+		http.Error(w, "Tag required", http.StatusBadRequest)
+		return
+	}
+	indexed := namespacedKey(requestNamespace(r), tag)
+
+	switch r.Method {
+	case "GET":
+		keys := storage.TaggedKeys(indexed)
+		for i, key := range keys {
+			_, keys[i] = splitKey(key)
+		}
+		sort.Strings(keys)
+		writeJSON(w, map[string]interface{}{"tag": tag, "keys": keys})
+
+	case "DELETE":
+		removed := flushTagLocal(indexed, true)
+		writeJSON(w, map[string]interface{}{"success": true, "removed": removed})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTagFlush(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	putWithKey := func(key, body string) {
+		req, _ := http.NewRequest("POST", "/api/hypercacheio/cache/"+key, bytes.NewBufferString(body))
+		handleCache(httptest.NewRecorder(), req)
+	}
+	putWithKey("user:1", `{"value": "a", "tags": ["users", "team:1"]}`)
+	putWithKey("user:2", `{"value": "b", "tags": ["users"]}`)
+	putWithKey("post:1", `{"value": "c", "tags": ["posts"]}`)
+
+	// A write without tags keeps the existing ones
+	putWithKey("user:2", `{"value": "b2"}`)
+
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM cache_tags WHERE tag = ?", "users").Scan(&count)
+	if count != 2 {
+		t.Errorf("Expected 2 persisted keys for tag 'users', got %d", count)
+	}
+
+	req, _ := http.NewRequest("DELETE", "/api/hypercacheio/tags/users", nil)
+	rr := httptest.NewRecorder()
+	handleTags(rr, req)
+
+	var resp map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp["removed"] != float64(2) {
+		t.Errorf("Expected 2 keys removed, got %v", resp["removed"])
+	}
+
+	if _, ok := getLocal("user:1"); ok {
+		t.Errorf("Tagged key user:1 survived the tag flush")
+	}
+	if _, ok := getLocal("post:1"); !ok {
+		t.Errorf("Untagged key post:1 was removed by the tag flush")
+	}
+
+	if stale := storage.TaggedKeys("team:1"); len(stale) > 0 {
+		t.Errorf("Tag 'team:1' still indexed after its only key was removed")
+	}
+
+	db.QueryRow("SELECT COUNT(*) FROM cache_tags").Scan(&count)
+	if count != 1 {
+		t.Errorf("Expected only the 'posts' tag row to remain, got %d rows", count)
+	}
+}
+
+func TestTagFramesRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	writeTagsFrame(&buf, "user:1", []string{"team:1", "users"})
+	writeTagFlushFrame(&buf, "users")
+
+	reader := bufio.NewReader(&buf)
+	if op, _ := reader.ReadByte(); op != OpTags {
+		t.Fatalf("Expected OpTags, got %d", op)
+	}
+	key, tags, err := readTagsFrame(reader)
+	if err != nil || key != "user:1" || len(tags) != 2 || tags[1] != "users" {
+		t.Errorf("TAGS frame did not round-trip: %v %v %v", key, tags, err)
+	}
+
+	if op, _ := reader.ReadByte(); op != OpTagFlush {
+		t.Fatalf("Expected OpTagFlush, got %d", op)
+	}
+	if tag, err := readTagFlushFrame(reader); err != nil || tag != "users" {
+		t.Errorf("TAGFLUSH frame did not round-trip: %v %v", tag, err)
+	}
+}
+
+func TestTaggedWritesTravelInOneFrame(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	local, remote := net.Pipe()
+	defer remote.Close()
+	peersMutex.Lock()
+	peers["peer"] = local
+	peerProtocols[local] = replProtocol
+	peersMutex.Unlock()
+	defer func() {
+		peersMutex.Lock()
+		delete(peers, "peer")
+		delete(peerProtocols, local)
+		peersMutex.Unlock()
+	}()
+
+	go func() {
+		req, _ := http.NewRequest("POST", "/api/hypercacheio/cache/user:1", bytes.NewBufferString(`{"value": "a", "tags": ["users"]}`))
+		handleCache(httptest.NewRecorder(), req)
+	}()
+	reader := bufio.NewReader(remote)
+	if op, _ := reader.ReadByte(); op != OpSetTags {
+		t.Fatalf("Expected one SETTAGS frame, got op %d", op)
+	}
+	key, _, _, version, tags, err := readSetTagsFrame(reader)
+	if err != nil || key != "user:1" || len(tags) != 1 || tags[0] != "users" {
+		t.Fatalf("SETTAGS frame did not round-trip: %q %v %v", key, tags, err)
+	}
+	remote.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if op, err := reader.ReadByte(); err == nil {
+		t.Errorf("Expected no frame after SETTAGS, got op %d", op)
+	}
+
+	// The receiving side applies both at once as well
+	replicateSet("user:2", []byte("i:1;"), 0, version+1, tags)
+	storage.View("user:2", func(tx *itemTx) {
+		if got := tx.Tags(); len(got) != 1 || got[0] != "users" {
+			t.Errorf("Expected the replicated tags, got %v", got)
+		}
+	})
+}
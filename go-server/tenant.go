@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+// -------------------------------------------------------------
+// Tenants
+// -------------------------------------------------------------
+//
+// Tenants are loaded from a JSON file (--tenants). Every tenant owns one or
+// more tokens and a namespace of its own; requests made with a tenant token
+// cannot leave that namespace. The global API token keeps full access.
+
+type Tenant struct {
+	Name      string   `json:"name"`
+	Tokens    []string `json:"tokens"`
+	MaxKeys   int      `json:"max_keys"`   // 0 means unlimited
+	MaxMemory int64    `json:"max_memory"` // Bytes of keys and values, 0 means unlimited
+
+	requests       atomic.Uint64
+	writes         atomic.Uint64
+	rejectedWrites atomic.Uint64
+}
+
+type TenantStats struct {
+	Name           string `json:"name"`
+	Items          int    `json:"items"`
+	Bytes          int64  `json:"bytes"`
+	MaxKeys        int    `json:"max_keys"`
+	MaxMemory      int64  `json:"max_memory"`
+	Requests       uint64 `json:"requests"`
+	Writes         uint64 `json:"writes"`
+	RejectedWrites uint64 `json:"rejected_writes"`
+}
+
+type tenantContextKey struct{}
+
+var (
+	tenantList    []*Tenant
+	tenantByToken = make(map[string]*Tenant)
+)
+
+// loadTenants reads the tenants file, e.g.
+// {"tenants": [{"name": "shop", "tokens": ["..."], "max_keys": 10000, "max_memory": 67108864}]}
+func loadTenants(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config struct {
+		Tenants []*Tenant `json:"tenants"`
+	}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return fmt.Errorf("invalid tenants file: %w", err)
+	}
+
+	names := make(map[string]bool)
+	byToken := make(map[string]*Tenant)
+	for _, tenant := range config.Tenants {
+		if tenant.Name == "" || names[tenant.Name] {
+			return fmt.Errorf("tenant names must be unique and not empty")
+		}
+		names[tenant.Name] = true
+		if len(tenant.Tokens) == 0 {
+			return fmt.Errorf("tenant %s has no tokens", tenant.Name)
+		}
+		for _, token := range tenant.Tokens {
+			if token == "" || token == apiToken || byToken[token] != nil {
+				return fmt.Errorf("tenant %s has an empty or reused token", tenant.Name)
+			}
+			byToken[token] = tenant
+		}
+	}
+
+	tenantList = config.Tenants
+	tenantByToken = byToken
+	return nil
+}
+
+func (t *Tenant) namespace() string {
+	return "tenant:" + t.Name
+}
+
+func (t *Tenant) stats() TenantStats {
+	used := usageOf(t.namespace())
+	return TenantStats{
+		Name:           t.Name,
+		Items:          used.Items,
+		Bytes:          used.Bytes,
+		MaxKeys:        t.MaxKeys,
+		MaxMemory:      t.MaxMemory,
+		Requests:       t.requests.Load(),
+		Writes:         t.writes.Load(),
+		RejectedWrites: t.rejectedWrites.Load(),
+	}
+}
+
+// withTenant attaches tenant to the request context and counts the request.
+func withTenant(r *http.Request, tenant *Tenant) *http.Request {
+	tenant.requests.Add(1)
+	return r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, tenant))
+}
+
+// requestTenant returns the tenant of an authenticated request, or nil for
+// requests made with the global API token.
+func requestTenant(r *http.Request) *Tenant {
+	tenant, _ := r.Context().Value(tenantContextKey{}).(*Tenant)
+	return tenant
+}
+
+// allowWrite checks the memory limit and the quota of the request tenant
+// before the given keys are written with values of the given sizes,
+// answering 507 when either would be exceeded. The check happens before the
+// write, so concurrent writers may overshoot by their in-flight writes.
+func allowWrite(w http.ResponseWriter, r *http.Request, sizes map[string]int) bool {
+	tenant := requestTenant(r)
+
+	newItems, grow := 0, int64(0)
+	for key, size := range sizes {
+		storage.View(key, func(tx *itemTx) {
+			if old, exists := tx.Item(); exists {
+				grow += int64(size - len(old.Value))
+				return
+			}
+			newItems++
+			grow += int64(len(key) + size)
+		})
+	}
+	var used usage
+	if tenant != nil {
+		used = usageOf(tenant.namespace())
+	}
+
+	if memoryFull(grow + int64(newItems*itemOverhead)) {
+		if tenant != nil {
+			tenant.rejectedWrites.Add(1)
+		}
+		http.Error(w, `{"error": "Memory limit reached"}`, http.StatusInsufficientStorage)
+		return false
+	}
+	if tenant == nil {
+		return true
+	}
+
+	items, bytes := used.Items+newItems, used.Bytes+grow
+	if (tenant.MaxKeys > 0 && items > tenant.MaxKeys && newItems > 0) ||
+		(tenant.MaxMemory > 0 && bytes > tenant.MaxMemory && grow > 0) {
+		tenant.rejectedWrites.Add(1)
+		http.Error(w, `{"error": "Tenant quota exceeded"}`, http.StatusInsufficientStorage)
+		return false
+	}
+	tenant.writes.Add(1)
+	return true
+}
+
+// tenantStats returns the stats of every tenant ordered by name.
+func tenantStats() []TenantStats {
+	result := make([]TenantStats, 0, len(tenantList))
+	for _, tenant := range tenantList {
+		result = append(result, tenant.stats())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func setupTenants(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	os.WriteFile(path, []byte(`{"tenants": [
+		{"name": "shop", "tokens": ["shop-token"], "max_keys": 2},
+		{"name": "blog", "tokens": ["blog-token", "blog-token-2"], "max_memory": 64}
+	]}`), 0600)
+
+	apiToken = "admin-token"
+	if err := loadTenants(path); err != nil {
+		t.Fatalf("Failed to load tenants: %v", err)
+	}
+	t.Cleanup(func() {
+		tenantList = nil
+		tenantByToken = make(map[string]*Tenant)
+	})
+}
+
+func tenantRequest(token, method, path, body string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/hypercacheio/cache/", handleCache)
+	mux.HandleFunc("/api/hypercacheio/ping", handlePing)
+
+	req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("X-Hypercacheio-Token", token)
+	req.Header.Set(namespaceHeader, "escape-attempt")
+	rr := httptest.NewRecorder()
+	authMiddleware(mux).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestTenantIsolation(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	setupTenants(t)
+
+	tenantRequest("shop-token", "POST", "/api/hypercacheio/cache/config", `{"value": "shop"}`)
+	tenantRequest("blog-token", "POST", "/api/hypercacheio/cache/config", `{"value": "blog"}`)
+
+	for token, want := range map[string]string{"shop-token": "shop", "blog-token-2": "blog"} {
+		rr := tenantRequest(token, "GET", "/api/hypercacheio/cache/config", "")
+		var resp map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		if resp["data"] != want {
+			t.Errorf("Token %s read %v, want %v", token, resp["data"], want)
+		}
+	}
+
+	if _, ok := getLocal(namespacedKey("tenant:shop", "config")); !ok {
+		t.Errorf("Expected the namespace header to be ignored for tenants")
+	}
+	if rr := tenantRequest("unknown", "GET", "/api/hypercacheio/cache/config", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected unknown tokens to be rejected, got %v", rr.Code)
+	}
+}
+
+func TestTenantQuotas(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	setupTenants(t)
+
+	tenantRequest("shop-token", "POST", "/api/hypercacheio/cache/a", `{"value": 1}`)
+	tenantRequest("shop-token", "POST", "/api/hypercacheio/cache/b", `{"value": 1}`)
+	if rr := tenantRequest("shop-token", "POST", "/api/hypercacheio/cache/c", `{"value": 1}`); rr.Code != http.StatusInsufficientStorage {
+		t.Errorf("Expected the key quota to reject a third key, got %v", rr.Code)
+	}
+	if rr := tenantRequest("shop-token", "POST", "/api/hypercacheio/cache/a", `{"value": 2}`); rr.Code != http.StatusOK {
+		t.Errorf("Expected overwriting an existing key to stay within quota, got %v", rr.Code)
+	}
+
+	big := `{"value": "` + string(bytes.Repeat([]byte("x"), 100)) + `"}`
+	if rr := tenantRequest("blog-token", "POST", "/api/hypercacheio/cache/post", big); rr.Code != http.StatusInsufficientStorage {
+		t.Errorf("Expected the memory quota to reject a large value, got %v", rr.Code)
+	}
+
+	rr := tenantRequest("shop-token", "GET", "/api/hypercacheio/ping", "")
+	var ping struct {
+		Namespaces map[string]int `json:"namespaces"`
+		Tenant     TenantStats    `json:"tenant"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &ping)
+	if ping.Namespaces != nil {
+		t.Errorf("Expected tenants not to see other namespaces")
+	}
+	if ping.Tenant.Items != 2 || ping.Tenant.Writes != 3 || ping.Tenant.RejectedWrites != 1 {
+		t.Errorf("Unexpected tenant stats: %+v", ping.Tenant)
+	}
+}
@@ -0,0 +1,843 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/maphash"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------------------------------------------------
+// Tiered Engine
+// -------------------------------------------------------------
+//
+// The tiered engine keeps the full store in SQLite and only a hot tier,
+// bounded by --max-memory, in memory. A key missing from memory is looked up
+// in the write-behind queue, then in SQLite, and promoted into memory. An
+// eviction demotes a key: it only leaves memory, SQLite still has it. Nothing
+// is loaded on startup except, with --warm-up, the keys that were most
+// recently used when the server last stopped.
+//
+// An operation on a key holds the stripe of that key from the lookup until
+// its new state is queued, so a promotion never brings back an older state
+// than one just written, and pins the key so it is not evicted halfway.
+// Operations spanning the keyspace flush the queue and read SQLite. Len and
+// the memory limit only see the hot tier, so tenant quotas do not apply, and
+// the number of cold keys in the stats is recounted at most every
+// tierCountInterval.
+
+const (
+	storageTiered = "tiered"
+
+	tierStripes   = 256
+	tierScanChunk = 256
+
+	tierCountInterval = 30 * time.Second
+)
+
+var warmUp int
+
+type tieredStore struct {
+	*sqliteStore
+	seed    maphash.Seed
+	stripes [tierStripes]tierStripe
+
+	hits       atomic.Uint64
+	misses     atomic.Uint64
+	promotions atomic.Uint64
+	warmed     atomic.Uint64
+
+	coldKeys    atomic.Int64
+	coldCounted atomic.Int64 // Unix nanoseconds of the last count
+	counting    atomic.Bool
+}
+
+// tierStripe serializes the operations on the keys hashed to it.
+type tierStripe struct {
+	sync.Mutex
+	pinMu sync.Mutex
+	pins  map[string]int // Guarded by pinMu
+}
+
+type TierStats struct {
+	HotKeys    int    `json:"hot_keys"`
+	ColdKeys   int64  `json:"cold_keys"`
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+	Promotions uint64 `json:"promotions"`
+	Demotions  uint64 `json:"demotions"`
+	WarmedUp   uint64 `json:"warmed_up"`
+}
+
+// coldKey is a key read from the cold tier.
+type coldKey struct {
+	item    CacheItem
+	counter *PNCounter
+	tags    []string
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Conn.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func newTieredStore(mem *memoryStore, db *sql.DB) (*tieredStore, error) {
+	if maxMemory <= 0 || evictionPolicy == policyNoEviction {
+		return nil, fmt.Errorf("the tiered storage engine needs --max-memory and an eviction policy other than noeviction")
+	}
+	if replicateEvictions {
+		return nil, fmt.Errorf("the tiered storage engine only demotes evicted keys, --replicate-evictions does not apply")
+	}
+	if encryptKeys {
+		return nil, fmt.Errorf("the tiered storage engine reads cold keys in key order, --encrypt-keys does not apply")
+	}
+	if len(tenantList) > 0 {
+		return nil, fmt.Errorf("the tiered storage engine keeps cold keys out of tenant quotas, --tenants does not apply")
+	}
+	s := &tieredStore{sqliteStore: newSqliteStore(mem, db), seed: maphash.MakeSeed()}
+	for i := range s.stripes {
+		s.stripes[i].pins = make(map[string]int)
+	}
+	if keys, ok := mem.keys.(*shardedStore); ok {
+		keys.pinned = s.pinned
+	}
+	return s, nil
+}
+
+func (s *tieredStore) stripe(key string) *tierStripe {
+	return &s.stripes[maphash.String(s.seed, key)%tierStripes]
+}
+
+func (s *tieredStore) pinned(key string) bool {
+	st := s.stripe(key)
+	st.pinMu.Lock()
+	defer st.pinMu.Unlock()
+	return st.pins[key] > 0
+}
+
+func (st *tierStripe) pin(key string, delta int) {
+	st.pinMu.Lock()
+	if st.pins[key] += delta; st.pins[key] <= 0 {
+		delete(st.pins, key)
+	}
+	st.pinMu.Unlock()
+}
+
+// withKeys locks the stripes of keys in a fixed order, promotes the keys
+// and runs fn while they are pinned.
+func (s *tieredStore) withKeys(keys []string, fn func()) {
+	indexes := make([]int, 0, len(keys))
+	held := make(map[int]bool, len(keys))
+	for _, key := range keys {
+		i := int(maphash.String(s.seed, key) % tierStripes)
+		if !held[i] {
+			held[i] = true
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+	for _, i := range indexes {
+		s.stripes[i].Lock()
+	}
+	defer func() {
+		for _, i := range indexes {
+			s.stripes[i].Unlock()
+		}
+	}()
+
+	for _, key := range keys {
+		st := s.stripe(key)
+		st.pin(key, 1)
+		defer st.pin(key, -1)
+		s.promote(key)
+	}
+	fn()
+}
+
+func (s *tieredStore) withKey(key string, fn func()) {
+	s.withKeys([]string{key}, fn)
+}
+
+// promote copies key from the cold tier into memory unless it is hot.
+// Callers must hold the stripe of key.
+func (s *tieredStore) promote(key string) {
+	if _, hot := s.keys.Get(key); hot {
+		s.hits.Add(1)
+		return
+	}
+	s.misses.Add(1)
+	cold, found, err := s.readCold(key)
+	if err != nil {
+		log.Printf("Failed to read %q from SQLite: %v", key, err)
+		return
+	}
+	if !found {
+		return
+	}
+	s.keys.Update(key, func(tx *itemTx) {
+		if _, exists := tx.Item(); exists {
+			return
+		}
+		tx.Store(cold.item.Value, cold.item.Expiration, cold.item.Version)
+		if cold.counter != nil {
+			tx.SetCounter(cold.counter)
+		}
+		if len(cold.tags) > 0 {
+			tx.SetTags(cold.tags)
+		}
+		s.promotions.Add(1)
+	})
+}
+
+// readCold returns the newest state of key outside of memory: queued for
+// SQLite or in it. Expired items are not returned.
+func (s *tieredStore) readCold(key string) (coldKey, bool, error) {
+	var cold coldKey
+	p, queued := s.queue.lookup(key)
+	if queued && p.state != nil {
+		if !p.state.exists {
+			return cold, false, nil
+		}
+		cold.item = p.state.item
+		if p.state.counter != nil {
+			cold.counter = p.state.counter.clone()
+		}
+	} else {
+		item, found, err := readColdItem(s.db, key)
+		if err != nil || !found {
+			return cold, false, err
+		}
+		cold.item = item
+		counters, err := readColdCounters(s.db, key, key)
+		if err != nil {
+			return cold, false, err
+		}
+		cold.counter = counters[key]
+	}
+	if cold.item.Expiration > 0 && cold.item.Expiration < time.Now().Unix() {
+		return cold, false, nil
+	}
+
+	switch {
+	case queued && p.hasTags:
+		cold.tags = p.tags
+	case queued && p.state != nil && p.state.dropped.tags:
+	default:
+		tags, err := readColdTags(s.db, key, key)
+		if err != nil {
+			return cold, false, err
+		}
+		cold.tags = tags[key]
+	}
+	return cold, true, nil
+}
+
+func (s *tieredStore) Get(key string) (CacheItem, bool) {
+	if item, ok := s.keys.Get(key); ok {
+		s.hits.Add(1)
+		return item, true
+	}
+	var item CacheItem
+	var ok bool
+	s.withKey(key, func() {
+		item, ok = s.keys.Get(key)
+	})
+	return item, ok
+}
+
+func (s *tieredStore) View(key string, fn func(tx *itemTx)) {
+	if _, hot := s.keys.Get(key); hot {
+		s.hits.Add(1)
+		s.keys.View(key, fn)
+		return
+	}
+	s.withKey(key, func() {
+		s.keys.View(key, fn)
+	})
+}
+
+func (s *tieredStore) Set(key string, val []byte, expiration int64, version uint64) CacheItem {
+	var item CacheItem
+	s.withKey(key, func() {
+		item = s.sqliteStore.Set(key, val, expiration, version)
+	})
+	return item
+}
+
+func (s *tieredStore) Add(key string, val []byte, expiration int64) (CacheItem, bool) {
+	var item CacheItem
+	added := false
+	s.withKey(key, func() {
+		item, added = s.sqliteStore.Add(key, val, expiration)
+	})
+	return item, added
+}
+
+func (s *tieredStore) CompareAndSwap(key string, val []byte, expiration int64, expected uint64) (uint64, bool) {
+	var version uint64
+	swapped := false
+	s.withKey(key, func() {
+		version, swapped = s.sqliteStore.CompareAndSwap(key, val, expiration, expected)
+	})
+	return version, swapped
+}
+
+func (s *tieredStore) Update(key string, fn func(tx *itemTx) bool) {
+	s.withKey(key, func() {
+		s.sqliteStore.Update(key, fn)
+	})
+}
+
+func (s *tieredStore) SetMany(items []BatchItem) {
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = item.Key
+	}
+	s.withKeys(keys, func() {
+		s.sqliteStore.SetMany(items)
+	})
+}
+
+func (s *tieredStore) SetTags(key string, tags []string) ([]string, bool) {
+	found := false
+	s.withKey(key, func() {
+		tags, found = s.sqliteStore.SetTags(key, tags)
+	})
+	return tags, found
+}
+
+func (s *tieredStore) Expire(key string, expiration int64) bool {
+	ok := false
+	s.withKey(key, func() {
+		ok = s.sqliteStore.Expire(key, expiration)
+	})
+	return ok
+}
+
+// Delete removes key from both tiers without promoting it first.
+func (s *tieredStore) Delete(key string) {
+	st := s.stripe(key)
+	st.Lock()
+	defer st.Unlock()
+	r := s.delete(key)
+	r.counter, r.tags = true, true // The cold tier may hold them
+	s.Discard([]removal{r})
+}
+
+func (s *tieredStore) DeleteMatching(prefix string, match func(key string) bool) []string {
+	matched := make([]string, 0)
+	s.Scan("", prefix, func(st keyState) bool {
+		if match(st.key) {
+			matched = append(matched, st.key)
+		}
+		return true
+	})
+	for _, key := range matched {
+		s.Delete(key)
+	}
+	return matched
+}
+
+// DeleteTagged promotes the cold keys carrying tag, then removes them with
+// the hot ones in one step.
+func (s *tieredStore) DeleteTagged(tag string) []string {
+	var removals []removal
+	s.withKeys(s.TaggedKeys(tag), func() {
+		removals = s.keys.RemoveTagged(tag, nil)
+	})
+	for i := range removals {
+		removals[i].counter, removals[i].tags = true, true // The cold tier may hold them
+	}
+	s.Discard(removals)
+	return removedKeys(removals)
+}
+
+// TaggedKeys returns the hot keys carrying tag and the cold ones SQLite has
+// it for.
+func (s *tieredStore) TaggedKeys(tag string) []string {
+	s.queue.flush()
+	keys := s.keys.TaggedKeys(tag)
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		seen[key] = true
+	}
+
+	_, name := splitKey(tag)
+	rows, err := s.db.Query("SELECT key FROM cache_tags WHERE tag = ?", name)
+	if err != nil {
+		log.Printf("Failed to read tags from SQLite: %v", err)
+		return keys
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		if rows.Scan(&key) != nil || seen[key] || indexedTag(key, name) != tag {
+			continue
+		}
+		hot := false
+		s.keys.View(key, func(tx *itemTx) {
+			_, hot = tx.Item()
+		})
+		if !hot { // Memory knows the current tags of hot keys
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// scanEntry is an item handed out by a scanCursor.
+type scanEntry struct {
+	key  string
+	item CacheItem
+	tags []string // Only read by Scan
+}
+
+// scanCursor walks one sorted source of items, fetching a chunk at a time.
+// A chunk shorter than tierScanChunk ends the source.
+type scanCursor struct {
+	fetch func(from string) []scanEntry
+	from  string
+	buf   []scanEntry
+	done  bool
+}
+
+func (c *scanCursor) peek() (scanEntry, bool) {
+	if len(c.buf) == 0 && !c.done {
+		c.buf = c.fetch(c.from)
+		c.done = len(c.buf) < tierScanChunk
+		if n := len(c.buf); n > 0 {
+			c.from = c.buf[n-1].key + "\x00"
+		}
+	}
+	if len(c.buf) == 0 {
+		return scanEntry{}, false
+	}
+	return c.buf[0], true
+}
+
+// Scan merges the hot tier with the items and locks in SQLite. Memory holds
+// the newest state of the keys it has, the queue that of recently demoted
+// ones.
+func (s *tieredStore) Scan(from, prefix string, fn func(st keyState) bool) {
+	if from < prefix {
+		from = prefix
+	}
+	s.queue.flush()
+
+	hot := &scanCursor{from: from, fetch: func(from string) []scanEntry {
+		chunk := make([]scanEntry, 0, tierScanChunk)
+		s.keys.Ascend(from, prefix, func(st keyState) bool {
+			chunk = append(chunk, scanEntry{key: st.key, item: st.item, tags: st.tags})
+			return len(chunk) < tierScanChunk
+		})
+		return chunk
+	}}
+	cold := &scanCursor{from: from, fetch: func(from string) []scanEntry {
+		chunk, err := readColdItems(s.db, from, prefix, tierScanChunk)
+		if err == nil && len(chunk) > 0 {
+			var tags map[string][]string
+			tags, err = readColdTags(s.db, chunk[0].key, chunk[len(chunk)-1].key)
+			for i := range chunk {
+				chunk[i].tags = tags[chunk[i].key]
+			}
+		}
+		if err != nil {
+			log.Printf("Failed to scan SQLite: %v", err)
+		}
+		return chunk
+	}}
+	locks, err := readColdLocks(s.db, from, prefix)
+	if err != nil {
+		log.Printf("Failed to scan SQLite locks: %v", err)
+	}
+	cursors := []*scanCursor{hot, cold, {buf: locks, done: true}}
+
+	for {
+		var next scanEntry
+		source := -1
+		for i, c := range cursors {
+			if e, ok := c.peek(); ok && (source < 0 || e.key < next.key) {
+				next, source = e, i
+			}
+		}
+		if source < 0 {
+			return
+		}
+		for _, c := range cursors {
+			if e, ok := c.peek(); ok && e.key == next.key {
+				c.buf = c.buf[1:]
+			}
+		}
+		if source > 0 {
+			if p, queued := s.queue.lookup(next.key); queued && p.state != nil {
+				if !p.state.exists {
+					continue
+				}
+				next.item, next.tags = p.state.item, p.state.tags
+			}
+		}
+		if !fn(keyState{key: next.key, item: next.item, exists: true, tags: next.tags}) {
+			return
+		}
+	}
+}
+
+// Range calls fn for every key in SQLite once the queue has been written.
+func (s *tieredStore) Range(fn func(st keyState) bool) {
+	s.queue.flush()
+	err := rangeCold(s.db, func(key string, cold coldKey) bool {
+		return fn(keyState{key: key, item: cold.item, exists: true, counter: cold.counter, tags: cold.tags})
+	})
+	if err != nil {
+		log.Printf("Failed to read SQLite: %v", err)
+	}
+}
+
+// Freeze runs fn for every key in SQLite as of one point in time: the queue
+// is written out and a read transaction started before any later batch.
+// Writers carry on while fn runs.
+func (s *tieredStore) Freeze(fn func(tx *itemTx) bool) {
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		log.Printf("Failed to freeze SQLite: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	s.queue.exclusive(false, func(ex execer) {
+		// A deferred transaction takes its snapshot at the first read
+		if _, err = conn.ExecContext(ctx, "BEGIN DEFERRED"); err == nil {
+			var n int
+			err = conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM cache_locks").Scan(&n)
+		}
+	})
+	defer conn.ExecContext(ctx, "ROLLBACK")
+	if err == nil {
+		err = rangeCold(conn, coldTx(fn))
+	}
+	if err != nil {
+		log.Printf("Failed to freeze SQLite: %v", err)
+	}
+}
+
+func (s *tieredStore) Sweep(now int64, batch int) int {
+	count := s.memoryStore.Sweep(now, batch)
+	// Cold keys expire without ever being in memory
+	s.queue.exclusive(false, func(ex execer) {
+		sweepSqlite(ex, now)
+	})
+	return count
+}
+
+// Load leaves the keys in SQLite and only promotes those that were most
+// recently used when the server stopped, up to --warm-up of them.
+func (s *tieredStore) Load() error {
+	s.startReencrypt()
+	if warmUp <= 0 {
+		return nil
+	}
+	rows, err := s.db.Query("SELECT key FROM cache_hot ORDER BY rank LIMIT ?", warmUp)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0)
+	for rows.Next() {
+		var key string
+		if rows.Scan(&key) == nil {
+			keys = append(keys, key)
+		}
+	}
+	rows.Close()
+
+	before := s.promotions.Load()
+	for _, key := range keys {
+		if s.keys.Memory() >= maxMemory {
+			break
+		}
+		s.withKey(key, func() {})
+	}
+	s.warmed.Store(s.promotions.Load() - before)
+	log.Printf("Warmed up %d of %d recently used keys from SQLite", s.warmed.Load(), len(keys))
+	return nil
+}
+
+// Close drains the queue and records the hot keys for the next warm-up.
+func (s *tieredStore) Close() error {
+	s.closeQueue()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM cache_hot"); err != nil {
+		return err
+	}
+	for rank, key := range s.keys.HotKeys(s.keys.Len()) {
+		if _, err := tx.Exec("INSERT INTO cache_hot(key, rank) VALUES(?, ?)", key, rank); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// countColdKeys recounts the keys in SQLite, which takes a full scan of
+// its tables, so Stats only reports the last count.
+func (s *tieredStore) countColdKeys() {
+	var cold int64
+	err := s.db.QueryRow("SELECT (SELECT COUNT(*) FROM cache) + (SELECT COUNT(*) FROM cache_locks)").Scan(&cold)
+	if err == nil {
+		s.coldKeys.Store(cold)
+	}
+	s.coldCounted.Store(time.Now().UnixNano())
+}
+
+func (s *tieredStore) Stats() StorageStats {
+	st := s.sqliteStore.Stats()
+	st.Engine = storageTiered
+
+	if time.Since(time.Unix(0, s.coldCounted.Load())) >= tierCountInterval && s.counting.CompareAndSwap(false, true) {
+		go func() {
+			defer s.counting.Store(false)
+			s.countColdKeys()
+		}()
+	}
+	statsMutex.Lock()
+	demotions := stats.Evictions
+	statsMutex.Unlock()
+	st.Tiers = &TierStats{
+		HotKeys:    s.keys.Len(),
+		ColdKeys:   s.coldKeys.Load(),
+		Hits:       s.hits.Load(),
+		Misses:     s.misses.Load(),
+		Promotions: s.promotions.Load(),
+		Demotions:  demotions,
+		WarmedUp:   s.warmed.Load(),
+	}
+	return st
+}
+
+// -------------------------------------------------------------
+// Cold Tier Reads
+// -------------------------------------------------------------
+
+func nullExpiration(exp sql.NullInt64) int64 {
+	if exp.Valid {
+		return exp.Int64
+	}
+	return 0
+}
+
+// readColdItem reads the item or lock stored under key.
+func readColdItem(q queryer, key string) (CacheItem, bool, error) {
+	var item CacheItem
+	var exp sql.NullInt64
+	var err error
+	ctx := context.Background()
+	if name, isLock := lockName(key); isLock {
+		var owner string
+		err = q.QueryRowContext(ctx, "SELECT owner, expiration FROM cache_locks WHERE key = ?", name).Scan(&owner, &exp)
+		item.Value = []byte(owner)
+	} else {
+		var version int64
+		err = q.QueryRowContext(ctx, "SELECT value, expiration, version FROM cache WHERE key = ?", key).Scan(&item.Value, &exp, &version)
+		item.Version = uint64(version)
+	}
+	if err == sql.ErrNoRows {
+		return item, false, nil
+	}
+	if err == nil {
+		_, item.Value, err = openValue(key, item.Value)
+	}
+	item.Expiration = nullExpiration(exp)
+	return item, err == nil, err
+}
+
+// readColdItems returns up to limit live items from key from on, in key order.
+func readColdItems(q queryer, from, prefix string, limit int) ([]scanEntry, error) {
+	query := "SELECT key, value, expiration, version FROM cache WHERE key >= ?"
+	args := []interface{}{from}
+	if end, bounded := prefixEnd(prefix); bounded {
+		query += " AND key < ?"
+		args = append(args, end)
+	}
+	rows, err := q.QueryContext(context.Background(), query+" ORDER BY key LIMIT ?", append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]scanEntry, 0, limit)
+	for rows.Next() {
+		var e scanEntry
+		var exp sql.NullInt64
+		var version int64
+		if err := rows.Scan(&e.key, &e.item.Value, &exp, &version); err != nil {
+			return entries, err
+		}
+		if _, e.item.Value, err = openValue(e.key, e.item.Value); err != nil {
+			return entries, err
+		}
+		e.item.Expiration, e.item.Version = nullExpiration(exp), uint64(version)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// readColdLocks returns the locks whose in-memory key starts with prefix
+// and is >= from, in key order. Lock names sort differently than their keys,
+// so all of them are read.
+func readColdLocks(q queryer, from, prefix string) ([]scanEntry, error) {
+	rows, err := q.QueryContext(context.Background(), "SELECT key, owner, expiration FROM cache_locks")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]scanEntry, 0)
+	for rows.Next() {
+		var name, owner string
+		var exp sql.NullInt64
+		if err := rows.Scan(&name, &owner, &exp); err != nil {
+			return entries, err
+		}
+		key := lockKey(name)
+		if key >= from && strings.HasPrefix(key, prefix) {
+			entries = append(entries, scanEntry{key: key, item: CacheItem{Value: []byte(owner), Expiration: nullExpiration(exp)}})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	return entries, rows.Err()
+}
+
+// readColdCounters returns the counters of the keys between first and last.
+func readColdCounters(q queryer, first, last string) (map[string]*PNCounter, error) {
+	rows, err := q.QueryContext(context.Background(), "SELECT key, node, epoch, pos, neg FROM cache_counters WHERE key >= ? AND key <= ?", first, last)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counters := make(map[string]*PNCounter)
+	for rows.Next() {
+		var key, node string
+		var epoch, pos, neg sql.NullInt64
+		if err := rows.Scan(&key, &node, &epoch, &pos, &neg); err != nil {
+			return counters, err
+		}
+		c, ok := counters[key]
+		if !ok {
+			c = newPNCounter()
+			counters[key] = c
+		}
+		c.Merge(uint64(epoch.Int64), node, uint64(pos.Int64), uint64(neg.Int64))
+	}
+	return counters, rows.Err()
+}
+
+// readColdTags returns the tags of the keys between first and last.
+func readColdTags(q queryer, first, last string) (map[string][]string, error) {
+	rows, err := q.QueryContext(context.Background(), "SELECT key, tag FROM cache_tags WHERE key >= ? AND key <= ?", first, last)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make(map[string][]string)
+	for rows.Next() {
+		var key, tag string
+		if err := rows.Scan(&key, &tag); err != nil {
+			return tags, err
+		}
+		tags[key] = append(tags[key], tag)
+	}
+	return tags, rows.Err()
+}
+
+// rangeCold runs fn for every live key in SQLite, items in key order after
+// the locks.
+func rangeCold(q queryer, fn func(key string, cold coldKey) bool) error {
+	now := time.Now().Unix()
+	visit := func(key string, cold coldKey) bool {
+		if cold.item.Expiration > 0 && cold.item.Expiration < now {
+			return true
+		}
+		return fn(key, cold)
+	}
+
+	locks, err := readColdLocks(q, "", "")
+	if err != nil {
+		return err
+	}
+	for _, l := range locks {
+		if !visit(l.key, coldKey{item: l.item}) {
+			return nil
+		}
+	}
+
+	for from := ""; ; {
+		chunk, err := readColdItems(q, from, "", tierScanChunk)
+		if err != nil || len(chunk) == 0 {
+			return err
+		}
+		first, last := chunk[0].key, chunk[len(chunk)-1].key
+		counters, err := readColdCounters(q, first, last)
+		if err != nil {
+			return err
+		}
+		tags, err := readColdTags(q, first, last)
+		if err != nil {
+			return err
+		}
+		for _, e := range chunk {
+			if !visit(e.key, coldKey{item: e.item, counter: counters[e.key], tags: tags[e.key]}) {
+				return nil
+			}
+		}
+		if len(chunk) < tierScanChunk {
+			return nil
+		}
+		from = last + "\x00"
+	}
+}
+
+// coldTx hands every cold key to fn as an itemTx of a scratch keyspace.
+func coldTx(fn func(tx *itemTx) bool) func(key string, cold coldKey) bool {
+	scratch := newShardedStore(1)
+	return func(key string, cold coldKey) bool {
+		more := true
+		scratch.Update(key, func(tx *itemTx) {
+			tx.Store(cold.item.Value, cold.item.Expiration, cold.item.Version)
+			if cold.counter != nil {
+				tx.SetCounter(cold.counter)
+			}
+			if len(cold.tags) > 0 {
+				tx.SetTags(cold.tags)
+			}
+			more = fn(tx)
+			tx.Remove()
+		})
+		return more
+	}
+}
+
+// prefixEnd returns the smallest string above every string starting with
+// prefix, if there is one.
+func prefixEnd(prefix string) (string, bool) {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1]), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func setupTiered(t *testing.T) (*tieredStore, *sql.DB) {
+	conn, err := openSqlite(filepath.Join(t.TempDir(), "tiered.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	if _, err := migrate(conn, false); err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+	maxMemory, evictionPolicy = 4096, policyLRU
+	s, err := newTieredStore(newMemoryStore(4), conn)
+	if err != nil {
+		t.Fatalf("Failed to create the tiered store: %v", err)
+	}
+	storage = s
+	t.Cleanup(func() {
+		storage.Close()
+		conn.Close()
+		maxMemory, warmUp = 0, 0
+		storage = newMemoryStore(defaultShards)
+	})
+	return s, conn
+}
+
+func TestTieredPromotesEvictedKeys(t *testing.T) {
+	s, _ := setupTiered(t)
+	written := make([]uint64, 100)
+	for i := 0; i < 100; i++ {
+		written[i] = s.Set(fmt.Sprintf("key:%03d", i), []byte(fmt.Sprintf("i:%d;", i)), 0, 0).Version
+	}
+	if s.Len() >= 100 || s.Memory() > maxMemory {
+		t.Fatalf("Expected the hot tier to stay within the limit, got %d keys and %d bytes", s.Len(), s.Memory())
+	}
+
+	// Demoted keys come back from the queue or SQLite alike
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key:%03d", i)
+		if item, ok := s.Get(key); !ok || string(item.Value) != fmt.Sprintf("i:%d;", i) || item.Version != written[i] {
+			t.Fatalf("Expected %s to be promoted with its value, got %+v", key, item)
+		}
+	}
+	s.queue.flush()
+	s.countColdKeys()
+	if stats := s.Stats().Tiers; stats.Promotions == 0 || stats.ColdKeys != 100 {
+		t.Errorf("Expected promotions to be counted and every key in SQLite, got %+v", stats)
+	}
+
+	// A write to a cold key gets a version newer than its stored one
+	s.keys.Flush(nil)
+	if item := s.Set("key:000", []byte("i:0;"), 0, 0); item.Version <= written[0] {
+		t.Errorf("Expected a version newer than %d, got %d", written[0], item.Version)
+	}
+	if _, added := s.Add("key:001", []byte("i:1;"), 0); added {
+		t.Errorf("Expected Add to see the cold key")
+	}
+}
+
+func TestTieredColdKeysKeepTheirState(t *testing.T) {
+	s, _ := setupTiered(t)
+	s.Set("tagged", []byte("i:1;"), 0, 0)
+	s.SetTags("tagged", []string{"group"})
+	incrCounter("hits", 3, nil)
+	s.Set("gone", []byte("i:1;"), 0, 0)
+	s.Set("stale", []byte("i:1;"), time.Now().Unix()-1, 0)
+	s.queue.flush()
+	s.keys.Flush(nil) // Demote everything
+
+	s.Delete("gone")
+	if _, ok := s.Get("gone"); ok {
+		t.Errorf("Expected a deleted cold key to stay deleted")
+	}
+	if _, ok := s.Get("stale"); ok {
+		t.Errorf("Expected an expired cold key not to be promoted")
+	}
+	if v, _ := incrCounter("hits", 2, nil); v != 5 {
+		t.Errorf("Expected the cold counter to carry on, got %d", v)
+	}
+
+	s.keys.Flush(nil)
+	if keys := s.TaggedKeys(indexedTag("tagged", "group")); len(keys) != 1 {
+		t.Errorf("Expected the cold tagged key to be found, got %v", keys)
+	}
+	if n := len(s.DeleteTagged(indexedTag("tagged", "group"))); n != 1 {
+		t.Errorf("Expected the cold tagged key to be deleted, got %d", n)
+	}
+	if _, ok := s.Get("tagged"); ok {
+		t.Errorf("Expected tagged to be gone")
+	}
+}
+
+func TestTieredScanMergesTiers(t *testing.T) {
+	s, _ := setupTiered(t)
+	s.Set("a:1", []byte("i:1;"), 0, 0)
+	s.Set("a:2", []byte("i:2;"), 0, 0)
+	s.Set(lockKey("a:job"), []byte("owner"), 0, 0)
+	s.queue.flush()
+	s.keys.Flush(nil)
+	s.Get("a:2") // Hot again
+	s.Set("a:3", []byte("i:3;"), 0, 0)
+	s.Set("b:1", []byte("i:1;"), 0, 0)
+
+	keys := make([]string, 0)
+	s.Scan("", "a:", func(st keyState) bool {
+		keys = append(keys, st.key)
+		return true
+	})
+	expected := []string{"a:1", "a:2", "a:3"}
+	if fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, keys)
+	}
+
+	all := 0
+	s.Scan("", "", func(keyState) bool {
+		all++
+		return true
+	})
+	if all != 5 {
+		t.Errorf("Expected all 5 keys including the lock, got %d", all)
+	}
+	if n := len(s.DeleteMatching("a:", func(string) bool { return true })); n != 3 {
+		t.Errorf("Expected 3 keys to be deleted, got %d", n)
+	}
+}
+
+func TestTieredExportLeavesColdKeysCold(t *testing.T) {
+	s, _ := setupTiered(t)
+	s.Set("tagged", []byte("i:1;"), 0, 0)
+	s.SetTags("tagged", []string{"group"})
+	s.queue.flush()
+	s.keys.Flush(nil)
+
+	var line exportLine
+	json.Unmarshal([]byte(exportBody(t, "")), &line)
+	if fmt.Sprint(line.Tags) != "[group]" {
+		t.Errorf("Expected the tags of the cold key to be exported, got %+v", line)
+	}
+	if n := s.Len(); n != 0 {
+		t.Errorf("Expected the export to leave the key cold, got %d hot keys", n)
+	}
+}
+
+func TestTieredSnapshotCoversColdKeys(t *testing.T) {
+	s, _ := setupTiered(t)
+	snapshotDir = t.TempDir()
+	defer func() { snapshotDir = "" }()
+	s.Set("cold", []byte("i:1;"), 0, 0)
+	s.SetTags("cold", []string{"group"})
+	s.queue.flush()
+	s.keys.Flush(nil)
+	s.Set("hot", []byte("i:2;"), 0, 0)
+
+	info, err := writeSnapshot(snapshotDir)
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if info.Keys != 2 {
+		t.Errorf("Expected both tiers in the snapshot, got %d keys", info.Keys)
+	}
+}
+
+func TestTieredWarmUp(t *testing.T) {
+	s, conn := setupTiered(t)
+	for i := 0; i < 5; i++ {
+		s.Set(fmt.Sprintf("key:%d", i), []byte("i:1;"), 0, 0)
+	}
+	s.Get("key:0")
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	warmUp = 2
+	restarted, err := newTieredStore(newMemoryStore(4), conn)
+	if err != nil {
+		t.Fatalf("Failed to create the tiered store: %v", err)
+	}
+	storage = restarted
+	if restarted.Len() != 0 {
+		t.Fatalf("Expected a lazy start")
+	}
+	if err := restarted.Load(); err != nil {
+		t.Fatalf("Warm-up failed: %v", err)
+	}
+	if restarted.Len() != 2 || restarted.Stats().Tiers.WarmedUp != 2 {
+		t.Errorf("Expected 2 warmed up keys, got %d", restarted.Len())
+	}
+	if _, hot := restarted.keys.Get("key:0"); !hot {
+		t.Errorf("Expected the most recently used key to be warmed up")
+	}
+}
+
+func TestTieredNeedsMemoryLimit(t *testing.T) {
+	if _, err := newTieredStore(newMemoryStore(1), nil); err == nil {
+		t.Errorf("Expected the tiered store to need --max-memory")
+	}
+}
+
+func TestTieredRefusesTenants(t *testing.T) {
+	setupTenants(t)
+	defer func() { maxMemory = 0 }()
+	maxMemory, evictionPolicy = 4096, policyLRU
+	if _, err := newTieredStore(newMemoryStore(1), nil); err == nil {
+		t.Errorf("Expected the tiered store to refuse tenant quotas it cannot enforce")
+	}
+}
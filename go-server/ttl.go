@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// -------------------------------------------------------------
+// Touch & TTL Inspection
+// -------------------------------------------------------------
+
+// touchLocal updates the expiration of a live key without rewriting its value.
+// The version is left untouched since the value did not change.
+func touchLocal(key string, expiration int64, broadcast bool) bool {
+	if !storage.Expire(key, expiration) {
+		return false
+	}
+
+	if broadcast {
+		broadcastTouch(key, expiration)
+	}
+	return true
+}
+
+// TouchPayload sets a new TTL. A key only becomes permanent when asked for
+// explicitly, so a request missing its TTL cannot drop an expiration.
+type TouchPayload struct {
+	TTL     *int `json:"ttl"`
+	Forever bool `json:"forever"`
+}
+
+// broadcastTouch sends a new expiration to every peer. Legacy peers cannot
+// read OpTouch and get the value again with the new expiration.
+func broadcastTouch(key string, expiration int64) {
+	peersMutex.Lock()
+	defer peersMutex.Unlock()
+	for addr, conn := range peers {
+		var err error
+		if peerProtocols[conn] >= opProtocol(OpTouch) {
+			err = writeTouchFrame(conn, key, expiration)
+		} else if item, ok := storage.Get(key); ok {
+			err = writePeerSetFrame(conn, replLegacy, OpSet, key, item.Value, item.Expiration, 0)
+		} else {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to broadcast TOUCH to %s: %v", addr, err)
+		} else {
+			statsMutex.Lock()
+			stats.TotalBroadcasts++
+			statsMutex.Unlock()
+		}
+	}
+}
+
+// writeTouchFrame encodes: op | keyLen u16 | exp u32 | key
+func writeTouchFrame(w io.Writer, key string, exp int64) error {
+	header := make([]byte, 7)
+	header[0] = OpTouch
+	binary.BigEndian.PutUint16(header[1:3], uint16(len(key)))
+	binary.BigEndian.PutUint32(header[3:7], uint32(exp))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(key)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func readTouchFrame(r *bufio.Reader) (string, int64, error) {
+	header := make([]byte, 6) // We already read the Op byte
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", 0, err
+	}
+	keyLen := binary.BigEndian.Uint16(header[0:2])
+	exp := int64(binary.BigEndian.Uint32(header[2:6]))
+	keyBytes := make([]byte, keyLen)
+	if _, err := io.ReadFull(r, keyBytes); err != nil {
+		return "", 0, err
+	}
+	return string(keyBytes), exp, nil
+}
+
+// itemMeta describes an item for with_meta and TTL responses.
+func itemMeta(item CacheItem) map[string]interface{} {
+	return map[string]interface{}{
+		"expiration": item.Expiration,
+		"size":       len(item.Value),
+		"version":    item.Version,
+	}
+}
+
+// -------------------------------------------------------------
+// Touch & TTL HTTP Handlers
+// -------------------------------------------------------------
+
+func handleTouch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := namespacedKey(requestNamespace(r), strings.TrimPrefix(r.URL.Path, "/api/hypercacheio/touch/"))
+	if key == "" {
+		http.Error(w, "Key required", http.StatusBadRequest)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	var payload TouchPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case payload.TTL == nil && !payload.Forever:
+		http.Error(w, "ttl or forever required", http.StatusBadRequest)
+		return
+	case payload.TTL != nil && (*payload.TTL < 0 || (payload.Forever && *payload.TTL > 0)):
+		http.Error(w, "Invalid ttl", http.StatusBadRequest)
+		return
+	}
+
+	// A TTL of 0 or forever makes the key permanent
+	var expiration int64
+	if payload.TTL != nil && *payload.TTL > 0 {
+		expiration = time.Now().Unix() + int64(*payload.TTL)
+	}
+
+	touched := touchLocal(key, expiration, true)
+	writeJSON(w, map[string]interface{}{"touched": touched, "expiration": expiration})
+}
+
+// handleTTL follows the Redis convention: -2 for missing keys, -1 for keys
+// without an expiration, otherwise the remaining seconds.
+func handleTTL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := namespacedKey(requestNamespace(r), strings.TrimPrefix(r.URL.Path, "/api/hypercacheio/ttl/"))
+	if key == "" {
+		http.Error(w, "Key required", http.StatusBadRequest)
+		return
+	}
+
+	item, ok := getItemLocal(key)
+	if !ok {
+		writeJSON(w, map[string]interface{}{"ttl": -2, "expiration": nil})
+		return
+	}
+	ttl := int64(-1)
+	if item.Expiration > 0 {
+		ttl = item.Expiration - time.Now().Unix()
+		if ttl < 0 {
+			ttl = 0
+		}
+	}
+	writeJSON(w, map[string]interface{}{"ttl": ttl, "expiration": item.Expiration})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getTTL(t *testing.T, key string) map[string]interface{} {
+	req, _ := http.NewRequest("GET", "/api/hypercacheio/ttl/"+key, nil)
+	rr := httptest.NewRecorder()
+	handleTTL(rr, req)
+	var resp map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	return resp
+}
+
+func TestHandleTouchAndTTL(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	version := setLocal("session", []byte(`s:4:"data";`), time.Now().Unix()+10, false)
+
+	if resp := getTTL(t, "missing"); resp["ttl"] != float64(-2) {
+		t.Errorf("Expected ttl -2 for missing key, got %v", resp["ttl"])
+	}
+
+	req, _ := http.NewRequest("POST", "/api/hypercacheio/touch/session", bytes.NewBufferString(`{"ttl": 3600}`))
+	rr := httptest.NewRecorder()
+	handleTouch(rr, req)
+
+	var touchResp map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &touchResp)
+	if touchResp["touched"] != true {
+		t.Fatalf("Expected touch to succeed, got %v", touchResp)
+	}
+
+	resp := getTTL(t, "session")
+	if ttl := resp["ttl"].(float64); ttl < 3590 || ttl > 3600 {
+		t.Errorf("Expected ttl close to 3600 after touch, got %v", ttl)
+	}
+
+	item, _ := getItemLocal("session")
+	if string(item.Value) != `s:4:"data";` || item.Version != version {
+		t.Errorf("Touch must not rewrite the value or bump the version: %+v", item)
+	}
+
+	var persisted int64
+	db.QueryRow("SELECT expiration FROM cache WHERE key = ?", "session").Scan(&persisted)
+	if persisted != item.Expiration {
+		t.Errorf("Expected persisted expiration %d, got %d", item.Expiration, persisted)
+	}
+
+	// A key only becomes permanent when asked for explicitly
+	for body, code := range map[string]int{``: 400, `{}`: 400, `{"ttl": -1}`: 400, `{"ttl": 60, "forever": true}`: 400, `{"ttl": 0}`: 200, `{"forever": true}`: 200} {
+		setLocal("session", []byte(`s:4:"data";`), time.Now().Unix()+10, false)
+		rr := httptest.NewRecorder()
+		handleTouch(rr, httptest.NewRequest("POST", "/api/hypercacheio/touch/session", bytes.NewBufferString(body)))
+		if rr.Code != code {
+			t.Errorf("%q: Expected %d, got %d", body, code, rr.Code)
+		}
+		permanent := getTTL(t, "session")["ttl"] == float64(-1)
+		if permanent != (code == 200) {
+			t.Errorf("%q: Expected the key to be permanent only after a valid request, got ttl %v", body, getTTL(t, "session")["ttl"])
+		}
+	}
+}
+
+func TestHandleCacheWithMeta(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	version := setLocal("meta", []byte(`s:5:"value";`), 0, false)
+
+	req, _ := http.NewRequest("GET", "/api/hypercacheio/cache/meta?with_meta=1", nil)
+	rr := httptest.NewRecorder()
+	handleCache(rr, req)
+
+	var resp map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	meta, ok := resp["meta"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("Expected meta in response, got %v", resp)
+	}
+	if meta["size"] != float64(12) || meta["version"] != float64(version) || meta["expiration"] != float64(0) {
+		t.Errorf("Unexpected meta: %v", meta)
+	}
+}
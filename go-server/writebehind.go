@@ -0,0 +1,341 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------------------------------------------------
+// Write-behind Persistence
+// -------------------------------------------------------------
+//
+// The sqlite engine hands the state of every written key to a queue instead
+// of writing it in the request path. The queue keeps only the latest state
+// per key, so a hot key is written once per flush however often it changes.
+// States are queued under the shard lock of their key, so the latest queued
+// state is always the one memory applied last.
+// A background writer flushes the queue in transactions of up to writeBatch
+// keys, every writeInterval or as soon as a full batch is waiting. Writers
+// flush synchronously once the queue holds writeQueueFactor full batches, so
+// a slow disk slows writers down instead of growing the queue without bound.
+
+const writeQueueFactor = 8
+
+var (
+	writeBehindEnabled = true
+	writeBatch         = 512
+	writeInterval      = 100 * time.Millisecond
+)
+
+type writeBehind struct {
+	db        *sql.DB
+	batchSize int
+	interval  time.Duration
+	async     bool
+
+	mu       sync.Mutex
+	pending  map[string]*pendingWrite // Guarded by mu
+	inflight map[string]*pendingWrite // Taken from pending, not committed yet. Guarded by mu
+
+	// writeMu serializes batches with the bulk statements of Flush and Sweep,
+	// so a batch taken from the queue never lands after them.
+	writeMu sync.Mutex
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+
+	enqueued  atomic.Uint64
+	coalesced atomic.Uint64
+	batches   atomic.Uint64
+	written   atomic.Uint64
+	errors    atomic.Uint64
+	lastError atomic.Value // string
+}
+
+// pendingWrite is the latest unwritten state of one key.
+type pendingWrite struct {
+	state   *keyState
+	tags    []string
+	hasTags bool
+}
+
+type WriteBehindStats struct {
+	Enabled    bool   `json:"enabled"`
+	QueueDepth int    `json:"queue_depth"`
+	Enqueued   uint64 `json:"enqueued"`
+	Coalesced  uint64 `json:"coalesced"`
+	Batches    uint64 `json:"batches"`
+	Written    uint64 `json:"written"`
+	Errors     uint64 `json:"errors"`
+	LastError  string `json:"last_error,omitempty"`
+}
+
+// newWriteBehind returns a queue writing to db. Unless async is set every
+// write is flushed right away, in the caller.
+func newWriteBehind(db *sql.DB, batchSize int, interval time.Duration, async bool) *writeBehind {
+	w := &writeBehind{
+		db:        db,
+		batchSize: batchSize,
+		interval:  interval,
+		async:     async,
+		pending:   make(map[string]*pendingWrite),
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if async {
+		go w.run()
+	} else {
+		close(w.done)
+	}
+	return w
+}
+
+func (w *writeBehind) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.wake:
+		case <-w.stop:
+			w.flush()
+			return
+		}
+		w.flush()
+	}
+}
+
+// put queues the state of a key, merging it into an unwritten earlier state.
+// It is called under the shard lock of the key, so it never writes; callers
+// call settle once the lock has been released.
+func (w *writeBehind) put(st keyState) {
+	w.enqueue(st.key, func(p *pendingWrite) {
+		if p.state != nil {
+			// Derived state dropped earlier still has to be deleted
+			st.dropped.counter = st.dropped.counter || p.state.dropped.counter
+			st.dropped.tags = st.dropped.tags || p.state.dropped.tags
+		}
+		switch {
+		case st.tagged:
+			p.tags, p.hasTags = st.tags, true
+		case st.dropped.tags:
+			p.tags, p.hasTags = nil, false
+		}
+		p.state = &st
+	})
+}
+
+func (w *writeBehind) enqueue(key string, merge func(p *pendingWrite)) {
+	w.mu.Lock()
+	p, ok := w.pending[key]
+	if ok {
+		w.coalesced.Add(1)
+	} else {
+		p = &pendingWrite{}
+		w.pending[key] = p
+	}
+	merge(p)
+	w.mu.Unlock()
+	w.enqueued.Add(1)
+}
+
+// settle flushes the queue in the caller when writes are synchronous or the
+// queue is full, and wakes the background writer once a batch is waiting.
+// Callers must not hold any shard lock.
+func (w *writeBehind) settle() {
+	w.mu.Lock()
+	depth := len(w.pending)
+	w.mu.Unlock()
+
+	switch {
+	case !w.async || depth >= w.batchSize*writeQueueFactor:
+		w.flush()
+	case depth >= w.batchSize:
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// flush writes everything queued so far.
+func (w *writeBehind) flush() {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	w.flushLocked()
+}
+
+func (w *writeBehind) flushLocked() {
+	w.mu.Lock()
+	queued := w.pending
+	w.pending = make(map[string]*pendingWrite)
+	w.inflight = queued
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		w.inflight = nil
+		w.mu.Unlock()
+	}()
+
+	keys := make([]string, 0, len(queued))
+	for key := range queued {
+		keys = append(keys, key)
+	}
+	for start := 0; start < len(keys); start += w.batchSize {
+		end := start + w.batchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err := w.writeBatch(keys[start:end], queued); err != nil {
+			w.fail(err)
+			w.requeue(keys[start:], queued)
+			return
+		}
+	}
+}
+
+// writeBatch writes the given keys in one transaction. Failing statements
+// are counted without aborting the rest of the batch.
+func (w *writeBehind) writeBatch(keys []string, queued map[string]*pendingWrite) error {
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	ex := &errExecer{ex: tx}
+	for _, key := range keys {
+		p := queued[key]
+		if p.state != nil {
+			persistState(ex, *p.state)
+		}
+		if p.hasTags {
+			persistTags(ex, key, p.tags)
+		}
+		if ex.err != nil {
+			w.fail(ex.err)
+			ex.err = nil
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	w.batches.Add(1)
+	w.written.Add(uint64(len(keys)))
+	return nil
+}
+
+// requeue puts back writes that could not be committed, unless a newer
+// state of the key has been queued in the meantime.
+func (w *writeBehind) requeue(keys []string, queued map[string]*pendingWrite) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, key := range keys {
+		if _, newer := w.pending[key]; !newer {
+			w.pending[key] = queued[key]
+		}
+	}
+}
+
+// lookup returns the unwritten state of key, if any, with what is queued
+// merged over what is being written.
+func (w *writeBehind) lookup(key string) (pendingWrite, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	newer, queued := w.pending[key]
+	older, writing := w.inflight[key]
+	switch {
+	case queued && writing:
+		merged := *older
+		if newer.state != nil {
+			merged.state = newer.state
+			if newer.state.dropped.tags {
+				merged.tags, merged.hasTags = nil, false
+			}
+		}
+		if newer.hasTags {
+			merged.tags, merged.hasTags = newer.tags, true
+		}
+		return merged, true
+	case queued:
+		return *newer, true
+	case writing:
+		return *older, true
+	}
+	return pendingWrite{}, false
+}
+
+func (w *writeBehind) fail(err error) {
+	w.errors.Add(1)
+	w.lastError.Store(err.Error())
+	log.Printf("Failed to persist to SQLite: %v", err)
+}
+
+// discard drops every queued write. Writes that are being committed are not
+// affected.
+func (w *writeBehind) discard() {
+	w.mu.Lock()
+	w.pending = make(map[string]*pendingWrite)
+	w.mu.Unlock()
+}
+
+// exclusive writes everything queued so far, then runs fn before any later
+// batch. With discard set the queue is dropped instead of written.
+func (w *writeBehind) exclusive(discard bool, fn func(ex execer)) {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if discard {
+		w.discard()
+	} else {
+		w.flushLocked()
+	}
+	ex := &errExecer{ex: w.db}
+	fn(ex)
+	if ex.err != nil {
+		w.fail(ex.err)
+	}
+}
+
+// close stops the background writer once the queue has been drained.
+func (w *writeBehind) close() {
+	if w.async {
+		close(w.stop)
+	}
+	<-w.done
+	w.flush()
+}
+
+func (w *writeBehind) stats() *WriteBehindStats {
+	w.mu.Lock()
+	depth := len(w.pending)
+	w.mu.Unlock()
+	lastError, _ := w.lastError.Load().(string)
+	return &WriteBehindStats{
+		Enabled:    w.async,
+		QueueDepth: depth,
+		Enqueued:   w.enqueued.Load(),
+		Coalesced:  w.coalesced.Load(),
+		Batches:    w.batches.Load(),
+		Written:    w.written.Load(),
+		Errors:     w.errors.Load(),
+		LastError:  lastError,
+	}
+}
+
+// errExecer remembers the first error of the statements run through it.
+type errExecer struct {
+	ex  execer
+	err error
+}
+
+func (e *errExecer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	result, err := e.ex.Exec(query, args...)
+	if err != nil && e.err == nil {
+		e.err = err
+	}
+	return result, err
+}
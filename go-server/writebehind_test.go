@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setupWriteBehind returns a sqlite engine with an asynchronous queue.
+func setupWriteBehind(t *testing.T, batch int, interval time.Duration) *sqliteStore {
+	db.SetMaxOpenConns(1) // Every connection to :memory: is a database of its own
+	writeBehindEnabled, writeBatch, writeInterval = true, batch, interval
+	t.Cleanup(func() {
+		writeBehindEnabled, writeBatch, writeInterval = false, 512, 100*time.Millisecond
+	})
+	return newSqliteStore(newMemoryStore(4), db)
+}
+
+func countRows(query string, args ...interface{}) int {
+	var count int
+	db.QueryRow(query, args...).Scan(&count)
+	return count
+}
+
+func TestWriteBehindCoalescesAndDrains(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	store := setupWriteBehind(t, 512, time.Hour)
+
+	var hot uint64
+	for i := 0; i < 3; i++ {
+		hot = store.Set("hot", []byte("i:1;"), 0, 0).Version
+	}
+	store.Set("doomed", []byte("i:1;"), 0, 0)
+	store.SetTags("doomed", []string{"t"})
+	store.Delete("doomed")
+
+	if n := countRows("SELECT COUNT(*) FROM cache"); n != 0 {
+		t.Errorf("Expected nothing written before a flush, got %d rows", n)
+	}
+	queued := store.Stats().WriteBehind
+	if queued.QueueDepth != 2 || queued.Coalesced != 4 {
+		t.Errorf("Expected 2 queued keys and 4 coalesced writes, got %+v", queued)
+	}
+
+	store.Close()
+
+	if n := countRows("SELECT COUNT(*) FROM cache WHERE key = ? AND version = ?", "hot", int64(hot)); n != 1 {
+		t.Errorf("Expected the latest version of hot to be written on close")
+	}
+	if n := countRows("SELECT COUNT(*) FROM cache_tags"); n != 0 {
+		t.Errorf("Expected the tags of a deleted key not to be written, got %d", n)
+	}
+	drained := store.Stats().WriteBehind
+	if drained.QueueDepth != 0 || drained.Written != 2 || drained.Batches != 1 {
+		t.Errorf("Expected one batch of 2 keys, got %+v", drained)
+	}
+}
+
+func TestWriteBehindFlushesFullBatches(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	store := setupWriteBehind(t, 2, time.Hour)
+	defer store.Close()
+
+	store.Set("a", []byte("i:1;"), 0, 0)
+	store.Set("b", []byte("i:1;"), 0, 0)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for store.Stats().WriteBehind.Written < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := countRows("SELECT COUNT(*) FROM cache"); n != 2 {
+		t.Errorf("Expected a full batch to be flushed without waiting for the interval, got %d rows", n)
+	}
+}
+
+func TestWriteBehindReportsErrors(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	store := setupWriteBehind(t, 512, time.Hour)
+
+	db.Exec("DROP TABLE cache_tags")
+	store.Set("a", []byte("i:1;"), 0, 0)
+	store.SetTags("a", []string{"t"})
+	store.Close()
+
+	stats := store.Stats().WriteBehind
+	if stats.Errors == 0 || stats.LastError == "" {
+		t.Errorf("Expected the failed tag write to be reported, got %+v", stats)
+	}
+	if n := countRows("SELECT COUNT(*) FROM cache WHERE key = ?", "a"); n != 1 {
+		t.Errorf("Expected the rest of the batch to be committed")
+	}
+}
+
+func TestWriteBehindQueuesInWriteOrder(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	store := setupWriteBehind(t, 1, time.Millisecond)
+
+	// Every state must reach the queue in the order memory applied it
+	var mu sync.Mutex
+	var last uint64
+	queue := store.memoryStore.persist
+	store.memoryStore.persist = func(st keyState) {
+		mu.Lock()
+		if st.item.Version <= last {
+			t.Errorf("Expected version %d to be queued after %d", st.item.Version, last)
+		}
+		last = st.item.Version
+		mu.Unlock()
+		queue(st)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				store.Set("contended", []byte(fmt.Sprintf("i:%d;", w*1000+i)), 0, 0)
+			}
+		}(w)
+	}
+	wg.Wait()
+	store.Close()
+
+	item, _ := store.Get("contended")
+	var value string
+	db.QueryRow("SELECT value FROM cache WHERE key = ?", "contended").Scan(&value)
+	if value != string(item.Value) {
+		t.Errorf("Expected SQLite to hold %q like memory, got %q", item.Value, value)
+	}
+}
+
+func TestWriteBehindFlushDropsOnlyEarlierWrites(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	store := setupWriteBehind(t, 64, time.Hour)
+	store.Set("early", []byte("i:1;"), 0, 0)
+
+	// A write arriving during the flush waits for the shard locks and must
+	// end up in SQLite like it does in memory
+	var late sync.WaitGroup
+	flushed := store.memoryStore.flushed
+	store.memoryStore.flushed = func() {
+		flushed()
+		late.Add(1)
+		go func() {
+			defer late.Done()
+			store.Set("late", []byte("i:1;"), 0, 0)
+		}()
+		time.Sleep(10 * time.Millisecond)
+	}
+	store.Flush()
+	late.Wait()
+	store.Close()
+
+	if _, ok := store.Get("early"); ok || countRows("SELECT COUNT(*) FROM cache WHERE key = ?", "early") != 0 {
+		t.Errorf("Expected the write queued before the flush to be dropped")
+	}
+	if _, ok := store.Get("late"); !ok || countRows("SELECT COUNT(*) FROM cache WHERE key = ?", "late") != 1 {
+		t.Errorf("Expected the write after the flush in memory and SQLite")
+	}
+}
@@ -3,7 +3,9 @@
 namespace Iperamuna\Hypercacheio\Console;
 
 use Illuminate\Console\Command;
+use Illuminate\Http\Client\ConnectionException;
 use Illuminate\Support\Facades\File;
+use Illuminate\Support\Facades\Http;
 
 class GoServerCommand extends Command
 {
@@ -12,7 +14,8 @@ class GoServerCommand extends Command
      *
      * @var string
      */
-    protected $signature = 'hypercacheio:go-server {action : start|stop|restart|status|compile|make-service|service:start|service:stop|service:restart|service:remove|service:status}';
+    protected $signature = 'hypercacheio:go-server {action : start|stop|restart|status|compile|make-service|service:start|service:stop|service:restart|service:remove|service:status|backup}
+                            {--path= : For backup: download the backup to this file instead of writing it to the server\'s backup directory}';
 
     /**
      * The console command description.
@@ -63,6 +66,8 @@ class GoServerCommand extends Command
             case 'service:status':
                 $this->serviceStatus();
                 break;
+            case 'backup':
+                return $this->backup();
             default:
                 $this->error('Unknown action: '.$action);
 
@@ -113,7 +118,7 @@ class GoServerCommand extends Command
         } else {
             $this->info('Makefile not found, building for current platform only...');
             $binName = $this->getBinaryName();
-            $command = "cd $goPath && go build -o \"$binDir/$binName\" main.go";
+            $command = "cd $goPath && go build -o \"$binDir/$binName\" .";
             exec($command, $output, $result);
         }
 
@@ -187,11 +192,30 @@ class GoServerCommand extends Command
 
         $this->info('Starting Go server using binary: '.basename($binPath));
 
+        $args = $this->serverArguments($config);
+
+        $logPath = $config['log_path'];
+        $command = "nohup $binPath ".implode(' ', $args)." > $logPath 2>&1 & echo $!";
+
+        $pid = trim(shell_exec($command));
+
+        if ($pid > 0) {
+            File::put($pidPath, $pid);
+            $this->info("Go server started (PID: $pid)");
+        } else {
+            $this->error('Failed to start Go server.');
+        }
+    }
+
+    /**
+     * Build the command line arguments of the Go server from the config.
+     */
+    protected function serverArguments(array $config): array
+    {
         $listenHost = $config['listen_host'] ?? '0.0.0.0';
 
         $sqliteDir = config('hypercacheio.sqlite_path') ?? storage_path('hypercacheio');
         $sqlitePath = rtrim($sqliteDir, '/').'/hypercacheio.sqlite';
-        $prefix = config('cache.prefix') ?? '';
         $directSqlite = config('hypercacheio.go_server.direct_sqlite', true) ? 'true' : 'false';
 
         $args = [
@@ -200,33 +224,83 @@ class GoServerCommand extends Command
             '--token='.config('hypercacheio.api_token'),
             '--artisan="'.base_path('artisan').'"',
             '--sqlite-path="'.$sqlitePath.'"',
-            '--prefix="'.$prefix.'"',
             '--direct-sqlite='.$directSqlite,
             '--ha-mode='.($config['ha_mode'] ? 'true' : 'false'),
         ];
 
-        if ($config['ssl']['enabled']) {
+        if ($config['ssl']['enabled'] ?? false) {
             $args[] = '--ssl=true';
             $args[] = "--cert={$config['ssl']['certificate']}";
             $args[] = "--key={$config['ssl']['certificate_key']}";
         }
 
-        if ($config['ha_mode'] && ! empty($config['peer_addrs'])) {
-            $args[] = "--peers={$config['peer_addrs']}";
-            $args[] = "--repl-port={$config['repl_port']}";
+        if (! empty($config['tenants_file'])) {
+            $args[] = '--tenants="'.$config['tenants_file'].'"';
         }
 
-        $logPath = $config['log_path'];
-        $command = "nohup $binPath ".implode(' ', $args)." > $logPath 2>&1 & echo $!";
+        if (! empty($config['namespace'])) {
+            $args[] = '--namespace="'.$config['namespace'].'"';
+        }
 
-        $pid = trim(shell_exec($command));
+        if (! empty($config['storage'])) {
+            $args[] = "--storage={$config['storage']}";
+        }
 
-        if ($pid > 0) {
-            File::put($pidPath, $pid);
-            $this->info("Go server started (PID: $pid)");
-        } else {
-            $this->error('Failed to start Go server.');
+        if (($config['storage'] ?? '') === 'aof') {
+            $args[] = '--aof-path="'.$config['aof_path'].'"';
+            $args[] = '--aof-fsync='.($config['aof_fsync'] ?? 'everysec');
+            $args[] = '--aof-rewrite-min-size='.($config['aof_rewrite_min_size'] ?? '64mb');
+            $args[] = '--aof-rewrite-percentage='.($config['aof_rewrite_percentage'] ?? 100);
+        }
+
+        if (($config['storage'] ?? '') === 'tiered') {
+            $args[] = '--warm-up='.($config['warm_up'] ?? 0);
+        }
+
+        $args[] = '--compression='.($config['compression'] ?? 'none');
+        $args[] = '--compress-min-size='.($config['compress_min_size'] ?? '1kb');
+        $args[] = '--compress-sqlite='.(($config['compress_sqlite'] ?? false) ? 'true' : 'false');
+
+        if (! empty($config['encryption_key_file'])) {
+            $args[] = '--encryption-key-file="'.$config['encryption_key_file'].'"';
+            $args[] = '--encrypt-keys='.(($config['encrypt_keys'] ?? false) ? 'true' : 'false');
+        }
+
+        $args[] = '--write-behind='.(($config['write_behind'] ?? true) ? 'true' : 'false');
+        $args[] = '--write-batch='.($config['write_batch'] ?? 512);
+        $args[] = '--write-interval='.($config['write_interval'] ?? '100ms');
+        $args[] = '--sqlite-journal-mode='.($config['sqlite_journal_mode'] ?? 'wal');
+        $args[] = '--sqlite-synchronous='.($config['sqlite_synchronous'] ?? 'normal');
+        $args[] = '--sqlite-busy-timeout='.($config['sqlite_busy_timeout'] ?? '5s');
+        $args[] = '--sqlite-mmap-size='.($config['sqlite_mmap_size'] ?? '256mb');
+        $args[] = '--sqlite-cache-size='.($config['sqlite_cache_size'] ?? '64mb');
+        $args[] = '--sqlite-quick-check='.(($config['sqlite_quick_check'] ?? true) ? 'true' : 'false');
+
+        if (! empty($config['snapshot_dir'])) {
+            $args[] = '--snapshot-dir="'.$config['snapshot_dir'].'"';
+            $args[] = '--snapshot-retain='.($config['snapshot_retain'] ?? 5);
+        }
+
+        if (! empty($config['snapshot_interval'])) {
+            $args[] = "--snapshot-interval={$config['snapshot_interval']}";
+        }
+
+        if (! empty($config['backup_dir'])) {
+            $args[] = '--backup-dir="'.$config['backup_dir'].'"';
+        }
+
+        if (! empty($config['max_memory'])) {
+            $args[] = "--max-memory={$config['max_memory']}";
+            $args[] = '--eviction-policy='.($config['eviction_policy'] ?? 'lru');
+            $args[] = '--replicate-evictions='.(($config['replicate_evictions'] ?? false) ? 'true' : 'false');
+        }
+
+        if ($config['ha_mode'] && ! empty($config['peer_addrs'])) {
+            $args[] = "--peers={$config['peer_addrs']}";
+            $args[] = "--repl-port={$config['repl_port']}";
         }
+
+        return $args;
     }
 
     protected function detectBinary()
@@ -343,6 +417,91 @@ class GoServerCommand extends Command
         $this->line("Tip: start via 'php artisan hypercacheio:go-server service:start' or 'start'.");
     }
 
+    /**
+     * Take an online backup of the SQLite file through the running server,
+     * either downloaded to --path or written to the server's backup directory.
+     */
+    protected function backup()
+    {
+        $go = config('hypercacheio.go_server');
+        $scheme = ($go['ssl']['enabled'] ?? false) ? 'https' : 'http';
+        $url = "{$scheme}://127.0.0.1:{$go['port']}/api/hypercacheio/admin/backup";
+        $request = Http::timeout(0)->withHeaders([
+            'X-Hypercacheio-Token' => config('hypercacheio.api_token'),
+            'X-Hypercacheio-Server-ID' => gethostname(),
+        ]);
+        $path = $this->option('path');
+
+        if (! $path) {
+            $this->info('Writing a backup to the server\'s backup directory...');
+            try {
+                $response = $request->post($url);
+            } catch (ConnectionException $e) {
+                $this->error("Cannot reach the Go server at {$url}: {$e->getMessage()}");
+
+                return 1;
+            }
+            if (! $response->successful()) {
+                $this->error('Backup failed: '.($response->json('error') ?? "HTTP {$response->status()}"));
+
+                return 1;
+            }
+            $this->info("Backup written to {$response->json('path')}");
+            $this->line('Size: '.$this->formatBytes((int) $response->json('size')).", took {$response->json('duration_ms')}ms");
+
+            return 0;
+        }
+
+        $this->info("Downloading a backup to {$path}...");
+        $partPath = $path.'.part';
+        $bar = null;
+        try {
+            $response = $request->withOptions([
+                'sink' => $partPath,
+                'progress' => function ($total, $downloaded) use (&$bar) {
+                    if ($total > 0 && $bar === null) {
+                        $bar = $this->output->createProgressBar($total);
+                        $bar->start();
+                    }
+                    $bar?->setProgress($downloaded);
+                },
+            ])->get($url);
+        } catch (ConnectionException $e) {
+            File::delete($partPath);
+            $this->error("Cannot reach the Go server at {$url}: {$e->getMessage()}");
+
+            return 1;
+        }
+        $bar?->finish();
+        $this->newLine();
+
+        if (! $response->successful()) {
+            $error = json_decode((string) File::get($partPath), true)['error'] ?? "HTTP {$response->status()}";
+            File::delete($partPath);
+            $this->error('Backup failed: '.$error);
+
+            return 1;
+        }
+
+        File::move($partPath, $path);
+        $this->info("Backup saved to {$path}");
+        $this->line('Size: '.$this->formatBytes(File::size($path)));
+
+        return 0;
+    }
+
+    protected function formatBytes(int $bytes): string
+    {
+        $units = ['B', 'KB', 'MB', 'GB', 'TB'];
+        $i = 0;
+        while ($bytes >= 1024 && $i < count($units) - 1) {
+            $bytes /= 1024;
+            $i++;
+        }
+
+        return round($bytes, 1).' '.$units[$i];
+    }
+
     protected function makeService()
     {
         $this->info('Generating service configuration files...');
@@ -356,34 +515,7 @@ class GoServerCommand extends Command
             return;
         }
 
-        $listenHost = $config['listen_host'] ?? '0.0.0.0';
-
-        $sqliteDir = config('hypercacheio.sqlite_path') ?? storage_path('hypercacheio');
-        $sqlitePath = rtrim($sqliteDir, '/').'/hypercacheio.sqlite';
-        $prefix = config('cache.prefix') ?? '';
-        $directSqlite = config('hypercacheio.go_server.direct_sqlite', true) ? 'true' : 'false';
-
-        $argsList = [
-            "--port={$config['port']}",
-            "--host={$listenHost}",
-            '--token='.config('hypercacheio.api_token'),
-            '--artisan="'.base_path('artisan').'"',
-            '--sqlite-path="'.$sqlitePath.'"',
-            '--prefix="'.$prefix.'"',
-            '--direct-sqlite='.$directSqlite,
-            '--ha-mode='.($config['ha_mode'] ? 'true' : 'false'),
-        ];
-
-        if ($config['ssl']['enabled'] ?? false) {
-            $argsList[] = '--ssl=true';
-            $argsList[] = "--cert={$config['ssl']['certificate']}";
-            $argsList[] = "--key={$config['ssl']['certificate_key']}";
-        }
-
-        if ($config['ha_mode'] && ! empty($config['peer_addrs'])) {
-            $argsList[] = "--peers={$config['peer_addrs']}";
-            $argsList[] = "--repl-port={$config['repl_port']}";
-        }
+        $argsList = $this->serverArguments($config);
 
         $fullCommand = "$binPath ".implode(' ', $argsList);
         $user = get_current_user();
@@ -37,6 +37,7 @@ class HypercacheioServiceProvider extends ServiceProvider
         $this->app->make('cache')->extend('hypercacheio', function ($app, $config) {
             // Merge defaults from config/hypercacheio.php with store-specific config from cache.php
             $mergedConfig = array_merge($app['config']->get('hypercacheio', []), $config);
+            $mergedConfig['prefix'] = $config['prefix'] ?? $app['config']->get('cache.prefix', '');
 
             return $app['cache']->repository(new HypercacheioStore($mergedConfig));
         });
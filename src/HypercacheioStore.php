@@ -2,12 +2,12 @@
 
 namespace Iperamuna\Hypercacheio;
 
+use Illuminate\Cache\TaggableStore;
 use Illuminate\Contracts\Cache\LockProvider;
-use Illuminate\Contracts\Cache\Store;
 use Illuminate\Support\Facades\Http;
 use Iperamuna\Hypercacheio\Concerns\InteractsWithSqlite;
 
-class HypercacheioStore implements LockProvider, Store
+class HypercacheioStore extends TaggableStore implements LockProvider
 {
     use InteractsWithSqlite;
 
@@ -56,6 +56,16 @@ class HypercacheioStore implements LockProvider, Store
      */
     protected bool $haMode;
 
+    /**
+     * The server type (laravel or go).
+     */
+    protected string $serverType;
+
+    /**
+     * The tags given to every write, set on the store of a tagged cache.
+     */
+    protected ?array $tagNames = null;
+
     /**
      * Create a new Hypercacheio store instance.
      *
@@ -69,8 +79,10 @@ class HypercacheioStore implements LockProvider, Store
         $this->apiToken = $config['api_token'] ?? '';
         $this->async = $config['async_requests'] ?? true;
         $this->haMode = $config['go_server']['ha_mode'] ?? $config['ha_mode'] ?? false;
+        $this->serverType = $config['server_type'] ?? 'laravel';
+        $this->prefix = $config['prefix'] ?? '';
 
-        if ($this->haMode && ($config['server_type'] ?? 'laravel') === 'go') {
+        if ($this->haMode && $this->serverType === 'go') {
             // In HA mode with Go server, we always talk to the LOCAL Go server.
             // The Go server handles replication to the peer.
             $goConfig = $config['go_server'] ?? [];
@@ -98,6 +110,15 @@ class HypercacheioStore implements LockProvider, Store
         }
     }
 
+    /**
+     * Whether requests go to a Go server, which offers batch and atomic
+     * endpoints the Laravel routes do not.
+     */
+    protected function usesGoServer(): bool
+    {
+        return $this->role !== 'primary' && $this->serverType === 'go';
+    }
+
     protected function doRequest(string $method, string $endpoint, array $payload = [], bool $forceSync = false)
     {
         if ($this->async && ! $forceSync) {
@@ -109,15 +130,30 @@ class HypercacheioStore implements LockProvider, Store
         }
     }
 
+    /**
+     * Get the headers sent with every request. The cache prefix travels as
+     * the namespace, so apps sharing a Go server keep their keys apart.
+     */
+    protected function headers(): array
+    {
+        $headers = [
+            'X-Hypercacheio-Token' => $this->apiToken,
+            'X-Hypercacheio-Server-ID' => gethostname(),
+        ];
+
+        if ($this->prefix !== '') {
+            $headers['X-Hypercacheio-Namespace'] = $this->prefix;
+        }
+
+        return $headers;
+    }
+
     protected function asyncRequest(string $method, string $endpoint, array $payload = [])
     {
         try {
 
             $promise = Http::timeout($this->timeout)
-                ->withHeaders([
-                    'X-Hypercacheio-Token' => $this->apiToken,
-                    'X-Hypercacheio-Server-ID' => gethostname(),
-                ])
+                ->withHeaders($this->headers())
                 ->async()
                 ->$method("{$this->primaryUrl}/{$endpoint}", $payload);
 
@@ -131,10 +167,7 @@ class HypercacheioStore implements LockProvider, Store
     {
         try {
             $response = Http::timeout($this->timeout)
-                ->withHeaders([
-                    'X-Hypercacheio-Token' => $this->apiToken,
-                    'X-Hypercacheio-Server-ID' => gethostname(),
-                ])
+                ->withHeaders($this->headers())
                 ->$method("{$this->primaryUrl}/{$endpoint}", $payload);
 
             if ($response->successful()) {
@@ -194,7 +227,7 @@ class HypercacheioStore implements LockProvider, Store
             return true;
         } else {
 
-            $this->doRequest('post', "cache/{$key}", ['value' => $value, 'ttl' => $seconds]);
+            $this->doRequest('post', "cache/{$key}", $this->withTagNames(['value' => $value, 'ttl' => $seconds]));
 
             return true;
         }
@@ -227,7 +260,7 @@ class HypercacheioStore implements LockProvider, Store
                 return false;
             }
         } else {
-            $response = $this->doRequest('post', "add/{$key}", ['value' => $value, 'ttl' => $seconds], true);
+            $response = $this->doRequest('post', "add/{$key}", $this->withTagNames(['value' => $value, 'ttl' => $seconds]), true);
 
             return $response['added'] ?? false;
         }
@@ -235,6 +268,14 @@ class HypercacheioStore implements LockProvider, Store
 
     public function increment($key, $value = 1)
     {
+        if ($this->usesGoServer()) {
+            return $this->incrementRemote('incr', $key, $value);
+        }
+
+        if ($this->role === 'primary' && ! $this->haMode) {
+            return $this->incrementLocal($key, $value);
+        }
+
         $current = $this->get($key) ?? 0;
         $new = $current + $value;
         $this->put($key, $new, null);
@@ -242,6 +283,45 @@ class HypercacheioStore implements LockProvider, Store
         return $new;
     }
 
+    /**
+     * Increment or decrement an item in SQLite. The write lock taken by the
+     * transaction keeps other processes from changing the item in between.
+     *
+     * @return int|float|false
+     */
+    protected function incrementLocal($key, $value)
+    {
+        $this->sqlite->exec('BEGIN IMMEDIATE');
+
+        try {
+            $stmt = $this->sqlite->prepare('SELECT value, expiration FROM cache WHERE key=:key');
+            $stmt->execute([':key' => $key]);
+            $row = $stmt->fetch(\PDO::FETCH_ASSOC);
+
+            $live = $row && ! ($row['expiration'] && $row['expiration'] < time());
+            $current = $live ? unserialize($row['value']) : 0;
+            if (! is_numeric($current)) {
+                $this->sqlite->exec('ROLLBACK');
+
+                return false;
+            }
+
+            $new = $current + $value;
+            $stmt = $this->sqlite->prepare('
+                REPLACE INTO cache(key, value, expiration)
+                VALUES(:key, :value, :exp)
+            ');
+            $stmt->execute([':key' => $key, ':value' => serialize($new), ':exp' => $live ? $row['expiration'] : null]);
+            $this->sqlite->exec('COMMIT');
+        } catch (\Throwable $e) {
+            $this->sqlite->exec('ROLLBACK');
+
+            throw $e;
+        }
+
+        return $this->l1[$key] = $new;
+    }
+
     protected function gc()
     {
         if (rand(1, 100) <= 1) { // 1% chance
@@ -251,9 +331,32 @@ class HypercacheioStore implements LockProvider, Store
 
     public function decrement($key, $value = 1)
     {
+        if ($this->usesGoServer()) {
+            return $this->incrementRemote('decr', $key, $value);
+        }
+
         return $this->increment($key, $value * -1);
     }
 
+    /**
+     * Increment or decrement an item on the Go server, which applies the
+     * change atomically and replicates it to its peers.
+     *
+     * @return int|float|false
+     */
+    protected function incrementRemote(string $endpoint, $key, $value)
+    {
+        $response = $this->doRequest('post', "{$endpoint}/{$key}", ['value' => $value], true);
+
+        if (! isset($response['value'])) {
+            unset($this->l1[$key]);
+
+            return false;
+        }
+
+        return $this->l1[$key] = $response['value'];
+    }
+
     public function forever($key, $value)
     {
         return $this->put($key, $value, null);
@@ -289,6 +392,57 @@ class HypercacheioStore implements LockProvider, Store
         }
     }
 
+    /**
+     * Begin executing a new tags operation. The Go server keeps an index of
+     * tags itself, so tagged items keep their keys and a flush removes them
+     * on the server in one request per tag.
+     *
+     * @param  array|mixed  $names
+     * @return \Illuminate\Cache\TaggedCache|\Iperamuna\Hypercacheio\HypercacheioTaggedCache
+     */
+    public function tags($names)
+    {
+        $names = is_array($names) ? $names : func_get_args();
+
+        if (! $this->usesGoServer()) {
+            return parent::tags($names);
+        }
+
+        $store = clone $this;
+        $store->tagNames = array_values($names);
+        $store->l1 = &$this->l1;
+        $store->promises = &$this->promises;
+
+        return new HypercacheioTaggedCache($store, $names);
+    }
+
+    /**
+     * Remove every item stored under any of the tags from the Go server.
+     */
+    public function flushTags(array $names)
+    {
+        // The L1 cache does not know which items carry the tags
+        $this->l1 = [];
+
+        foreach ($names as $name) {
+            $this->doRequest('delete', 'tags/'.rawurlencode($name));
+        }
+
+        return true;
+    }
+
+    /**
+     * Add the tags of a tagged cache to a write payload.
+     */
+    protected function withTagNames(array $payload): array
+    {
+        if ($this->tagNames !== null) {
+            $payload['tags'] = $this->tagNames;
+        }
+
+        return $payload;
+    }
+
     public function getPrefix()
     {
         return $this->prefix;
@@ -296,11 +450,19 @@ class HypercacheioStore implements LockProvider, Store
 
     public function setPrefix($prefix)
     {
-        $this->prefix = $prefix;
+        $this->prefix = (string) $prefix;
     }
 
     public function putMany(array $values, $seconds)
     {
+        if ($this->usesGoServer() && $this->tagNames === null) {
+            $this->l1 = array_merge($this->l1, $values);
+            // An object keeps numeric keys from being sent as a JSON list
+            $this->doRequest('post', 'put-many', ['values' => (object) $values, 'ttl' => $seconds]);
+
+            return true;
+        }
+
         foreach ($values as $key => $value) {
             $this->put($key, $value, $seconds);
         }
@@ -310,6 +472,25 @@ class HypercacheioStore implements LockProvider, Store
 
     public function many(array $keys)
     {
+        if ($this->usesGoServer()) {
+            $missing = array_values(array_filter($keys, fn ($key) => ! isset($this->l1[$key])));
+            $data = [];
+            if ($missing !== []) {
+                $response = $this->doRequest('post', 'many', ['keys' => $missing], true);
+                $data = $response['data'] ?? [];
+            }
+
+            $results = [];
+            foreach ($keys as $key) {
+                $results[$key] = $this->l1[$key] ?? $data[$key] ?? null;
+                if ($results[$key] !== null) {
+                    $this->l1[$key] = $results[$key];
+                }
+            }
+
+            return $results;
+        }
+
         $results = [];
         foreach ($keys as $key) {
             $results[$key] = $this->get($key);
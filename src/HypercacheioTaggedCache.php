@@ -0,0 +1,49 @@
+<?php
+
+namespace Iperamuna\Hypercacheio;
+
+use Illuminate\Cache\Repository;
+
+class HypercacheioTaggedCache extends Repository
+{
+    /**
+     * The tag names.
+     */
+    protected array $names;
+
+    /**
+     * Create a new tagged cache instance backed by the tag index of the Go
+     * server. Items keep their own keys; the server records their tags.
+     *
+     * @return void
+     */
+    public function __construct(HypercacheioStore $store, array $names)
+    {
+        parent::__construct($store);
+
+        $this->names = $names;
+    }
+
+    /**
+     * Remove every item stored under any of the tags.
+     *
+     * @return bool
+     */
+    public function flush()
+    {
+        return $this->store->flushTags($this->names);
+    }
+
+    public function clear(): bool
+    {
+        return $this->flush();
+    }
+
+    /**
+     * Get the tag names.
+     */
+    public function getNames(): array
+    {
+        return $this->names;
+    }
+}
@@ -68,6 +68,35 @@ it('performs primary role operations correctly', function () {
     }
 });
 
+it('increments in SQLite on the primary without losing the expiration', function () {
+    config(['hypercacheio.role' => 'primary']);
+    config(['hypercacheio.async_requests' => false]);
+    config(['hypercacheio.sqlite_path' => null]);
+
+    Cache::forgetDriver('hypercacheio');
+    Http::fake();
+
+    $store = Cache::store('hypercacheio')->getStore();
+    $store->put('hits', 1, 60);
+
+    // A second store stands for another PHP process sharing the file
+    Cache::forgetDriver('hypercacheio');
+    $other = Cache::store('hypercacheio')->getStore();
+
+    expect($store->increment('hits', 2))->toBe(3);
+    expect($other->increment('hits', 4))->toBe(7);
+    expect($store->decrement('missing', 1))->toBe(-1);
+
+    $store->put('name', 'Ada', 60);
+    expect($store->increment('name'))->toBeFalse();
+
+    $sqlite = (fn () => $this->sqlite)->call($store);
+    $expiration = $sqlite->query("SELECT expiration FROM cache WHERE key = 'hits'")->fetchColumn();
+    expect((int) $expiration)->toBeGreaterThan(time());
+
+    Http::assertNothingSent();
+});
+
 it('performs secondary role operations correctly via HTTP', function () {
     // Reconfigure as secondary
     config(['hypercacheio.role' => 'secondary']);
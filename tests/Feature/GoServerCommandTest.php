@@ -1,6 +1,7 @@
 <?php
 
 use Illuminate\Support\Facades\File;
+use Illuminate\Support\Facades\Http;
 
 use function Pest\Laravel\artisan;
 
@@ -135,3 +136,37 @@ it('shows error when service:start plist missing on macOS', function () {
 it('listen_host defaults to 0.0.0.0 in config', function () {
     expect(config('hypercacheio.go_server.listen_host'))->toBe('0.0.0.0');
 });
+
+it('writes a backup to the server backup directory', function () {
+    config(['hypercacheio.api_token' => 'test-token']);
+    config(['hypercacheio.go_server.port' => '8081']);
+
+    Http::fake([
+        '127.0.0.1:8081/api/hypercacheio/admin/backup' => Http::response([
+            'path' => '/var/lib/hypercacheio/backups/hypercacheio-20261019T120000Z.sqlite',
+            'created' => 1792411200,
+            'size' => 3145728,
+            'duration_ms' => 42,
+        ], 200),
+    ]);
+
+    artisan('hypercacheio:go-server backup')
+        ->expectsOutputToContain('Backup written to /var/lib/hypercacheio/backups/hypercacheio-20261019T120000Z.sqlite')
+        ->expectsOutputToContain('Size: 3 MB, took 42ms')
+        ->assertExitCode(0);
+
+    Http::assertSent(fn ($request) => $request->method() === 'POST'
+        && $request->hasHeader('X-Hypercacheio-Token', 'test-token'));
+});
+
+it('reports a failed backup', function () {
+    config(['hypercacheio.go_server.port' => '8081']);
+
+    Http::fake([
+        '127.0.0.1:8081/api/hypercacheio/admin/backup' => Http::response(['error' => 'Backups need the sqlite or tiered storage engine'], 503),
+    ]);
+
+    artisan('hypercacheio:go-server backup')
+        ->expectsOutputToContain('Backup failed: Backups need the sqlite or tiered storage engine')
+        ->assertExitCode(1);
+});
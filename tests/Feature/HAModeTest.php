@@ -65,3 +65,110 @@ it('supports multiple peers in config without double prefixing issues', function
         return str_contains($request->url(), '/api/hypercacheio/cache/');
     });
 });
+
+it('sends the cache prefix as the namespace header', function () {
+    config(['hypercacheio.go_server.ha_mode' => true]);
+    config(['hypercacheio.server_type' => 'go']);
+    config(['hypercacheio.async_requests' => false]);
+    config(['cache.prefix' => 'shop_cache']);
+
+    Cache::forgetDriver('hypercacheio');
+
+    Http::fake([
+        '*/api/hypercacheio/cache/*' => Http::response(['success' => true], 200),
+    ]);
+
+    Cache::store('hypercacheio')->put('cart', 'value', 60);
+
+    Http::assertSent(function ($request) {
+        return str_ends_with($request->url(), '/cache/cart')
+            && $request->header('X-Hypercacheio-Namespace') === ['shop_cache'];
+    });
+});
+
+it('reads and writes many keys with a single request each', function () {
+    config(['hypercacheio.go_server.ha_mode' => true]);
+    config(['hypercacheio.server_type' => 'go']);
+    config(['hypercacheio.async_requests' => false]);
+
+    Cache::forgetDriver('hypercacheio');
+
+    Http::fake([
+        '*/api/hypercacheio/put-many' => Http::response(['success' => true, 'count' => 3], 200),
+        '*/api/hypercacheio/many' => Http::response(['data' => ['a' => 1, 'b' => null, 'c' => 'three']], 200),
+    ]);
+
+    $store = Cache::store('hypercacheio')->getStore();
+    $store->putMany(['a' => 1, 'b' => 2, 'c' => 'three'], 60);
+
+    Http::assertSentCount(1);
+    Http::assertSent(function ($request) {
+        return str_ends_with($request->url(), '/put-many')
+            && $request['values'] === ['a' => 1, 'b' => 2, 'c' => 'three']
+            && $request['ttl'] === 60;
+    });
+
+    Cache::forgetDriver('hypercacheio');
+    $values = Cache::store('hypercacheio')->getStore()->many(['a', 'b', 'c']);
+
+    Http::assertSentCount(2);
+    expect($values)->toBe(['a' => 1, 'b' => null, 'c' => 'three']);
+});
+
+it('stores and flushes tags through the tag index of the Go server', function () {
+    config(['hypercacheio.go_server.ha_mode' => true]);
+    config(['hypercacheio.server_type' => 'go']);
+    config(['hypercacheio.async_requests' => false]);
+    config(['cache.prefix' => '']);
+
+    Cache::forgetDriver('hypercacheio');
+
+    Http::fake([
+        '*/api/hypercacheio/cache/*' => Http::response(['success' => true], 200),
+        '*/api/hypercacheio/tags/*' => Http::response(['success' => true, 'removed' => 1], 200),
+    ]);
+
+    Cache::store('hypercacheio')->tags(['users', 'team:1'])->put('user:1', 'Ada', 600);
+
+    Http::assertSent(function ($request) {
+        return str_ends_with($request->url(), '/cache/user:1')
+            && $request->method() === 'POST'
+            && $request['tags'] === ['users', 'team:1'];
+    });
+
+    Cache::store('hypercacheio')->tags(['users'])->flush();
+
+    Http::assertSentCount(2);
+    Http::assertSent(function ($request) {
+        return str_ends_with($request->url(), '/tags/users')
+            && $request->method() === 'DELETE';
+    });
+});
+
+it('increments and decrements on the Go server in one request', function () {
+    config(['hypercacheio.go_server.ha_mode' => true]);
+    config(['hypercacheio.server_type' => 'go']);
+    config(['hypercacheio.async_requests' => false]);
+    config(['cache.prefix' => '']);
+
+    Cache::forgetDriver('hypercacheio');
+
+    Http::fake([
+        '*/api/hypercacheio/incr/hits' => Http::response(['value' => 5], 200),
+        '*/api/hypercacheio/decr/hits' => Http::response(['value' => 3], 200),
+    ]);
+
+    expect(Cache::store('hypercacheio')->increment('hits', 5))->toBe(5);
+    expect(Cache::store('hypercacheio')->decrement('hits', 2))->toBe(3);
+
+    Http::assertSentCount(2);
+    Http::assertSent(function ($request) {
+        return str_ends_with($request->url(), '/incr/hits')
+            && $request->method() === 'POST'
+            && $request['value'] === 5;
+    });
+    Http::assertSent(function ($request) {
+        return str_ends_with($request->url(), '/decr/hits')
+            && $request['value'] === 2;
+    });
+});